@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Custom metrics are the generic series of a tenant, queried as "custom:<metric name>". Their labels aren't
+// columns, so the series matching the filters are looked up in the label index first and the samples are
+// then read, ranked and grouped by series like the other metrics.
+const CustomMetricPrefix = "custom:"
+
+// Custom metrics are grouped by series, one series per label set
+const GroupBySeries = "series"
+
+// customSeries is a generic series selected by a query
+type customSeries struct {
+	deviceID   string
+	metricType string
+	labels     map[string]string
+}
+
+// customMetric returns the metric of the generic series named name
+func customMetric(name string) metric {
+	return metric{
+		raw: view{
+			from:   "{db}.GenericSamples gs JOIN {db}.GenericSeries s ON s.series_id = gs.series_id",
+			device: "s.device_id",
+			times:  []string{"gs.timestamp"},
+			value:  "gs.value",
+			labels: map[string]string{GroupBySeries: "gs.series_id"},
+		},
+		groupings:      map[string]grouping{GroupBySeries: {rank: GroupBySeries, series: GroupBySeries}},
+		defaultGroupBy: GroupBySeries,
+		customName:     name,
+	}
+}
+
+// custom tells if the plan is on a custom metric
+func (p *plan) custom() bool {
+	return p.metric.customName != ""
+}
+
+// resolveCustomSeries selects the series of the custom metric on the devices that match the filters
+func (p *plan) resolveCustomSeries(db *sql.DB, deviceIDs []string) error {
+	p.customSeries = make(map[string]customSeries)
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+
+	dbName := "`" + p.dbName + "`"
+	conditions := []string{"s.metric_name = ?", fmt.Sprintf("s.device_id IN (%s)", strings.Trim(strings.Repeat("?,", len(deviceIDs)), ","))}
+	args := []interface{}{p.metric.customName}
+	for _, deviceID := range deviceIDs {
+		args = append(args, deviceID)
+	}
+
+	for _, filter := range p.Filters {
+		label := fmt.Sprintf("SELECT l.series_id FROM %s.GenericSeriesLabels l WHERE l.label_name = ?", dbName)
+		value := models.GenericLabelValue(filter.Value)
+
+		switch {
+		case filter.Op == FilterEqual && value == "":
+			// A label equal to nothing is a missing label
+			conditions = append(conditions, fmt.Sprintf("s.series_id NOT IN (%s AND l.label_value != '')", label))
+			args = append(args, filter.Label)
+			continue
+		case filter.Op == FilterEqual:
+			conditions = append(conditions, fmt.Sprintf("s.series_id IN (%s AND l.label_value = ?)", label))
+		case filter.Op == FilterNotEqual:
+			conditions = append(conditions, fmt.Sprintf("s.series_id NOT IN (%s AND l.label_value = ?)", label))
+		case filter.Op == FilterRegex:
+			conditions = append(conditions, fmt.Sprintf("s.series_id IN (%s AND l.label_value REGEXP CONCAT('^(', ?, ')$'))", label))
+		case filter.Op == FilterNotRegex:
+			conditions = append(conditions, fmt.Sprintf("s.series_id NOT IN (%s AND l.label_value REGEXP CONCAT('^(', ?, ')$'))", label))
+		default:
+			conditions = append(conditions, fmt.Sprintf("s.series_id IN (%s AND l.label_value %s ?)", label, filter.Op))
+		}
+		args = append(args, filter.Label, value)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT s.series_id, s.device_id, s.metric_type, s.labels
+        FROM %s.GenericSeries s
+        WHERE %s
+    `, dbName, strings.Join(conditions, " AND ")), args...)
+	if err != nil {
+		return fmt.Errorf("error selecting %s series: %v", p.metric.customName, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var series customSeries
+		var labels string
+		if err := rows.Scan(&id, &series.deviceID, &series.metricType, &labels); err != nil {
+			return fmt.Errorf("error scanning series: %v", err)
+		}
+
+		if err := json.Unmarshal([]byte(labels), &series.labels); err != nil {
+			return fmt.Errorf("error reading labels of series %d: %v", id, err)
+		}
+		p.customSeries[strconv.FormatInt(id, 10)] = series
+	}
+
+	return rows.Err()
+}
+
+// customSeriesCondition restricts the samples to the selected series
+func (p *plan) customSeriesCondition() (string, []interface{}) {
+	ids := make([]string, 0, len(p.customSeries))
+	for id := range p.customSeries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	return fmt.Sprintf("gs.series_id IN (%s)", strings.Trim(strings.Repeat("?,", len(ids)), ",")), args
+}
+
+// describeCustomSeries gives the grouped series the labels and type of their generic series, keyed by label set
+func (p *plan) describeCustomSeries(series []Series) {
+	for i := range series {
+		s, ok := p.customSeries[series[i].Key]
+		if !ok {
+			continue
+		}
+
+		series[i].Key = LabelSignature(s.labels)
+		series[i].Labels = s.labels
+		series[i].Type = s.metricType
+	}
+}
+
+// LabelSignature formats labels in name order, like {path="/",status="200"}
+func LabelSignature(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CustomMetricInfo describes a custom metric of a tenant
+type CustomMetricInfo struct {
+	Metric string   `json:"metric"`
+	Type   string   `json:"type"`
+	Series int      `json:"series"`
+	Labels []string `json:"labels"`
+}
+
+// CustomMetrics lists the custom metrics of a tenant with the labels their series have
+func CustomMetrics(db *sql.DB, tenantID string) ([]CustomMetricInfo, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT metric_name, MIN(metric_type), COUNT(*)
+        FROM %s.GenericSeries
+        GROUP BY metric_name
+        ORDER BY metric_name
+    `, dbName))
+	if err != nil {
+		return nil, fmt.Errorf("error listing custom metrics: %v", err)
+	}
+	defer rows.Close()
+
+	catalog := []CustomMetricInfo{}
+	byName := make(map[string]int)
+	for rows.Next() {
+		info := CustomMetricInfo{Labels: []string{}}
+		if err := rows.Scan(&info.Metric, &info.Type, &info.Series); err != nil {
+			return nil, fmt.Errorf("error scanning custom metric: %v", err)
+		}
+		byName[info.Metric] = len(catalog)
+		catalog = append(catalog, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	labelRows, err := db.Query(fmt.Sprintf(`
+        SELECT DISTINCT s.metric_name, l.label_name
+        FROM %s.GenericSeries s
+        JOIN %s.GenericSeriesLabels l ON l.series_id = s.series_id
+        ORDER BY s.metric_name, l.label_name
+    `, dbName, dbName))
+	if err != nil {
+		return nil, fmt.Errorf("error listing custom metric labels: %v", err)
+	}
+	defer labelRows.Close()
+
+	for labelRows.Next() {
+		var name, label string
+		if err := labelRows.Scan(&name, &label); err != nil {
+			return nil, fmt.Errorf("error scanning custom metric label: %v", err)
+		}
+		if i, ok := byName[name]; ok {
+			catalog[i].Labels = append(catalog[i].Labels, label)
+		}
+	}
+
+	return catalog, labelRows.Err()
+}
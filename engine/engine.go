@@ -0,0 +1,585 @@
+// Package engine answers metric queries: it ranks the series of a metric on every requested device,
+// reads the samples of the top ones, from the raw tables or the rollups, and groups them into series.
+package engine
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Functions series can be ranked by
+const (
+	RankSum = "sum"
+	RankAvg = "avg"
+	RankMax = "max"
+	RankMin = "min"
+)
+
+// Filter operators, the regex ones match the whole label value
+const (
+	FilterEqual       = "="
+	FilterNotEqual    = "!="
+	FilterRegex       = "=~"
+	FilterNotRegex    = "!~"
+	FilterGreaterThan = ">"
+	FilterLessThan    = "<"
+)
+
+// Ranking selects the series returned for every device
+type Ranking struct {
+	Function string `json:"function"`
+	// Series kept per device, all of them when 0
+	Limit int `json:"limit"`
+	// "desc" keeps the top series, "asc" the bottom ones
+	Order string `json:"order"`
+}
+
+// Filter restricts the samples to those whose label matches
+type Filter struct {
+	Label string `json:"label"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// Request is a query on one metric of a tenant
+type Request struct {
+	TenantID  string
+	Metric    string
+	Devices   []string
+	TimeStart string
+	TimeEnd   string
+	GroupBy   string
+	Rank      Ranking
+	Filters   []Filter
+	// Point budget per series, picks a rollup resolution for long ranges
+	MaxPoints int
+	// When set samples are aggregated into evenly spaced buckets
+	Step         time.Duration
+	Aggregations []string
+}
+
+// Sample is one point of a series, rolled up samples carry the stats of their bucket
+type Sample struct {
+	Timestamp string              `json:"timestamp"`
+	Value     float64             `json:"value"`
+	Labels    map[string]string   `json:"-"`
+	Stats     *models.RollupStats `json:"-"`
+}
+
+// Series groups the samples sharing the value of the grouping label
+type Series struct {
+	Key string `json:"key"`
+	// Labels with the same value in every sample of the series
+	Labels map[string]string `json:"labels"`
+	// Type of a custom metric series: gauge, counter or histogram
+	Type    string           `json:"type,omitempty"`
+	Avg     float64          `json:"avg"`
+	Samples []Sample         `json:"samples,omitempty"`
+	Buckets []helpers.Bucket `json:"buckets,omitempty"`
+}
+
+type DeviceResult struct {
+	DeviceID   string   `json:"deviceID"`
+	DeviceName string   `json:"deviceName"`
+	Series     []Series `json:"series"`
+}
+
+type Result struct {
+	Metric     string         `json:"metric"`
+	GroupBy    string         `json:"groupBy"`
+	Resolution int            `json:"resolution"`
+	Devices    []DeviceResult `json:"devices"`
+}
+
+// BadRequestError is returned for queries that can't be answered as asked
+type BadRequestError struct {
+	Message string
+}
+
+func (e *BadRequestError) Error() string {
+	return e.Message
+}
+
+// ErrNoDevices is returned when none of the requested devices is known
+var ErrNoDevices = &BadRequestError{Message: "No device IDs found for the given device names"}
+
+func badRequest(format string, args ...interface{}) error {
+	return &BadRequestError{Message: fmt.Sprintf(format, args...)}
+}
+
+// plan is a validated request
+type plan struct {
+	Request
+	metric   metric
+	grouping grouping
+	dbName   string
+	// Series of a custom metric matching the filters, by series ID
+	customSeries map[string]customSeries
+}
+
+// prepare validates the request and fills in the defaults
+func prepare(request Request) (*plan, error) {
+	if request.TenantID == "" {
+		return nil, badRequest("Tenant ID is required")
+	}
+
+	m, ok := metrics[request.Metric]
+	if name := strings.TrimPrefix(request.Metric, CustomMetricPrefix); name != request.Metric && name != "" {
+		m, ok = customMetric(name), true
+	}
+	if !ok {
+		return nil, badRequest("unknown metric: %s", request.Metric)
+	}
+
+	if request.GroupBy == "" {
+		request.GroupBy = m.defaultGroupBy
+	}
+	g, ok := m.groupings[request.GroupBy]
+	if !ok {
+		return nil, badRequest("unknown groupBy for metric %s: %s", request.Metric, request.GroupBy)
+	}
+
+	switch request.Rank.Function {
+	case "":
+		request.Rank.Function = RankSum
+	case RankSum, RankAvg, RankMax, RankMin:
+	default:
+		return nil, badRequest("unknown ranking function: %s", request.Rank.Function)
+	}
+
+	switch request.Rank.Order {
+	case "":
+		request.Rank.Order = "desc"
+	case "asc", "desc":
+	default:
+		return nil, badRequest("unknown ranking order: %s", request.Rank.Order)
+	}
+
+	for _, filter := range request.Filters {
+		// Custom metrics have whatever labels their series were stored with
+		if _, ok := m.raw.labels[filter.Label]; !ok && m.customName == "" {
+			return nil, badRequest("unknown label for metric %s: %s", request.Metric, filter.Label)
+		}
+
+		switch filter.Op {
+		case FilterEqual, FilterNotEqual, FilterRegex, FilterNotRegex, FilterGreaterThan, FilterLessThan:
+		default:
+			return nil, badRequest("unknown filter operator: %s", filter.Op)
+		}
+	}
+
+	if request.Step > 0 {
+		aggregations, err := helpers.ValidateAggregations(request.Aggregations)
+		if err != nil {
+			return nil, badRequest("%v", err)
+		}
+		request.Aggregations = aggregations
+	}
+
+	return &plan{
+		Request:  request,
+		metric:   m,
+		grouping: g,
+		dbName:   fmt.Sprintf("Performance_%s", request.TenantID),
+	}, nil
+}
+
+// Validate checks a request without running it, like rules saved to be run later
+func Validate(request Request) error {
+	_, err := prepare(request)
+	return err
+}
+
+// rollupUsable tells if the rollups know every label the plan needs
+func (p *plan) rollupUsable() bool {
+	if p.metric.rollup == nil {
+		return false
+	}
+
+	needed := []string{p.grouping.rank, p.grouping.series}
+	for _, filter := range p.Filters {
+		needed = append(needed, filter.Label)
+	}
+
+	for _, label := range needed {
+		if _, ok := p.metric.rollup.labels[label]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolution picks the rollup resolution to answer from, 0 for the raw samples
+func (p *plan) resolution(db *sql.DB) (int, error) {
+	if !p.rollupUsable() {
+		return 0, nil
+	}
+
+	var resolution int
+	var err error
+	if p.Step > 0 {
+		resolution, err = helpers.ChooseStepResolution(db, p.TenantID, p.TimeEnd, p.Step, p.Aggregations)
+	} else {
+		resolution, err = helpers.ChooseResolution(db, p.TenantID, p.TimeStart, p.TimeEnd, p.MaxPoints)
+	}
+	if err != nil {
+		return 0, badRequest("%v", err)
+	}
+
+	return resolution, nil
+}
+
+// view returns where the samples are read from at the resolution
+func (p *plan) view(resolution int) view {
+	if resolution > 0 {
+		return *p.metric.rollup
+	}
+
+	return p.metric.raw
+}
+
+// conditions returns the WHERE conditions shared by the ranking and the sample queries, and their arguments
+func (p *plan) conditions(v view, resolution int) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	for _, column := range v.times {
+		conditions = append(conditions, column+" BETWEEN ? AND ?")
+		args = append(args, p.TimeStart, p.TimeEnd)
+	}
+
+	if v.rollup() {
+		conditions = append(conditions, "r.resolution = ?", "r.metric = ?")
+		args = append(args, resolution, v.rollupMetric)
+	}
+
+	// The filters of a custom metric already selected its series
+	if p.custom() {
+		condition, seriesArgs := p.customSeriesCondition()
+		return append(conditions, condition), append(args, seriesArgs...)
+	}
+
+	for _, filter := range p.Filters {
+		column := v.labels[filter.Label]
+		switch filter.Op {
+		case FilterRegex:
+			conditions = append(conditions, column+" REGEXP CONCAT('^(', ?, ')$')")
+		case FilterNotRegex:
+			conditions = append(conditions, "("+column+" IS NULL OR "+column+" NOT REGEXP CONCAT('^(', ?, ')$'))")
+		case FilterNotEqual:
+			conditions = append(conditions, "("+column+" IS NULL OR "+column+" != ?)")
+		default:
+			conditions = append(conditions, column+" "+filter.Op+" ?")
+		}
+		args = append(args, filter.Value)
+	}
+
+	return conditions, args
+}
+
+// Rank returns the keys of the top series of every device, in rank order. Devices without any series are left out.
+func Rank(db *sql.DB, request Request, deviceIDs []string, resolution int) (map[string][]string, error) {
+	p, err := prepare(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.custom() {
+		if err := p.resolveCustomSeries(db, deviceIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.rank(db, deviceIDs, resolution)
+}
+
+// rank ranks the series of all devices with a single query, ROW_NUMBER keeps the top ones of each device
+func (p *plan) rank(db *sql.DB, deviceIDs []string, resolution int) (map[string][]string, error) {
+	deviceKeysMap := make(map[string][]string)
+	if len(deviceIDs) == 0 || (p.custom() && len(p.customSeries) == 0) {
+		return deviceKeysMap, nil
+	}
+
+	v := p.view(resolution)
+	key := v.labels[p.grouping.rank]
+
+	conditions, conditionArgs := p.conditions(v, resolution)
+	conditions = append(conditions, fmt.Sprintf("%s IN (%s)", v.device, strings.Trim(strings.Repeat("?,", len(deviceIDs)), ",")), key+" IS NOT NULL")
+
+	args := conditionArgs
+	for _, deviceID := range deviceIDs {
+		args = append(args, deviceID)
+	}
+
+	order := "DESC"
+	if p.Rank.Order == "asc" {
+		order = "ASC"
+	}
+
+	rankQuery := fmt.Sprintf(`
+        SELECT ranked.device_id, ranked.series_key
+        FROM (
+            SELECT %s AS device_id, %s AS series_key,
+                ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s %s) AS series_rank
+            FROM %s
+            WHERE %s
+            GROUP BY %s, %s
+        ) ranked
+    `, v.device, key, v.device, v.rankExpression(p.Rank.Function), order, v.fromClause(p.dbName), strings.Join(conditions, " AND "), v.device, key)
+
+	if p.Rank.Limit > 0 {
+		rankQuery += " WHERE ranked.series_rank <= ?"
+		args = append(args, p.Rank.Limit)
+	}
+	rankQuery += " ORDER BY ranked.device_id, ranked.series_rank"
+
+	rows, err := db.Query(rankQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error ranking %s series: %v", p.Metric, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deviceID, seriesKey string
+		if err := rows.Scan(&deviceID, &seriesKey); err != nil {
+			return nil, fmt.Errorf("error scanning series key: %v", err)
+		}
+		deviceKeysMap[deviceID] = append(deviceKeysMap[deviceID], seriesKey)
+	}
+
+	return deviceKeysMap, rows.Err()
+}
+
+// samples reads the samples of the ranked series of a device in time order
+func (p *plan) samples(db *sql.DB, deviceID string, keys []string, resolution int) ([]Sample, error) {
+	v := p.view(resolution)
+	labelNames := v.labelNames()
+
+	columns := []string{v.times[0]}
+	if v.rollup() {
+		columns = append(columns, "r.min_value", "r.max_value", "r.sum_value", "r.sample_count", "r.p95_value")
+	} else {
+		columns = append(columns, "COALESCE("+v.value+", 0)")
+	}
+	for _, label := range labelNames {
+		columns = append(columns, v.labels[label])
+	}
+
+	conditions, args := p.conditions(v, resolution)
+	conditions = append(conditions, v.device+" = ?", fmt.Sprintf("%s IN (%s)", v.labels[p.grouping.rank], strings.Trim(strings.Repeat("?,", len(keys)), ",")))
+	args = append(args, deviceID)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	samplesQuery := fmt.Sprintf(`
+        SELECT %s
+        FROM %s
+        WHERE %s
+        ORDER BY %s
+    `, strings.Join(columns, ", "), v.fromClause(p.dbName), strings.Join(conditions, " AND "), v.times[0])
+
+	rows, err := db.Query(samplesQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s samples: %v", p.Metric, err)
+	}
+	defer rows.Close()
+
+	var samples []Sample
+	for rows.Next() {
+		var sample Sample
+		var stats models.RollupStats
+		labelValues := make([]sql.NullString, len(labelNames))
+
+		dest := []interface{}{&sample.Timestamp}
+		if v.rollup() {
+			dest = append(dest, &stats.Min, &stats.Max, &stats.Sum, &stats.Count, &stats.P95)
+		} else {
+			dest = append(dest, &sample.Value)
+		}
+		for i := range labelValues {
+			dest = append(dest, &labelValues[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+
+		if v.rollup() {
+			sample.Stats = &stats
+			sample.Value = stats.Avg()
+		}
+
+		sample.Labels = make(map[string]string, len(labelNames))
+		for i, label := range labelNames {
+			if labelValues[i].Valid {
+				sample.Labels[label] = labelValues[i].String
+			}
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, rows.Err()
+}
+
+// group splits the samples of a device into series by the grouping label, best ranked first
+func (p *plan) group(samples []Sample) ([]Series, error) {
+	var order []string
+	groups := make(map[string][]Sample)
+	for _, sample := range samples {
+		key := sample.Labels[p.grouping.series]
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], sample)
+	}
+
+	series := make([]Series, 0, len(groups))
+	for _, key := range order {
+		s := Series{Key: key, Labels: commonLabels(groups[key]), Samples: groups[key]}
+
+		for _, sample := range s.Samples {
+			s.Avg += sample.Value
+		}
+		s.Avg /= float64(len(s.Samples))
+
+		// Bucketed series replace the samples
+		if p.Step > 0 {
+			bucketSamples := make([]helpers.BucketSample, len(s.Samples))
+			for i, sample := range s.Samples {
+				bucketSamples[i] = helpers.BucketSample{Timestamp: sample.Timestamp, Value: sample.Value, Stats: sample.Stats}
+			}
+
+			buckets, err := helpers.Bucketize(bucketSamples, p.TimeStart, p.TimeEnd, p.Step, p.Aggregations)
+			if err != nil {
+				return nil, badRequest("%v", err)
+			}
+
+			s.Buckets = buckets
+			s.Samples = nil
+		}
+
+		series = append(series, s)
+	}
+
+	sort.SliceStable(series, func(i, j int) bool {
+		if p.Rank.Order == "asc" {
+			return series[i].Avg < series[j].Avg
+		}
+		return series[i].Avg > series[j].Avg
+	})
+
+	return series, nil
+}
+
+// commonLabels returns the labels having the same value in every sample
+func commonLabels(samples []Sample) map[string]string {
+	labels := make(map[string]string)
+	for label, value := range samples[0].Labels {
+		labels[label] = value
+	}
+
+	for _, sample := range samples[1:] {
+		for label, value := range labels {
+			if sample.Labels[label] != value {
+				delete(labels, label)
+			}
+		}
+	}
+
+	return labels
+}
+
+// checkTenant checks that the tenant of the query is registered
+func (p *plan) checkTenant(db *sql.DB) error {
+	var exists int
+	err := db.QueryRow("SELECT EXISTS(SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = ?)", p.dbName).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking tenant %s: %v", p.TenantID, err)
+	}
+	if exists == 0 {
+		return badRequest("unknown tenant: %s", p.TenantID)
+	}
+
+	return nil
+}
+
+// Execute answers a query
+func Execute(db *sql.DB, request Request) (*Result, error) {
+	p, err := prepare(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkTenant(db); err != nil {
+		return nil, err
+	}
+
+	// Resolve the requested devices, all devices if none were given
+	deviceMap, err := helpers.GetDeviceMap(db, p.dbName, p.Devices)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(deviceMap) == 0 {
+		return nil, ErrNoDevices
+	}
+
+	deviceIDs := make([]string, 0, len(deviceMap))
+	for deviceID := range deviceMap {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	if p.custom() {
+		if err := p.resolveCustomSeries(db, deviceIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	resolution, err := p.resolution(db)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceKeysMap, err := p.rank(db, deviceIDs, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Metric: p.Metric, GroupBy: p.GroupBy, Resolution: resolution, Devices: []DeviceResult{}}
+	for _, deviceID := range deviceIDs {
+		keys, ok := deviceKeysMap[deviceID]
+		if !ok {
+			continue
+		}
+
+		samples, err := p.samples(db, deviceID, keys, resolution)
+		if err != nil {
+			return nil, err
+		}
+
+		series, err := p.group(samples)
+		if err != nil {
+			return nil, err
+		}
+		if p.custom() {
+			p.describeCustomSeries(series)
+		}
+
+		result.Devices = append(result.Devices, DeviceResult{
+			DeviceID:   deviceID,
+			DeviceName: deviceMap[deviceID],
+			Series:     series,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,556 @@
+package engine
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quantiles estimated when a histogram query doesn't ask for any
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// How far before the start of a histogram query a sample is looked for, the increase of a cumulative series
+// over the first window is counted from it
+const histogramLookback = 5 * time.Minute
+
+// An interval of a distribution holds the values in (lower, upper], or the value lower when both are equal
+type interval struct {
+	lower float64
+	upper float64
+	count float64
+}
+
+// intervals returns the buckets of a histogram as intervals in increasing order. The first explicit bucket
+// starts at 0 when its bound is positive, like Prometheus assumes.
+func intervals(h models.Histogram) []interval {
+	var list []interval
+
+	if h.Exponential {
+		base := math.Pow(2, math.Pow(2, float64(-h.Schema)))
+
+		negative := make([]int, 0, len(h.Negative))
+		for i := range h.Negative {
+			negative = append(negative, i)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(negative)))
+		for _, i := range negative {
+			list = append(list, interval{-math.Pow(base, float64(i)), -math.Pow(base, float64(i-1)), h.Negative[i]})
+		}
+
+		if h.ZeroCount > 0 {
+			list = append(list, interval{-h.ZeroThreshold, h.ZeroThreshold, h.ZeroCount})
+		}
+
+		positive := make([]int, 0, len(h.Positive))
+		for i := range h.Positive {
+			positive = append(positive, i)
+		}
+		sort.Ints(positive)
+		for _, i := range positive {
+			list = append(list, interval{math.Pow(base, float64(i-1)), math.Pow(base, float64(i)), h.Positive[i]})
+		}
+
+		return list
+	}
+
+	lower := math.Inf(-1)
+	if len(h.ExplicitBounds) > 0 && h.ExplicitBounds[0] > 0 {
+		lower = 0
+	}
+	for i, count := range h.BucketCounts {
+		upper := math.Inf(1)
+		if i < len(h.ExplicitBounds) {
+			upper = h.ExplicitBounds[i]
+		}
+		list = append(list, interval{lower, upper, count})
+		lower = upper
+	}
+
+	return list
+}
+
+// mergeIntervals merges the intervals of several histograms. Overlapping buckets are split at every bound of
+// the others, their count shared in proportion to the width of the parts, so buckets of different layouts add
+// up. Exponential buckets of different schemas nest, their merge is exact.
+func mergeIntervals(list []interval) []interval {
+	points := make(map[float64]bool)
+	for _, in := range list {
+		points[in.lower] = true
+		points[in.upper] = true
+	}
+	sorted := make([]float64, 0, len(points))
+	for point := range points {
+		sorted = append(sorted, point)
+	}
+	sort.Float64s(sorted)
+
+	type key struct{ lower, upper float64 }
+	counts := make(map[key]float64)
+	for _, in := range list {
+		if in.count == 0 {
+			continue
+		}
+		if in.lower == in.upper {
+			counts[key{in.lower, in.upper}] += in.count
+			continue
+		}
+
+		// The bounds strictly inside the interval
+		first := sort.SearchFloat64s(sorted, in.lower) + 1
+		last := sort.SearchFloat64s(sorted, in.upper)
+		if first >= last {
+			counts[key{in.lower, in.upper}] += in.count
+			continue
+		}
+
+		parts := append(append([]float64{in.lower}, sorted[first:last]...), in.upper)
+		width := in.upper - in.lower
+		for i := 0; i+1 < len(parts); i++ {
+			part := key{parts[i], parts[i+1]}
+			switch {
+			case math.IsInf(in.upper, 1):
+				// Unbounded buckets keep their count in their unbounded part, beyond every finite bound
+				if i == len(parts)-2 {
+					counts[part] += in.count
+				}
+			case math.IsInf(in.lower, -1):
+				if i == 0 {
+					counts[part] += in.count
+				}
+			default:
+				counts[part] += in.count * (parts[i+1] - parts[i]) / width
+			}
+		}
+	}
+
+	merged := make([]interval, 0, len(counts))
+	for k, count := range counts {
+		merged = append(merged, interval{k.lower, k.upper, count})
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].upper != merged[j].upper {
+			return merged[i].upper < merged[j].upper
+		}
+		return merged[i].lower < merged[j].lower
+	})
+
+	return merged
+}
+
+// quantile estimates a quantile of merged intervals, interpolating linearly within the bucket it falls in. A
+// quantile in an unbounded bucket is its finite bound. NaN when there is no observation.
+func quantile(q float64, merged []interval) float64 {
+	var total float64
+	for _, in := range merged {
+		total += in.count
+	}
+	switch {
+	case total == 0 || math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	rank := q * total
+	var cumulative float64
+	for _, in := range merged {
+		if in.count == 0 || cumulative+in.count < rank {
+			cumulative += in.count
+			continue
+		}
+
+		switch {
+		case math.IsInf(in.lower, -1):
+			return in.upper
+		case math.IsInf(in.upper, 1):
+			return in.lower
+		}
+		return in.lower + (in.upper-in.lower)*(rank-cumulative)/in.count
+	}
+
+	return merged[len(merged)-1].upper
+}
+
+// histogramIncrease returns what a cumulative histogram gained from previous to current. It is false when
+// the series was reset or changed its buckets in between, current then holds everything since.
+func histogramIncrease(previous models.Histogram, current models.Histogram) (models.Histogram, bool) {
+	if current.Count < previous.Count || current.Exponential != previous.Exponential {
+		return current, false
+	}
+
+	increase := current
+	increase.Count -= previous.Count
+	increase.Sum -= previous.Sum
+
+	if current.Exponential {
+		if current.Schema != previous.Schema || current.ZeroThreshold != previous.ZeroThreshold || current.ZeroCount < previous.ZeroCount {
+			return current, false
+		}
+		increase.ZeroCount -= previous.ZeroCount
+
+		var ok bool
+		if increase.Positive, ok = subtractBuckets(current.Positive, previous.Positive); !ok {
+			return current, false
+		}
+		if increase.Negative, ok = subtractBuckets(current.Negative, previous.Negative); !ok {
+			return current, false
+		}
+		return increase, true
+	}
+
+	if len(current.ExplicitBounds) != len(previous.ExplicitBounds) || len(current.BucketCounts) != len(previous.BucketCounts) {
+		return current, false
+	}
+	for i, bound := range current.ExplicitBounds {
+		if previous.ExplicitBounds[i] != bound {
+			return current, false
+		}
+	}
+
+	increase.BucketCounts = make([]float64, len(current.BucketCounts))
+	for i, count := range current.BucketCounts {
+		if count < previous.BucketCounts[i] {
+			return current, false
+		}
+		increase.BucketCounts[i] = count - previous.BucketCounts[i]
+	}
+
+	return increase, true
+}
+
+// subtractBuckets subtracts the exponential buckets of previous, false when one of them decreased
+func subtractBuckets(current map[int]float64, previous map[int]float64) (map[int]float64, bool) {
+	for i, count := range previous {
+		if current[i] < count {
+			return nil, false
+		}
+	}
+
+	result := make(map[int]float64, len(current))
+	for i, count := range current {
+		result[i] = count - previous[i]
+	}
+	return result, true
+}
+
+// HistogramRequest is a query on a histogram or summary custom metric of a tenant
+type HistogramRequest struct {
+	TenantID  string
+	Metric    string
+	Devices   []string
+	TimeStart string
+	TimeEnd   string
+	Filters   []Filter
+	Quantiles []float64
+	// When set the observations are counted per window of Step, else over the whole range
+	Step time.Duration
+	// Merge adds up the series of every device that share the values of the By labels
+	Merge bool
+	By    []string
+}
+
+// HistogramPoint describes the observations of a window. Quantiles and the average are null without any.
+type HistogramPoint struct {
+	Timestamp string              `json:"timestamp"`
+	Count     float64             `json:"count"`
+	Sum       float64             `json:"sum"`
+	Avg       *float64            `json:"avg"`
+	Quantiles map[string]*float64 `json:"quantiles"`
+}
+
+type HistogramSeries struct {
+	DeviceID   string            `json:"deviceID,omitempty"`
+	DeviceName string            `json:"deviceName,omitempty"`
+	Labels     map[string]string `json:"labels"`
+	Type       string            `json:"type"`
+	// Number of series added up into this one
+	Merged int              `json:"merged"`
+	Total  HistogramPoint   `json:"total"`
+	Points []HistogramPoint `json:"points,omitempty"`
+}
+
+type HistogramResult struct {
+	Metric    string            `json:"metric"`
+	Quantiles []float64         `json:"quantiles"`
+	Series    []HistogramSeries `json:"series"`
+}
+
+// observations are what a series, or merged series, saw in a window
+type observations struct {
+	count     float64
+	sum       float64
+	intervals []interval
+	// Quantiles of the last summary sample, summaries of several series can't be merged
+	summary map[string]float64
+}
+
+func (o *observations) add(other observations) {
+	o.count += other.count
+	o.sum += other.sum
+	o.intervals = append(o.intervals, other.intervals...)
+}
+
+// point estimates the quantiles of the observations
+func (o observations) point(timestamp string, quantiles []float64, merged bool) HistogramPoint {
+	point := HistogramPoint{Timestamp: timestamp, Count: o.count, Sum: o.sum, Quantiles: make(map[string]*float64, len(quantiles))}
+	if o.count > 0 {
+		avg := o.sum / o.count
+		point.Avg = &avg
+	}
+
+	sorted := mergeIntervals(o.intervals)
+	for _, q := range quantiles {
+		name := strconv.FormatFloat(q, 'f', -1, 64)
+
+		value := math.NaN()
+		if o.summary != nil && !merged {
+			if v, ok := o.summary[name]; ok {
+				value = v
+			}
+		} else if len(sorted) > 0 {
+			value = quantile(q, sorted)
+		}
+
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			point.Quantiles[name] = &value
+		} else {
+			point.Quantiles[name] = nil
+		}
+	}
+
+	return point
+}
+
+type histogramSample struct {
+	timestamp time.Time
+	histogram models.Histogram
+}
+
+// windowObservations adds up what a series saw in [from, to), its samples being in time order
+func windowObservations(samples []histogramSample, from time.Time, to time.Time) observations {
+	var o observations
+	for i, sample := range samples {
+		if sample.timestamp.Before(from) || !sample.timestamp.Before(to) {
+			continue
+		}
+
+		if sample.histogram.Quantiles != nil {
+			o.summary = sample.histogram.Quantiles
+		}
+
+		increase := sample.histogram
+		if !increase.Delta {
+			// A cumulative series needs the sample before to know what changed
+			if i == 0 {
+				continue
+			}
+			increase, _ = histogramIncrease(samples[i-1].histogram, sample.histogram)
+		}
+
+		o.count += increase.Count
+		o.sum += increase.Sum
+		o.intervals = append(o.intervals, intervals(increase)...)
+	}
+
+	return o
+}
+
+// ExecuteHistogram estimates the quantiles of the observations of a histogram or summary metric
+func ExecuteHistogram(db *sql.DB, request HistogramRequest) (*HistogramResult, error) {
+	p, err := prepare(Request{
+		TenantID:  request.TenantID,
+		Metric:    CustomMetricPrefix + request.Metric,
+		Devices:   request.Devices,
+		TimeStart: request.TimeStart,
+		TimeEnd:   request.TimeEnd,
+		Filters:   request.Filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(request.Quantiles) == 0 {
+		request.Quantiles = DefaultQuantiles
+	}
+
+	start, err := helpers.ParseTimestamp(request.TimeStart)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	end, err := helpers.ParseTimestamp(request.TimeEnd)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if end.Before(start) {
+		return nil, badRequest("timeRange.end is before timeRange.start")
+	}
+	if request.Step > 0 && end.Sub(start)/request.Step > helpers.MaxBuckets {
+		return nil, badRequest("step too small for the time range, at most %d windows", helpers.MaxBuckets)
+	}
+
+	if err := p.checkTenant(db); err != nil {
+		return nil, err
+	}
+
+	deviceMap, err := helpers.GetDeviceMap(db, p.dbName, p.Devices)
+	if err != nil {
+		return nil, err
+	}
+	if len(deviceMap) == 0 {
+		return nil, ErrNoDevices
+	}
+
+	deviceIDs := make([]string, 0, len(deviceMap))
+	for deviceID := range deviceMap {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	if err := p.resolveCustomSeries(db, deviceIDs); err != nil {
+		return nil, err
+	}
+
+	result := &HistogramResult{Metric: request.Metric, Quantiles: request.Quantiles, Series: []HistogramSeries{}}
+	if len(p.customSeries) == 0 {
+		return result, nil
+	}
+	for _, s := range p.customSeries {
+		if s.metricType != models.GenericHistogram && s.metricType != models.GenericSummary {
+			return nil, badRequest("metric %s is a %s, not a histogram or summary", request.Metric, s.metricType)
+		}
+	}
+
+	samples, err := p.histogramSamples(db, start.Add(-histogramLookback), end)
+	if err != nil {
+		return nil, err
+	}
+
+	// Windows of the query, the whole range when there is no step
+	windows := []time.Time{start, end.Add(time.Millisecond)}
+	if request.Step > 0 {
+		windows = windows[:0]
+		for t := start; !t.After(end); t = t.Add(request.Step) {
+			windows = append(windows, t)
+		}
+		windows = append(windows, windows[len(windows)-1].Add(request.Step))
+	}
+
+	type group struct {
+		series HistogramSeries
+		total  observations
+		points []observations
+	}
+	var order []string
+	groups := make(map[string]*group)
+
+	ids := make([]string, 0, len(p.customSeries))
+	for id := range p.customSeries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := p.customSeries[ids[i]], p.customSeries[ids[j]]
+		if a.deviceID != b.deviceID {
+			return a.deviceID < b.deviceID
+		}
+		return LabelSignature(a.labels) < LabelSignature(b.labels)
+	})
+
+	for _, id := range ids {
+		s := p.customSeries[id]
+
+		key := id
+		labels := s.labels
+		if request.Merge {
+			labels = make(map[string]string)
+			for _, name := range request.By {
+				if value, ok := s.labels[name]; ok {
+					labels[name] = value
+				}
+			}
+			key = LabelSignature(labels)
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			g = &group{series: HistogramSeries{Labels: labels, Type: s.metricType}, points: make([]observations, len(windows)-1)}
+			if !request.Merge {
+				g.series.DeviceID, g.series.DeviceName = s.deviceID, deviceMap[s.deviceID]
+			}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.series.Merged++
+
+		seriesSamples := samples[id]
+		g.total.add(windowObservations(seriesSamples, start, end.Add(time.Millisecond)))
+		if len(seriesSamples) > 0 {
+			g.total.summary = seriesSamples[len(seriesSamples)-1].histogram.Quantiles
+		}
+		if request.Step > 0 {
+			for i := range g.points {
+				window := windowObservations(seriesSamples, windows[i], windows[i+1])
+				g.points[i].add(window)
+				g.points[i].summary = window.summary
+			}
+		}
+	}
+
+	for _, key := range order {
+		g := groups[key]
+		merged := g.series.Merged > 1
+
+		g.series.Total = g.total.point(start.Format(helpers.TimestampLayout), request.Quantiles, merged)
+		if request.Step > 0 {
+			for i, o := range g.points {
+				g.series.Points = append(g.series.Points, o.point(windows[i].Format(helpers.TimestampLayout), request.Quantiles, merged))
+			}
+		}
+		result.Series = append(result.Series, g.series)
+	}
+
+	return result, nil
+}
+
+// histogramSamples reads the samples of the selected series in [from, to], in time order by series ID
+func (p *plan) histogramSamples(db *sql.DB, from time.Time, to time.Time) (map[string][]histogramSample, error) {
+	condition, args := p.customSeriesCondition()
+	condition = strings.Replace(condition, "gs.series_id", "h.series_id", 1)
+	args = append([]interface{}{from.Format(helpers.TimestampLayout), to.Format(helpers.TimestampLayout)}, args...)
+
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT h.series_id, h.timestamp, h.histogram
+        FROM %s.GenericHistograms h
+        WHERE h.timestamp BETWEEN ? AND ? AND %s
+        ORDER BY h.series_id, h.timestamp
+    `, "`"+p.dbName+"`", condition), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s samples: %v", p.metric.customName, err)
+	}
+	defer rows.Close()
+
+	samples := make(map[string][]histogramSample)
+	for rows.Next() {
+		var id, timestamp, encoded string
+		if err := rows.Scan(&id, &timestamp, &encoded); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+
+		var sample histogramSample
+		if sample.timestamp, err = helpers.ParseTimestamp(timestamp); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(encoded), &sample.histogram); err != nil {
+			return nil, fmt.Errorf("error reading histogram of series %s: %v", id, err)
+		}
+		samples[id] = append(samples[id], sample)
+	}
+
+	return samples, rows.Err()
+}
@@ -0,0 +1,251 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+)
+
+// A view is where the samples of a metric are read from, the raw sample tables or a rollup table.
+// {db} in the FROM clause is replaced by the tenant db.
+type view struct {
+	from   string
+	device string
+	// Columns restricted to the time range, the first one is the sample timestamp. Joined partitioned
+	// tables list their own timestamp too so both get pruned.
+	times []string
+	value string
+	// Label name -> column
+	labels map[string]string
+	// Rollup table metric, empty for raw views
+	rollupMetric string
+}
+
+func (v view) rollup() bool {
+	return v.rollupMetric != ""
+}
+
+// fromClause returns the FROM clause for the tenant db
+func (v view) fromClause(dbName string) string {
+	return strings.ReplaceAll(v.from, "{db}", "`"+dbName+"`")
+}
+
+// labelNames returns the labels of the view in a stable order
+func (v view) labelNames() []string {
+	names := make([]string, 0, len(v.labels))
+	for name := range v.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// rankExpression returns the aggregate a series is ranked by
+func (v view) rankExpression(function string) string {
+	if v.rollup() {
+		switch function {
+		case RankAvg:
+			return "SUM(r.sum_value) / SUM(r.sample_count)"
+		case RankMax:
+			return "MAX(r.max_value)"
+		case RankMin:
+			return "MIN(r.min_value)"
+		}
+		return "SUM(r.sum_value)"
+	}
+
+	switch function {
+	case RankAvg:
+		return "AVG(" + v.value + ")"
+	case RankMax:
+		return "MAX(" + v.value + ")"
+	case RankMin:
+		return "MIN(" + v.value + ")"
+	}
+	return "SUM(" + v.value + ")"
+}
+
+// A grouping says which label series are ranked by and which one samples are grouped into series by
+type grouping struct {
+	rank   string
+	series string
+}
+
+// metric describes a queryable metric
+type metric struct {
+	raw view
+	// nil when the metric isn't rolled up
+	rollup         *view
+	groupings      map[string]grouping
+	defaultGroupBy string
+	// Name of the generic series of a custom metric, their labels are resolved through the label index
+	customName string
+}
+
+// Ways a query can group its samples
+const (
+	GroupByName     = "name"
+	GroupByPID      = "pid"
+	GroupByInstance = "instance"
+	GroupByWorkload = "workload"
+	GroupByDevice   = "device"
+	GroupByMount    = "mount"
+)
+
+const processFrom = `{db}.PerformanceMetrics pm
+    JOIN {db}.ProcessMetrics psm ON pm.metric_id = psm.metric_id AND pm.timestamp = psm.timestamp
+    LEFT JOIN {db}.ProcessNames pn ON pn.name_id = psm.name_id
+    LEFT JOIN {db}.ProcessCommands pc ON pc.command_id = psm.command_id`
+
+var processLabels = map[string]string{
+	"pid":         "psm.process_pid",
+	"name":        "pn.process_name",
+	"command":     "pc.process_command",
+	"instance":    "psm.process_instance",
+	"workload":    "psm.workload_key",
+	"user":        "psm.process_user",
+	"ppid":        "psm.process_ppid",
+	"state":       "psm.process_state",
+	"threads":     "psm.process_threads",
+	"open_fds":    "psm.process_open_fds",
+	"start_time":  "psm.process_start_time",
+	"read_bytes":  "psm.process_read_bytes",
+	"write_bytes": "psm.process_write_bytes",
+}
+
+const processRollupFrom = `{db}.ProcessRollups r
+    LEFT JOIN {db}.ProcessNames pn ON pn.name_id = r.name_id`
+
+var processRollupLabels = map[string]string{
+	"pid":      "r.process_pid",
+	"name":     "pn.process_name",
+	"instance": "r.process_instance",
+	"workload": "r.workload_key",
+}
+
+// Processes grouped by name are ranked by PID, so the top N are N processes even when some share their name
+var processGroupings = map[string]grouping{
+	GroupByName:     {rank: "pid", series: "name"},
+	GroupByPID:      {rank: "pid", series: "pid"},
+	GroupByInstance: {rank: "instance", series: "instance"},
+	GroupByWorkload: {rank: "workload", series: "workload"},
+}
+
+func processMetric(column string, rolledUp bool) metric {
+	m := metric{
+		raw: view{
+			from:   processFrom,
+			device: "pm.device_id",
+			times:  []string{"pm.timestamp", "psm.timestamp"},
+			value:  "psm." + column,
+			labels: processLabels,
+		},
+		groupings:      processGroupings,
+		defaultGroupBy: GroupByName,
+	}
+
+	if rolledUp {
+		m.rollup = &view{
+			from:         processRollupFrom,
+			device:       "r.device_id",
+			times:        []string{"r.bucket_start"},
+			labels:       processRollupLabels,
+			rollupMetric: column,
+		}
+	}
+
+	return m
+}
+
+func hostMetric(column string, rolledUp bool) metric {
+	m := metric{
+		raw: view{
+			from:   "{db}.PerformanceMetrics pm",
+			device: "pm.device_id",
+			times:  []string{"pm.timestamp"},
+			value:  "pm." + column,
+			labels: map[string]string{"device": "pm.device_id"},
+		},
+		groupings:      map[string]grouping{GroupByDevice: {rank: "device", series: "device"}},
+		defaultGroupBy: GroupByDevice,
+	}
+
+	if rolledUp {
+		m.rollup = &view{
+			from:         "{db}.HostRollups r",
+			device:       "r.device_id",
+			times:        []string{"r.bucket_start"},
+			labels:       map[string]string{"device": "r.device_id"},
+			rollupMetric: column,
+		}
+	}
+
+	return m
+}
+
+func diskMetric(value string) metric {
+	return metric{
+		raw: view{
+			from: `{db}.PerformanceMetrics pm
+    JOIN {db}.DiskMetrics dm ON dm.metric_id = pm.metric_id`,
+			device: "pm.device_id",
+			times:  []string{"pm.timestamp"},
+			value:  value,
+			labels: map[string]string{
+				"mount":       "dm.mount_point",
+				"file_system": "dm.file_system",
+				"fs_type":     "dm.fs_type",
+			},
+		},
+		groupings:      map[string]grouping{GroupByMount: {rank: "mount", series: "mount"}},
+		defaultGroupBy: GroupByMount,
+	}
+}
+
+// Metrics that can be queried, by name
+var metrics = map[string]metric{
+	"cpu":         processMetric("process_cpu_usage", true),
+	"ram":         processMetric("process_ram_usage", true),
+	"threads":     processMetric("process_threads", false),
+	"open_fds":    processMetric("process_open_fds", false),
+	"read_bytes":  processMetric("process_read_bytes", false),
+	"write_bytes": processMetric("process_write_bytes", false),
+
+	"host_cpu":   hostMetric("cpu_usage", true),
+	"host_ram":   hostMetric("ram_usage", true),
+	"host_disk":  hostMetric("disk_usage", true),
+	"load1":      hostMetric("load_avg_1", true),
+	"load5":      hostMetric("load_avg_5", true),
+	"load15":     hostMetric("load_avg_15", true),
+	"cpu_user":   hostMetric("cpu_user", true),
+	"cpu_system": hostMetric("cpu_system", true),
+	"cpu_iowait": hostMetric("cpu_iowait", true),
+	"cpu_steal":  hostMetric("cpu_steal", true),
+
+	"disk":              diskMetric("dm.used_bytes"),
+	"disk_used_percent": diskMetric("100 * dm.used_bytes / NULLIF(dm.total_bytes, 0)"),
+	"disk_inodes_used":  diskMetric("dm.inodes_used"),
+	"disk_read_iops":    diskMetric("dm.read_iops"),
+	"disk_write_iops":   diskMetric("dm.write_iops"),
+}
+
+// MetricNames returns the names of the metrics that can be queried
+func MetricNames() []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Labels returns the labels a metric can be filtered on
+func Labels(metricName string) []string {
+	m, ok := metrics[metricName]
+	if !ok {
+		return nil
+	}
+
+	return m.raw.labelNames()
+}
@@ -0,0 +1,536 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/jobs"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Structs to match the JSON request
+
+// An alert rule, window and for are durations ("5m") or seconds
+type AlertRulePayload struct {
+	ID          int64           `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Metric      string          `json:"metric"`
+	Devices     []string        `json:"devices"`
+	Filters     []engine.Filter `json:"filters"`
+	GroupBy     string          `json:"groupBy,omitempty"`
+	Aggregation string          `json:"aggregation"`
+	Operator    string          `json:"operator"`
+	Threshold   float64         `json:"threshold"`
+	Window      string          `json:"window"`
+	For         string          `json:"for"`
+	Severity    string          `json:"severity"`
+	Channels    []int64         `json:"channels"`
+	Enabled     *bool           `json:"enabled"`
+	CreatedAt   string          `json:"createdAt,omitempty"`
+	UpdatedAt   string          `json:"updatedAt,omitempty"`
+	Alerts      []AlertPayload  `json:"alerts,omitempty"`
+}
+
+type AlertRuleRequest struct {
+	TenantID string           `json:"tenantID"`
+	Rule     AlertRulePayload `json:"rule"`
+}
+
+type AlertPayload struct {
+	RuleID      int64             `json:"ruleID"`
+	RuleName    string            `json:"ruleName,omitempty"`
+	Severity    string            `json:"severity,omitempty"`
+	DeviceID    string            `json:"deviceID"`
+	DeviceName  string            `json:"deviceName"`
+	Series      string            `json:"series"`
+	Labels      map[string]string `json:"labels"`
+	State       string            `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveSince string            `json:"activeSince"`
+	FiredAt     string            `json:"firedAt,omitempty"`
+	EvaluatedAt string            `json:"evaluatedAt"`
+	SilencedBy  string            `json:"silencedBy,omitempty"`
+}
+
+type AlertEventPayload struct {
+	ID         int64             `json:"id"`
+	RuleID     int64             `json:"ruleID"`
+	RuleName   string            `json:"ruleName,omitempty"`
+	DeviceID   string            `json:"deviceID"`
+	DeviceName string            `json:"deviceName"`
+	Series     string            `json:"series"`
+	Labels     map[string]string `json:"labels"`
+	State      string            `json:"state"`
+	Value      float64           `json:"value"`
+	Threshold  float64           `json:"threshold"`
+	Timestamp  string            `json:"timestamp"`
+	SilencedBy string            `json:"silencedBy,omitempty"`
+}
+
+// Default window of a rule, and transitions returned by the history when no limit is given, and at most
+const (
+	defaultAlertWindow  = time.Minute
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 5000
+)
+
+// alertRuleFromPayload validates a rule sent by a client
+func alertRuleFromPayload(tenantID string, payload AlertRulePayload) (models.AlertRule, error) {
+	rule := models.AlertRule{
+		ID:          payload.ID,
+		Name:        payload.Name,
+		Description: payload.Description,
+		Metric:      payload.Metric,
+		Devices:     payload.Devices,
+		GroupBy:     payload.GroupBy,
+		Aggregation: payload.Aggregation,
+		Operator:    payload.Operator,
+		Threshold:   payload.Threshold,
+		Window:      defaultAlertWindow,
+		Severity:    payload.Severity,
+		Enabled:     payload.Enabled == nil || *payload.Enabled,
+	}
+
+	if rule.Aggregation == "" {
+		rule.Aggregation = jobs.AlertAvg
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+
+	var err error
+	if payload.Window != "" {
+		if rule.Window, err = helpers.ParseStep(payload.Window); err != nil {
+			return rule, fmt.Errorf("invalid window: %v", err)
+		}
+	}
+	if payload.For != "" && payload.For != "0" {
+		if rule.For, err = helpers.ParseStep(payload.For); err != nil {
+			return rule, fmt.Errorf("invalid for: %v", err)
+		}
+	}
+
+	if payload.Filters == nil {
+		payload.Filters = []engine.Filter{}
+	}
+	filters, err := json.Marshal(payload.Filters)
+	if err != nil {
+		return rule, err
+	}
+	rule.Filters = string(filters)
+
+	return rule, jobs.ValidateAlertRule(tenantID, rule)
+}
+
+func alertRulePayload(rule models.AlertRule) AlertRulePayload {
+	payload := AlertRulePayload{
+		ID:          rule.ID,
+		Name:        rule.Name,
+		Description: rule.Description,
+		Metric:      rule.Metric,
+		Devices:     rule.Devices,
+		GroupBy:     rule.GroupBy,
+		Aggregation: rule.Aggregation,
+		Operator:    rule.Operator,
+		Threshold:   rule.Threshold,
+		Window:      rule.Window.String(),
+		For:         rule.For.String(),
+		Severity:    rule.Severity,
+		Enabled:     &rule.Enabled,
+		CreatedAt:   rule.CreatedAt,
+		UpdatedAt:   rule.UpdatedAt,
+	}
+	json.Unmarshal([]byte(rule.Filters), &payload.Filters)
+
+	return payload
+}
+
+func alertPayload(alert models.Alert, deviceMap map[string]string) AlertPayload {
+	return AlertPayload{
+		RuleID:      alert.RuleID,
+		DeviceID:    alert.DeviceID,
+		DeviceName:  deviceMap[alert.DeviceID],
+		Series:      alert.SeriesKey,
+		Labels:      alert.Labels,
+		State:       alert.State,
+		Value:       alert.Value,
+		ActiveSince: alert.ActiveSince,
+		FiredAt:     alert.FiredAt,
+		EvaluatedAt: alert.EvaluatedAt,
+		SilencedBy:  alert.SilencedBy,
+	}
+}
+
+// writeJSON encodes a response as JSON and sends it to the client
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// Function to manage the alert rules of a tenant
+// GET /api/v1/alerts?tenantID=1234 lists the rules with their pending and firing alerts, &id=7 returns one
+// POST /api/v1/alerts with an AlertRuleRequest body creates a rule, such as host_cpu avg over 1m > 90 for 5m, its
+// alerts are notified on the notification channels listed in rule.channels
+// PUT /api/v1/alerts with an AlertRuleRequest body replaces the rule with the ID of the body
+// DELETE /api/v1/alerts?tenantID=1234&id=7 deletes a rule, its history is kept
+func ManageAlerts(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+	var ruleID int64
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		tenantID = r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+		if id := r.URL.Query().Get("id"); id != "" {
+			var err error
+			if ruleID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == http.MethodDelete && ruleID == 0 {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost, http.MethodPut:
+		var alertRuleRequest AlertRuleRequest
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, &alertRuleRequest); err != nil {
+			http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+			return
+		}
+
+		tenantID = alertRuleRequest.TenantID
+		if tenantID == "" {
+			http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut && alertRuleRequest.Rule.ID == 0 {
+			http.Error(w, "rule.id is required", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := alertRuleFromPayload(tenantID, alertRuleRequest.Rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if detectorID, ok := jobs.AnomalySource(rule.Metric); ok {
+			detector, err := models.GetAnomalyDetector(db, tenantID, detectorID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying anomaly detector: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if detector == nil {
+				http.Error(w, fmt.Sprintf("Unknown anomaly detector %d", detectorID), http.StatusBadRequest)
+				return
+			}
+		}
+
+		channels, err := models.GetNotificationChannels(db, tenantID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying notification channels: %v", err), http.StatusInternalServerError)
+			return
+		}
+		known := make(map[int64]bool, len(channels))
+		for _, channel := range channels {
+			known[channel.ID] = true
+		}
+		for _, channelID := range alertRuleRequest.Rule.Channels {
+			if !known[channelID] {
+				http.Error(w, fmt.Sprintf("Unknown notification channel %d", channelID), http.StatusBadRequest)
+				return
+			}
+		}
+
+		now := time.Now().UTC().Format(helpers.TimestampLayout)
+		if r.Method == http.MethodPost {
+			if ruleID, err = models.CreateAlertRule(db, tenantID, rule, now); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving alert rule: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			found, err := models.UpdateAlertRule(db, tenantID, rule, now)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving alert rule: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Alert rule not found", http.StatusNotFound)
+				return
+			}
+			ruleID = rule.ID
+		}
+
+		if err := models.SetAlertRoutes(db, tenantID, ruleID, alertRuleRequest.Rule.Channels); err != nil {
+			http.Error(w, fmt.Sprintf("Error saving the channels of the alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		found, err := models.DeleteAlertRule(db, tenantID, ruleID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Alert rule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rules, err := models.GetAlertRules(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alert rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+	alerts, err := models.GetAlerts(db, tenantID, ruleID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alerts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	routes, err := models.GetAlertRoutes(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alert routes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deviceMap, err := helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := []AlertRulePayload{}
+	for _, rule := range rules {
+		if ruleID != 0 && rule.ID != ruleID {
+			continue
+		}
+
+		payload := alertRulePayload(rule)
+		payload.Channels = routes[rule.ID]
+		if payload.Channels == nil {
+			payload.Channels = []int64{}
+		}
+		for _, alert := range alerts {
+			if alert.RuleID == rule.ID {
+				payload.Alerts = append(payload.Alerts, alertPayload(alert, deviceMap))
+			}
+		}
+		payloads = append(payloads, payload)
+	}
+
+	switch {
+	case ruleID == 0:
+		writeJSON(w, http.StatusOK, payloads)
+	case len(payloads) == 0:
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+	case r.Method == http.MethodPost:
+		writeJSON(w, http.StatusCreated, payloads[0])
+	default:
+		writeJSON(w, http.StatusOK, payloads[0])
+	}
+}
+
+// Function to list the pending and firing alerts of a tenant, across rules
+// GET /api/v1/alerts/active?tenantID=1234&state=firing&silenced=false, silenced alerts have the silence or
+// maintenance window muting them in silencedBy
+func GetActiveAlerts(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.URL.Query().Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	if state != "" && state != models.AlertPending && state != models.AlertFiring {
+		http.Error(w, "Invalid state, expected pending or firing", http.StatusBadRequest)
+		return
+	}
+	silenced := r.URL.Query().Get("silenced")
+	if silenced != "" && silenced != "true" && silenced != "false" {
+		http.Error(w, "Invalid silenced, expected true or false", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rules, err := models.GetAlertRules(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alert rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+	alerts, err := models.GetAlerts(db, tenantID, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alerts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deviceMap, err := helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rulesByID := make(map[int64]models.AlertRule, len(rules))
+	for _, rule := range rules {
+		rulesByID[rule.ID] = rule
+	}
+
+	payloads := []AlertPayload{}
+	for _, alert := range alerts {
+		if state != "" && alert.State != state {
+			continue
+		}
+		if silenced != "" && (alert.SilencedBy != "") != (silenced == "true") {
+			continue
+		}
+
+		payload := alertPayload(alert, deviceMap)
+		payload.RuleName = rulesByID[alert.RuleID].Name
+		payload.Severity = rulesByID[alert.RuleID].Severity
+		payloads = append(payloads, payload)
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// Function to read the history of the alerts of a tenant, newest transitions first
+// GET /api/v1/alerts/history?tenantID=1234&ruleID=7&device=web-1&state=firing&start=...&end=...&limit=100
+func GetAlertHistory(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	tenantID := params.Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	query := models.AlertHistoryQuery{State: params.Get("state"), Limit: defaultHistoryLimit}
+	if value := params.Get("ruleID"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ruleID", http.StatusBadRequest)
+			return
+		}
+		query.RuleID = id
+	}
+	for param, bound := range map[string]*string{"start": &query.From, "end": &query.To} {
+		if value := params.Get(param); value != "" {
+			t, err := helpers.ParseTimestamp(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*bound = t.UTC().Format(helpers.TimestampLayout)
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+	if device := params.Get("device"); device != "" {
+		deviceMap, err := helpers.GetDeviceMap(db, dbName, []string{device})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(deviceMap) == 0 {
+			http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+			return
+		}
+		for deviceID := range deviceMap {
+			query.DeviceID = deviceID
+		}
+	}
+
+	events, err := models.GetAlertHistory(db, tenantID, query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alert history: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rules, err := models.GetAlertRules(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alert rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ruleNames := make(map[int64]string, len(rules))
+	for _, rule := range rules {
+		ruleNames[rule.ID] = rule.Name
+	}
+
+	payloads := make([]AlertEventPayload, 0, len(events))
+	for _, event := range events {
+		payloads = append(payloads, AlertEventPayload{
+			ID:         event.ID,
+			RuleID:     event.RuleID,
+			RuleName:   ruleNames[event.RuleID],
+			DeviceID:   event.DeviceID,
+			DeviceName: deviceMap[event.DeviceID],
+			Series:     event.SeriesKey,
+			Labels:     event.Labels,
+			State:      event.State,
+			Value:      event.Value,
+			Threshold:  event.Threshold,
+			Timestamp:  event.Timestamp,
+			SilencedBy: event.SilencedBy,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
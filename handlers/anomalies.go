@@ -0,0 +1,480 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/jobs"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Structs to match the JSON request
+
+// An anomaly detector, step and training are durations ("5m", "336h") or seconds. The zero values of the settings
+// take the defaults of the model.
+type AnomalyDetectorPayload struct {
+	ID             int64           `json:"id"`
+	Name           string          `json:"name"`
+	Metric         string          `json:"metric"`
+	Devices        []string        `json:"devices"`
+	Filters        []engine.Filter `json:"filters"`
+	GroupBy        string          `json:"groupBy,omitempty"`
+	Top            int             `json:"top"`
+	Model          string          `json:"model"`
+	Step           string          `json:"step"`
+	Training       string          `json:"training"`
+	Threshold      float64         `json:"threshold"`
+	Direction      string          `json:"direction"`
+	MinDeviation   float64         `json:"minDeviation"`
+	MinSamples     int             `json:"minSamples"`
+	Enabled        *bool           `json:"enabled"`
+	EvaluatedUntil string          `json:"evaluatedUntil,omitempty"`
+	CreatedAt      string          `json:"createdAt,omitempty"`
+	UpdatedAt      string          `json:"updatedAt,omitempty"`
+}
+
+type AnomalyDetectorRequest struct {
+	TenantID string                 `json:"tenantID"`
+	Detector AnomalyDetectorPayload `json:"detector"`
+}
+
+type AnomalyPayload struct {
+	ID         int64             `json:"id"`
+	DetectorID int64             `json:"detectorID"`
+	Detector   string            `json:"detector,omitempty"`
+	Metric     string            `json:"metric,omitempty"`
+	DeviceID   string            `json:"deviceID"`
+	DeviceName string            `json:"deviceName"`
+	Series     string            `json:"series"`
+	Labels     map[string]string `json:"labels"`
+	Timestamp  string            `json:"timestamp"`
+	Value      float64           `json:"value"`
+	Expected   float64           `json:"expected"`
+	Stddev     float64           `json:"stddev"`
+	Score      float64           `json:"score"`
+	DetectedAt string            `json:"detectedAt"`
+}
+
+type AnomalyBaselinePayload struct {
+	DeviceID   string            `json:"deviceID"`
+	DeviceName string            `json:"deviceName"`
+	Series     string            `json:"series"`
+	Labels     map[string]string `json:"labels"`
+	Slot       int               `json:"slot"`
+	Mean       float64           `json:"mean"`
+	Stddev     float64           `json:"stddev"`
+	Samples    int               `json:"samples"`
+}
+
+// Anomalies returned when no limit is given, and at most
+const (
+	defaultAnomalyLimit = 100
+	maxAnomalyLimit     = 5000
+)
+
+// anomalyDetectorFromPayload validates a detector sent by a client
+func anomalyDetectorFromPayload(tenantID string, payload AnomalyDetectorPayload) (models.AnomalyDetector, error) {
+	detector := models.AnomalyDetector{
+		ID:           payload.ID,
+		Name:         payload.Name,
+		Metric:       payload.Metric,
+		Devices:      payload.Devices,
+		GroupBy:      payload.GroupBy,
+		Top:          payload.Top,
+		Model:        payload.Model,
+		Threshold:    payload.Threshold,
+		Direction:    payload.Direction,
+		MinDeviation: payload.MinDeviation,
+		MinSamples:   payload.MinSamples,
+		Enabled:      payload.Enabled == nil || *payload.Enabled,
+	}
+
+	var err error
+	if payload.Step != "" {
+		if detector.Step, err = helpers.ParseStep(payload.Step); err != nil {
+			return detector, fmt.Errorf("invalid step: %v", err)
+		}
+	}
+	if payload.Training != "" {
+		if detector.Training, err = helpers.ParseStep(payload.Training); err != nil {
+			return detector, fmt.Errorf("invalid training: %v", err)
+		}
+	}
+	jobs.AnomalyDefaults(&detector)
+
+	if payload.Filters == nil {
+		payload.Filters = []engine.Filter{}
+	}
+	filters, err := json.Marshal(payload.Filters)
+	if err != nil {
+		return detector, err
+	}
+	detector.Filters = string(filters)
+
+	return detector, jobs.ValidateAnomalyDetector(tenantID, detector)
+}
+
+func anomalyDetectorPayload(detector models.AnomalyDetector) AnomalyDetectorPayload {
+	var filters []engine.Filter
+	if err := json.Unmarshal([]byte(detector.Filters), &filters); err != nil || filters == nil {
+		filters = []engine.Filter{}
+	}
+
+	return AnomalyDetectorPayload{
+		ID:             detector.ID,
+		Name:           detector.Name,
+		Metric:         detector.Metric,
+		Devices:        detector.Devices,
+		Filters:        filters,
+		GroupBy:        detector.GroupBy,
+		Top:            detector.Top,
+		Model:          detector.Model,
+		Step:           detector.Step.String(),
+		Training:       detector.Training.String(),
+		Threshold:      detector.Threshold,
+		Direction:      detector.Direction,
+		MinDeviation:   detector.MinDeviation,
+		MinSamples:     detector.MinSamples,
+		Enabled:        &detector.Enabled,
+		EvaluatedUntil: detector.EvaluatedUntil,
+		CreatedAt:      detector.CreatedAt,
+		UpdatedAt:      detector.UpdatedAt,
+	}
+}
+
+// Function to manage the anomaly detectors of a tenant, they learn the baselines of the series of a metric and
+// record the steps deviating from them
+// GET /api/v1/anomalies/detectors?tenantID=1234 lists the detectors, &id=3 returns one
+// POST /api/v1/anomalies/detectors with an AnomalyDetectorRequest body creates a detector
+// PUT /api/v1/anomalies/detectors with an AnomalyDetectorRequest body replaces the detector with the ID of the body,
+// its baselines are learned again
+// DELETE /api/v1/anomalies/detectors?tenantID=1234&id=3 deletes a detector, its anomalies are kept
+func ManageAnomalyDetectors(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+	var detectorID int64
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		tenantID = r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+		if id := r.URL.Query().Get("id"); id != "" {
+			var err error
+			if detectorID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == http.MethodDelete && detectorID == 0 {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost, http.MethodPut:
+		var detectorRequest AnomalyDetectorRequest
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, &detectorRequest); err != nil {
+			http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+			return
+		}
+
+		tenantID = detectorRequest.TenantID
+		if tenantID == "" {
+			http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut && detectorRequest.Detector.ID == 0 {
+			http.Error(w, "detector.id is required", http.StatusBadRequest)
+			return
+		}
+
+		detector, err := anomalyDetectorFromPayload(tenantID, detectorRequest.Detector)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC().Format(helpers.TimestampLayout)
+		if r.Method == http.MethodPost {
+			if detectorID, err = models.CreateAnomalyDetector(db, tenantID, detector, now); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving anomaly detector: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			found, err := models.UpdateAnomalyDetector(db, tenantID, detector, now)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving anomaly detector: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Anomaly detector not found", http.StatusNotFound)
+				return
+			}
+			detectorID = detector.ID
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		found, err := models.DeleteAnomalyDetector(db, tenantID, detectorID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting anomaly detector: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Anomaly detector not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if detectorID != 0 {
+		detector, err := models.GetAnomalyDetector(db, tenantID, detectorID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying anomaly detector: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if detector == nil {
+			http.Error(w, "Anomaly detector not found", http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, anomalyDetectorPayload(*detector))
+		return
+	}
+
+	detectors, err := models.GetAnomalyDetectors(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying anomaly detectors: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]AnomalyDetectorPayload, 0, len(detectors))
+	for _, detector := range detectors {
+		payloads = append(payloads, anomalyDetectorPayload(detector))
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// Function to read the anomalies found by the detectors of a tenant, newest first. minScore keeps the anomalies
+// scoring at least that many standard deviations away from their baseline.
+// GET /api/v1/anomalies?tenantID=1234&detectorID=3&device=web-1&start=...&end=...&minScore=4&limit=100
+func GetAnomalies(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	tenantID := params.Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	query := models.AnomalyQuery{Limit: defaultAnomalyLimit}
+	if value := params.Get("detectorID"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid detectorID", http.StatusBadRequest)
+			return
+		}
+		query.DetectorID = id
+	}
+	for param, bound := range map[string]*string{"start": &query.From, "end": &query.To} {
+		if value := params.Get(param); value != "" {
+			t, err := helpers.ParseTimestamp(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*bound = t.UTC().Format(helpers.TimestampLayout)
+		}
+	}
+	if value := params.Get("minScore"); value != "" {
+		minScore, err := strconv.ParseFloat(value, 64)
+		if err != nil || minScore < 0 {
+			http.Error(w, "Invalid minScore", http.StatusBadRequest)
+			return
+		}
+		query.MinScore = minScore
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxAnomalyLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxAnomalyLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+	if device := params.Get("device"); device != "" {
+		deviceMap, err := helpers.GetDeviceMap(db, dbName, []string{device})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(deviceMap) == 0 {
+			http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+			return
+		}
+		for deviceID := range deviceMap {
+			query.DeviceIDs = append(query.DeviceIDs, deviceID)
+		}
+	}
+
+	anomalies, err := models.GetAnomalies(db, tenantID, query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying anomalies: %v", err), http.StatusInternalServerError)
+		return
+	}
+	detectors, err := models.GetAnomalyDetectors(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying anomaly detectors: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	detectorsByID := make(map[int64]models.AnomalyDetector, len(detectors))
+	for _, detector := range detectors {
+		detectorsByID[detector.ID] = detector
+	}
+
+	payloads := make([]AnomalyPayload, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		payloads = append(payloads, AnomalyPayload{
+			ID:         anomaly.ID,
+			DetectorID: anomaly.DetectorID,
+			Detector:   detectorsByID[anomaly.DetectorID].Name,
+			Metric:     detectorsByID[anomaly.DetectorID].Metric,
+			DeviceID:   anomaly.DeviceID,
+			DeviceName: deviceMap[anomaly.DeviceID],
+			Series:     anomaly.SeriesKey,
+			Labels:     anomaly.Labels,
+			Timestamp:  anomaly.Timestamp,
+			Value:      anomaly.Value,
+			Expected:   anomaly.Expected,
+			Stddev:     anomaly.Stddev,
+			Score:      anomaly.Score,
+			DetectedAt: anomaly.DetectedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// Function to read the baselines a detector learned, the slot is the UTC hour of the day for daily detectors, the
+// hour of the week from Sunday 00:00 UTC for weekly ones and 0 for rolling ones
+// GET /api/v1/anomalies/baselines?tenantID=1234&detectorID=3&device=web-1
+func GetAnomalyBaselines(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	tenantID := params.Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+	detectorID, err := strconv.ParseInt(params.Get("detectorID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid detectorID", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	detector, err := models.GetAnomalyDetector(db, tenantID, detectorID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying anomaly detector: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if detector == nil {
+		http.Error(w, "Anomaly detector not found", http.StatusNotFound)
+		return
+	}
+
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+	var deviceIDs []string
+	if device := params.Get("device"); device != "" {
+		deviceMap, err := helpers.GetDeviceMap(db, dbName, []string{device})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(deviceMap) == 0 {
+			http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+			return
+		}
+		for deviceID := range deviceMap {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+
+	baselines, err := models.GetAnomalyBaselines(db, tenantID, detectorID, deviceIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying anomaly baselines: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]AnomalyBaselinePayload, 0, len(baselines))
+	for _, baseline := range baselines {
+		payloads = append(payloads, AnomalyBaselinePayload{
+			DeviceID:   baseline.DeviceID,
+			DeviceName: deviceMap[baseline.DeviceID],
+			Series:     baseline.SeriesKey,
+			Labels:     baseline.Labels,
+			Slot:       baseline.Slot,
+			Mean:       baseline.Mean,
+			Stddev:     baseline.Stddev,
+			Samples:    baseline.Samples,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
@@ -7,7 +7,7 @@ func EnableCORS(next http.Handler) http.Handler {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")                                // Allow any origin
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE") // Allowed methods
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Scope-OrgID")
 
 		// Check if the request is for the OPTIONS method (pre-flight request)
 		// If so, return with status 200 and the headers set above
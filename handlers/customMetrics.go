@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/ingest"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Structs to match the JSON request
+
+// A custom metric sample. Gauges and counters have a value. Histograms have cumulative bucket counts by upper
+// bound ("+Inf" for the last one), or exponential buckets from a schema, with a sum and count. Summaries have
+// quantiles computed by the client with a sum and count. Histogram and summary counts are cumulative unless
+// delta is set.
+type CustomMetric struct {
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Labels    map[string]string  `json:"labels"`
+	Value     *float64           `json:"value"`
+	Buckets   map[string]float64 `json:"buckets"`
+	Sum       *float64           `json:"sum"`
+	Count     *float64           `json:"count"`
+	Delta     bool               `json:"delta"`
+	Timestamp string             `json:"timestamp"`
+
+	// Exponential histograms
+	Schema        *int               `json:"schema"`
+	ZeroThreshold float64            `json:"zeroThreshold"`
+	ZeroCount     float64            `json:"zeroCount"`
+	Positive      *ExponentialSpan   `json:"positive"`
+	Negative      *ExponentialSpan   `json:"negative"`
+	Quantiles     map[string]float64 `json:"quantiles"`
+}
+
+// Counts of consecutive exponential buckets, the first one being bucket offset
+type ExponentialSpan struct {
+	Offset int       `json:"offset"`
+	Counts []float64 `json:"counts"`
+}
+
+type CustomMetricsRequest struct {
+	TenantID   string         `json:"tenantID"`
+	DeviceID   string         `json:"deviceID"`
+	DeviceName string         `json:"deviceName"`
+	Metrics    []CustomMetric `json:"metrics"`
+}
+
+// Longest metric and label name, the columns holding them
+const maxCustomNameLength = 255
+
+// customMetricSamples validates a custom metric and returns its sample, at the given time when it has none.
+// Gauges and counters are generic samples, histograms and summaries histogram samples.
+func customMetricSamples(metric CustomMetric, deviceID string, timestamp time.Time) ([]models.GenericSample, []models.HistogramSample, error) {
+	if metric.Name == "" || len(metric.Name) > maxCustomNameLength {
+		return nil, nil, fmt.Errorf("invalid metric name %q", metric.Name)
+	}
+
+	if metric.Type == "" {
+		metric.Type = models.GenericGauge
+	}
+	if !models.ValidGenericType(metric.Type) {
+		return nil, nil, fmt.Errorf("invalid type %q of metric %s, expected gauge, counter, histogram or summary", metric.Type, metric.Name)
+	}
+
+	for name := range metric.Labels {
+		if name == "" || len(name) > maxCustomNameLength {
+			return nil, nil, fmt.Errorf("invalid label name %q of metric %s", name, metric.Name)
+		}
+	}
+
+	if metric.Timestamp != "" {
+		parsed, err := helpers.ParseTimestamp(metric.Timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+		timestamp = parsed
+	}
+
+	if metric.Type == models.GenericGauge || metric.Type == models.GenericCounter {
+		if metric.Value == nil || math.IsNaN(*metric.Value) {
+			return nil, nil, fmt.Errorf("missing value of metric %s", metric.Name)
+		}
+		return []models.GenericSample{{
+			Name:      metric.Name,
+			DeviceID:  deviceID,
+			Type:      metric.Type,
+			Labels:    metric.Labels,
+			Timestamp: timestamp.UnixMilli(),
+			Value:     *metric.Value,
+		}}, nil, nil
+	}
+
+	histogram, err := customHistogram(metric)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := histogram.Valid(); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s %s: %v", metric.Type, metric.Name, err)
+	}
+
+	return nil, []models.HistogramSample{{
+		Name:      metric.Name,
+		DeviceID:  deviceID,
+		Type:      metric.Type,
+		Labels:    metric.Labels,
+		Timestamp: timestamp.UnixMilli(),
+		Histogram: histogram,
+	}}, nil
+}
+
+// customHistogram returns the distribution of a histogram or summary custom metric
+func customHistogram(metric CustomMetric) (models.Histogram, error) {
+	histogram := models.Histogram{Delta: metric.Delta}
+	if metric.Sum != nil {
+		histogram.Sum = *metric.Sum
+	}
+
+	if metric.Type == models.GenericSummary {
+		if metric.Count == nil {
+			return histogram, fmt.Errorf("missing count of summary %s", metric.Name)
+		}
+		histogram.Count = *metric.Count
+
+		histogram.Quantiles = make(map[string]float64, len(metric.Quantiles))
+		for q, value := range metric.Quantiles {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				return histogram, fmt.Errorf("invalid quantile %q of summary %s", q, metric.Name)
+			}
+			histogram.Quantiles[strconv.FormatFloat(parsed, 'f', -1, 64)] = value
+		}
+		return histogram, nil
+	}
+
+	if metric.Schema != nil {
+		histogram.Exponential = true
+		histogram.Schema = *metric.Schema
+		histogram.ZeroThreshold = metric.ZeroThreshold
+		histogram.ZeroCount = metric.ZeroCount
+		histogram.Positive = exponentialBuckets(metric.Positive)
+		histogram.Negative = exponentialBuckets(metric.Negative)
+
+		histogram.Count = histogram.ZeroCount
+		for _, count := range histogram.Positive {
+			histogram.Count += count
+		}
+		for _, count := range histogram.Negative {
+			histogram.Count += count
+		}
+		if metric.Count != nil {
+			histogram.Count = *metric.Count
+		}
+		return histogram, nil
+	}
+
+	if len(metric.Buckets) == 0 {
+		return histogram, fmt.Errorf("missing buckets of histogram %s", metric.Name)
+	}
+
+	type bucket struct {
+		upperBound float64
+		count      float64
+	}
+	buckets := make([]bucket, 0, len(metric.Buckets)+1)
+	for le, count := range metric.Buckets {
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil || math.IsNaN(upperBound) {
+			return histogram, fmt.Errorf("invalid bucket %q of histogram %s", le, metric.Name)
+		}
+		buckets = append(buckets, bucket{upperBound, count})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+
+	histogram.Count = buckets[len(buckets)-1].count
+	if metric.Count != nil {
+		histogram.Count = *metric.Count
+	}
+	if !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		buckets = append(buckets, bucket{math.Inf(1), histogram.Count})
+	}
+
+	// Buckets are stored with the count of their own range
+	previous := 0.0
+	for i, b := range buckets {
+		if b.count < previous {
+			return histogram, fmt.Errorf("bucket counts of histogram %s aren't cumulative", metric.Name)
+		}
+		if i < len(buckets)-1 {
+			histogram.ExplicitBounds = append(histogram.ExplicitBounds, b.upperBound)
+		}
+		histogram.BucketCounts = append(histogram.BucketCounts, b.count-previous)
+		previous = b.count
+	}
+
+	return histogram, nil
+}
+
+// exponentialBuckets returns the counts of a span by bucket index
+func exponentialBuckets(span *ExponentialSpan) map[int]float64 {
+	if span == nil {
+		return nil
+	}
+
+	buckets := make(map[int]float64, len(span.Counts))
+	for i, count := range span.Counts {
+		if count != 0 {
+			buckets[span.Offset+i] = count
+		}
+	}
+	return buckets
+}
+
+// storeCustomMetrics stores the custom metrics of a device, the samples without a time are at timestamp
+func storeCustomMetrics(tenantID string, deviceID string, metrics []CustomMetric, timestamp time.Time) error {
+	var samples []models.GenericSample
+	var histograms []models.HistogramSample
+	for _, metric := range metrics {
+		metricSamples, metricHistograms, err := customMetricSamples(metric, deviceID, timestamp)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, metricSamples...)
+		histograms = append(histograms, metricHistograms...)
+	}
+
+	if err := ingest.StoreGeneric(db, tenantID, samples); err != nil {
+		return err
+	}
+	return ingest.StoreHistograms(db, tenantID, histograms)
+}
+
+// Function to handle the custom metrics of a tenant
+// GET /api/v1/custommetrics?tenantID=1234 lists the custom metrics with their type and labels
+// POST /api/v1/custommetrics with a CustomMetricsRequest body stores custom metrics of a device.
+// Custom metrics are queried on /api/v1/query as the metric "custom:<name>", filtered by any of their labels,
+// histograms and summaries on /api/v1/histograms.
+func HandleCustomMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		tenantID := r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		catalog, err := engine.CustomMetrics(db, tenantID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(catalog); err != nil {
+			http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var customMetricsRequest CustomMetricsRequest
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON data
+	if err := json.Unmarshal(body, &customMetricsRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	if customMetricsRequest.TenantID == "" || customMetricsRequest.DeviceID == "" {
+		http.Error(w, "tenantID and deviceID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Validate every metric before storing any
+	now := time.Now().UTC()
+	for _, metric := range customMetricsRequest.Metrics {
+		if _, _, err := customMetricSamples(metric, customMetricsRequest.DeviceID, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := models.CreatePerformanceDB(db, customMetricsRequest.TenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Devices only sending custom metrics must be known to be queried
+	device := models.DeviceData{DeviceID: customMetricsRequest.DeviceID, Hostname: customMetricsRequest.DeviceName}
+	if device.Hostname == "" {
+		device.Hostname = device.DeviceID
+	}
+	if err := models.RegisterDevice(db, customMetricsRequest.TenantID, device); err != nil {
+		http.Error(w, fmt.Sprintf("Error registering device: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := storeCustomMetrics(customMetricsRequest.TenantID, customMetricsRequest.DeviceID, customMetricsRequest.Metrics, now); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Custom metrics recorded successfully"))
+}
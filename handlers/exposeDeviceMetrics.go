@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bufio"
+	"cloudVigilante/backend/promql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types of the Prometheus text format and of OpenMetrics
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Processes exposed per device and metric when the scrape doesn't ask for a number
+const defaultExposedProcesses = 10
+
+// escapeLabelValue escapes a label value for the exposition formats
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// escapeHelp escapes a HELP text for the Prometheus text format
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// formatLabels formats the labels of a sample in name order, without the metric name
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != promql.LabelName {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value, the special values as the exposition formats spell them
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Function to expose the latest metrics of every device of a tenant for Prometheus to scrape
+// GET /metrics/devices?tenantID=1234&top=10, the tenant can also be given in the X-Scope-OrgID header.
+// Host and disk metrics are exposed for every device, process metrics for the top processes of each.
+// OpenMetrics is returned when the Accept header asks for it, the Prometheus text format otherwise.
+func ExposeDeviceMetrics(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Header.Get(tenantHeader)
+	if tenantID == "" {
+		tenantID = r.URL.Query().Get("tenantID")
+	}
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	top := defaultExposedProcesses
+	if value := r.URL.Query().Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid top, expected a positive number", http.StatusBadRequest)
+			return
+		}
+		top = parsed
+	}
+
+	families, err := promql.Latest(db, tenantID, time.Now().UTC(), top)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypeText)
+	}
+
+	out := bufio.NewWriter(w)
+	for _, family := range families {
+		if len(family.Samples) == 0 {
+			continue
+		}
+
+		if openMetrics {
+			// OpenMetrics names counter families without their _total suffix and has timestamps in seconds
+			name := family.Name
+			if family.Type == promql.TypeCounter {
+				name = strings.TrimSuffix(name, "_total")
+			}
+
+			fmt.Fprintf(out, "# TYPE %s %s\n", name, family.Type)
+			fmt.Fprintf(out, "# HELP %s %s\n", name, escapeLabelValue(family.Help))
+			for _, sample := range family.Samples {
+				fmt.Fprintf(out, "%s%s %s %s\n", family.Name, formatLabels(sample.Labels), formatValue(sample.Value),
+					strconv.FormatFloat(float64(sample.Timestamp)/1000, 'f', -1, 64))
+			}
+			continue
+		}
+
+		fmt.Fprintf(out, "# HELP %s %s\n", family.Name, escapeHelp(family.Help))
+		fmt.Fprintf(out, "# TYPE %s %s\n", family.Name, family.Type)
+		for _, sample := range family.Samples {
+			fmt.Fprintf(out, "%s%s %s %d\n", family.Name, formatLabels(sample.Labels), formatValue(sample.Value), sample.Timestamp)
+		}
+	}
+
+	if openMetrics {
+		fmt.Fprint(out, "# EOF\n")
+	}
+
+	if err := out.Flush(); err != nil {
+		fmt.Printf("Error writing metrics: %v\n", err)
+	}
+}
@@ -1,14 +1,13 @@
 package handlers
 
 import (
+	"cloudVigilante/backend/engine"
 	"cloudVigilante/backend/handlers/helpers"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"sort"
-	"strings"
+	"strconv"
 )
 
 // Structs to match the JSON request
@@ -26,6 +25,11 @@ type Query struct {
 	Devices           []string  `json:"devices"`
 	TimeRange         TimeRange `json:"timeRange"`
 	Metrics           Metrics   `json:"metrics"`
+	GroupBy           string    `json:"groupBy"`
+	// Points per series, the raw samples are returned when 0
+	MaxPoints    int      `json:"maxPoints"`
+	Step         string   `json:"step"`
+	Aggregations []string `json:"aggregations"`
 }
 
 type CPUMetricsRequest struct {
@@ -39,6 +43,90 @@ type CPUMetricsResponse struct {
 	ProcessName     string  `json:"processName"`
 	ProcessCommand  string  `json:"processCommand"`
 	ProcessCPUUsage float64 `json:"processCpuUsage"`
+	ProcessAttributes
+}
+
+// Optional process attributes, NULL in the database when the agent didn't report them
+type ProcessAttributes struct {
+	ProcessUser  *string `json:"processUser,omitempty"`
+	ParentPID    *int    `json:"processParentPID,omitempty"`
+	ProcessState *string `json:"processState,omitempty"`
+	Threads      *int    `json:"processThreads,omitempty"`
+	OpenFDs      *int    `json:"processOpenFDs,omitempty"`
+	StartTime    *string `json:"processStartTime,omitempty"`
+	ReadBytes    *int64  `json:"processReadBytes,omitempty"`
+	WriteBytes   *int64  `json:"processWriteBytes,omitempty"`
+	// Stable identity of the process, see models.ProcessInstanceKey and models.WorkloadKey
+	ProcessInstance string `json:"processInstance,omitempty"`
+	WorkloadKey     string `json:"workloadKey,omitempty"`
+}
+
+// processFromLabels reads the process fields of an engine sample back from its labels
+func processFromLabels(labels map[string]string) (pid int, name string, command string, attributes ProcessAttributes) {
+	pid, _ = strconv.Atoi(labels["pid"])
+	name = labels["name"]
+	command = labels["command"]
+
+	optionalString := func(label string) *string {
+		if value, ok := labels[label]; ok {
+			return &value
+		}
+		return nil
+	}
+	optionalInt := func(label string) *int {
+		if value, err := strconv.Atoi(labels[label]); err == nil {
+			return &value
+		}
+		return nil
+	}
+	optionalInt64 := func(label string) *int64 {
+		if value, err := strconv.ParseInt(labels[label], 10, 64); err == nil {
+			return &value
+		}
+		return nil
+	}
+
+	attributes = ProcessAttributes{
+		ProcessUser:     optionalString("user"),
+		ParentPID:       optionalInt("ppid"),
+		ProcessState:    optionalString("state"),
+		Threads:         optionalInt("threads"),
+		OpenFDs:         optionalInt("open_fds"),
+		StartTime:       optionalString("start_time"),
+		ReadBytes:       optionalInt64("read_bytes"),
+		WriteBytes:      optionalInt64("write_bytes"),
+		ProcessInstance: labels["instance"],
+		WorkloadKey:     labels["workload"],
+	}
+
+	return pid, name, command, attributes
+}
+
+// processEngineRequest turns the query of the CPU and RAM endpoints into a query on a process metric. Their clients
+// get the raw samples unless they send a point budget.
+func processEngineRequest(tenantID string, metric string, query Query) (engine.Request, error) {
+	request := engine.Request{
+		TenantID:     tenantID,
+		Metric:       metric,
+		Devices:      query.Devices,
+		TimeStart:    query.TimeRange.Start,
+		TimeEnd:      query.TimeRange.End,
+		GroupBy:      query.GroupBy,
+		Rank:         engine.Ranking{Function: engine.RankSum, Limit: query.NumberOfProcesses},
+		MaxPoints:    query.MaxPoints,
+		Aggregations: query.Aggregations,
+	}
+
+	// Validate the optional bucketing of the series
+	if query.Step != "" {
+		step, err := helpers.ParseStep(query.Step)
+		if err != nil {
+			return request, err
+		}
+		request.Step = step
+	}
+
+	return request, nil
 }
 
 type ProcessGroup struct {
@@ -56,17 +144,21 @@ type ProcessMetrics struct {
 
 type CpuProcessGroup struct {
 	ProcessName string               `json:"processName"`
+	GroupKey    string               `json:"groupKey,omitempty"`
 	AvgCpu      int64                `json:"avgCpu"`
-	Metrics     []CPUMetricsResponse `json:"metrics"`
+	Metrics     []CPUMetricsResponse `json:"metrics,omitempty"`
+	Buckets     []helpers.Bucket     `json:"buckets,omitempty"`
 }
 
 type CpuDeviceMetrics struct {
 	DeviceID   string            `json:"DeviceID"`
 	DeviceName string            `json:"DeviceName"`
+	Resolution int               `json:"resolution,omitempty"`
 	Metrics    []CpuProcessGroup `json:"Metrics"`
 }
 
 // Function to handle the retrieval of CPU metrics
+// Kept for the existing clients, it answers a "cpu" query of the query engine in its own response format
 func RetrieveCPUMetrics(w http.ResponseWriter, r *http.Request) {
 	var cpuMetricsRequest CPUMetricsRequest
 
@@ -84,102 +176,20 @@ func RetrieveCPUMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tenantID := cpuMetricsRequest.TenantID
-	devices := cpuMetricsRequest.Query.Devices
-	timeStart := cpuMetricsRequest.Query.TimeRange.Start
-	timeEnd := cpuMetricsRequest.Query.TimeRange.End
-	numberOfProcesses := cpuMetricsRequest.Query.NumberOfProcesses
-
-	// Validate the tenant ID
-	if tenantID == "" {
-		http.Error(w, "Tenant ID is required", http.StatusBadRequest)
-		return
-	}
-
-	// Determine the database name
-	dbName := fmt.Sprintf("Performance_%s", tenantID)
-
-	// Check if the tenant is registered
-	var exists int
-	query := fmt.Sprintf("SELECT EXISTS(SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = '%s')", dbName)
-	err = db.QueryRow(query).Scan(&exists)
-
-	if exists == 0 {
-		log.Printf("DB: %s does not exist", dbName)
-		http.Error(w, fmt.Sprintf("Error checking tenant: %s", tenantID), http.StatusInternalServerError)
-		return
-	}
-
-	// If devices array is empty, query all devices
-	deviceMap := make(map[string]string)
-	if len(devices) == 0 {
-		deviceQuery := fmt.Sprintf("SELECT device_id, device_hostname FROM `%s`.Devices", dbName)
-		rows, err := db.Query(deviceQuery)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error querying devices: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var deviceID, deviceHostname string
-			if err := rows.Scan(&deviceID, &deviceHostname); err != nil {
-				http.Error(w, fmt.Sprintf("Error scanning device ID and hostname: %v", err), http.StatusInternalServerError)
-				return
-			}
-			deviceMap[deviceID] = deviceHostname
-		}
-	} else {
-		// Translate device names to device IDs
-		queryPlaceholders := strings.Repeat("?,", len(devices))
-		queryPlaceholders = strings.TrimSuffix(queryPlaceholders, ",")
-		deviceNameQuery := fmt.Sprintf("SELECT device_id, device_hostname FROM `%s`.Devices WHERE TRIM(device_hostname) IN (%s)", dbName, queryPlaceholders)
-
-		args := make([]interface{}, len(devices))
-		for i, device := range devices {
-			args[i] = device
-		}
-
-		rows, err := db.Query(deviceNameQuery, args...)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error querying device names: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var deviceID, deviceHostname string
-			if err := rows.Scan(&deviceID, &deviceHostname); err != nil {
-				http.Error(w, fmt.Sprintf("Error scanning device ID and hostname: %v", err), http.StatusInternalServerError)
-				return
-			}
-			deviceMap[deviceID] = deviceHostname
-		}
-	}
-
-	// Fill deviceIDs array
-
-	deviceIDs := make([]string, 0, len(deviceMap))
-
-	for deviceID := range deviceMap {
-		deviceIDs = append(deviceIDs, deviceID)
-	}
-
-	// Construct the query for performance metrics
-	if len(deviceIDs) == 0 {
-		http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+	request, err := processEngineRequest(cpuMetricsRequest.TenantID, "cpu", cpuMetricsRequest.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get the top process IDs using the new function
-	devicePIDsMap, err := helpers.GetTopProcessIDs(db, dbName, deviceIDs, timeStart, timeEnd, numberOfProcesses)
+	result, err := engine.Execute(db, request)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeQueryError(w, err)
 		return
 	}
 
 	// If no processes are identified, return an empty response
-	if len(devicePIDsMap) == 0 {
+	if len(result.Devices) == 0 {
 		fmt.Println("No processes were found when querying CPU metrics")
 		w.Header().Set("Content-Type", "application/json")
 
@@ -197,98 +207,42 @@ func RetrieveCPUMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// DS to hold metrics per device
-	deviceMetricsMap := make(map[string][]CPUMetricsResponse)
-	// Construct the query for performance metrics for the identified top processes
-	for deviceID, pids := range devicePIDsMap {
-
-		performanceQuery := fmt.Sprintf(`
-		SELECT 
-			pm.timestamp,
-			psm.process_pid,
-			psm.process_name,
-			psm.process_command,
-			process_cpu_usage
-		FROM 
-			%s.PerformanceMetrics pm
-		JOIN 
-			%s.ProcessMetrics psm ON pm.metric_id = psm.metric_id
-		WHERE 
-			pm.device_id = ?
-			AND psm.process_pid IN (%s)
-			AND pm.timestamp BETWEEN ? AND ?
-		ORDER BY 
-			pm.timestamp
-	`, fmt.Sprintf("`%s`", dbName), fmt.Sprintf("`%s`", dbName), strings.Trim(strings.Repeat("?,", len(pids)), ","))
-
-		// Prepare the arguments for the performanceQuery
-		args := []interface{}{deviceID}
-		for _, pid := range pids {
-			args = append(args, pid)
-		}
-		args = append(args, timeStart, timeEnd)
-
-		rows, err := db.Query(performanceQuery, args...)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error querying CPU performance metrics: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		// Parse and MAP the query results
-		for rows.Next() {
-			var metric CPUMetricsResponse
-			if err := rows.Scan(&metric.Timestamp, &metric.ProcessPID, &metric.ProcessName, &metric.ProcessCommand, &metric.ProcessCPUUsage); err != nil {
-				http.Error(w, fmt.Sprintf("Error scanning row: %v", err), http.StatusInternalServerError)
-				return
+	// One group of samples per series, busiest first as ranked by the engine
+	deviceMetrics := make([]CpuDeviceMetrics, 0, len(result.Devices))
+	for _, device := range result.Devices {
+		groupedMetrics := make([]CpuProcessGroup, 0, len(device.Series))
+		for _, series := range device.Series {
+			group := CpuProcessGroup{
+				ProcessName: series.Labels["name"],
+				AvgCpu:      int64(series.Avg),
+				Buckets:     series.Buckets,
+			}
+			if request.GroupBy == engine.GroupByInstance || request.GroupBy == engine.GroupByWorkload {
+				group.GroupKey = series.Key
 			}
-			deviceMetricsMap[deviceID] = append(deviceMetricsMap[deviceID], metric)
-		}
 
-	}
+			for _, sample := range series.Samples {
+				metric := CPUMetricsResponse{Timestamp: sample.Timestamp, ProcessCPUUsage: sample.Value}
+				metric.ProcessPID, metric.ProcessName, metric.ProcessCommand, metric.ProcessAttributes = processFromLabels(sample.Labels)
+				group.Metrics = append(group.Metrics, metric)
+			}
 
-	// BEGIN NEW CODE
-	// Group Metrics by process name for each device ID
-	var deviceMetrics []CpuDeviceMetrics
-	for deviceID, metrics := range deviceMetricsMap {
-		processGroups := make(map[string][]CPUMetricsResponse)
-		cpuUsageTotals := make(map[string]float64)
-		cpuUsageCounts := make(map[string]int)
-
-		// Group metrics by process name
-		for _, metric := range metrics {
-			processName := metric.ProcessName
-			processGroups[processName] = append(processGroups[processName], metric)
-			cpuUsageTotals[processName] += metric.ProcessCPUUsage
-			cpuUsageCounts[processName]++
-		}
+			// Groups mixing several names take the name of their first sample
+			if group.ProcessName == "" && len(group.Metrics) > 0 {
+				group.ProcessName = group.Metrics[0].ProcessName
+			}
 
-		// Calculate the average CPU usage for each process
-		groupedMetrics := make([]CpuProcessGroup, 0, len(processGroups))
-		for name, metrics := range processGroups {
-			avgCpu := int64(cpuUsageTotals[name] / float64(cpuUsageCounts[name]))
-			groupedMetrics = append(groupedMetrics, CpuProcessGroup{
-				ProcessName: name,
-				AvgCpu:      avgCpu,
-				Metrics:     metrics,
-			})
+			groupedMetrics = append(groupedMetrics, group)
 		}
 
-		// Sort the grouped metrics by average CPU usage
-		sort.Slice(groupedMetrics, func(i, j int) bool {
-			return groupedMetrics[i].AvgCpu > groupedMetrics[j].AvgCpu
-		})
-
-		// Append sorted metrics to response
 		deviceMetrics = append(deviceMetrics, CpuDeviceMetrics{
-			DeviceID:   deviceID,
-			DeviceName: deviceMap[deviceID],
+			DeviceID:   device.DeviceID,
+			DeviceName: device.DeviceName,
+			Resolution: result.Resolution,
 			Metrics:    groupedMetrics,
 		})
 	}
 
-	// END NEW CODE
-
 	// Encode the structured response as JSON and send it to the client.
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(deviceMetrics); err != nil {
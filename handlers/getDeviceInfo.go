@@ -26,7 +26,8 @@ func GetDeviceInfo(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.URL.Query().Get("tenantID")
 	if tenantID == "" {
 		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
-		fmt.Println("Invalid tenantID, %s", tenantID)
+		fmt.Printf("Invalid tenantID, %s\n", tenantID)
+		return
 	}
 
 	// Query the Devices table for the tenantID
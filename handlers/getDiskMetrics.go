@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Structs to match the JSON request
+
+type DiskQuery struct {
+	NumberOfMounts int       `json:"numberOfMounts"`
+	Devices        []string  `json:"devices"`
+	TimeRange      TimeRange `json:"timeRange"`
+}
+
+type DiskMetricsRequest struct {
+	TenantID string    `json:"tenantID"`
+	Query    DiskQuery `json:"query"`
+}
+
+type DiskMetricsResponse struct {
+	Timestamp   string  `json:"timestamp"`
+	UsedBytes   int64   `json:"usedBytes"`
+	TotalBytes  int64   `json:"totalBytes"`
+	UsedPercent float64 `json:"usedPercent"`
+	InodesUsed  int64   `json:"inodesUsed"`
+	InodesTotal int64   `json:"inodesTotal"`
+	ReadBytes   int64   `json:"readBytes"`
+	WriteBytes  int64   `json:"writeBytes"`
+	ReadIOPS    float64 `json:"readIops"`
+	WriteIOPS   float64 `json:"writeIops"`
+}
+
+type DiskMountGroup struct {
+	MountPoint  string                `json:"mountPoint"`
+	FileSystem  string                `json:"fileSystem"`
+	FSType      string                `json:"fsType"`
+	UsedPercent float64               `json:"usedPercent"`
+	GrowthRate  float64               `json:"growthRate"`
+	Metrics     []DiskMetricsResponse `json:"metrics"`
+}
+
+type DiskDeviceMetrics struct {
+	DeviceID   string           `json:"DeviceID"`
+	DeviceName string           `json:"DeviceName"`
+	Metrics    []DiskMountGroup `json:"Metrics"`
+}
+
+// Function to handle the retrieval of disk metrics
+func RetrieveDiskMetrics(w http.ResponseWriter, r *http.Request) {
+	var diskMetricsRequest DiskMetricsRequest
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON data
+	if err := json.Unmarshal(body, &diskMetricsRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	tenantID := diskMetricsRequest.TenantID
+	timeStart := diskMetricsRequest.Query.TimeRange.Start
+	timeEnd := diskMetricsRequest.Query.TimeRange.End
+
+	// Validate the tenant ID
+	if tenantID == "" {
+		http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Determine the database name
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+
+	// Resolve the requested devices, all devices if none were given
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, diskMetricsRequest.Query.Devices)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	deviceIDs := make([]string, 0, len(deviceMap))
+	for deviceID := range deviceMap {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	if len(deviceIDs) == 0 {
+		http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+		return
+	}
+
+	// Get the fullest mount points of every device
+	deviceMountsMap, err := helpers.GetTopDiskMounts(db, dbName, deviceIDs, timeStart, timeEnd, diskMetricsRequest.Query.NumberOfMounts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// If no mount points are identified, return an empty response
+	if len(deviceMountsMap) == 0 {
+		fmt.Println("No mount points were found when querying disk metrics")
+		w.Header().Set("Content-Type", "application/json")
+
+		response := map[string]string{
+			"message": "No mount points were found when querying disk metrics",
+		}
+
+		responseJSON, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, "Error creating JSON response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(responseJSON)
+		return
+	}
+
+	var deviceMetrics []DiskDeviceMetrics
+	for deviceID, mounts := range deviceMountsMap {
+		performanceQuery := fmt.Sprintf(`
+		SELECT
+			pm.timestamp,
+			dm.mount_point,
+			dm.file_system,
+			dm.fs_type,
+			dm.used_bytes,
+			dm.total_bytes,
+			dm.inodes_used,
+			dm.inodes_total,
+			dm.read_bytes,
+			dm.write_bytes,
+			dm.read_iops,
+			dm.write_iops
+		FROM
+			%s.PerformanceMetrics pm
+		JOIN
+			%s.DiskMetrics dm ON pm.metric_id = dm.metric_id
+		WHERE
+			pm.device_id = ?
+			AND dm.mount_point IN (%s)
+			AND pm.timestamp BETWEEN ? AND ?
+		ORDER BY
+			pm.timestamp
+	`, fmt.Sprintf("`%s`", dbName), fmt.Sprintf("`%s`", dbName), strings.Trim(strings.Repeat("?,", len(mounts)), ","))
+
+		// Prepare the arguments for the performanceQuery
+		args := []interface{}{deviceID}
+		for _, mount := range mounts {
+			args = append(args, mount)
+		}
+		args = append(args, timeStart, timeEnd)
+
+		rows, err := db.Query(performanceQuery, args...)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying disk performance metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Group the samples by mount point
+		mountGroups := make(map[string]*DiskMountGroup)
+		for rows.Next() {
+			var metric DiskMetricsResponse
+			var mountPoint, fileSystem, fsType string
+			if err := rows.Scan(&metric.Timestamp, &mountPoint, &fileSystem, &fsType, &metric.UsedBytes, &metric.TotalBytes,
+				&metric.InodesUsed, &metric.InodesTotal, &metric.ReadBytes, &metric.WriteBytes, &metric.ReadIOPS, &metric.WriteIOPS); err != nil {
+				http.Error(w, fmt.Sprintf("Error scanning row: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			if metric.TotalBytes > 0 {
+				metric.UsedPercent = float64(metric.UsedBytes) / float64(metric.TotalBytes) * 100
+			}
+
+			group, ok := mountGroups[mountPoint]
+			if !ok {
+				group = &DiskMountGroup{MountPoint: mountPoint, FileSystem: fileSystem, FSType: fsType}
+				mountGroups[mountPoint] = group
+			}
+			group.Metrics = append(group.Metrics, metric)
+		}
+
+		// Latest usage and growth rate for each mount point
+		groupedMetrics := make([]DiskMountGroup, 0, len(mountGroups))
+		for _, group := range mountGroups {
+			group.UsedPercent = group.Metrics[len(group.Metrics)-1].UsedPercent
+			group.GrowthRate = diskGrowthRate(group.Metrics)
+			groupedMetrics = append(groupedMetrics, *group)
+		}
+
+		// Sort the grouped metrics by the fullest mount point
+		sort.Slice(groupedMetrics, func(i, j int) bool {
+			return groupedMetrics[i].UsedPercent > groupedMetrics[j].UsedPercent
+		})
+
+		deviceMetrics = append(deviceMetrics, DiskDeviceMetrics{
+			DeviceID:   deviceID,
+			DeviceName: deviceMap[deviceID],
+			Metrics:    groupedMetrics,
+		})
+	}
+
+	// Encode the structured response as JSON and send it to the client
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deviceMetrics); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// diskGrowthRate fits a least squares line through the used bytes and returns its slope in bytes per hour
+func diskGrowthRate(metrics []DiskMetricsResponse) float64 {
+	if len(metrics) < 2 {
+		return 0
+	}
+
+	first, err := helpers.ParseTimestamp(metrics[0].Timestamp)
+	if err != nil {
+		return 0
+	}
+
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, metric := range metrics {
+		t, err := helpers.ParseTimestamp(metric.Timestamp)
+		if err != nil {
+			continue
+		}
+
+		x := t.Sub(first).Hours()
+		y := float64(metric.UsedBytes)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator
+}
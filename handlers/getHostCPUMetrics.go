@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Structs to match the JSON request
+
+type HostCPUMetricsRequest struct {
+	TenantID string `json:"tenantID"`
+	Query    Query  `json:"query"`
+}
+
+type HostCPUMetricsResponse struct {
+	Timestamp  string    `json:"timestamp"`
+	CPUUsage   float64   `json:"cpuUsage"`
+	LoadAvg1   float64   `json:"loadAvg1"`
+	LoadAvg5   float64   `json:"loadAvg5"`
+	LoadAvg15  float64   `json:"loadAvg15"`
+	CPUUser    float64   `json:"cpuUser"`
+	CPUSystem  float64   `json:"cpuSystem"`
+	CPUIowait  float64   `json:"cpuIowait"`
+	CPUSteal   float64   `json:"cpuSteal"`
+	PerCoreCPU []float64 `json:"perCoreCpu"`
+}
+
+type HostCPUDeviceMetrics struct {
+	DeviceID   string                   `json:"DeviceID"`
+	DeviceName string                   `json:"DeviceName"`
+	AvgCPU     float64                  `json:"avgCpu"`
+	AvgIowait  float64                  `json:"avgIowait"`
+	AvgSteal   float64                  `json:"avgSteal"`
+	MaxCoreCPU float64                  `json:"maxCoreCpu"`
+	Resolution int                      `json:"resolution"`
+	Metrics    []HostCPUMetricsResponse `json:"Metrics"`
+}
+
+// Function to handle the retrieval of host level CPU metrics
+func RetrieveHostCPUMetrics(w http.ResponseWriter, r *http.Request) {
+	var hostCPUMetricsRequest HostCPUMetricsRequest
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON data
+	if err := json.Unmarshal(body, &hostCPUMetricsRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	tenantID := hostCPUMetricsRequest.TenantID
+	timeStart := hostCPUMetricsRequest.Query.TimeRange.Start
+	timeEnd := hostCPUMetricsRequest.Query.TimeRange.End
+
+	// Validate the tenant ID
+	if tenantID == "" {
+		http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Determine the database name
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+
+	// Resolve the requested devices, all devices if none were given
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, hostCPUMetricsRequest.Query.Devices)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(deviceMap) == 0 {
+		http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+		return
+	}
+
+	// Answer from the rollups when the range is too long for the point budget
+	resolution, err := helpers.ChooseResolution(db, tenantID, timeStart, timeEnd, hostCPUMetricsRequest.Query.MaxPoints)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deviceIDs := make([]string, 0, len(deviceMap))
+	for deviceID := range deviceMap {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	var deviceSamples map[string][]HostCPUMetricsResponse
+	if resolution > 0 {
+		deviceSamples, err = hostCPURollupSamples(dbName, deviceIDs, resolution, timeStart, timeEnd)
+	} else {
+		deviceSamples, err = hostCPURawSamples(dbName, deviceIDs, timeStart, timeEnd)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Summarise every device
+	deviceMetrics := make([]HostCPUDeviceMetrics, 0, len(deviceSamples))
+	for deviceID, samples := range deviceSamples {
+		device := HostCPUDeviceMetrics{
+			DeviceID:   deviceID,
+			DeviceName: deviceMap[deviceID],
+			Resolution: resolution,
+			Metrics:    samples,
+		}
+
+		for _, sample := range samples {
+			device.AvgCPU += sample.CPUUsage
+			device.AvgIowait += sample.CPUIowait
+			device.AvgSteal += sample.CPUSteal
+			for _, coreUsage := range sample.PerCoreCPU {
+				if coreUsage > device.MaxCoreCPU {
+					device.MaxCoreCPU = coreUsage
+				}
+			}
+		}
+
+		count := float64(len(samples))
+		device.AvgCPU /= count
+		device.AvgIowait /= count
+		device.AvgSteal /= count
+
+		deviceMetrics = append(deviceMetrics, device)
+	}
+
+	// Busiest devices first
+	sort.Slice(deviceMetrics, func(i, j int) bool {
+		return deviceMetrics[i].AvgCPU > deviceMetrics[j].AvgCPU
+	})
+
+	// Encode the structured response as JSON and send it to the client
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deviceMetrics); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// hostCPURawSamples returns the raw host CPU samples of every device, with their per core utilisation
+func hostCPURawSamples(dbName string, deviceIDs []string, timeStart string, timeEnd string) (map[string][]HostCPUMetricsResponse, error) {
+	args := make([]interface{}, 0, len(deviceIDs)+2)
+	for _, deviceID := range deviceIDs {
+		args = append(args, deviceID)
+	}
+	args = append(args, timeStart, timeEnd)
+	devicePlaceholders := strings.Trim(strings.Repeat("?,", len(deviceIDs)), ",")
+
+	// Samples written before the breakdown existed have NULL columns
+	performanceQuery := fmt.Sprintf(`
+		SELECT
+			pm.metric_id,
+			pm.device_id,
+			pm.timestamp,
+			COALESCE(pm.cpu_usage, 0),
+			COALESCE(pm.load_avg_1, 0),
+			COALESCE(pm.load_avg_5, 0),
+			COALESCE(pm.load_avg_15, 0),
+			COALESCE(pm.cpu_user, 0),
+			COALESCE(pm.cpu_system, 0),
+			COALESCE(pm.cpu_iowait, 0),
+			COALESCE(pm.cpu_steal, 0)
+		FROM
+			%s.PerformanceMetrics pm
+		WHERE
+			pm.device_id IN (%s)
+			AND pm.timestamp BETWEEN ? AND ?
+		ORDER BY
+			pm.timestamp
+	`, fmt.Sprintf("`%s`", dbName), devicePlaceholders)
+
+	rows, err := db.Query(performanceQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying host CPU metrics: %v", err)
+	}
+	defer rows.Close()
+
+	// Keep the samples per device, and where each metric ID landed to attach the cores afterwards
+	deviceSamples := make(map[string][]HostCPUMetricsResponse)
+	type samplePosition struct {
+		deviceID string
+		index    int
+	}
+	positions := make(map[int64]samplePosition)
+
+	for rows.Next() {
+		var metricID int64
+		var deviceID string
+		var metric HostCPUMetricsResponse
+		if err := rows.Scan(&metricID, &deviceID, &metric.Timestamp, &metric.CPUUsage, &metric.LoadAvg1, &metric.LoadAvg5, &metric.LoadAvg15,
+			&metric.CPUUser, &metric.CPUSystem, &metric.CPUIowait, &metric.CPUSteal); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+
+		positions[metricID] = samplePosition{deviceID: deviceID, index: len(deviceSamples[deviceID])}
+		deviceSamples[deviceID] = append(deviceSamples[deviceID], metric)
+	}
+
+	// Attach the per core utilisation to each sample
+	coreQuery := fmt.Sprintf(`
+		SELECT
+			cm.metric_id,
+			cm.core_index,
+			cm.core_usage
+		FROM
+			%s.PerformanceMetrics pm
+		JOIN
+			%s.CoreMetrics cm ON pm.metric_id = cm.metric_id
+		WHERE
+			pm.device_id IN (%s)
+			AND pm.timestamp BETWEEN ? AND ?
+		ORDER BY
+			cm.metric_id, cm.core_index
+	`, fmt.Sprintf("`%s`", dbName), fmt.Sprintf("`%s`", dbName), devicePlaceholders)
+
+	coreRows, err := db.Query(coreQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying per core CPU metrics: %v", err)
+	}
+	defer coreRows.Close()
+
+	for coreRows.Next() {
+		var metricID int64
+		var coreIndex int
+		var coreUsage float64
+		if err := coreRows.Scan(&metricID, &coreIndex, &coreUsage); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+
+		position, ok := positions[metricID]
+		if !ok {
+			continue
+		}
+
+		sample := &deviceSamples[position.deviceID][position.index]
+		sample.PerCoreCPU = append(sample.PerCoreCPU, coreUsage)
+	}
+
+	return deviceSamples, nil
+}
+
+// hostCPURollupSamples returns one sample per rollup bucket holding the bucket averages, cores are not rolled up
+func hostCPURollupSamples(dbName string, deviceIDs []string, resolution int, timeStart string, timeEnd string) (map[string][]HostCPUMetricsResponse, error) {
+	metrics := []string{"cpu_usage", "load_avg_1", "load_avg_5", "load_avg_15", "cpu_user", "cpu_system", "cpu_iowait", "cpu_steal"}
+
+	series, err := helpers.GetHostRollupSeries(db, dbName, deviceIDs, metrics, resolution, timeStart, timeEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceSamples := make(map[string][]HostCPUMetricsResponse)
+	for deviceID, deviceSeries := range series {
+		// Every metric of a device is rolled up together so they share their buckets
+		buckets := deviceSeries["cpu_usage"]
+		samples := make([]HostCPUMetricsResponse, len(buckets))
+		positions := make(map[string]int, len(buckets))
+		for i, bucket := range buckets {
+			samples[i].Timestamp = bucket.Timestamp
+			positions[bucket.Timestamp] = i
+		}
+
+		fields := map[string]func(*HostCPUMetricsResponse) *float64{
+			"cpu_usage":   func(m *HostCPUMetricsResponse) *float64 { return &m.CPUUsage },
+			"load_avg_1":  func(m *HostCPUMetricsResponse) *float64 { return &m.LoadAvg1 },
+			"load_avg_5":  func(m *HostCPUMetricsResponse) *float64 { return &m.LoadAvg5 },
+			"load_avg_15": func(m *HostCPUMetricsResponse) *float64 { return &m.LoadAvg15 },
+			"cpu_user":    func(m *HostCPUMetricsResponse) *float64 { return &m.CPUUser },
+			"cpu_system":  func(m *HostCPUMetricsResponse) *float64 { return &m.CPUSystem },
+			"cpu_iowait":  func(m *HostCPUMetricsResponse) *float64 { return &m.CPUIowait },
+			"cpu_steal":   func(m *HostCPUMetricsResponse) *float64 { return &m.CPUSteal },
+		}
+
+		for metric, field := range fields {
+			for _, bucket := range deviceSeries[metric] {
+				if i, ok := positions[bucket.Timestamp]; ok {
+					*field(&samples[i]) = bucket.Stats.Avg()
+				}
+			}
+		}
+
+		deviceSamples[deviceID] = samples
+	}
+
+	return deviceSamples, nil
+}
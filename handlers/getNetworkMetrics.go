@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Views supported by the network metrics endpoint
+const (
+	NetworkViewDevice     = "device"
+	NetworkViewTopTalkers = "topTalkers"
+)
+
+// Structs to match the JSON request
+
+type NetworkQuery struct {
+	NumberOfInterfaces int       `json:"numberOfInterfaces"`
+	Devices            []string  `json:"devices"`
+	TimeRange          TimeRange `json:"timeRange"`
+	View               string    `json:"view"`
+}
+
+type NetworkMetricsRequest struct {
+	TenantID string       `json:"tenantID"`
+	Query    NetworkQuery `json:"query"`
+}
+
+// Rates are per second, derived from two consecutive counter samples
+type NetworkMetricsResponse struct {
+	Timestamp     string  `json:"timestamp"`
+	RxBytesRate   float64 `json:"rxBytesRate"`
+	TxBytesRate   float64 `json:"txBytesRate"`
+	RxPacketsRate float64 `json:"rxPacketsRate"`
+	TxPacketsRate float64 `json:"txPacketsRate"`
+	RxErrorsRate  float64 `json:"rxErrorsRate"`
+	TxErrorsRate  float64 `json:"txErrorsRate"`
+	RxDropsRate   float64 `json:"rxDropsRate"`
+	TxDropsRate   float64 `json:"txDropsRate"`
+}
+
+type NetworkInterfaceGroup struct {
+	Interface      string                   `json:"interface"`
+	TotalRxBytes   uint64                   `json:"totalRxBytes"`
+	TotalTxBytes   uint64                   `json:"totalTxBytes"`
+	AvgRxBytesRate float64                  `json:"avgRxBytesRate"`
+	AvgTxBytesRate float64                  `json:"avgTxBytesRate"`
+	Metrics        []NetworkMetricsResponse `json:"metrics"`
+}
+
+type NetworkDeviceMetrics struct {
+	DeviceID   string                  `json:"DeviceID"`
+	DeviceName string                  `json:"DeviceName"`
+	Metrics    []NetworkInterfaceGroup `json:"Metrics"`
+}
+
+type NetworkTopTalker struct {
+	DeviceID       string  `json:"DeviceID"`
+	DeviceName     string  `json:"DeviceName"`
+	Interface      string  `json:"interface"`
+	TotalBytes     uint64  `json:"totalBytes"`
+	TotalRxBytes   uint64  `json:"totalRxBytes"`
+	TotalTxBytes   uint64  `json:"totalTxBytes"`
+	AvgRxBytesRate float64 `json:"avgRxBytesRate"`
+	AvgTxBytesRate float64 `json:"avgTxBytesRate"`
+}
+
+// Raw counter sample as stored in NetworkMetrics
+type networkCounterSample struct {
+	timestamp string
+	counters  [8]uint64
+}
+
+// Function to handle the retrieval of network metrics
+func RetrieveNetworkMetrics(w http.ResponseWriter, r *http.Request) {
+	var networkMetricsRequest NetworkMetricsRequest
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON data
+	if err := json.Unmarshal(body, &networkMetricsRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	tenantID := networkMetricsRequest.TenantID
+	timeStart := networkMetricsRequest.Query.TimeRange.Start
+	timeEnd := networkMetricsRequest.Query.TimeRange.End
+	view := networkMetricsRequest.Query.View
+
+	// Validate the tenant ID and the view
+	if tenantID == "" {
+		http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if view == "" {
+		view = NetworkViewDevice
+	}
+
+	if view != NetworkViewDevice && view != NetworkViewTopTalkers {
+		http.Error(w, fmt.Sprintf("Unknown view: %s", view), http.StatusBadRequest)
+		return
+	}
+
+	// Determine the database name
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+
+	// Resolve the requested devices, all devices if none were given
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, networkMetricsRequest.Query.Devices)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(deviceMap) == 0 {
+		http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+		return
+	}
+
+	args := make([]interface{}, 0, len(deviceMap)+2)
+	for deviceID := range deviceMap {
+		args = append(args, deviceID)
+	}
+	args = append(args, timeStart, timeEnd)
+
+	performanceQuery := fmt.Sprintf(`
+		SELECT
+			pm.device_id,
+			pm.timestamp,
+			nm.interface_name,
+			nm.rx_bytes,
+			nm.tx_bytes,
+			nm.rx_packets,
+			nm.tx_packets,
+			nm.rx_errors,
+			nm.tx_errors,
+			nm.rx_drops,
+			nm.tx_drops
+		FROM
+			%s.PerformanceMetrics pm
+		JOIN
+			%s.NetworkMetrics nm ON pm.metric_id = nm.metric_id
+		WHERE
+			pm.device_id IN (%s)
+			AND pm.timestamp BETWEEN ? AND ?
+		ORDER BY
+			pm.timestamp
+	`, fmt.Sprintf("`%s`", dbName), fmt.Sprintf("`%s`", dbName), strings.Trim(strings.Repeat("?,", len(deviceMap)), ","))
+
+	rows, err := db.Query(performanceQuery, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying network performance metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Group the counter samples by device and interface
+	deviceSamples := make(map[string]map[string][]networkCounterSample)
+	for rows.Next() {
+		var deviceID, iface string
+		var sample networkCounterSample
+		c := &sample.counters
+		if err := rows.Scan(&deviceID, &sample.timestamp, &iface, &c[0], &c[1], &c[2], &c[3], &c[4], &c[5], &c[6], &c[7]); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning row: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if deviceSamples[deviceID] == nil {
+			deviceSamples[deviceID] = make(map[string][]networkCounterSample)
+		}
+		deviceSamples[deviceID][iface] = append(deviceSamples[deviceID][iface], sample)
+	}
+
+	// Convert the counters into rates for every device and interface
+	var deviceMetrics []NetworkDeviceMetrics
+	for deviceID, interfaces := range deviceSamples {
+		groupedMetrics := make([]NetworkInterfaceGroup, 0, len(interfaces))
+		for iface, samples := range interfaces {
+			groupedMetrics = append(groupedMetrics, networkRates(iface, samples))
+		}
+
+		// Busiest interfaces first
+		sort.Slice(groupedMetrics, func(i, j int) bool {
+			return groupedMetrics[i].TotalRxBytes+groupedMetrics[i].TotalTxBytes > groupedMetrics[j].TotalRxBytes+groupedMetrics[j].TotalTxBytes
+		})
+
+		if n := networkMetricsRequest.Query.NumberOfInterfaces; n > 0 && len(groupedMetrics) > n {
+			groupedMetrics = groupedMetrics[:n]
+		}
+
+		deviceMetrics = append(deviceMetrics, NetworkDeviceMetrics{
+			DeviceID:   deviceID,
+			DeviceName: deviceMap[deviceID],
+			Metrics:    groupedMetrics,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// The device view returns the full series, top talkers only the totals across the fleet
+	var response interface{} = deviceMetrics
+	if view == NetworkViewTopTalkers {
+		var talkers []NetworkTopTalker
+		for _, device := range deviceMetrics {
+			for _, group := range device.Metrics {
+				talkers = append(talkers, NetworkTopTalker{
+					DeviceID:       device.DeviceID,
+					DeviceName:     device.DeviceName,
+					Interface:      group.Interface,
+					TotalBytes:     group.TotalRxBytes + group.TotalTxBytes,
+					TotalRxBytes:   group.TotalRxBytes,
+					TotalTxBytes:   group.TotalTxBytes,
+					AvgRxBytesRate: group.AvgRxBytesRate,
+					AvgTxBytesRate: group.AvgTxBytesRate,
+				})
+			}
+		}
+
+		sort.Slice(talkers, func(i, j int) bool {
+			return talkers[i].TotalBytes > talkers[j].TotalBytes
+		})
+
+		if n := networkMetricsRequest.Query.NumberOfInterfaces; n > 0 && len(talkers) > n {
+			talkers = talkers[:n]
+		}
+
+		response = talkers
+	}
+
+	// Encode the structured response as JSON and send it to the client
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// networkRates turns consecutive counter samples of one interface into per second rates
+func networkRates(iface string, samples []networkCounterSample) NetworkInterfaceGroup {
+	group := NetworkInterfaceGroup{Interface: iface, Metrics: []NetworkMetricsResponse{}}
+
+	var elapsedSeconds float64
+	for i := 1; i < len(samples); i++ {
+		previous, current := samples[i-1], samples[i]
+
+		previousTime, err := helpers.ParseTimestamp(previous.timestamp)
+		if err != nil {
+			continue
+		}
+		currentTime, err := helpers.ParseTimestamp(current.timestamp)
+		if err != nil {
+			continue
+		}
+
+		elapsed := currentTime.Sub(previousTime)
+		if elapsed <= 0 {
+			continue
+		}
+
+		var rates [8]float64
+		for c := range rates {
+			rates[c] = helpers.CounterRate(previous.counters[c], current.counters[c], elapsed)
+		}
+
+		group.TotalRxBytes += helpers.CounterIncrease(previous.counters[0], current.counters[0])
+		group.TotalTxBytes += helpers.CounterIncrease(previous.counters[1], current.counters[1])
+		elapsedSeconds += elapsed.Seconds()
+
+		group.Metrics = append(group.Metrics, NetworkMetricsResponse{
+			Timestamp:     current.timestamp,
+			RxBytesRate:   rates[0],
+			TxBytesRate:   rates[1],
+			RxPacketsRate: rates[2],
+			TxPacketsRate: rates[3],
+			RxErrorsRate:  rates[4],
+			TxErrorsRate:  rates[5],
+			RxDropsRate:   rates[6],
+			TxDropsRate:   rates[7],
+		})
+	}
+
+	if elapsedSeconds > 0 {
+		group.AvgRxBytesRate = float64(group.TotalRxBytes) / elapsedSeconds
+		group.AvgTxBytesRate = float64(group.TotalTxBytes) / elapsedSeconds
+	}
+
+	return group
+}
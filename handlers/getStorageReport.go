@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type TableSizeResponse struct {
+	Table      string `json:"table"`
+	Rows       int64  `json:"rows"`
+	DataBytes  int64  `json:"dataBytes"`
+	IndexBytes int64  `json:"indexBytes"`
+}
+
+type StorageReportEntry struct {
+	Description string `json:"description"`
+	BytesBefore int64  `json:"bytesBefore"`
+	BytesAfter  int64  `json:"bytesAfter"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+type StorageReportResponse struct {
+	Tables  []TableSizeResponse  `json:"tables"`
+	Reports []StorageReportEntry `json:"reports"`
+}
+
+// Function to report how much storage a tenant uses, and what the storage migrations saved
+// URL needs to contain the tenantID as a query parameter with the following format:
+// /api/v1/storagereport?tenantID=1234
+func GetStorageReport(w http.ResponseWriter, r *http.Request) {
+
+	// Extract tenantID from URL
+	tenantID := r.URL.Query().Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+
+	sizes, err := models.GetTableSizes(context.Background(), db, dbName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying table sizes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := StorageReportResponse{
+		Tables:  make([]TableSizeResponse, 0, len(sizes)),
+		Reports: []StorageReportEntry{},
+	}
+
+	for _, size := range sizes {
+		response.Tables = append(response.Tables, TableSizeResponse(size))
+	}
+
+	query := fmt.Sprintf("SELECT description, bytes_before, bytes_after, created_at FROM `%s`.StorageReports ORDER BY created_at", dbName)
+	rows, err := db.Query(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying storage reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry StorageReportEntry
+		if err := rows.Scan(&entry.Description, &entry.BytesBefore, &entry.BytesAfter, &entry.CreatedAt); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning storage report: %v", err), http.StatusInternalServerError)
+			return
+		}
+		response.Reports = append(response.Reports, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
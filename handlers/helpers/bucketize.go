@@ -0,0 +1,232 @@
+package helpers
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Aggregation functions a bucketed query can ask for
+const (
+	AggregationAvg  = "avg"
+	AggregationMin  = "min"
+	AggregationMax  = "max"
+	AggregationSum  = "sum"
+	AggregationP50  = "p50"
+	AggregationP95  = "p95"
+	AggregationP99  = "p99"
+	AggregationLast = "last"
+)
+
+var aggregationQuantiles = map[string]float64{
+	AggregationP50: 0.50,
+	AggregationP95: 0.95,
+	AggregationP99: 0.99,
+}
+
+// Aggregations the rollup tables can answer exactly, or for p95 approximately
+var rollupAggregations = map[string]bool{
+	AggregationAvg: true,
+	AggregationMin: true,
+	AggregationMax: true,
+	AggregationSum: true,
+	AggregationP95: true,
+}
+
+// Upper bound on the buckets a single series can be split into
+const MaxBuckets = 11000
+
+// BucketSample is one input point of a bucketed series. Raw samples only have a value,
+// rolled up buckets carry their stats so they can be merged exactly.
+type BucketSample struct {
+	Timestamp string
+	Value     float64
+	Stats     *models.RollupStats
+}
+
+// Bucket is one step of a bucketed series. Buckets without any sample are gaps and have no values.
+type Bucket struct {
+	Timestamp string             `json:"timestamp"`
+	Count     int64              `json:"count"`
+	Gap       bool               `json:"gap"`
+	Values    map[string]float64 `json:"values,omitempty"`
+}
+
+// ParseStep reads a bucket width given in seconds ("60") or as a duration ("1m", "1h30m")
+func ParseStep(step string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(step); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("invalid step: %s", step)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	duration, err := time.ParseDuration(step)
+	if err != nil || duration < time.Second {
+		return 0, fmt.Errorf("invalid step: %s", step)
+	}
+
+	return duration, nil
+}
+
+// ValidateAggregations checks the requested aggregation functions, avg when none are given
+func ValidateAggregations(aggregations []string) ([]string, error) {
+	if len(aggregations) == 0 {
+		return []string{AggregationAvg}, nil
+	}
+
+	for _, aggregation := range aggregations {
+		switch aggregation {
+		case AggregationAvg, AggregationMin, AggregationMax, AggregationSum, AggregationP50, AggregationP95, AggregationP99, AggregationLast:
+		default:
+			return nil, fmt.Errorf("unknown aggregation: %s", aggregation)
+		}
+	}
+
+	return aggregations, nil
+}
+
+// ChooseStepResolution returns the coarsest rollup resolution that evenly divides the step and can answer
+// the aggregations, 0 when the raw samples have to be used.
+func ChooseStepResolution(db *sql.DB, tenantID string, timeEnd string, step time.Duration, aggregations []string) (int, error) {
+	for _, aggregation := range aggregations {
+		if !rollupAggregations[aggregation] {
+			return 0, nil
+		}
+	}
+
+	end, err := ParseTimestamp(timeEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(models.RollupResolutions) - 1; i >= 0; i-- {
+		resolution := models.RollupResolutions[i]
+		bucketSize := time.Duration(resolution) * time.Second
+		if step%bucketSize != 0 {
+			continue
+		}
+
+		rolledUpTo, err := models.GetRollupWatermark(db, tenantID, resolution)
+		if err != nil {
+			return 0, err
+		}
+
+		if !rolledUpTo.Before(end.Add(-bucketSize)) {
+			return resolution, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Bucketize splits [start, end] into evenly spaced buckets of width step, aligned on multiples of step,
+// and computes the aggregations over the samples falling in each of them.
+func Bucketize(samples []BucketSample, timeStart string, timeEnd string, step time.Duration, aggregations []string) ([]Bucket, error) {
+	start, err := ParseTimestamp(timeStart)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ParseTimestamp(timeEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	first := start.Truncate(step)
+	count := int(end.Sub(first)/step) + 1
+	if count > MaxBuckets {
+		return nil, fmt.Errorf("too many buckets (%d), use a larger step", count)
+	}
+
+	// Samples of every bucket, in time order
+	grouped := make([][]BucketSample, count)
+	sorted := make([]BucketSample, len(samples))
+	copy(sorted, samples)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+
+	for _, sample := range sorted {
+		t, err := ParseTimestamp(sample.Timestamp)
+		if err != nil || t.Before(first) || t.After(end) {
+			continue
+		}
+
+		index := int(t.Sub(first) / step)
+		grouped[index] = append(grouped[index], sample)
+	}
+
+	buckets := make([]Bucket, count)
+	for i := range buckets {
+		buckets[i].Timestamp = first.Add(time.Duration(i) * step).Format(TimestampLayout)
+		if len(grouped[i]) == 0 {
+			buckets[i].Gap = true
+			continue
+		}
+
+		buckets[i].Count, buckets[i].Values = aggregate(grouped[i], aggregations)
+	}
+
+	return buckets, nil
+}
+
+// aggregate computes the aggregations over the samples of one bucket
+func aggregate(samples []BucketSample, aggregations []string) (int64, map[string]float64) {
+	// Raw samples are turned into single sample stats so both kinds merge the same way
+	stats := make([]models.RollupStats, len(samples))
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		if sample.Stats != nil {
+			stats[i] = *sample.Stats
+			values[i] = sample.Stats.Avg()
+		} else {
+			stats[i] = models.RollupStats{Min: sample.Value, Max: sample.Value, Sum: sample.Value, Count: 1, P95: sample.Value}
+			values[i] = sample.Value
+		}
+	}
+
+	merged := models.MergeRollupStats(stats)
+	result := make(map[string]float64, len(aggregations))
+
+	for _, aggregation := range aggregations {
+		switch aggregation {
+		case AggregationAvg:
+			result[aggregation] = merged.Avg()
+		case AggregationMin:
+			result[aggregation] = merged.Min
+		case AggregationMax:
+			result[aggregation] = merged.Max
+		case AggregationSum:
+			result[aggregation] = merged.Sum
+		case AggregationLast:
+			result[aggregation] = values[len(values)-1]
+		case AggregationP95:
+			result[aggregation] = merged.P95
+			if samples[0].Stats == nil {
+				result[aggregation] = quantile(values, aggregationQuantiles[aggregation])
+			}
+		default:
+			result[aggregation] = quantile(values, aggregationQuantiles[aggregation])
+		}
+	}
+
+	return merged.Count, result
+}
+
+// quantile returns the q-quantile of the values, interpolating between the closest ranks
+func quantile(values []float64, q float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
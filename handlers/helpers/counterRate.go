@@ -0,0 +1,23 @@
+package helpers
+
+import "time"
+
+// CounterIncrease returns how much a cumulative counter grew between two samples.
+// A counter that went backwards was reset (agent or host restart), in that case
+// the current value is everything that was counted since the reset.
+func CounterIncrease(previous uint64, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+
+	return current - previous
+}
+
+// CounterRate returns the per second rate of a cumulative counter between two samples
+func CounterRate(previous uint64, current uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(CounterIncrease(previous, current)) / elapsed.Seconds()
+}
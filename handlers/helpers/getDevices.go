@@ -0,0 +1,42 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// GetDeviceMap resolves the requested device hostnames to a map of device ID -> hostname.
+// If no devices are given every device registered for the tenant is returned.
+func GetDeviceMap(db *sql.DB, dbName string, devices []string) (map[string]string, error) {
+	deviceMap := make(map[string]string)
+
+	deviceQuery := fmt.Sprintf("SELECT device_id, device_hostname FROM `%s`.Devices", dbName)
+	args := make([]interface{}, len(devices))
+
+	// Translate device names to device IDs
+	if len(devices) > 0 {
+		queryPlaceholders := strings.TrimSuffix(strings.Repeat("?,", len(devices)), ",")
+		deviceQuery += fmt.Sprintf(" WHERE TRIM(device_hostname) IN (%s)", queryPlaceholders)
+
+		for i, device := range devices {
+			args[i] = device
+		}
+	}
+
+	rows, err := db.Query(deviceQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying devices: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deviceID, deviceHostname string
+		if err := rows.Scan(&deviceID, &deviceHostname); err != nil {
+			return nil, fmt.Errorf("error scanning device ID and hostname: %v", err)
+		}
+		deviceMap[deviceID] = deviceHostname
+	}
+
+	return deviceMap, rows.Err()
+}
@@ -0,0 +1,60 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// GetTopDiskMounts returns, for every device, the mount points ordered by how full they got in the time range
+func GetTopDiskMounts(db *sql.DB, dbName string, deviceIDs []string, timeStart string, timeEnd string, numberOfMounts int) (map[string][]string, error) {
+	// Define a map to hold the device IDs and their corresponding mount points
+	deviceMountsMap := make(map[string][]string)
+
+	// Iterate over each device ID to query the mount points
+	for _, deviceID := range deviceIDs {
+		// Rank mount points by the highest used ratio seen in the time range
+		topMountsQuery := fmt.Sprintf(`
+        SELECT 
+            dm.mount_point
+        FROM 
+            %s.PerformanceMetrics pm
+        JOIN 
+            %s.DiskMetrics dm ON pm.metric_id = dm.metric_id
+        WHERE 
+            pm.device_id = ?
+            AND pm.timestamp BETWEEN ? AND ?
+            AND dm.total_bytes > 0
+        GROUP BY 
+            dm.mount_point
+        ORDER BY 
+            MAX(dm.used_bytes / dm.total_bytes) DESC
+    `, fmt.Sprintf("`%s`", dbName), fmt.Sprintf("`%s`", dbName))
+
+		// Add LIMIT clause only if numberOfMounts is greater than 0
+		if numberOfMounts > 0 {
+			topMountsQuery += fmt.Sprintf(" LIMIT %d", numberOfMounts)
+		}
+
+		rows, err := db.Query(topMountsQuery, deviceID, timeStart, timeEnd)
+		if err != nil {
+			return nil, fmt.Errorf("error querying top mount points for device %s: %v", deviceID, err)
+		}
+		defer rows.Close()
+
+		// Collect the mount points for the current device ID
+		var mounts []string
+		for rows.Next() {
+			var mountPoint string
+			if err := rows.Scan(&mountPoint); err != nil {
+				return nil, fmt.Errorf("error scanning mount point for device %s: %v", deviceID, err)
+			}
+			mounts = append(mounts, mountPoint)
+		}
+
+		if len(mounts) > 0 {
+			deviceMountsMap[deviceID] = mounts
+		}
+	}
+
+	return deviceMountsMap, nil
+}
@@ -0,0 +1,27 @@
+package helpers
+
+import (
+	"fmt"
+	"time"
+)
+
+// Layouts accepted for timestamps, the first one is how MySQL returns DATETIME columns
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+}
+
+// TimestampLayout is the layout used when writing timestamps back to the database
+const TimestampLayout = "2006-01-02 15:04:05"
+
+// ParseTimestamp parses a timestamp as stored in the database or sent by the agents
+func ParseTimestamp(value string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp: %s", value)
+}
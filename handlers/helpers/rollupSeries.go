@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Assumed interval between raw samples, used to estimate how many points a raw query returns
+const RawSampleInterval = 10 * time.Second
+
+// Point budget per series of the /api/v1/query queries whose client didn't send one, so long ranges are answered from
+// the rollups. The older endpoints return the raw samples unless asked for a budget.
+const DefaultMaxPoints = 1000
+
+// PointBudget returns the point budget a client asked for, DefaultMaxPoints when it didn't
+func PointBudget(maxPoints int) int {
+	if maxPoints <= 0 {
+		return DefaultMaxPoints
+	}
+	return maxPoints
+}
+
+// ChooseResolution returns the resolution, in seconds, to answer a time range with at most maxPoints per series.
+// It is the finest one that fits the budget, 0 meaning the raw samples. A rollup is only used when it is
+// complete up to the end of the range, apart from the bucket still being filled.
+func ChooseResolution(db *sql.DB, tenantID string, timeStart string, timeEnd string, maxPoints int) (int, error) {
+	if maxPoints <= 0 {
+		return 0, nil
+	}
+
+	start, err := ParseTimestamp(timeStart)
+	if err != nil {
+		return 0, err
+	}
+	end, err := ParseTimestamp(timeEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	span := end.Sub(start)
+	if span <= RawSampleInterval*time.Duration(maxPoints) {
+		return 0, nil
+	}
+
+	for _, resolution := range models.RollupResolutions {
+		bucketSize := time.Duration(resolution) * time.Second
+		if span > bucketSize*time.Duration(maxPoints) && resolution != models.RollupDay {
+			continue
+		}
+
+		rolledUpTo, err := models.GetRollupWatermark(db, tenantID, resolution)
+		if err != nil {
+			return 0, err
+		}
+
+		// Not caught up yet, the raw samples are the only complete source
+		if rolledUpTo.Before(end.Add(-bucketSize)) {
+			return 0, nil
+		}
+
+		return resolution, nil
+	}
+
+	return 0, nil
+}
+
+// RollupPoint is one bucket of a rolled up series
+type RollupPoint struct {
+	Timestamp string
+	Stats     models.RollupStats
+}
+
+// GetHostRollupSeries returns the buckets of the given host metrics, per device and metric
+func GetHostRollupSeries(db *sql.DB, dbName string, deviceIDs []string, metrics []string, resolution int, timeStart string, timeEnd string) (map[string]map[string][]RollupPoint, error) {
+	query := fmt.Sprintf(`
+		SELECT device_id, metric, bucket_start, min_value, max_value, sum_value, sample_count, p95_value
+		FROM %s.HostRollups
+		WHERE resolution = ?
+			AND device_id IN (%s)
+			AND metric IN (%s)
+			AND bucket_start BETWEEN ? AND ?
+		ORDER BY bucket_start
+	`, fmt.Sprintf("`%s`", dbName), strings.Trim(strings.Repeat("?,", len(deviceIDs)), ","), strings.Trim(strings.Repeat("?,", len(metrics)), ","))
+
+	args := []interface{}{resolution}
+	for _, deviceID := range deviceIDs {
+		args = append(args, deviceID)
+	}
+	for _, metric := range metrics {
+		args = append(args, metric)
+	}
+	args = append(args, timeStart, timeEnd)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying host rollups: %v", err)
+	}
+	defer rows.Close()
+
+	series := make(map[string]map[string][]RollupPoint)
+	for rows.Next() {
+		var deviceID, metric string
+		var point RollupPoint
+		if err := rows.Scan(&deviceID, &metric, &point.Timestamp, &point.Stats.Min, &point.Stats.Max, &point.Stats.Sum, &point.Stats.Count, &point.Stats.P95); err != nil {
+			return nil, fmt.Errorf("error scanning host rollup: %v", err)
+		}
+
+		if series[deviceID] == nil {
+			series[deviceID] = make(map[string][]RollupPoint)
+		}
+		series[deviceID][metric] = append(series[deviceID][metric], point)
+	}
+
+	return series, rows.Err()
+}
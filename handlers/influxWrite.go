@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/ingest"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Function to receive Influx line protocol writes, as sent by Telegraf
+// POST /api/v1/write?precision=s with a batch of lines, optionally gzip compressed, of up to 32 MB. The tenant is
+// given in the X-Scope-OrgID header, or the tenantID parameter, or the db parameter of the Telegraf influxdb output.
+// Lines that can't be parsed don't stop the others from being stored, the request then fails as a partial write.
+func ReceiveInfluxWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID := r.Header.Get(tenantHeader)
+	for _, param := range []string{"tenantID", "db"} {
+		if tenantID == "" {
+			tenantID = r.URL.Query().Get(param)
+		}
+	}
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	unit, err := ingest.InfluxPrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, ok := readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	points, errs := ingest.ParseLineProtocol(body, unit, time.Now().UnixMilli())
+
+	stats, err := ingest.InfluxWrite(db, tenantID, points)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing line protocol points: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stored line protocol write of tenant %s: %d points as %d device samples and %d generic samples",
+		tenantID, stats.Points, stats.Frames, stats.GenericSamples)
+
+	if len(errs) > 0 {
+		http.Error(w, fmt.Sprintf("partial write: %d lines dropped, %v", len(errs), errs[0]), http.StatusBadRequest)
+		return
+	}
+
+	// Influx answers writes with no content
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Largest body of a write request, compressed and once decompressed
+const maxIngestBody = 32 << 20
+
+// readIngestBody reads the body of a write request, decompressed when its Content-Encoding is gzip. Bodies over
+// maxIngestBody bytes, before or after decompression, are refused. On errors it answers the request and returns false.
+func readIngestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxIngestBody)
+
+	var reader io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decompressing request body: %v", err), http.StatusBadRequest)
+			return nil, false
+		}
+		defer gz.Close()
+		// A few KB of gzip can decompress to gigabytes, one byte over the limit is enough to refuse it
+		reader = io.LimitReader(gz, maxIngestBody+1)
+	default:
+		http.Error(w, "Unsupported content encoding, expected gzip", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	// Read the request body
+	body, err := io.ReadAll(reader)
+	// http.MaxBytesError only exists since Go 1.19
+	if len(body) > maxIngestBody || (err != nil && err.Error() == "http: request body too large") {
+		http.Error(w, fmt.Sprintf("Request body over the %d bytes limit", maxIngestBody), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return body, true
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"bufio"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/ingest"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Largest StatsD datagram, and largest NDJSON line, a sample of the agent with its processes
+const (
+	maxStatsDPacket   = 65535
+	maxNDJSONLine     = 4 << 20
+	ndjsonIdleTimeout = 5 * time.Minute
+)
+
+// Largest syslog datagram or TCP frame
+const maxSyslogMessage = 65535
+
+// ListenerStats counts what a listener received since the server started
+type ListenerStats struct {
+	// UDP packets, TCP lines or syslog frames
+	Packets uint64 `json:"packets"`
+	// Metrics, samples or log events accepted
+	Accepted uint64 `json:"accepted"`
+	// Packets or lines that couldn't be parsed, or had no tenant or device or an unknown tenant. StatsD series of
+	// unknown tenants are counted when they are flushed.
+	Malformed uint64 `json:"malformed"`
+	// Failures storing what was accepted
+	StoreErrors uint64 `json:"storeErrors"`
+}
+
+func (s *ListenerStats) snapshot() ListenerStats {
+	return ListenerStats{
+		Packets:     atomic.LoadUint64(&s.Packets),
+		Accepted:    atomic.LoadUint64(&s.Accepted),
+		Malformed:   atomic.LoadUint64(&s.Malformed),
+		StoreErrors: atomic.LoadUint64(&s.StoreErrors),
+	}
+}
+
+var statsdStats, ndjsonStats, syslogStats ListenerStats
+
+// ServeStatsD receives StatsD and DogStatsD packets on a UDP address, metrics are routed to their tenant and
+// device by their tenant and host or device_id tags and stored every helpers.RawSampleInterval. Gauges and counters
+// not updated for expireFlushes flushes are forgotten, after ingest.DefaultStatsDExpireFlushes when it is 0.
+func ServeStatsD(addr string, expireFlushes int) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Printf("Error starting the StatsD listener: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("StatsD listener is running on %s", addr)
+
+	statsd := ingest.NewStatsD(expireFlushes)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(helpers.RawSampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				stats, err := statsd.Flush(db, now.UTC())
+				atomic.AddUint64(&statsdStats.Malformed, uint64(stats.Refused))
+				if err != nil {
+					atomic.AddUint64(&statsdStats.StoreErrors, 1)
+					log.Printf("Error storing StatsD metrics: %v", err)
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, maxStatsDPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Reading a closed socket fails right away, forever
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading StatsD packet: %v", err)
+			continue
+		}
+		atomic.AddUint64(&statsdStats.Packets, 1)
+
+		metrics, errs := ingest.ParseStatsD(buf[:n])
+		for _, metric := range metrics {
+			if err := statsd.Add(metric); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			atomic.AddUint64(&statsdStats.Accepted, 1)
+		}
+		if len(errs) > 0 {
+			atomic.AddUint64(&statsdStats.Malformed, 1)
+		}
+	}
+}
+
+// ServeNDJSON receives samples in the format of our agent on a TCP address, one JSON document per line. The
+// tenant and device of every sample are the ones of its machineProperties, like for /api/v1/postmetrics, but the
+// tenant must already exist.
+func ServeNDJSON(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Error starting the NDJSON listener: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	log.Printf("NDJSON listener is running on %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error accepting NDJSON connection: %v", err)
+			continue
+		}
+		go readNDJSON(conn)
+	}
+}
+
+// readNDJSON stores the samples of a connection until it is closed or idle for ndjsonIdleTimeout
+func readNDJSON(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ndjsonIdleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		atomic.AddUint64(&ndjsonStats.Packets, 1)
+
+		var performanceData PerformanceData
+		if err := json.Unmarshal(line, &performanceData); err != nil ||
+			performanceData.MachineProperties.TenantID == "" || performanceData.MachineProperties.DeviceID == "" {
+			atomic.AddUint64(&ndjsonStats.Malformed, 1)
+			continue
+		}
+
+		// Anyone can connect, only the tenants that already exist are stored
+		exists, err := models.TenantExists(db, performanceData.MachineProperties.TenantID)
+		if err != nil {
+			atomic.AddUint64(&ndjsonStats.StoreErrors, 1)
+			log.Printf("Error checking tenant of NDJSON sample of %s: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		if !exists {
+			atomic.AddUint64(&ndjsonStats.Malformed, 1)
+			continue
+		}
+
+		// Boxes without a clock leave the time of the sample to us
+		if performanceData.MachineProperties.TimeStamp == "" {
+			performanceData.MachineProperties.TimeStamp = time.Now().UTC().Format(helpers.TimestampLayout)
+		}
+
+		if err := StorePerformanceData(performanceData); err != nil {
+			atomic.AddUint64(&ndjsonStats.StoreErrors, 1)
+			log.Printf("Error storing NDJSON sample of %s: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		atomic.AddUint64(&ndjsonStats.Accepted, 1)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return
+		}
+		// Lines over maxNDJSONLine end the connection
+		atomic.AddUint64(&ndjsonStats.Malformed, 1)
+		log.Printf("Error reading NDJSON connection of %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// storeSyslog stores a syslog message on its tenant and device, when the tenant exists
+func storeSyslog(packet []byte, remote net.Addr, defaultTenant string) {
+	atomic.AddUint64(&syslogStats.Packets, 1)
+
+	message, err := ingest.ParseSyslog(packet)
+	if err != nil {
+		atomic.AddUint64(&syslogStats.Malformed, 1)
+		return
+	}
+	tenantID, line, err := ingest.SyslogLine(message, defaultTenant, time.Now().UnixMilli())
+	if err != nil {
+		atomic.AddUint64(&syslogStats.Malformed, 1)
+		return
+	}
+
+	// Anyone can send, only the tenants that already exist are stored
+	exists, err := models.TenantExists(db, tenantID)
+	if err != nil {
+		atomic.AddUint64(&syslogStats.StoreErrors, 1)
+		log.Printf("Error checking tenant of syslog message of %s: %v", remote, err)
+		return
+	}
+	if !exists {
+		atomic.AddUint64(&syslogStats.Malformed, 1)
+		return
+	}
+
+	if err := ingest.StoreLogs(db, tenantID, []ingest.LogLine{line}); err != nil {
+		atomic.AddUint64(&syslogStats.StoreErrors, 1)
+		log.Printf("Error storing syslog message of %s: %v", remote, err)
+		return
+	}
+	atomic.AddUint64(&syslogStats.Accepted, 1)
+}
+
+// ServeSyslogUDP receives RFC 5424 and RFC 3164 syslog messages on a UDP address, one per datagram. The tenant of
+// a message is its tenant structured data parameter or else defaultTenant, the device its device_id parameter or
+// else its hostname.
+func ServeSyslogUDP(addr string, defaultTenant string) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Printf("Error starting the syslog UDP listener: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("Syslog UDP listener is running on %s", addr)
+
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading syslog packet: %v", err)
+			continue
+		}
+		storeSyslog(buf[:n], remote, defaultTenant)
+	}
+}
+
+// ServeSyslogTCP receives RFC 5424 and RFC 3164 syslog messages on a TCP address, framed by octet counting or
+// newlines. Messages are routed like on ServeSyslogUDP.
+func ServeSyslogTCP(addr string, defaultTenant string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Error starting the syslog TCP listener: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	log.Printf("Syslog TCP listener is running on %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error accepting syslog connection: %v", err)
+			continue
+		}
+		go readSyslog(conn, defaultTenant)
+	}
+}
+
+// readSyslog stores the messages of a connection until it is closed or idle for ndjsonIdleTimeout
+func readSyslog(conn net.Conn, defaultTenant string) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxSyslogMessage+16)
+	scanner.Split(ingest.SplitSyslog)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ndjsonIdleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		storeSyslog(scanner.Bytes(), conn.RemoteAddr(), defaultTenant)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return
+		}
+		// Bad frames end the connection, the stream can't be resynchronised
+		atomic.AddUint64(&syslogStats.Malformed, 1)
+		log.Printf("Error reading syslog connection of %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Function to get the counters of the StatsD, NDJSON and syslog listeners
+// GET /api/v1/listenerstats
+func GetListenerStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]ListenerStats{
+		"statsd": statsdStats.snapshot(),
+		"ndjson": ndjsonStats.snapshot(),
+		"syslog": syslogStats.snapshot(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
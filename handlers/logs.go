@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/ingest"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log events returned by a search when no limit is given, and at most
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 5000
+)
+
+// Window searched on both sides of the time of a spike when none is given
+const defaultLogWindow = 5 * time.Minute
+
+type LogEventResponse struct {
+	ID          int64             `json:"id"`
+	Timestamp   string            `json:"timestamp"`
+	DeviceID    string            `json:"deviceID"`
+	DeviceName  string            `json:"deviceName"`
+	Severity    string            `json:"severity,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	ProcessPID  *int              `json:"processPID,omitempty"`
+	ProcessName string            `json:"processName,omitempty"`
+	Message     string            `json:"message"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+type LogSearchResponse struct {
+	Start  string             `json:"start"`
+	End    string             `json:"end"`
+	Events []LogEventResponse `json:"events"`
+}
+
+type LogIngestResponse struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Errors of rejected lines returned to the client, the others are only counted
+const maxReportedLogErrors = 10
+
+// Function to receive log events as JSON lines
+// POST /api/v1/logs?deviceID=web-1 with one JSON object per line, optionally gzip compressed, of up to 32 MB. The
+// tenant is given in the X-Scope-OrgID header or the tenantID parameter. Every line has a message and optionally a
+// timestamp, severity, pid, process, source and a device, deviceID by default. Other fields are kept as attributes.
+// Lines that can't be read don't stop the others from being stored.
+func ReceiveLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID := r.Header.Get(tenantHeader)
+	if tenantID == "" {
+		tenantID = r.URL.Query().Get("tenantID")
+	}
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	body, ok := readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	lines, errs := ingest.ParseJSONLogs(body, r.URL.Query().Get("deviceID"), time.Now().UnixMilli())
+
+	if err := ingest.StoreLogs(db, tenantID, lines); err != nil {
+		http.Error(w, fmt.Sprintf("Error storing log events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := LogIngestResponse{Accepted: len(lines), Rejected: len(errs)}
+	for i, err := range errs {
+		if i == maxReportedLogErrors {
+			break
+		}
+		response.Errors = append(response.Errors, err.Error())
+	}
+
+	status := http.StatusOK
+	if len(lines) == 0 && len(errs) > 0 {
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// logQueryParams reads the filters shared by the log searches, pid, process, severity, q and limit
+func logQueryParams(params url.Values) (models.LogQuery, error) {
+	query := models.LogQuery{
+		Text:        params.Get("q"),
+		ProcessName: params.Get("process"),
+		Limit:       defaultLogLimit,
+	}
+
+	if value := params.Get("pid"); value != "" {
+		pid, err := strconv.Atoi(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid pid %q", value)
+		}
+		query.ProcessPID = &pid
+	}
+
+	if value := params.Get("severity"); value != "" {
+		query.MinSeverity = ingest.NormalizeSeverity(value)
+		if query.MinSeverity == "" {
+			return query, fmt.Errorf("invalid severity %q, expected one of %s", value, strings.Join(models.LogSeverities, ", "))
+		}
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxLogLimit {
+			return query, fmt.Errorf("invalid limit %q, expected 1 to %d", value, maxLogLimit)
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
+
+// searchLogs runs a log query on the devices named, all devices if none, and writes the events found
+func searchLogs(w http.ResponseWriter, tenantID string, devices []string, query models.LogQuery) {
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	dbName := fmt.Sprintf("Performance_%s", tenantID)
+	deviceMap, err := helpers.GetDeviceMap(db, dbName, devices)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(deviceMap) == 0 {
+		http.Error(w, "No device IDs found for the given device names", http.StatusBadRequest)
+		return
+	}
+	if len(devices) > 0 {
+		for deviceID := range deviceMap {
+			query.DeviceIDs = append(query.DeviceIDs, deviceID)
+		}
+	}
+
+	events, err := models.SearchLogEvents(db, tenantID, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := LogSearchResponse{
+		Start:  query.From.UTC().Format(helpers.TimestampLayout),
+		End:    query.To.UTC().Format(helpers.TimestampLayout),
+		Events: []LogEventResponse{},
+	}
+	for _, event := range events {
+		response.Events = append(response.Events, LogEventResponse{
+			ID:          event.ID,
+			Timestamp:   time.UnixMilli(event.Timestamp).UTC().Format(time.RFC3339Nano),
+			DeviceID:    event.DeviceID,
+			DeviceName:  deviceMap[event.DeviceID],
+			Severity:    event.Severity,
+			Source:      event.Source,
+			ProcessPID:  event.ProcessPID,
+			ProcessName: event.ProcessName,
+			Message:     event.Message,
+			Attributes:  event.Attributes,
+		})
+	}
+
+	// Encode the structured response as JSON and send it to the client
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// Function to search the log events of a tenant
+// GET /api/v1/logs/search?tenantID=1234&start=2024-01-01T00:00:00Z&end=2024-01-01T01:00:00Z&devices=web-1,web-2
+// &q=+timeout -retry&pid=4242&process=nginx&severity=warning&limit=100 returns the newest events first. q is a
+// full-text search in the messages: +word must match, -word must not, "a phrase", prefix*.
+func SearchLogs(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	tenantID := params.Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	query, err := logQueryParams(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if query.From, err = helpers.ParseTimestamp(params.Get("start")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.To, err = helpers.ParseTimestamp(params.Get("end")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.To.Before(query.From) {
+		http.Error(w, "end is before start", http.StatusBadRequest)
+		return
+	}
+
+	var devices []string
+	if value := params.Get("devices"); value != "" {
+		devices = strings.Split(value, ",")
+	}
+
+	searchLogs(w, tenantID, devices, query)
+}
+
+// Function to get the logs of a device around a spike, like one seen in RetrieveCPUMetrics
+// GET /api/v1/logs/around?tenantID=1234&device=web-1&timestamp=2024-01-01 10:00:00&window=5m&pid=4242 returns the
+// events logged within window before and after timestamp, oldest first. pid or process narrow them to the
+// process that spiked, q, severity and limit work like on /api/v1/logs/search.
+func GetLogsAround(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	tenantID := params.Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	device := params.Get("device")
+	if device == "" {
+		http.Error(w, "device is required", http.StatusBadRequest)
+		return
+	}
+
+	timestamp, err := helpers.ParseTimestamp(params.Get("timestamp"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	window := defaultLogWindow
+	if value := params.Get("window"); value != "" {
+		if window, err = helpers.ParseStep(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query, err := logQueryParams(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.From = timestamp.Add(-window)
+	query.To = timestamp.Add(window)
+	query.Ascending = true
+
+	searchLogs(w, tenantID, []string{device}, query)
+}
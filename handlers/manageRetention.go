@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/jobs"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type RetentionPolicyPayload struct {
+	DataType      string `json:"dataType"`
+	RetentionDays int    `json:"retentionDays"`
+	UpdatedAt     string `json:"updatedAt,omitempty"`
+}
+
+type RetentionRequest struct {
+	TenantID string                   `json:"tenantID"`
+	Policies []RetentionPolicyPayload `json:"policies"`
+}
+
+type RetentionRunResponse struct {
+	DataType    string `json:"dataType"`
+	StartedAt   string `json:"startedAt"`
+	FinishedAt  string `json:"finishedAt"`
+	DeletedRows int64  `json:"deletedRows"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+type RetentionResponse struct {
+	Policies []RetentionPolicyPayload `json:"policies"`
+	Progress jobs.RetentionProgress   `json:"progress"`
+	Runs     []RetentionRunResponse   `json:"runs"`
+}
+
+// Number of past retention runs returned
+const retentionRunsLimit = 20
+
+// Function to read and update the retention policies of a tenant
+// GET /api/v1/retention?tenantID=1234 returns the policies, the job progress and the last runs
+// POST /api/v1/retention with a RetentionRequest body sets policies, 0 days keeps the data forever. Details are
+// deleted with their host samples, a process, disk or network policy longer than the host one keeps those longer.
+func ManageRetention(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+
+	switch r.Method {
+	case http.MethodGet:
+		tenantID = r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		var retentionRequest RetentionRequest
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, &retentionRequest); err != nil {
+			http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+			return
+		}
+
+		tenantID = retentionRequest.TenantID
+		if tenantID == "" {
+			http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		updatedAt := time.Now().UTC().Format("2006-01-02 15:04:05")
+		for _, policy := range retentionRequest.Policies {
+			if !models.ValidRetentionDataType(policy.DataType) {
+				http.Error(w, fmt.Sprintf("Unknown data type: %s", policy.DataType), http.StatusBadRequest)
+				return
+			}
+
+			if err := models.SetRetentionPolicy(db, tenantID, policy.DataType, policy.RetentionDays, updatedAt); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving retention policy: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	policies, err := models.GetRetentionPolicies(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying retention policies: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	runs, err := models.GetRetentionRuns(db, tenantID, retentionRunsLimit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying retention runs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := RetentionResponse{
+		Policies: make([]RetentionPolicyPayload, 0, len(policies)),
+		Progress: jobs.GetRetentionProgress(tenantID),
+		Runs:     make([]RetentionRunResponse, 0, len(runs)),
+	}
+
+	for _, policy := range policies {
+		response.Policies = append(response.Policies, RetentionPolicyPayload(policy))
+	}
+
+	for _, run := range runs {
+		response.Runs = append(response.Runs, RetentionRunResponse(run))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
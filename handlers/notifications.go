@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/jobs"
+	"cloudVigilante/backend/models"
+	"cloudVigilante/backend/notify"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Structs to match the JSON request
+
+// A notification channel, the secret and password of its config are never returned
+type NotificationChannelPayload struct {
+	ID           int64         `json:"id"`
+	Name         string        `json:"name"`
+	Type         string        `json:"type"`
+	Config       notify.Config `json:"config"`
+	SendResolved *bool         `json:"sendResolved"`
+	Enabled      *bool         `json:"enabled"`
+	CreatedAt    string        `json:"createdAt,omitempty"`
+	UpdatedAt    string        `json:"updatedAt,omitempty"`
+}
+
+type NotificationChannelRequest struct {
+	TenantID string                     `json:"tenantID"`
+	Channel  NotificationChannelPayload `json:"channel"`
+}
+
+// Test sends go to a saved channel when channelID is given, else to the channel of the request
+type TestNotificationRequest struct {
+	TenantID  string                      `json:"tenantID"`
+	ChannelID int64                       `json:"channelID"`
+	Channel   *NotificationChannelPayload `json:"channel"`
+}
+
+type DeliveryPayload struct {
+	ID            int64                `json:"id"`
+	ChannelID     int64                `json:"channelID"`
+	ChannelName   string               `json:"channelName,omitempty"`
+	RuleID        int64                `json:"ruleID"`
+	State         string               `json:"state"`
+	AlertCount    int                  `json:"alertCount"`
+	Status        string               `json:"status"`
+	Attempts      int                  `json:"attempts"`
+	LastError     string               `json:"lastError,omitempty"`
+	CreatedAt     string               `json:"createdAt"`
+	NextAttemptAt string               `json:"nextAttemptAt,omitempty"`
+	SentAt        string               `json:"sentAt,omitempty"`
+	Notification  *notify.Notification `json:"notification,omitempty"`
+}
+
+// Deliveries returned by the history when no limit is given, and at most
+const (
+	defaultDeliveryLimit = 100
+	maxDeliveryLimit     = 5000
+)
+
+// notificationChannelFromPayload validates a channel sent by a client. The secret and password of the channel
+// replaced, if any, are kept when the payload has none.
+func notificationChannelFromPayload(payload NotificationChannelPayload, existing *models.NotificationChannel) (models.NotificationChannel, error) {
+	channel := models.NotificationChannel{
+		ID:           payload.ID,
+		Name:         payload.Name,
+		Type:         payload.Type,
+		SendResolved: payload.SendResolved == nil || *payload.SendResolved,
+		Enabled:      payload.Enabled == nil || *payload.Enabled,
+	}
+	if channel.Name == "" {
+		return channel, fmt.Errorf("name is required")
+	}
+
+	config := payload.Config
+	if existing != nil {
+		previous, err := jobs.ChannelConfig(*existing)
+		if err != nil {
+			return channel, err
+		}
+		if config.Secret == "" {
+			config.Secret = previous.Secret
+		}
+		if config.Password == "" {
+			config.Password = previous.Password
+		}
+	}
+	if err := config.Validate(channel.Type); err != nil {
+		return channel, err
+	}
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return channel, err
+	}
+	channel.Config = string(encoded)
+
+	return channel, nil
+}
+
+func notificationChannelPayload(channel models.NotificationChannel) NotificationChannelPayload {
+	payload := NotificationChannelPayload{
+		ID:           channel.ID,
+		Name:         channel.Name,
+		Type:         channel.Type,
+		SendResolved: &channel.SendResolved,
+		Enabled:      &channel.Enabled,
+		CreatedAt:    channel.CreatedAt,
+		UpdatedAt:    channel.UpdatedAt,
+	}
+	json.Unmarshal([]byte(channel.Config), &payload.Config)
+	payload.Config.Secret = ""
+	payload.Config.Password = ""
+
+	return payload
+}
+
+// Function to manage the notification channels of a tenant
+// GET /api/v1/notifications/channels?tenantID=1234 lists the channels, &id=3 returns one
+// POST /api/v1/notifications/channels with a NotificationChannelRequest body creates a channel of type webhook, email,
+// slack or teams. Webhooks are signed with their config.secret, see notify.SignatureHeader.
+// PUT /api/v1/notifications/channels with a NotificationChannelRequest body replaces the channel with the ID of the
+// body, an empty secret or password keeps the current one
+// DELETE /api/v1/notifications/channels?tenantID=1234&id=3 deletes a channel and removes it from the alert rules
+func ManageNotificationChannels(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+	var channelID int64
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		tenantID = r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+		if id := r.URL.Query().Get("id"); id != "" {
+			var err error
+			if channelID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == http.MethodDelete && channelID == 0 {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost, http.MethodPut:
+		var channelRequest NotificationChannelRequest
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, &channelRequest); err != nil {
+			http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+			return
+		}
+
+		tenantID = channelRequest.TenantID
+		if tenantID == "" {
+			http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut && channelRequest.Channel.ID == 0 {
+			http.Error(w, "channel.id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		var existing *models.NotificationChannel
+		if r.Method == http.MethodPut {
+			if existing, err = models.GetNotificationChannel(db, tenantID, channelRequest.Channel.ID); err != nil {
+				http.Error(w, fmt.Sprintf("Error querying notification channel: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if existing == nil {
+				http.Error(w, "Notification channel not found", http.StatusNotFound)
+				return
+			}
+		} else {
+			channelRequest.Channel.ID = 0
+		}
+
+		channel, err := notificationChannelFromPayload(channelRequest.Channel, existing)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().UTC().Format(helpers.TimestampLayout)
+		if r.Method == http.MethodPost {
+			if channelID, err = models.CreateNotificationChannel(db, tenantID, channel, now); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving notification channel: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			found, err := models.UpdateNotificationChannel(db, tenantID, channel, now)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving notification channel: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Notification channel not found", http.StatusNotFound)
+				return
+			}
+			channelID = channel.ID
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		found, err := models.DeleteNotificationChannel(db, tenantID, channelID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting notification channel: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Notification channel not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if channelID != 0 {
+		channel, err := models.GetNotificationChannel(db, tenantID, channelID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying notification channel: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if channel == nil {
+			http.Error(w, "Notification channel not found", http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, notificationChannelPayload(*channel))
+		return
+	}
+
+	channels, err := models.GetNotificationChannels(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying notification channels: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]NotificationChannelPayload, 0, len(channels))
+	for _, channel := range channels {
+		payloads = append(payloads, notificationChannelPayload(channel))
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// Function to send a test notification on a channel, saved or not
+// POST /api/v1/notifications/test with a TestNotificationRequest body, the test sends of saved channels are recorded
+// in their deliveries. Channels that fail to send answer 502 with the error of the channel.
+func TestNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var testRequest TestNotificationRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(body, &testRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		return
+	}
+
+	if testRequest.TenantID == "" {
+		http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+		return
+	}
+	if (testRequest.ChannelID == 0) == (testRequest.Channel == nil) {
+		http.Error(w, "Either channelID or channel is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.CreatePerformanceDB(db, testRequest.TenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var channel models.NotificationChannel
+	if testRequest.ChannelID != 0 {
+		existing, err := models.GetNotificationChannel(db, testRequest.TenantID, testRequest.ChannelID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying notification channel: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if existing == nil {
+			http.Error(w, "Notification channel not found", http.StatusNotFound)
+			return
+		}
+		channel = *existing
+	} else {
+		testRequest.Channel.ID = 0
+		if channel, err = notificationChannelFromPayload(*testRequest.Channel, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	delivery, err := jobs.SendTestNotification(db, testRequest.TenantID, channel, time.Now().UTC())
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusBadGateway
+	}
+
+	writeJSON(w, status, deliveryPayload(delivery, channel.Name, false))
+}
+
+func deliveryPayload(delivery models.NotificationDelivery, channelName string, withNotification bool) DeliveryPayload {
+	payload := DeliveryPayload{
+		ID:            delivery.ID,
+		ChannelID:     delivery.ChannelID,
+		ChannelName:   channelName,
+		RuleID:        delivery.RuleID,
+		State:         delivery.State,
+		AlertCount:    delivery.AlertCount,
+		Status:        delivery.Status,
+		Attempts:      delivery.Attempts,
+		LastError:     delivery.LastError,
+		CreatedAt:     delivery.CreatedAt,
+		NextAttemptAt: delivery.NextAttemptAt,
+		SentAt:        delivery.SentAt,
+	}
+	if withNotification {
+		var notification notify.Notification
+		if err := json.Unmarshal([]byte(delivery.Payload), &notification); err == nil {
+			payload.Notification = &notification
+		}
+	}
+
+	return payload
+}
+
+// Function to read the delivery history of the notifications of a tenant, newest first
+// GET /api/v1/notifications/deliveries?tenantID=1234&channelID=3&ruleID=7&status=failed&limit=100, the statuses are
+// pending, sent, failed and duplicate. &notifications=true includes what was sent.
+func GetNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	tenantID := params.Get("tenantID")
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	query := models.DeliveryQuery{Status: params.Get("status"), Limit: defaultDeliveryLimit}
+	for param, id := range map[string]*int64{"channelID": &query.ChannelID, "ruleID": &query.RuleID} {
+		if value := params.Get(param); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s", param), http.StatusBadRequest)
+				return
+			}
+			*id = parsed
+		}
+	}
+	switch query.Status {
+	case "", models.DeliveryPending, models.DeliverySent, models.DeliveryFailed, models.DeliveryDuplicate:
+	default:
+		http.Error(w, "Invalid status, expected pending, sent, failed or duplicate", http.StatusBadRequest)
+		return
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxDeliveryLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxDeliveryLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+	withNotifications := params.Get("notifications") == "true"
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := models.GetNotificationDeliveries(db, tenantID, query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying notification deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	channels, err := models.GetNotificationChannels(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying notification channels: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	channelNames := make(map[int64]string, len(channels))
+	for _, channel := range channels {
+		channelNames[channel.ID] = channel.Name
+	}
+
+	payloads := make([]DeliveryPayload, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		payloads = append(payloads, deliveryPayload(delivery, channelNames[delivery.ChannelID], withNotifications))
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
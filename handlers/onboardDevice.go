@@ -14,7 +14,7 @@ func generateDeviceID() string {
 	b := make([]byte, 16)
 	_, err := io.ReadFull(rand.Reader, b)
 	if err != nil {
-		fmt.Sprintf("Failed to generate a random device ID: %x ERROR: %s", b, err)
+		fmt.Printf("Failed to generate a random device ID: %x ERROR: %s\n", b, err)
 	}
 
 	return fmt.Sprintf("%x", b)
@@ -90,7 +90,7 @@ func OnboarDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Sprint("Onboard script created successfully: %s", scriptPath)
+	fmt.Printf("Onboard script created successfully: %s\n", scriptPath)
 
 	// Return link to download the script
 
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/ingest"
 	"cloudVigilante/backend/models"
 	"database/sql"
 	"encoding/json"
@@ -8,14 +10,23 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
 // Define the Go structs that match the JSON structure
 type TotalConsumption struct {
-	TotalCPU       float64 `json:"TotalCpu"`
-	TotalMemory    int64   `json:"TotalMemory"`
-	UsedMemory     int64   `json:"UsedMemory"`
-	UsedMemoryPerc float64 `json:"UsedMemoryP"`
+	TotalCPU       float64   `json:"TotalCpu"`
+	TotalMemory    int64     `json:"TotalMemory"`
+	UsedMemory     int64     `json:"UsedMemory"`
+	UsedMemoryPerc float64   `json:"UsedMemoryP"`
+	LoadAvg1       float64   `json:"LoadAvg1"`
+	LoadAvg5       float64   `json:"LoadAvg5"`
+	LoadAvg15      float64   `json:"LoadAvg15"`
+	CPUUser        float64   `json:"CpuUser"`
+	CPUSystem      float64   `json:"CpuSystem"`
+	CPUIowait      float64   `json:"CpuIowait"`
+	CPUSteal       float64   `json:"CpuSteal"`
+	PerCoreCPU     []float64 `json:"PerCoreCpu"`
 }
 
 type MachineProperties struct {
@@ -27,18 +38,57 @@ type MachineProperties struct {
 	TimeStamp  string `json:"timeStamp"`
 }
 
+// Fields after ProcessMemUsage are optional, older agents don't send them
 type ProcessInfo struct {
-	ProcessPID      int     `json:"processPID"`
-	ProcessName     string  `json:"processName"`
-	ProcessCommand  string  `json:"processCommand"`
-	ProcessCpuUsage float64 `json:"ProcessCpuUsage"`
-	ProcessMemUsage int64   `json:"ProcessMemUsage"`
+	ProcessPID        int     `json:"processPID"`
+	ProcessName       string  `json:"processName"`
+	ProcessCommand    string  `json:"processCommand"`
+	ProcessCpuUsage   float64 `json:"ProcessCpuUsage"`
+	ProcessMemUsage   int64   `json:"ProcessMemUsage"`
+	ProcessUser       *string `json:"processUser"`
+	ProcessParentPID  *int    `json:"processParentPID"`
+	ProcessState      *string `json:"processState"`
+	ProcessThreads    *int    `json:"processThreads"`
+	ProcessOpenFDs    *int    `json:"processOpenFDs"`
+	ProcessStartTime  *string `json:"processStartTime"`
+	ProcessReadBytes  *int64  `json:"processReadBytes"`
+	ProcessWriteBytes *int64  `json:"processWriteBytes"`
+}
+
+type DiskInfo struct {
+	MountPoint  string  `json:"mountPoint"`
+	FileSystem  string  `json:"fileSystem"`
+	FSType      string  `json:"fsType"`
+	UsedBytes   int64   `json:"usedBytes"`
+	TotalBytes  int64   `json:"totalBytes"`
+	InodesUsed  int64   `json:"inodesUsed"`
+	InodesTotal int64   `json:"inodesTotal"`
+	ReadBytes   int64   `json:"readBytes"`
+	WriteBytes  int64   `json:"writeBytes"`
+	ReadIOPS    float64 `json:"readIops"`
+	WriteIOPS   float64 `json:"writeIops"`
+}
+
+type NetworkInfo struct {
+	Interface string `json:"interface"`
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	TxPackets uint64 `json:"txPackets"`
+	RxErrors  uint64 `json:"rxErrors"`
+	TxErrors  uint64 `json:"txErrors"`
+	RxDrops   uint64 `json:"rxDrops"`
+	TxDrops   uint64 `json:"txDrops"`
 }
 
 type PerformanceData struct {
 	TotalConsumption  TotalConsumption  `json:"totalConsumption"`
 	MachineProperties MachineProperties `json:"machineProperties"`
 	ProcessInfo       []ProcessInfo     `json:"processInfo"`
+	DiskInfo          []DiskInfo        `json:"diskInfo"`
+	NetworkInfo       []NetworkInfo     `json:"networkInfo"`
+	// Optional application metrics of the device, see CustomMetric
+	CustomMetrics []CustomMetric `json:"customMetrics"`
 }
 
 // Declare global db var
@@ -70,15 +120,23 @@ func ReceivePerformanceMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orgID := performanceData.MachineProperties.TenantID
-
-	// Ensure the PerformanceDB for the organization exists
-	err = models.CreatePerformanceDB(db, orgID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+	if err := StorePerformanceData(performanceData); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	log.Println("Inserted performance metrics successfully")
+
+	// Respond to the client
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Performance data recorded successfully"))
+
+}
+
+// StorePerformanceData stores a sample in the format of our agent
+func StorePerformanceData(performanceData PerformanceData) error {
+	orgID := performanceData.MachineProperties.TenantID
+
 	deviceData := models.DeviceData{
 		DeviceID:   performanceData.MachineProperties.DeviceID,
 		Hostname:   performanceData.MachineProperties.DeviceName,
@@ -93,30 +151,80 @@ func ReceivePerformanceMetrics(w http.ResponseWriter, r *http.Request) {
 		RAMUsage:    performanceData.TotalConsumption.UsedMemory,
 		TotalMemory: performanceData.TotalConsumption.TotalMemory,
 		UsedMemoryP: performanceData.TotalConsumption.UsedMemoryPerc,
+		LoadAvg1:    performanceData.TotalConsumption.LoadAvg1,
+		LoadAvg5:    performanceData.TotalConsumption.LoadAvg5,
+		LoadAvg15:   performanceData.TotalConsumption.LoadAvg15,
+		CPUUser:     performanceData.TotalConsumption.CPUUser,
+		CPUSystem:   performanceData.TotalConsumption.CPUSystem,
+		CPUIowait:   performanceData.TotalConsumption.CPUIowait,
+		CPUSteal:    performanceData.TotalConsumption.CPUSteal,
+		CoreUsage:   performanceData.TotalConsumption.PerCoreCPU,
 		Processes:   make([]models.ProcessData, len(performanceData.ProcessInfo)),
+		Disks:       make([]models.DiskData, len(performanceData.DiskInfo)),
+		Interfaces:  make([]models.NetworkData, len(performanceData.NetworkInfo)),
 	}
 
 	for i, process := range performanceData.ProcessInfo {
 		performance.Processes[i] = models.ProcessData{
-			PID:      process.ProcessPID,
-			Name:     process.ProcessName,
-			Command:  process.ProcessCommand,
-			CPUUsage: process.ProcessCpuUsage,
-			RAMUsage: process.ProcessMemUsage,
+			PID:        process.ProcessPID,
+			Name:       process.ProcessName,
+			Command:    process.ProcessCommand,
+			CPUUsage:   process.ProcessCpuUsage,
+			RAMUsage:   process.ProcessMemUsage,
+			User:       process.ProcessUser,
+			ParentPID:  process.ProcessParentPID,
+			State:      process.ProcessState,
+			Threads:    process.ProcessThreads,
+			OpenFDs:    process.ProcessOpenFDs,
+			StartTime:  process.ProcessStartTime,
+			ReadBytes:  process.ProcessReadBytes,
+			WriteBytes: process.ProcessWriteBytes,
 		}
 	}
 
-	err = models.InsertPerformanceData(db, orgID, deviceData, performance)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error inserting performance data: %v", err), http.StatusInternalServerError)
-		return
+	for i, disk := range performanceData.DiskInfo {
+		performance.Disks[i] = models.DiskData{
+			MountPoint:  disk.MountPoint,
+			FileSystem:  disk.FileSystem,
+			FSType:      disk.FSType,
+			UsedBytes:   disk.UsedBytes,
+			TotalBytes:  disk.TotalBytes,
+			InodesUsed:  disk.InodesUsed,
+			InodesTotal: disk.InodesTotal,
+			ReadBytes:   disk.ReadBytes,
+			WriteBytes:  disk.WriteBytes,
+			ReadIOPS:    disk.ReadIOPS,
+			WriteIOPS:   disk.WriteIOPS,
+		}
 	}
 
-	log.Println(performance)
-	log.Println("Inserted performance metrics successfully")
+	for i, iface := range performanceData.NetworkInfo {
+		performance.Interfaces[i] = models.NetworkData{
+			Interface: iface.Interface,
+			RxBytes:   iface.RxBytes,
+			TxBytes:   iface.TxBytes,
+			RxPackets: iface.RxPackets,
+			TxPackets: iface.TxPackets,
+			RxErrors:  iface.RxErrors,
+			TxErrors:  iface.TxErrors,
+			RxDrops:   iface.RxDrops,
+			TxDrops:   iface.TxDrops,
+		}
+	}
 
-	// Respond to the client
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Performance data recorded successfully"))
+	// Ensure the PerformanceDB for the organization exists and insert the sample
+	if err := ingest.Store(db, orgID, deviceData, performance); err != nil {
+		return err
+	}
 
+	if len(performanceData.CustomMetrics) == 0 {
+		return nil
+	}
+
+	// Custom metrics without a time of their own are at the time of the sample
+	timestamp, err := helpers.ParseTimestamp(performance.Timestamp)
+	if err != nil {
+		timestamp = time.Now().UTC()
+	}
+	return storeCustomMetrics(orgID, deviceData.DeviceID, performanceData.CustomMetrics, timestamp)
 }
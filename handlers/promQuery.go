@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/promql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of the Prometheus compatible API. A Grafana Prometheus data source pointed at it calls the
+// API under <prefix>/api/v1/, the query endpoints are also served right under the prefix.
+const PromAPIPrefix = "/api/v1/prom/"
+
+// Header Grafana and the Prometheus tooling use to pass the tenant
+const tenantHeader = "X-Scope-OrgID"
+
+// Structs of the Prometheus HTTP API responses
+
+type PromResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type PromQueryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type PromSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+type PromSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+type PromMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// writePromResponse encodes a Prometheus API response
+func writePromResponse(w http.ResponseWriter, status int, response PromResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Printf("Error encoding response: %v\n", err)
+	}
+}
+
+func writePromData(w http.ResponseWriter, data interface{}) {
+	writePromResponse(w, http.StatusOK, PromResponse{Status: "success", Data: data})
+}
+
+// writePromError answers with the error type Prometheus uses for the error
+func writePromError(w http.ResponseWriter, err error) {
+	var badData *promql.BadDataError
+	if errors.As(err, &badData) {
+		writePromResponse(w, http.StatusBadRequest, PromResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+		return
+	}
+
+	writePromResponse(w, http.StatusUnprocessableEntity, PromResponse{Status: "error", ErrorType: "execution", Error: err.Error()})
+}
+
+func promBadData(format string, args ...interface{}) error {
+	return &promql.BadDataError{Message: fmt.Sprintf(format, args...)}
+}
+
+// promPoint formats a point as [unix seconds, "value"]
+func promPoint(point promql.Point) [2]interface{} {
+	value := strconv.FormatFloat(point.Value, 'f', -1, 64)
+	switch {
+	case math.IsNaN(point.Value):
+		value = "NaN"
+	case math.IsInf(point.Value, 1):
+		value = "+Inf"
+	case math.IsInf(point.Value, -1):
+		value = "-Inf"
+	}
+
+	return [2]interface{}{float64(point.Timestamp) / 1000, value}
+}
+
+// parsePromTime parses a time given as RFC3339 or unix seconds, def is used when it's empty
+func parsePromTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	return time.Time{}, promBadData("cannot parse %q to a valid timestamp", value)
+}
+
+// parsePromDuration parses a duration given in seconds or as a PromQL duration
+func parsePromDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, promBadData("zero or negative query resolution step widths are not accepted")
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	duration, err := promql.ParseDuration(value)
+	if err != nil {
+		return 0, promBadData("cannot parse %q to a valid duration", value)
+	}
+	return duration, nil
+}
+
+// promTenant returns the tenant of a request, from the X-Scope-OrgID header or the tenantID parameter
+func promTenant(r *http.Request) (string, error) {
+	if tenantID := r.Header.Get(tenantHeader); tenantID != "" {
+		return tenantID, nil
+	}
+	if tenantID := r.Form.Get("tenantID"); tenantID != "" {
+		return tenantID, nil
+	}
+
+	return "", promBadData("the tenant is required, in the %s header or the tenantID parameter", tenantHeader)
+}
+
+// Function to handle the Prometheus HTTP API
+// GET or POST /api/v1/prom/query?query=...&time=... evaluates an instant query
+// GET or POST /api/v1/prom/query_range?query=...&start=...&end=...&step=... evaluates a range query
+// Grafana also uses labels, label/<name>/values, series, metadata and status/buildinfo. Every endpoint is
+// served under /api/v1/prom/api/v1/ too, so the data source URL can be http://<host>:8080/api/v1/prom
+func PromAPI(w http.ResponseWriter, r *http.Request) {
+	// Parse the query string and the form encoded body Grafana posts
+	if err := r.ParseForm(); err != nil {
+		writePromError(w, promBadData("error parsing form values: %v", err))
+		return
+	}
+
+	endpoint := strings.TrimPrefix(r.URL.Path, PromAPIPrefix)
+	endpoint = strings.TrimPrefix(endpoint, "api/v1/")
+
+	if endpoint == "status/buildinfo" {
+		writePromData(w, map[string]string{"version": "2.40.0", "revision": "", "branch": "", "goVersion": ""})
+		return
+	}
+
+	tenantID, err := promTenant(r)
+	if err != nil {
+		writePromError(w, err)
+		return
+	}
+
+	switch {
+	case endpoint == "query":
+		err = promInstantQuery(w, r, tenantID)
+	case endpoint == "query_range":
+		err = promRangeQuery(w, r, tenantID)
+	case endpoint == "labels":
+		writePromData(w, promql.LabelNames())
+	case strings.HasPrefix(endpoint, "label/") && strings.HasSuffix(endpoint, "/values"):
+		err = promLabelValues(w, r, tenantID, strings.TrimSuffix(strings.TrimPrefix(endpoint, "label/"), "/values"))
+	case endpoint == "series":
+		err = promSeries(w, r, tenantID)
+	case endpoint == "metadata":
+		metadata := make(map[string][]PromMetadata)
+		for _, metric := range promql.Metrics() {
+			metadata[metric.Name] = []PromMetadata{{Type: metric.Type, Help: metric.Help}}
+		}
+		writePromData(w, metadata)
+	case endpoint == "query_exemplars" || endpoint == "rules" || endpoint == "alerts":
+		writePromData(w, []interface{}{})
+	default:
+		writePromResponse(w, http.StatusNotFound, PromResponse{Status: "error", ErrorType: "not_found", Error: fmt.Sprintf("unknown endpoint: %s", endpoint)})
+	}
+
+	if err != nil {
+		writePromError(w, err)
+	}
+}
+
+func promInstantQuery(w http.ResponseWriter, r *http.Request, tenantID string) error {
+	at, err := parsePromTime(r.Form.Get("time"), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	result, err := promql.Evaluate(db, tenantID, r.Form.Get("query"), at, at, 0)
+	if err != nil {
+		return err
+	}
+
+	if result.Scalar {
+		writePromData(w, PromQueryData{ResultType: promql.ResultScalar, Result: promPoint(result.Series[0].Points[0])})
+		return nil
+	}
+
+	samples := []PromSample{}
+	for _, series := range result.Series {
+		samples = append(samples, PromSample{Metric: series.Labels, Value: promPoint(series.Points[0])})
+	}
+	writePromData(w, PromQueryData{ResultType: promql.ResultVector, Result: samples})
+	return nil
+}
+
+func promRangeQuery(w http.ResponseWriter, r *http.Request, tenantID string) error {
+	if r.Form.Get("start") == "" || r.Form.Get("end") == "" || r.Form.Get("step") == "" {
+		return promBadData("start, end and step are required")
+	}
+
+	start, err := parsePromTime(r.Form.Get("start"), time.Time{})
+	if err != nil {
+		return err
+	}
+	end, err := parsePromTime(r.Form.Get("end"), time.Time{})
+	if err != nil {
+		return err
+	}
+	step, err := parsePromDuration(r.Form.Get("step"))
+	if err != nil {
+		return err
+	}
+
+	result, err := promql.Evaluate(db, tenantID, r.Form.Get("query"), start, end, step)
+	if err != nil {
+		return err
+	}
+
+	// Scalars are returned as a series without labels
+	matrix := []PromSeries{}
+	for _, series := range result.Series {
+		values := make([][2]interface{}, len(series.Points))
+		for i, point := range series.Points {
+			values[i] = promPoint(point)
+		}
+		matrix = append(matrix, PromSeries{Metric: series.Labels, Values: values})
+	}
+	writePromData(w, PromQueryData{ResultType: promql.ResultMatrix, Result: matrix})
+	return nil
+}
+
+// promTimeRange returns the range of the series lookups, the last hour by default
+func promTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	end, err := parsePromTime(r.Form.Get("end"), time.Now().UTC())
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start, err := parsePromTime(r.Form.Get("start"), end.Add(-time.Hour))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return start, end, nil
+}
+
+func promSeries(w http.ResponseWriter, r *http.Request, tenantID string) error {
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		return promBadData("no match[] parameter provided")
+	}
+
+	start, end, err := promTimeRange(r)
+	if err != nil {
+		return err
+	}
+
+	series, err := promql.FindSeries(db, tenantID, selectors, start, end)
+	if err != nil {
+		return err
+	}
+
+	if series == nil {
+		series = []map[string]string{}
+	}
+	writePromData(w, series)
+	return nil
+}
+
+func promLabelValues(w http.ResponseWriter, r *http.Request, tenantID string, label string) error {
+	selectors := r.Form["match[]"]
+
+	values := map[string]bool{}
+	switch {
+	case label == promql.LabelName && len(selectors) == 0:
+		for _, metric := range promql.Metrics() {
+			values[metric.Name] = true
+		}
+
+	case (label == promql.LabelDevice || label == promql.LabelDeviceID) && len(selectors) == 0:
+		deviceMap, err := helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), nil)
+		if err != nil {
+			return err
+		}
+		for deviceID, hostname := range deviceMap {
+			if label == promql.LabelDevice {
+				values[hostname] = true
+			} else {
+				values[deviceID] = true
+			}
+		}
+
+	default:
+		// Other labels are read from the series of the metrics carrying them
+		if len(selectors) == 0 {
+			selectors = promql.MetricsWithLabel(label)
+		}
+
+		start, end, err := promTimeRange(r)
+		if err != nil {
+			return err
+		}
+
+		series, err := promql.FindSeries(db, tenantID, selectors, start, end)
+		if err != nil {
+			return err
+		}
+		for _, labels := range series {
+			if value, ok := labels[label]; ok {
+				values[value] = true
+			}
+		}
+	}
+
+	list := make([]string, 0, len(values))
+	for value := range values {
+		list = append(list, value)
+	}
+	sort.Strings(list)
+
+	writePromData(w, list)
+	return nil
+}
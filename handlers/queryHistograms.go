@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Structs to match the JSON request
+
+type HistogramQuery struct {
+	Metric    string          `json:"metric"`
+	Devices   []string        `json:"devices"`
+	TimeRange TimeRange       `json:"timeRange"`
+	Filters   []engine.Filter `json:"filters"`
+	Quantiles []float64       `json:"quantiles"`
+	Step      string          `json:"step"`
+	Merge     bool            `json:"merge"`
+	By        []string        `json:"by"`
+}
+
+type HistogramQueryRequest struct {
+	TenantID string         `json:"tenantID"`
+	Query    HistogramQuery `json:"query"`
+}
+
+// Function to handle quantile queries on histogram and summary custom metrics
+// POST /api/v1/histograms with a HistogramQueryRequest body estimates the quantiles of the observations over
+// the time range, or over every step of it. With merge the series of all devices are added up, per value of
+// the "by" labels.
+func QueryHistograms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var histogramQueryRequest HistogramQueryRequest
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON data
+	if err := json.Unmarshal(body, &histogramQueryRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	query := histogramQueryRequest.Query
+	for _, q := range query.Quantiles {
+		if q < 0 || q > 1 {
+			http.Error(w, fmt.Sprintf("Invalid quantile %v, expected 0 to 1", q), http.StatusBadRequest)
+			return
+		}
+	}
+
+	request := engine.HistogramRequest{
+		TenantID:  histogramQueryRequest.TenantID,
+		Metric:    query.Metric,
+		Devices:   query.Devices,
+		TimeStart: query.TimeRange.Start,
+		TimeEnd:   query.TimeRange.End,
+		Filters:   query.Filters,
+		Quantiles: query.Quantiles,
+		Merge:     query.Merge,
+		By:        query.By,
+	}
+
+	if query.Step != "" {
+		request.Step, err = helpers.ParseStep(query.Step)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := engine.ExecuteHistogram(db, request)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	// Encode the structured response as JSON and send it to the client
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/ingest"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// Content types of the OTLP/HTTP encodings
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// Function to receive OpenTelemetry metrics over OTLP/HTTP
+// POST /v1/metrics with an ExportMetricsServiceRequest body, in protobuf or JSON as the Content-Type says,
+// optionally gzip compressed, of up to 32 MB. The tenant is given in the X-Scope-OrgID header, or the tenantID
+// parameter.
+// hostmetrics and process receiver metrics are stored like the samples of our agent, the others as generic series.
+func ReceiveOTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID := r.Header.Get(tenantHeader)
+	if tenantID == "" {
+		tenantID = r.URL.Query().Get("tenantID")
+	}
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != contentTypeProtobuf && contentType != contentTypeJSON {
+		http.Error(w, fmt.Sprintf("Unsupported content type, expected %s or %s", contentTypeProtobuf, contentTypeJSON),
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, ok := readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var resources []ingest.OTLPResource
+	var err error
+	if contentType == contentTypeProtobuf {
+		resources, err = ingest.DecodeOTLPProtobuf(body)
+	} else {
+		resources, err = ingest.DecodeOTLPJSON(body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding OTLP metrics: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := ingest.StoreOTLP(db, tenantID, resources)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing OTLP metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stored OTLP metrics of tenant %s: %d points as %d device samples, %d generic samples and %d histograms",
+		tenantID, stats.Points, stats.Frames, stats.GenericSamples, stats.Histograms)
+
+	// An empty ExportMetricsServiceResponse, in the encoding of the request
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if contentType == contentTypeJSON {
+		fmt.Fprint(w, "{}")
+	}
+}
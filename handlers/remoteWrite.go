@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/ingest"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Function to receive Prometheus remote write requests
+// POST /api/v1/remote_write with a snappy compressed protobuf WriteRequest body. The tenant is given in the
+// X-Scope-OrgID header, or the tenantID parameter for senders that can't set headers.
+func ReceiveRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID := r.Header.Get(tenantHeader)
+	if tenantID == "" {
+		tenantID = r.URL.Query().Get("tenantID")
+	}
+	if tenantID == "" {
+		http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+		return
+	}
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	decoded, err := ingest.DecodeSnappy(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decompressing request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	series, err := ingest.DecodeWriteRequest(decoded)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := ingest.RemoteWrite(db, tenantID, series)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing remote write samples: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stored remote write request of tenant %s: %d samples as %d device samples and %d generic samples",
+		tenantID, stats.Samples, stats.Frames, stats.GenericSamples)
+
+	// Prometheus expects no content on success
+	w.WriteHeader(http.StatusNoContent)
+}
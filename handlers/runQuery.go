@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Structs to match the JSON request
+
+type MetricQuery struct {
+	Metric    string          `json:"metric"`
+	Devices   []string        `json:"devices"`
+	TimeRange TimeRange       `json:"timeRange"`
+	GroupBy   string          `json:"groupBy"`
+	Rank      engine.Ranking  `json:"rank"`
+	Filters   []engine.Filter `json:"filters"`
+	// Points per series, helpers.DefaultMaxPoints when 0
+	MaxPoints    int      `json:"maxPoints"`
+	Step         string   `json:"step"`
+	Aggregations []string `json:"aggregations"`
+}
+
+type MetricQueryRequest struct {
+	TenantID string      `json:"tenantID"`
+	Query    MetricQuery `json:"query"`
+}
+
+type MetricCatalogEntry struct {
+	Metric string   `json:"metric"`
+	Labels []string `json:"labels"`
+}
+
+// writeQueryError answers with the status matching an error of the query engine
+func writeQueryError(w http.ResponseWriter, err error) {
+	var badRequest *engine.BadRequestError
+	if errors.As(err, &badRequest) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Function to handle queries on any metric
+// GET /api/v1/query lists the metrics and the labels they can be filtered on
+// POST /api/v1/query with a MetricQueryRequest body ranks, filters and groups the series of a metric
+func RunQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		catalog := []MetricCatalogEntry{}
+		for _, metric := range engine.MetricNames() {
+			catalog = append(catalog, MetricCatalogEntry{Metric: metric, Labels: engine.Labels(metric)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(catalog); err != nil {
+			http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var metricQueryRequest MetricQueryRequest
+
+	// Read the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON data
+	if err := json.Unmarshal(body, &metricQueryRequest); err != nil {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	query := metricQueryRequest.Query
+	request := engine.Request{
+		TenantID:     metricQueryRequest.TenantID,
+		Metric:       query.Metric,
+		Devices:      query.Devices,
+		TimeStart:    query.TimeRange.Start,
+		TimeEnd:      query.TimeRange.End,
+		GroupBy:      query.GroupBy,
+		Rank:         query.Rank,
+		Filters:      query.Filters,
+		MaxPoints:    helpers.PointBudget(query.MaxPoints),
+		Aggregations: query.Aggregations,
+	}
+
+	if query.Step != "" {
+		request.Step, err = helpers.ParseStep(query.Step)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := engine.Execute(db, request)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	// Encode the structured response as JSON and send it to the client
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/jobs"
+	"cloudVigilante/backend/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Structs to match the JSON request
+
+// A silence, startsAt defaults to now and endsAt to startsAt plus duration, like "2h"
+type SilencePayload struct {
+	ID        int64             `json:"id"`
+	RuleID    int64             `json:"ruleID"`
+	Devices   []string          `json:"devices"`
+	Labels    map[string]string `json:"labels"`
+	StartsAt  string            `json:"startsAt"`
+	EndsAt    string            `json:"endsAt"`
+	Duration  string            `json:"duration,omitempty"`
+	Comment   string            `json:"comment,omitempty"`
+	CreatedBy string            `json:"createdBy,omitempty"`
+	CreatedAt string            `json:"createdAt,omitempty"`
+	Active    bool              `json:"active"`
+}
+
+type SilenceRequest struct {
+	TenantID string         `json:"tenantID"`
+	Silence  SilencePayload `json:"silence"`
+}
+
+// A maintenance window of a device group, every device when devices is empty. It starts at every time of its cron
+// schedule, read in its timezone, and lasts duration, like "2h".
+type MaintenanceWindowPayload struct {
+	ID              int64    `json:"id"`
+	Name            string   `json:"name"`
+	Devices         []string `json:"devices"`
+	Schedule        string   `json:"schedule"`
+	Duration        string   `json:"duration"`
+	Timezone        string   `json:"timezone"`
+	SuppressOffline bool     `json:"suppressOffline"`
+	Enabled         *bool    `json:"enabled"`
+	CreatedAt       string   `json:"createdAt,omitempty"`
+	UpdatedAt       string   `json:"updatedAt,omitempty"`
+	Active          bool     `json:"active"`
+	CurrentStart    string   `json:"currentStart,omitempty"`
+	NextStart       string   `json:"nextStart,omitempty"`
+}
+
+type MaintenanceWindowRequest struct {
+	TenantID string                   `json:"tenantID"`
+	Window   MaintenanceWindowPayload `json:"window"`
+}
+
+// silenceFromPayload validates a silence sent by a client
+func silenceFromPayload(payload SilencePayload, now time.Time) (models.Silence, error) {
+	silence := models.Silence{
+		ID:        payload.ID,
+		RuleID:    payload.RuleID,
+		Devices:   payload.Devices,
+		Labels:    payload.Labels,
+		Comment:   payload.Comment,
+		CreatedBy: payload.CreatedBy,
+	}
+
+	start := now
+	if payload.StartsAt != "" {
+		var err error
+		if start, err = helpers.ParseTimestamp(payload.StartsAt); err != nil {
+			return silence, fmt.Errorf("invalid startsAt: %v", err)
+		}
+	}
+
+	var end time.Time
+	switch {
+	case payload.EndsAt != "":
+		var err error
+		if end, err = helpers.ParseTimestamp(payload.EndsAt); err != nil {
+			return silence, fmt.Errorf("invalid endsAt: %v", err)
+		}
+	case payload.Duration != "":
+		duration, err := helpers.ParseStep(payload.Duration)
+		if err != nil {
+			return silence, fmt.Errorf("invalid duration: %v", err)
+		}
+		end = start.Add(duration)
+	default:
+		return silence, fmt.Errorf("endsAt or duration is required")
+	}
+	if !end.After(start) {
+		return silence, fmt.Errorf("endsAt must be after startsAt")
+	}
+
+	silence.StartsAt = start.UTC().Format(helpers.TimestampLayout)
+	silence.EndsAt = end.UTC().Format(helpers.TimestampLayout)
+
+	return silence, nil
+}
+
+func silencePayload(silence models.Silence, now string) SilencePayload {
+	return SilencePayload{
+		ID:        silence.ID,
+		RuleID:    silence.RuleID,
+		Devices:   silence.Devices,
+		Labels:    silence.Labels,
+		StartsAt:  silence.StartsAt,
+		EndsAt:    silence.EndsAt,
+		Comment:   silence.Comment,
+		CreatedBy: silence.CreatedBy,
+		CreatedAt: silence.CreatedAt,
+		// The timestamps share a layout, they compare as strings
+		Active: silence.StartsAt <= now && now < silence.EndsAt,
+	}
+}
+
+// Function to manage the silences of the alerts of a tenant, silenced alerts are recorded but not notified
+// GET /api/v1/alerts/silences?tenantID=1234 lists the silences, &active=true the ones under way, &id=3 returns one
+// POST /api/v1/alerts/silences with a SilenceRequest body creates a silence of the alerts of silence.ruleID, every
+// rule when 0, on silence.devices with silence.labels
+// PUT /api/v1/alerts/silences with a SilenceRequest body replaces the silence with the ID of the body
+// DELETE /api/v1/alerts/silences?tenantID=1234&id=3 deletes a silence, its alerts are notified again
+func ManageSilences(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+	var silenceID int64
+	now := time.Now().UTC()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		tenantID = r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+		if id := r.URL.Query().Get("id"); id != "" {
+			var err error
+			if silenceID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == http.MethodDelete && silenceID == 0 {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost, http.MethodPut:
+		var silenceRequest SilenceRequest
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, &silenceRequest); err != nil {
+			http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+			return
+		}
+
+		tenantID = silenceRequest.TenantID
+		if tenantID == "" {
+			http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut && silenceRequest.Silence.ID == 0 {
+			http.Error(w, "silence.id is required", http.StatusBadRequest)
+			return
+		}
+
+		silence, err := silenceFromPayload(silenceRequest.Silence, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if silence.RuleID != 0 {
+			rule, err := models.GetAlertRule(db, tenantID, silence.RuleID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying alert rule: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if rule == nil {
+				http.Error(w, fmt.Sprintf("Unknown alert rule %d", silence.RuleID), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if r.Method == http.MethodPost {
+			if silenceID, err = models.CreateSilence(db, tenantID, silence, now.Format(helpers.TimestampLayout)); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving silence: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			found, err := models.UpdateSilence(db, tenantID, silence)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving silence: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Silence not found", http.StatusNotFound)
+				return
+			}
+			silenceID = silence.ID
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		found, err := models.DeleteSilence(db, tenantID, silenceID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting silence: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Silence not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	nowString := now.Format(helpers.TimestampLayout)
+
+	if silenceID != 0 {
+		silence, err := models.GetSilence(db, tenantID, silenceID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying silence: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if silence == nil {
+			http.Error(w, "Silence not found", http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, silencePayload(*silence, nowString))
+		return
+	}
+
+	activeAt := ""
+	if r.URL.Query().Get("active") == "true" {
+		activeAt = nowString
+	}
+	silences, err := models.GetSilences(db, tenantID, activeAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying silences: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]SilencePayload, 0, len(silences))
+	for _, silence := range silences {
+		payloads = append(payloads, silencePayload(silence, nowString))
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// maintenanceWindowFromPayload validates a maintenance window sent by a client
+func maintenanceWindowFromPayload(payload MaintenanceWindowPayload) (models.MaintenanceWindow, error) {
+	window := models.MaintenanceWindow{
+		ID:              payload.ID,
+		Name:            payload.Name,
+		Devices:         payload.Devices,
+		Schedule:        payload.Schedule,
+		Timezone:        payload.Timezone,
+		SuppressOffline: payload.SuppressOffline,
+		Enabled:         payload.Enabled == nil || *payload.Enabled,
+	}
+	if window.Timezone == "" {
+		window.Timezone = "UTC"
+	}
+
+	var err error
+	if window.Duration, err = helpers.ParseStep(payload.Duration); err != nil {
+		return window, fmt.Errorf("invalid duration: %v", err)
+	}
+
+	return window, jobs.ValidateMaintenanceWindow(window)
+}
+
+func maintenanceWindowPayload(window models.MaintenanceWindow, now time.Time) MaintenanceWindowPayload {
+	payload := MaintenanceWindowPayload{
+		ID:              window.ID,
+		Name:            window.Name,
+		Devices:         window.Devices,
+		Schedule:        window.Schedule,
+		Duration:        window.Duration.String(),
+		Timezone:        window.Timezone,
+		SuppressOffline: window.SuppressOffline,
+		Enabled:         &window.Enabled,
+		CreatedAt:       window.CreatedAt,
+		UpdatedAt:       window.UpdatedAt,
+	}
+
+	start, active, next, err := jobs.MaintenanceStart(window, now)
+	if err != nil {
+		return payload
+	}
+	payload.Active = active && window.Enabled
+	if payload.Active {
+		payload.CurrentStart = start.UTC().Format(helpers.TimestampLayout)
+	}
+	if !next.IsZero() {
+		payload.NextStart = next.UTC().Format(helpers.TimestampLayout)
+	}
+
+	return payload
+}
+
+// Function to manage the recurring maintenance windows of a tenant, the alerts of their devices are recorded but
+// not notified while a window is under way
+// GET /api/v1/alerts/maintenance?tenantID=1234 lists the windows with whether they are active and their next start,
+// &id=2 returns one
+// POST /api/v1/alerts/maintenance with a MaintenanceWindowRequest body creates a window, such as every Sunday at
+// 02:00 for 2h: {"name": "Patching", "devices": ["web-1", "web-2"], "schedule": "0 2 * * SUN", "duration": "2h",
+// "timezone": "Europe/Paris", "suppressOffline": true}. suppressOffline also mutes the absent rules, that detect
+// the devices that stopped sending data.
+// PUT /api/v1/alerts/maintenance with a MaintenanceWindowRequest body replaces the window with the ID of the body
+// DELETE /api/v1/alerts/maintenance?tenantID=1234&id=2 deletes a window
+func ManageMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+	var windowID int64
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		tenantID = r.URL.Query().Get("tenantID")
+		if tenantID == "" {
+			http.Error(w, "Invalid tenantID", http.StatusBadRequest)
+			return
+		}
+
+		if id := r.URL.Query().Get("id"); id != "" {
+			var err error
+			if windowID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == http.MethodDelete && windowID == 0 {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost, http.MethodPut:
+		var windowRequest MaintenanceWindowRequest
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, &windowRequest); err != nil {
+			http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+			return
+		}
+
+		tenantID = windowRequest.TenantID
+		if tenantID == "" {
+			http.Error(w, "Tenant ID is required", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut && windowRequest.Window.ID == 0 {
+			http.Error(w, "window.id is required", http.StatusBadRequest)
+			return
+		}
+
+		window, err := maintenanceWindowFromPayload(windowRequest.Window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+			http.Error(w, fmt.Sprintf("Error creating PerformanceDB: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC().Format(helpers.TimestampLayout)
+		if r.Method == http.MethodPost {
+			if windowID, err = models.CreateMaintenanceWindow(db, tenantID, window, now); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving maintenance window: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			found, err := models.UpdateMaintenanceWindow(db, tenantID, window, now)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving maintenance window: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Maintenance window not found", http.StatusNotFound)
+				return
+			}
+			windowID = window.ID
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		found, err := models.DeleteMaintenanceWindow(db, tenantID, windowID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting maintenance window: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Maintenance window not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if windowID != 0 {
+		window, err := models.GetMaintenanceWindow(db, tenantID, windowID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying maintenance window: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if window == nil {
+			http.Error(w, "Maintenance window not found", http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, maintenanceWindowPayload(*window, now))
+		return
+	}
+
+	windows, err := models.GetMaintenanceWindows(db, tenantID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying maintenance windows: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]MaintenanceWindowPayload, 0, len(windows))
+	for _, window := range windows {
+		payloads = append(payloads, maintenanceWindowPayload(window, now))
+	}
+
+	writeJSON(w, http.StatusOK, payloads)
+}
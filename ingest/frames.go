@@ -0,0 +1,282 @@
+package ingest
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Host values a frame can report, those it doesn't are carried over from the last stored sample of the device
+const (
+	hostCPU         = "cpu"
+	hostCPUModes    = "cpu_modes"
+	hostRAM         = "ram"
+	hostTotalMemory = "total_memory"
+	hostLoad1       = "load1"
+	hostLoad5       = "load5"
+	hostLoad15      = "load15"
+)
+
+// CPU modes gopsutil doesn't count as busy, our agent reports the usage the same way
+var idleCPUModes = map[string]bool{"idle": true, "iowait": true, "wait": true}
+
+// A frame collects what was reported about a device at one time, it is stored as one sample
+type frame struct {
+	device    models.DeviceData
+	timestamp int64
+	host      models.PerformanceData
+	reported  map[string]bool
+
+	processes     map[string]*models.ProcessData
+	processOrder  []string
+	disks         map[string]*models.DiskData
+	diskOrder     []string
+	interfaces    map[string]*models.NetworkData
+	interfaceList []string
+
+	// Time spent per second in every CPU mode, by CPU, turned into percentages when the frame is stored
+	cpuTime map[string]map[string]float64
+	// CPU seconds per second of every process
+	processCPUTime map[string]float64
+	// Memory available, the used memory is the rest of the total
+	memoryAvailable    int64
+	hasMemoryAvailable bool
+}
+
+func (f *frame) report(field string) {
+	f.reported[field] = true
+}
+
+// process returns the process reported under key, adding it when it is new
+func (f *frame) process(key string, pid int, name string) *models.ProcessData {
+	process, ok := f.processes[key]
+	if !ok {
+		process = &models.ProcessData{PID: pid, Name: name, Command: name}
+		f.processes[key] = process
+		f.processOrder = append(f.processOrder, key)
+	}
+	return process
+}
+
+// disk returns the file system mounted at mountPoint, adding it when it is new
+func (f *frame) disk(mountPoint string) *models.DiskData {
+	disk, ok := f.disks[mountPoint]
+	if !ok {
+		disk = &models.DiskData{MountPoint: mountPoint}
+		f.disks[mountPoint] = disk
+		f.diskOrder = append(f.diskOrder, mountPoint)
+	}
+	return disk
+}
+
+// networkInterface returns the interface named name, adding it when it is new
+func (f *frame) networkInterface(name string) *models.NetworkData {
+	iface, ok := f.interfaces[name]
+	if !ok {
+		iface = &models.NetworkData{Interface: name}
+		f.interfaces[name] = iface
+		f.interfaceList = append(f.interfaceList, name)
+	}
+	return iface
+}
+
+// setMemoryAvailable reports the memory available, used memory is derived from it once the total is known
+func (f *frame) setMemoryAvailable(available int64) {
+	f.memoryAvailable = available
+	f.hasMemoryAvailable = true
+}
+
+// addCPUTime adds the seconds per second a CPU spent in a mode
+func (f *frame) addCPUTime(cpu string, mode string, perSecond float64) {
+	if f.cpuTime[cpu] == nil {
+		f.cpuTime[cpu] = make(map[string]float64)
+	}
+	f.cpuTime[cpu][mode] += perSecond
+}
+
+// addProcessCPUTime adds CPU seconds per second to a process
+func (f *frame) addProcessCPUTime(key string, pid int, name string, perSecond float64) {
+	f.process(key, pid, name)
+	f.processCPUTime[key] += perSecond
+}
+
+// empty tells if nothing was reported that a sample could hold
+func (f *frame) empty() bool {
+	return len(f.reported) == 0 && !f.hasMemoryAvailable && len(f.processes) == 0 && len(f.disks) == 0 && len(f.interfaces) == 0 && len(f.cpuTime) == 0
+}
+
+// performance completes the frame into the sample to store
+func (f *frame) performance(last models.PerformanceData, hasLast bool) models.PerformanceData {
+	perf := f.host
+	perf.DeviceID = f.device.DeviceID
+	perf.Timestamp = time.UnixMilli(f.timestamp).UTC().Format(helpers.TimestampLayout)
+
+	// CPU usage from the time spent per mode, over all CPUs and per core
+	if len(f.cpuTime) > 0 {
+		var busy, total float64
+		modes := make(map[string]float64)
+
+		cpus := make([]string, 0, len(f.cpuTime))
+		for cpu := range f.cpuTime {
+			cpus = append(cpus, cpu)
+		}
+		sort.Slice(cpus, func(i, j int) bool {
+			a, errA := strconv.Atoi(cpus[i])
+			b, errB := strconv.Atoi(cpus[j])
+			if errA == nil && errB == nil {
+				return a < b
+			}
+			return cpus[i] < cpus[j]
+		})
+
+		for _, cpu := range cpus {
+			var coreBusy, coreTotal float64
+			for mode, perSecond := range f.cpuTime[cpu] {
+				coreTotal += perSecond
+				if !idleCPUModes[mode] {
+					coreBusy += perSecond
+				}
+				modes[mode] += perSecond
+			}
+
+			if coreTotal > 0 {
+				perf.CoreUsage = append(perf.CoreUsage, 100*coreBusy/coreTotal)
+			}
+			busy += coreBusy
+			total += coreTotal
+		}
+
+		if total > 0 {
+			perf.CPUUsage = 100 * busy / total
+			perf.CPUUser = 100 * modes["user"] / total
+			perf.CPUSystem = 100 * modes["system"] / total
+			perf.CPUIowait = 100 * (modes["iowait"] + modes["wait"]) / total
+			perf.CPUSteal = 100 * modes["steal"] / total
+			f.report(hostCPU)
+			f.report(hostCPUModes)
+		}
+	}
+
+	if f.hasMemoryAvailable {
+		total := perf.TotalMemory
+		if !f.reported[hostTotalMemory] && hasLast {
+			total = last.TotalMemory
+		}
+		if total > 0 {
+			perf.RAMUsage = total - f.memoryAvailable
+			f.report(hostRAM)
+		}
+	}
+
+	if f.reported[hostRAM] && f.reported[hostTotalMemory] && perf.TotalMemory > 0 {
+		perf.UsedMemoryP = 100 * float64(perf.RAMUsage) / float64(perf.TotalMemory)
+	}
+
+	if hasLast {
+		if !f.reported[hostCPU] {
+			perf.CPUUsage = last.CPUUsage
+		}
+		if !f.reported[hostCPUModes] {
+			perf.CPUUser, perf.CPUSystem, perf.CPUIowait, perf.CPUSteal = last.CPUUser, last.CPUSystem, last.CPUIowait, last.CPUSteal
+		}
+		if !f.reported[hostRAM] {
+			perf.RAMUsage, perf.UsedMemoryP = last.RAMUsage, last.UsedMemoryP
+		}
+		if !f.reported[hostTotalMemory] {
+			perf.TotalMemory = last.TotalMemory
+		}
+		if !f.reported[hostLoad1] {
+			perf.LoadAvg1 = last.LoadAvg1
+		}
+		if !f.reported[hostLoad5] {
+			perf.LoadAvg5 = last.LoadAvg5
+		}
+		if !f.reported[hostLoad15] {
+			perf.LoadAvg15 = last.LoadAvg15
+		}
+		if len(f.disks) == 0 {
+			perf.DiskUsage = last.DiskUsage
+		}
+	}
+
+	for _, key := range f.processOrder {
+		process := *f.processes[key]
+		if perSecond, ok := f.processCPUTime[key]; ok {
+			process.CPUUsage = 100 * perSecond
+		}
+		perf.Processes = append(perf.Processes, process)
+	}
+	for _, mountPoint := range f.diskOrder {
+		perf.Disks = append(perf.Disks, *f.disks[mountPoint])
+	}
+	for _, name := range f.interfaceList {
+		perf.Interfaces = append(perf.Interfaces, *f.interfaces[name])
+	}
+
+	return perf
+}
+
+// frames gathers the frames of a batch by device and time
+type frames struct {
+	tenantID string
+	byKey    map[string]*frame
+}
+
+func newFrames(tenantID string) *frames {
+	return &frames{tenantID: tenantID, byKey: make(map[string]*frame)}
+}
+
+// get returns the frame of a device at a time, adding it when it is new. Samples are stored to the second, so
+// what is reported within the same second shares a frame.
+func (fs *frames) get(device models.DeviceData, timestamp int64) *frame {
+	timestamp -= timestamp % 1000
+	key := device.DeviceID + "/" + strconv.FormatInt(timestamp, 10)
+	f, ok := fs.byKey[key]
+	if !ok {
+		f = &frame{
+			device:         device,
+			timestamp:      timestamp,
+			reported:       make(map[string]bool),
+			processes:      make(map[string]*models.ProcessData),
+			disks:          make(map[string]*models.DiskData),
+			interfaces:     make(map[string]*models.NetworkData),
+			cpuTime:        make(map[string]map[string]float64),
+			processCPUTime: make(map[string]float64),
+		}
+		fs.byKey[key] = f
+	}
+	return f
+}
+
+// state returns what was last seen of the device of a frame
+func (fs *frames) state(f *frame) *deviceState {
+	return stateOf(fs.tenantID, f.device.DeviceID)
+}
+
+// store stores the frames in time order and returns how many were stored
+func (fs *frames) store(db *sql.DB) (int, error) {
+	list := make([]*frame, 0, len(fs.byKey))
+	for _, f := range fs.byKey {
+		if !f.empty() {
+			list = append(list, f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].timestamp != list[j].timestamp {
+			return list[i].timestamp < list[j].timestamp
+		}
+		return list[i].device.DeviceID < list[j].device.DeviceID
+	})
+
+	for i, f := range list {
+		last, hasLast := fs.state(f).lastHost()
+		if err := Store(db, fs.tenantID, f.device, f.performance(last, hasLast)); err != nil {
+			return i, err
+		}
+	}
+
+	return len(list), nil
+}
@@ -0,0 +1,449 @@
+package ingest
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// InfluxPoint is a point of the Influx line protocol. Numeric and boolean fields are kept as values, string
+// fields apart.
+type InfluxPoint struct {
+	Measurement  string
+	Tags         map[string]string
+	Fields       map[string]float64
+	StringFields map[string]string
+	// Milliseconds since the epoch
+	Timestamp int64
+}
+
+// Nanoseconds per unit of the precisions of the v1 and v2 write APIs
+var influxPrecisions = map[string]int64{
+	"": 1, "n": 1, "ns": 1, "u": 1e3, "us": 1e3, "ms": 1e6, "s": 1e9, "m": 60e9, "h": 3600e9,
+}
+
+// InfluxPrecision returns the nanoseconds per unit of a write precision
+func InfluxPrecision(precision string) (int64, error) {
+	unit, ok := influxPrecisions[precision]
+	if !ok {
+		return 0, fmt.Errorf("invalid precision %q, expected ns, us, ms, s, m or h", precision)
+	}
+	return unit, nil
+}
+
+// ParseLineProtocol reads the points of a line protocol body. Points without a timestamp are at now, in
+// milliseconds. Lines that can't be parsed are skipped and returned as errors, so the others can still be stored.
+func ParseLineProtocol(body []byte, unit int64, now int64) ([]InfluxPoint, []error) {
+	var points []InfluxPoint
+	var errs []error
+
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		point, err := parseLine(line, unit, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", i+1, err))
+			continue
+		}
+		points = append(points, point)
+	}
+
+	return points, errs
+}
+
+// parseLine reads one line: the measurement and tags, the fields and an optional timestamp, separated by spaces
+func parseLine(line string, unit int64, now int64) (InfluxPoint, error) {
+	point := InfluxPoint{
+		Tags:         make(map[string]string),
+		Fields:       make(map[string]float64),
+		StringFields: make(map[string]string),
+		Timestamp:    now,
+	}
+
+	keyEnd := indexUnescaped(line, ' ', false)
+	if keyEnd < 0 {
+		return point, fmt.Errorf("missing fields")
+	}
+	rest := strings.TrimLeft(line[keyEnd:], " ")
+	fieldsEnd := indexUnescaped(rest, ' ', true)
+	if fieldsEnd < 0 {
+		fieldsEnd = len(rest)
+	}
+
+	key := splitUnescaped(line[:keyEnd], ',', false)
+	point.Measurement = unescapeInflux(key[0])
+	if point.Measurement == "" {
+		return point, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range key[1:] {
+		name, value, err := splitPair(tag, false)
+		if err != nil {
+			return point, fmt.Errorf("invalid tag %q: %v", tag, err)
+		}
+		point.Tags[name] = value
+	}
+
+	for _, field := range splitUnescaped(rest[:fieldsEnd], ',', true) {
+		name, value, err := splitPair(field, true)
+		if err != nil {
+			return point, fmt.Errorf("invalid field %q: %v", field, err)
+		}
+		if err := point.setField(name, value); err != nil {
+			return point, fmt.Errorf("invalid field %q: %v", field, err)
+		}
+	}
+	if len(point.Fields) == 0 && len(point.StringFields) == 0 {
+		return point, fmt.Errorf("missing fields")
+	}
+
+	if timestamp := strings.TrimSpace(rest[fieldsEnd:]); timestamp != "" {
+		value, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+		point.Timestamp = value * unit / 1e6
+	}
+
+	return point, nil
+}
+
+// setField sets a field from its line protocol value: a float, an integer ending with i or u, a boolean or a
+// quoted string
+func (point *InfluxPoint) setField(name string, value string) error {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return fmt.Errorf("unterminated string")
+		}
+		point.StringFields[name] = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+
+	case strings.HasSuffix(value, "i"):
+		i, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+		if err != nil {
+			return err
+		}
+		point.Fields[name] = float64(i)
+
+	case strings.HasSuffix(value, "u"):
+		u, err := strconv.ParseUint(strings.TrimSuffix(value, "u"), 10, 64)
+		if err != nil {
+			return err
+		}
+		point.Fields[name] = float64(u)
+
+	default:
+		switch value {
+		case "t", "T", "true", "True", "TRUE":
+			point.Fields[name] = 1
+		case "f", "F", "false", "False", "FALSE":
+			point.Fields[name] = 0
+		default:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			point.Fields[name] = f
+		}
+	}
+
+	return nil
+}
+
+// indexUnescaped returns the index of the first sep not escaped by a backslash, nor within double quotes when
+// quoted is set
+func indexUnescaped(s string, sep byte, quoted bool) int {
+	inString := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inString = !inString
+		case s[i] == sep && !inString:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnescaped splits s around every sep not escaped, nor within double quotes when quoted is set
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, sep, quoted)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// splitPair splits a tag or field into its unescaped name and value, field values are left as written
+func splitPair(pair string, field bool) (string, string, error) {
+	i := indexUnescaped(pair, '=', false)
+	if i <= 0 || i == len(pair)-1 {
+		return "", "", fmt.Errorf("expected name=value")
+	}
+
+	value := pair[i+1:]
+	if !field {
+		value = unescapeInflux(value)
+	}
+	return unescapeInflux(pair[:i]), value, nil
+}
+
+// unescapeInflux removes the backslashes escaping commas, equal signs, spaces and backslashes
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\\`, `\`).Replace(s)
+}
+
+// influxDevice returns the device a point is about, from the device_id tag or else the host tag Telegraf sets
+func influxDevice(tags map[string]string) models.DeviceData {
+	device := models.DeviceData{DeviceID: tags["device_id"], Hostname: tags["host"]}
+	if device.DeviceID == "" {
+		device.DeviceID = device.Hostname
+	}
+	if device.Hostname == "" {
+		device.Hostname = device.DeviceID
+	}
+	return device
+}
+
+// InfluxWriteStats says what a line protocol write was stored as
+type InfluxWriteStats struct {
+	Points         int
+	Frames         int
+	GenericSamples int
+}
+
+// InfluxWrite stores line protocol points. Telegraf's cpu, mem, system, disk, net and procstat fields become
+// host, disk, network and process samples of the device of their host, the other fields are stored as generic
+// series named <measurement>_<field>.
+func InfluxWrite(db *sql.DB, tenantID string, points []InfluxPoint) (InfluxWriteStats, error) {
+	stats := InfluxWriteStats{Points: len(points)}
+
+	fs := newFrames(tenantID)
+	var generic []models.GenericSample
+	for _, point := range points {
+		device := influxDevice(point.Tags)
+
+		for field, value := range point.Fields {
+			if device.DeviceID != "" && mapInfluxField(fs, device, point, field, value) {
+				continue
+			}
+
+			generic = append(generic, models.GenericSample{
+				Name:      point.Measurement + "_" + field,
+				DeviceID:  device.DeviceID,
+				Labels:    point.Tags,
+				Timestamp: point.Timestamp,
+				Value:     value,
+			})
+		}
+	}
+
+	stored, err := fs.store(db)
+	stats.Frames = stored
+	if err != nil {
+		return stats, err
+	}
+
+	if err := StoreGeneric(db, tenantID, generic); err != nil {
+		return stats, err
+	}
+	stats.GenericSamples = len(generic)
+
+	return stats, nil
+}
+
+// mapInfluxField puts a field of a Telegraf input into the frame of its device, it returns false for the
+// fields it doesn't know
+func mapInfluxField(fs *frames, device models.DeviceData, point InfluxPoint, field string, value float64) bool {
+	f := fs.get(device, point.Timestamp)
+	tags := point.Tags
+
+	switch point.Measurement {
+	case "cpu":
+		// Usage percentages of the interval, for cpu-total and every core
+		if !strings.HasPrefix(field, "usage_") {
+			return false
+		}
+		mode := strings.TrimPrefix(field, "usage_")
+		if mode == "guest" || mode == "guest_nice" {
+			// Already counted in user and nice
+			return true
+		}
+
+		if tags["cpu"] != "cpu-total" {
+			f.addCPUTime(strings.TrimPrefix(tags["cpu"], "cpu"), mode, value/100)
+			return true
+		}
+
+		switch mode {
+		case "idle":
+			// Usage is the rest of the idle and iowait time, like our agent
+			f.host.CPUUsage += 100 - value
+			f.report(hostCPU)
+		case "iowait":
+			f.host.CPUUsage -= value
+			f.host.CPUIowait = value
+			f.report(hostCPUModes)
+		case "user":
+			f.host.CPUUser = value
+			f.report(hostCPUModes)
+		case "system":
+			f.host.CPUSystem = value
+			f.report(hostCPUModes)
+		case "steal":
+			f.host.CPUSteal = value
+			f.report(hostCPUModes)
+		}
+
+	case "mem":
+		switch field {
+		case "total":
+			f.host.TotalMemory = int64(value)
+			f.report(hostTotalMemory)
+		case "used":
+			f.host.RAMUsage = int64(value)
+			f.report(hostRAM)
+		default:
+			return false
+		}
+
+	case "system":
+		switch field {
+		case "load1":
+			f.host.LoadAvg1 = value
+			f.report(hostLoad1)
+		case "load5":
+			f.host.LoadAvg5 = value
+			f.report(hostLoad5)
+		case "load15":
+			f.host.LoadAvg15 = value
+			f.report(hostLoad15)
+		default:
+			return false
+		}
+
+	case "disk":
+		if ignoredFSTypes[tags["fstype"]] || tags["path"] == "" {
+			return true
+		}
+
+		// Only known fields add the file system, the interface or the process to the frame
+		var set func(disk *models.DiskData)
+		switch field {
+		case "total":
+			set = func(disk *models.DiskData) { disk.TotalBytes = int64(value) }
+		case "used":
+			set = func(disk *models.DiskData) { disk.UsedBytes = int64(value) }
+		case "inodes_total":
+			set = func(disk *models.DiskData) { disk.InodesTotal = int64(value) }
+		case "inodes_used":
+			set = func(disk *models.DiskData) { disk.InodesUsed = int64(value) }
+		default:
+			return false
+		}
+
+		disk := f.disk(tags["path"])
+		disk.FileSystem, disk.FSType = tags["device"], tags["fstype"]
+		set(disk)
+
+	case "net":
+		// The interface named all only carries the protocol counters
+		if tags["interface"] == "" || tags["interface"] == "all" {
+			return false
+		}
+
+		counter := uint64(value)
+		var set func(iface *models.NetworkData)
+		switch field {
+		case "bytes_recv":
+			set = func(iface *models.NetworkData) { iface.RxBytes = counter }
+		case "bytes_sent":
+			set = func(iface *models.NetworkData) { iface.TxBytes = counter }
+		case "packets_recv":
+			set = func(iface *models.NetworkData) { iface.RxPackets = counter }
+		case "packets_sent":
+			set = func(iface *models.NetworkData) { iface.TxPackets = counter }
+		case "err_in":
+			set = func(iface *models.NetworkData) { iface.RxErrors = counter }
+		case "err_out":
+			set = func(iface *models.NetworkData) { iface.TxErrors = counter }
+		case "drop_in":
+			set = func(iface *models.NetworkData) { iface.RxDrops = counter }
+		case "drop_out":
+			set = func(iface *models.NetworkData) { iface.TxDrops = counter }
+		default:
+			return false
+		}
+
+		set(f.networkInterface(tags["interface"]))
+
+	case "procstat":
+		var set func(process *models.ProcessData)
+		switch field {
+		case "pid":
+			// Only identifies the process of the other fields
+			return true
+		case "cpu_usage":
+			set = func(process *models.ProcessData) { process.CPUUsage = value }
+		case "memory_rss":
+			set = func(process *models.ProcessData) { process.RAMUsage = int64(value) }
+		case "num_threads":
+			threads := int(value)
+			set = func(process *models.ProcessData) { process.Threads = &threads }
+		case "num_fds":
+			fds := int(value)
+			set = func(process *models.ProcessData) { process.OpenFDs = &fds }
+		case "read_bytes":
+			bytes := int64(value)
+			set = func(process *models.ProcessData) { process.ReadBytes = &bytes }
+		case "write_bytes":
+			bytes := int64(value)
+			set = func(process *models.ProcessData) { process.WriteBytes = &bytes }
+		case "ppid":
+			parent := int(value)
+			set = func(process *models.ProcessData) { process.ParentPID = &parent }
+		default:
+			return false
+		}
+
+		// The pid is a field, or a tag with pid_tag set
+		pid := int(point.Fields["pid"])
+		if pid == 0 {
+			parsed, err := strconv.Atoi(tags["pid"])
+			if err != nil {
+				return false
+			}
+			pid = parsed
+		}
+		name := tags["process_name"]
+
+		process := f.process(strconv.Itoa(pid), pid, name)
+		if command := point.StringFields["cmdline"]; command != "" {
+			process.Command = command
+		} else if command := tags["cmdline"]; command != "" {
+			process.Command = command
+		}
+		if user := tags["user"]; user != "" {
+			process.User = &user
+		}
+		set(process)
+
+	default:
+		return false
+	}
+
+	return true
+}
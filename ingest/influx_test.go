@@ -0,0 +1,231 @@
+package ingest
+
+import (
+	"cloudVigilante/backend/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const influxNow = 1700000000000
+
+func TestParseLineProtocol(t *testing.T) {
+	tests := []struct {
+		line string
+		want InfluxPoint
+	}{
+		{
+			"cpu,host=web-1,cpu=cpu-total usage_idle=97.5,usage_user=1.25 1700000000000000000",
+			InfluxPoint{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "web-1", "cpu": "cpu-total"},
+				Fields:      map[string]float64{"usage_idle": 97.5, "usage_user": 1.25},
+				Timestamp:   1700000000000,
+			},
+		},
+		// Points without a timestamp are at now
+		{"mem used=42", InfluxPoint{Measurement: "mem", Fields: map[string]float64{"used": 42}, Timestamp: influxNow}},
+		// Integers, unsigned integers, booleans and strings
+		{
+			`system n_cpus=8i,delta=-3i,uptime=18446744073709551615u,up=t,down=FALSE,ok=True,load=1e-2,version="5.15"`,
+			InfluxPoint{
+				Measurement: "system",
+				Fields: map[string]float64{
+					"n_cpus": 8, "delta": -3, "uptime": 18446744073709551615, "up": 1, "down": 0, "ok": 1, "load": 0.01,
+				},
+				StringFields: map[string]string{"version": "5.15"},
+				Timestamp:    influxNow,
+			},
+		},
+		// Commas, equal signs and spaces escaped in measurements, tag keys and values and field keys
+		{
+			`disk\ io,path=C:\\Temp,tag\,key=a\=b\ c read\ bytes=1i`,
+			InfluxPoint{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": `C:\Temp`, "tag,key": "a=b c"},
+				Fields:      map[string]float64{"read bytes": 1},
+				Timestamp:   influxNow,
+			},
+		},
+		// Spaces, commas and equal signs within strings, and escaped quotes and backslashes
+		{
+			`log message="GET /a?b=c, \"200\" in 3 ms",path="C:\\Temp" 1700000000000000000`,
+			InfluxPoint{
+				Measurement:  "log",
+				StringFields: map[string]string{"message": `GET /a?b=c, "200" in 3 ms`, "path": `C:\Temp`},
+				Timestamp:    1700000000000,
+			},
+		},
+		// Extra spaces between the sections
+		{"mem  used=1   1700000000000000000", InfluxPoint{Measurement: "mem", Fields: map[string]float64{"used": 1}, Timestamp: 1700000000000}},
+	}
+
+	for _, test := range tests {
+		points, errs := ParseLineProtocol([]byte(test.line), 1, influxNow)
+		if len(errs) > 0 || len(points) != 1 {
+			t.Errorf("ParseLineProtocol(%q) = %+v, %v, want one point", test.line, points, errs)
+			continue
+		}
+
+		want := test.want
+		if want.Tags == nil {
+			want.Tags = map[string]string{}
+		}
+		if want.Fields == nil {
+			want.Fields = map[string]float64{}
+		}
+		if want.StringFields == nil {
+			want.StringFields = map[string]string{}
+		}
+		if !reflect.DeepEqual(points[0], want) {
+			t.Errorf("ParseLineProtocol(%q) = %+v, want %+v", test.line, points[0], want)
+		}
+	}
+}
+
+func TestParseLineProtocolPrecision(t *testing.T) {
+	tests := []struct {
+		precision string
+		timestamp string
+	}{
+		{"", "1700000000123456789"},
+		{"ns", "1700000000123456789"},
+		{"us", "1700000000123456"},
+		{"ms", "1700000000123"},
+		{"s", "1700000000"},
+		{"m", "28333333"},
+		{"h", "472222"},
+	}
+	want := map[string]int64{
+		"": 1700000000123, "ns": 1700000000123, "us": 1700000000123, "ms": 1700000000123,
+		"s": 1700000000000, "m": 1699999980000, "h": 1699999200000,
+	}
+
+	for _, test := range tests {
+		unit, err := InfluxPrecision(test.precision)
+		if err != nil {
+			t.Errorf("InfluxPrecision(%q): %v", test.precision, err)
+			continue
+		}
+
+		points, errs := ParseLineProtocol([]byte("m v=1 "+test.timestamp), unit, influxNow)
+		if len(errs) > 0 || len(points) != 1 {
+			t.Errorf("precision %q: got %+v, %v", test.precision, points, errs)
+			continue
+		}
+		if points[0].Timestamp != want[test.precision] {
+			t.Errorf("precision %q: timestamp %s is %d ms, want %d", test.precision, test.timestamp, points[0].Timestamp, want[test.precision])
+		}
+	}
+
+	if _, err := InfluxPrecision("d"); err == nil {
+		t.Error("InfluxPrecision(\"d\") didn't fail")
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	lines := []string{
+		"cpu",
+		"cpu ",
+		",host=a v=1",
+		"cpu,host v=1",
+		"cpu,host= v=1",
+		"cpu v",
+		"cpu v=",
+		"cpu =1",
+		"cpu v=abc",
+		"cpu v=1.5i",
+		"cpu v=-1u",
+		`cpu v="unterminated`,
+		"cpu v=1 yesterday",
+	}
+
+	for _, line := range lines {
+		if points, errs := ParseLineProtocol([]byte(line), 1, influxNow); len(points) != 0 || len(errs) != 1 {
+			t.Errorf("ParseLineProtocol(%q) = %+v, %v, want an error", line, points, errs)
+		}
+	}
+}
+
+func TestParseLineProtocolSkipsBadLines(t *testing.T) {
+	body := strings.Join([]string{
+		"# comment",
+		"cpu usage=1",
+		"",
+		"cpu usage=",
+		"  mem used=2  ",
+	}, "\n")
+
+	points, errs := ParseLineProtocol([]byte(body), 1, influxNow)
+	if len(points) != 2 || points[0].Measurement != "cpu" || points[1].Measurement != "mem" {
+		t.Errorf("got points %+v, want cpu and mem", points)
+	}
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "line 4:") {
+		t.Errorf("got errors %v, want one on line 4", errs)
+	}
+}
+
+func TestInfluxDevice(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want [2]string
+	}{
+		{map[string]string{"host": "web-1"}, [2]string{"web-1", "web-1"}},
+		{map[string]string{"device_id": "d-1"}, [2]string{"d-1", "d-1"}},
+		{map[string]string{"device_id": "d-1", "host": "web-1"}, [2]string{"d-1", "web-1"}},
+		{map[string]string{}, [2]string{"", ""}},
+	}
+
+	for _, test := range tests {
+		device := influxDevice(test.tags)
+		if got := [2]string{device.DeviceID, device.Hostname}; got != test.want {
+			t.Errorf("influxDevice(%v) = %v, want %v", test.tags, got, test.want)
+		}
+	}
+}
+
+func TestMapInfluxField(t *testing.T) {
+	mapPoint := func(line string) (*frame, []string) {
+		t.Helper()
+		points, errs := ParseLineProtocol([]byte(line), 1, influxNow)
+		if len(errs) > 0 || len(points) != 1 {
+			t.Fatalf("ParseLineProtocol(%q) = %v, %v", line, points, errs)
+		}
+		point := points[0]
+
+		fs := newFrames("t1")
+		device := influxDevice(point.Tags)
+		var unknown []string
+		for field, value := range point.Fields {
+			if !mapInfluxField(fs, device, point, field, value) {
+				unknown = append(unknown, field)
+			}
+		}
+		return fs.get(device, point.Timestamp), unknown
+	}
+
+	// Unknown fields alone add no file system, interface or process
+	for _, line := range []string{
+		"disk,host=web-1,path=/,fstype=ext4 free=1i",
+		"net,host=web-1,interface=eth0 speed=1000i",
+		`procstat,host=web-1,process_name=nginx,user=www cpu_time_user=3.5,pid=42i,cmdline="nginx: master"`,
+	} {
+		f, unknown := mapPoint(line)
+		if len(unknown) != 1 || !f.empty() {
+			t.Errorf("%q: unknown fields %v, frame %+v", line, unknown, f)
+		}
+	}
+
+	f, unknown := mapPoint("disk,host=web-1,path=/data,device=sda1,fstype=xfs total=100i,used=40i,free=60i")
+	want := models.DiskData{MountPoint: "/data", FileSystem: "sda1", FSType: "xfs", TotalBytes: 100, UsedBytes: 40}
+	if len(unknown) != 1 || len(f.disks) != 1 || !reflect.DeepEqual(*f.disks["/data"], want) {
+		t.Errorf("got disks %v and unknown fields %v", f.disks, unknown)
+	}
+
+	f, unknown = mapPoint(`procstat,host=web-1,process_name=nginx,user=www cpu_usage=12.5,pid=42i,cmdline="nginx: master",cpu_time_user=3.5`)
+	process := f.processes["42"]
+	if len(unknown) != 1 || len(f.processes) != 1 || process.PID != 42 || process.CPUUsage != 12.5 ||
+		process.Command != "nginx: master" || process.User == nil || *process.User != "www" {
+		t.Errorf("got process %+v and unknown fields %v", process, unknown)
+	}
+}
@@ -0,0 +1,509 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log events arrive as JSON lines over HTTP, or as RFC 5424 and RFC 3164 syslog messages over UDP and TCP
+
+// Longest log message kept, longer ones are truncated
+const maxLogMessage = 64 << 10
+
+// Severity aliases of the usual loggers, by lower case name
+var severityAliases = map[string]string{
+	"emerg": "emergency", "panic": "emergency", "fatal": "critical", "crit": "critical", "err": "error",
+	"warn": "warning", "information": "info", "informational": "info", "trace": "debug",
+}
+
+// NormalizeSeverity returns one of models.LogSeverities, empty for a severity it doesn't know
+func NormalizeSeverity(severity string) string {
+	severity = strings.ToLower(strings.TrimSpace(severity))
+	if alias, ok := severityAliases[severity]; ok {
+		return alias
+	}
+	for _, known := range models.LogSeverities {
+		if severity == known {
+			return severity
+		}
+	}
+	return ""
+}
+
+// Fields of a JSON log line, the first one present is used. The other fields are kept as attributes.
+var (
+	logTimeFields     = []string{"timestamp", "time", "ts", "@timestamp"}
+	logMessageFields  = []string{"message", "msg", "log"}
+	logSeverityFields = []string{"severity", "level", "lvl"}
+	logDeviceFields   = []string{"deviceID", "device_id", "host", "hostname"}
+	logPIDFields      = []string{"pid", "processPID"}
+	logProcessFields  = []string{"process", "processName", "process_name"}
+	logSourceFields   = []string{"source", "app", "logger", "service"}
+)
+
+// LogLine is a log event read from a JSON line or a syslog message, with the device it was logged on
+type LogLine struct {
+	Device models.DeviceData
+	Event  models.LogEvent
+}
+
+// ParseJSONLogs reads log events, one JSON object per line. Lines without a device are logged on
+// defaultDevice, lines without a time at nowMs. Lines that can't be read are returned as errors, so the others
+// can still be stored.
+func ParseJSONLogs(body []byte, defaultDevice string, nowMs int64) ([]LogLine, []error) {
+	var lines []LogLine
+	var errs []error
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for n := 1; scanner.Scan(); n++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		line, err := parseJSONLog(text, defaultDevice, nowMs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", n, err))
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, errs
+}
+
+func parseJSONLog(text []byte, defaultDevice string, nowMs int64) (LogLine, error) {
+	var line LogLine
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return line, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	// take removes the first of the fields present and returns its value
+	take := func(names []string) (interface{}, bool) {
+		for _, name := range names {
+			if value, ok := fields[name]; ok && value != nil {
+				delete(fields, name)
+				return value, true
+			}
+		}
+		return nil, false
+	}
+
+	message, ok := take(logMessageFields)
+	if !ok {
+		return line, fmt.Errorf("missing message")
+	}
+	line.Event.Message = truncateLog(logString(message))
+
+	line.Event.Timestamp = nowMs
+	if value, ok := take(logTimeFields); ok {
+		timestamp, err := logTimestamp(value)
+		if err != nil {
+			return line, err
+		}
+		line.Event.Timestamp = timestamp
+	}
+
+	deviceID := defaultDevice
+	if value, ok := take(logDeviceFields); ok {
+		deviceID = logString(value)
+	}
+	if deviceID == "" {
+		return line, fmt.Errorf("missing device")
+	}
+	line.Device = models.DeviceData{DeviceID: deviceID, Hostname: deviceID}
+	line.Event.DeviceID = deviceID
+
+	if value, ok := take(logSeverityFields); ok {
+		line.Event.Severity = NormalizeSeverity(logString(value))
+	}
+	if value, ok := take(logPIDFields); ok {
+		pid, err := strconv.Atoi(logString(value))
+		if err != nil {
+			return line, fmt.Errorf("invalid pid %v", value)
+		}
+		line.Event.ProcessPID = &pid
+	}
+	if value, ok := take(logProcessFields); ok {
+		line.Event.ProcessName = logString(value)
+	}
+	if value, ok := take(logSourceFields); ok {
+		line.Event.Source = logString(value)
+	}
+
+	if len(fields) > 0 {
+		line.Event.Attributes = make(map[string]string, len(fields))
+		for name, value := range fields {
+			line.Event.Attributes[name] = logString(value)
+		}
+	}
+
+	return line, nil
+}
+
+// logString returns a JSON value as text, objects and arrays as JSON
+func logString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// logTimestamp reads the time of a log line, a timestamp or a number of seconds, milliseconds or nanoseconds
+// since the epoch told apart by their size
+func logTimestamp(value interface{}) (int64, error) {
+	if number, ok := value.(json.Number); ok {
+		f, err := number.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %v", value)
+		}
+		switch {
+		case f > 1e17:
+			return int64(f / 1e6), nil
+		case f > 1e11:
+			return int64(f), nil
+		}
+		return int64(f * 1e3), nil
+	}
+
+	t, err := helpers.ParseTimestamp(logString(value))
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func truncateLog(message string) string {
+	if len(message) <= maxLogMessage {
+		return message
+	}
+	return strings.ToValidUTF8(message[:maxLogMessage], "")
+}
+
+// Structured data parameters giving the tenant and the device of a syslog message, the device defaults to the
+// hostname of the message
+const (
+	SyslogTenantParam   = "tenant"
+	syslogDeviceIDParam = "device_id"
+)
+
+// SyslogMessage is an RFC 5424 or RFC 3164 message, "-" fields and the fields RFC 3164 lacks are empty
+type SyslogMessage struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// Parameters by SD-ID, then name
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+// ParseSyslog reads an RFC 5424 message: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG],
+// or an RFC 3164 one: <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
+func ParseSyslog(packet []byte) (SyslogMessage, error) {
+	var message SyslogMessage
+	text := strings.TrimRight(string(packet), "\r\n\x00")
+
+	if !strings.HasPrefix(text, "<") {
+		return message, fmt.Errorf("missing priority")
+	}
+	end := strings.Index(text, ">")
+	if end < 2 || end > 4 {
+		return message, fmt.Errorf("invalid priority")
+	}
+	priority, err := strconv.Atoi(text[1:end])
+	if err != nil || priority < 0 || priority > 191 {
+		return message, fmt.Errorf("invalid priority %q", text[1:end])
+	}
+	message.Facility, message.Severity = priority/8, priority%8
+	text = text[end+1:]
+
+	// RFC 5424 messages have a version after the priority, RFC 3164 ones a timestamp
+	if !strings.HasPrefix(text, "1 ") {
+		return message, parseRFC3164(&message, text, time.Now().UTC())
+	}
+
+	// The header fields are separated by single spaces
+	header := make([]string, 6)
+	for i := range header {
+		space := strings.IndexByte(text, ' ')
+		if space < 0 {
+			return message, fmt.Errorf("truncated header")
+		}
+		header[i], text = text[:space], text[space+1:]
+	}
+
+	if header[1] != "-" {
+		if message.Timestamp, err = time.Parse(time.RFC3339Nano, header[1]); err != nil {
+			return message, fmt.Errorf("invalid timestamp %q", header[1])
+		}
+	}
+	nilValue := func(value string) string {
+		if value == "-" {
+			return ""
+		}
+		return value
+	}
+	message.Hostname = nilValue(header[2])
+	message.AppName = nilValue(header[3])
+	message.ProcID = nilValue(header[4])
+	message.MsgID = nilValue(header[5])
+
+	message.StructuredData, text, err = parseStructuredData(text)
+	if err != nil {
+		return message, err
+	}
+
+	text = strings.TrimPrefix(text, " ")
+	message.Message = truncateLog(strings.TrimPrefix(text, "\ufeff"))
+	return message, nil
+}
+
+// parseRFC3164 reads an RFC 3164 message after its priority. Its timestamp has neither year nor zone, it is
+// taken as UTC in the year of now, or in the year before when that would put it over a day after now.
+func parseRFC3164(message *SyslogMessage, text string, now time.Time) error {
+	if len(text) <= len(time.Stamp) || text[len(time.Stamp)] != ' ' {
+		return fmt.Errorf("truncated header")
+	}
+	timestamp, err := time.Parse(time.Stamp, text[:len(time.Stamp)])
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", text[:len(time.Stamp)])
+	}
+	message.Timestamp = time.Date(now.Year(), timestamp.Month(), timestamp.Day(), timestamp.Hour(), timestamp.Minute(),
+		timestamp.Second(), 0, time.UTC)
+	if message.Timestamp.After(now.AddDate(0, 0, 1)) {
+		message.Timestamp = message.Timestamp.AddDate(-1, 0, 0)
+	}
+	text = text[len(time.Stamp)+1:]
+
+	space := strings.IndexByte(text, ' ')
+	if space <= 0 {
+		return fmt.Errorf("missing hostname")
+	}
+	message.Hostname, text = text[:space], text[space+1:]
+
+	// The tag is the app name, ended by a colon or the process ID in brackets. A first word ended by a space is
+	// already the message.
+	if end := strings.IndexAny(text, "[: "); end > 0 && text[end] != ' ' {
+		message.AppName, text = text[:end], text[end:]
+		if strings.HasPrefix(text, "[") {
+			if bracket := strings.IndexByte(text, ']'); bracket > 0 {
+				message.ProcID, text = text[1:bracket], text[bracket+1:]
+			}
+		}
+		text = strings.TrimPrefix(strings.TrimPrefix(text, ":"), " ")
+	}
+
+	message.Message = truncateLog(text)
+	return nil
+}
+
+// parseStructuredData reads the structured data at the start of text and returns what follows it
+func parseStructuredData(text string) (map[string]map[string]string, string, error) {
+	if strings.HasPrefix(text, "-") {
+		return nil, text[1:], nil
+	}
+
+	data := make(map[string]map[string]string)
+	for strings.HasPrefix(text, "[") {
+		text = text[1:]
+
+		// SD-ID, then name="value" parameters until the closing bracket
+		end := strings.IndexAny(text, " ]")
+		if end <= 0 {
+			return nil, "", fmt.Errorf("invalid structured data")
+		}
+		params := make(map[string]string)
+		data[text[:end]] = params
+		text = text[end:]
+
+		for strings.HasPrefix(text, " ") {
+			text = text[1:]
+			equals := strings.Index(text, "=\"")
+			if equals <= 0 {
+				return nil, "", fmt.Errorf("invalid structured data parameter")
+			}
+			name := text[:equals]
+			text = text[equals+2:]
+
+			// The value ends at the first unescaped quote, \" \\ and \] are escaped
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(text); i++ {
+				if text[i] == '\\' && i+1 < len(text) && strings.IndexByte(`"\]`, text[i+1]) >= 0 {
+					value.WriteByte(text[i+1])
+					i++
+					continue
+				}
+				if text[i] == '"' {
+					text = text[i+1:]
+					closed = true
+					break
+				}
+				value.WriteByte(text[i])
+			}
+			if !closed {
+				return nil, "", fmt.Errorf("unterminated structured data value")
+			}
+			params[name] = value.String()
+		}
+
+		if !strings.HasPrefix(text, "]") {
+			return nil, "", fmt.Errorf("unterminated structured data")
+		}
+		text = text[1:]
+	}
+
+	if len(data) == 0 {
+		return nil, "", fmt.Errorf("invalid structured data")
+	}
+	return data, text, nil
+}
+
+// SyslogLine returns the tenant and the log event of a syslog message. The tenant and the device can be given
+// by structured data parameters of any SD-ID, the tenant defaults to defaultTenant, which RFC 3164 messages
+// need, the device to the hostname and a missing time to nowMs. The app name is the process name and a numeric
+// process ID its PID.
+func SyslogLine(message SyslogMessage, defaultTenant string, nowMs int64) (string, LogLine, error) {
+	var line LogLine
+
+	var tenantID, deviceID string
+	attributes := map[string]string{"facility": strconv.Itoa(message.Facility)}
+	if message.MsgID != "" {
+		attributes["msgid"] = message.MsgID
+	}
+	for id, params := range message.StructuredData {
+		for name, value := range params {
+			switch name {
+			case SyslogTenantParam:
+				tenantID = value
+			case syslogDeviceIDParam:
+				deviceID = value
+			default:
+				attributes[id+"."+name] = value
+			}
+		}
+	}
+
+	if tenantID == "" {
+		tenantID = defaultTenant
+	}
+	if tenantID == "" {
+		return "", line, fmt.Errorf("message without a %s parameter", SyslogTenantParam)
+	}
+	if deviceID == "" {
+		deviceID = message.Hostname
+	}
+	if deviceID == "" {
+		return "", line, fmt.Errorf("message without a hostname")
+	}
+
+	line.Device = models.DeviceData{DeviceID: deviceID, Hostname: message.Hostname}
+	if line.Device.Hostname == "" {
+		line.Device.Hostname = deviceID
+	}
+
+	line.Event = models.LogEvent{
+		DeviceID:    deviceID,
+		Timestamp:   nowMs,
+		Severity:    models.LogSeverities[message.Severity],
+		Source:      message.AppName,
+		ProcessName: message.AppName,
+		Message:     message.Message,
+		Attributes:  attributes,
+	}
+	if !message.Timestamp.IsZero() {
+		line.Event.Timestamp = message.Timestamp.UnixMilli()
+	}
+	if pid, err := strconv.Atoi(message.ProcID); err == nil {
+		line.Event.ProcessPID = &pid
+	}
+
+	return tenantID, line, nil
+}
+
+// SplitSyslog splits a syslog TCP stream into messages, framed by octet counting ("LEN MSG") or ended by a
+// newline, as RFC 6587 describes
+func SplitSyslog(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > 0 && data[0] >= '1' && data[0] <= '9' {
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 {
+			if atEOF {
+				return 0, nil, fmt.Errorf("truncated syslog frame")
+			}
+			return 0, nil, nil
+		}
+
+		length, err := strconv.Atoi(string(data[:space]))
+		if err != nil || length <= 0 {
+			return 0, nil, fmt.Errorf("invalid syslog frame length %q", data[:space])
+		}
+		if len(data) < space+1+length {
+			if atEOF {
+				return 0, nil, fmt.Errorf("truncated syslog frame")
+			}
+			return 0, nil, nil
+		}
+		return space + 1 + length, data[space+1 : space+1+length], nil
+	}
+
+	return bufio.ScanLines(data, atEOF)
+}
+
+// StoreLogs saves log events of a tenant on the devices they were logged on, see models.ResolveDevice
+func StoreLogs(db *sql.DB, tenantID string, lines []LogLine) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		return fmt.Errorf("error creating PerformanceDB: %v", err)
+	}
+
+	deviceIDs := make(map[string]string)
+	events := make([]models.LogEvent, 0, len(lines))
+	for _, line := range lines {
+		deviceID, ok := deviceIDs[line.Device.DeviceID]
+		if !ok {
+			var err error
+			if deviceID, err = models.ResolveDevice(db, tenantID, line.Device); err != nil {
+				return fmt.Errorf("error resolving device: %v", err)
+			}
+			deviceIDs[line.Device.DeviceID] = deviceID
+		}
+
+		line.Event.DeviceID = deviceID
+		events = append(events, line.Event)
+	}
+
+	if err := models.InsertLogEvents(db, tenantID, events); err != nil {
+		return fmt.Errorf("error inserting log events: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package ingest
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestParseSyslogRFC5424(t *testing.T) {
+	tests := []struct {
+		packet string
+		want   SyslogMessage
+	}{
+		// The example of RFC 5424 with a BOM, and a second SD element
+		{
+			"<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 " +
+				`[exampleSDID@32473 iut="3" eventSource="Application"][cv tenant="t1" device_id="d-1"] ` +
+				"\ufeffAn application event log entry...\n",
+			SyslogMessage{
+				Facility: 20, Severity: 5,
+				Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC),
+				Hostname:  "mymachine.example.com", AppName: "evntslog", ProcID: "1234", MsgID: "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "Application"},
+					"cv":                {"tenant": "t1", "device_id": "d-1"},
+				},
+				Message: "An application event log entry...",
+			},
+		},
+		// Nil values everywhere and no message
+		{"<0>1 - - - - - -", SyslogMessage{}},
+		// Escaped quotes, backslashes and brackets in parameter values, an SD element without parameters
+		{
+			`<14>1 2003-08-24T05:14:15.000003-07:00 host app - - [a x="say \"hi\" \\ \]"][b] done`,
+			SyslogMessage{
+				Facility: 1, Severity: 6,
+				Timestamp: time.Date(2003, 8, 24, 12, 14, 15, 3000, time.UTC),
+				Hostname:  "host", AppName: "app",
+				StructuredData: map[string]map[string]string{"a": {"x": `say "hi" \ ]`}, "b": {}},
+				Message:        "done",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		message, err := ParseSyslog([]byte(test.packet))
+		if err != nil {
+			t.Errorf("ParseSyslog(%q): %v", test.packet, err)
+			continue
+		}
+		if !message.Timestamp.Equal(test.want.Timestamp) {
+			t.Errorf("ParseSyslog(%q) has timestamp %v, want %v", test.packet, message.Timestamp, test.want.Timestamp)
+		}
+		message.Timestamp = test.want.Timestamp
+		if !reflect.DeepEqual(message, test.want) {
+			t.Errorf("ParseSyslog(%q) = %+v, want %+v", test.packet, message, test.want)
+		}
+	}
+}
+
+func TestParseSyslogRFC3164(t *testing.T) {
+	// The year of the timestamps is the one of now
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		text string
+		want SyslogMessage
+	}{
+		// The example of RFC 3164
+		{
+			"Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			SyslogMessage{
+				Timestamp: time.Date(2023, 10, 11, 22, 14, 15, 0, time.UTC),
+				Hostname:  "mymachine", AppName: "su", Message: "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		// Days before the 10th are padded with a space, the process ID follows the tag in brackets
+		{
+			"Feb  5 17:32:18 10.0.0.99 sshd[4123]: Accepted publickey for root",
+			SyslogMessage{
+				Timestamp: time.Date(2024, 2, 5, 17, 32, 18, 0, time.UTC),
+				Hostname:  "10.0.0.99", AppName: "sshd", ProcID: "4123", Message: "Accepted publickey for root",
+			},
+		},
+		// Messages without a tag
+		{
+			"Jun  1 11:59:00 host Use the BFG!",
+			SyslogMessage{Timestamp: time.Date(2024, 6, 1, 11, 59, 0, 0, time.UTC), Hostname: "host", Message: "Use the BFG!"},
+		},
+		// Up to a day ahead of now, for senders with a fast clock, then it's last year
+		{
+			"Jun  2 11:00:00 host cron[1]:",
+			SyslogMessage{Timestamp: time.Date(2024, 6, 2, 11, 0, 0, 0, time.UTC), Hostname: "host", AppName: "cron", ProcID: "1"},
+		},
+		{
+			"Jun  2 13:00:00 host cron[1]:",
+			SyslogMessage{Timestamp: time.Date(2023, 6, 2, 13, 0, 0, 0, time.UTC), Hostname: "host", AppName: "cron", ProcID: "1"},
+		},
+	}
+
+	for _, test := range tests {
+		var message SyslogMessage
+		if err := parseRFC3164(&message, test.text, now); err != nil {
+			t.Errorf("parseRFC3164(%q): %v", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(message, test.want) {
+			t.Errorf("parseRFC3164(%q) = %+v, want %+v", test.text, message, test.want)
+		}
+	}
+
+	// Through ParseSyslog, which reads the priority
+	message, err := ParseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su: failed\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Facility != 4 || message.Severity != 2 || message.Hostname != "mymachine" || message.AppName != "su" ||
+		message.Message != "failed" || message.Timestamp.Month() != time.October {
+		t.Errorf("ParseSyslog read %+v", message)
+	}
+}
+
+func TestParseSyslogErrors(t *testing.T) {
+	packets := []string{
+		"",
+		"no priority",
+		"<>1 - - - - - -",
+		"<192>1 - - - - - -",
+		"<1a>1 - - - - - -",
+		"<1234>1 - - - - - -",
+		"<34>1 - - - -",
+		"<34>1 yesterday host app - - -",
+		"<34>1 - host app - - x",
+		`<34>1 - host app - - [id x=y]`,
+		`<34>1 - host app - - [id x="y]`,
+		`<34>1 - host app - - [id x="y"`,
+		"<34>1 - host app - - []",
+		"<34>Oct 11 22:14:15",
+		"<34>Octo 1 22:14:15 host app: x",
+		"<34>Oct 11 22:14:15 ",
+		"<34>Oct 11 22:14:15 host",
+	}
+
+	for _, packet := range packets {
+		if message, err := ParseSyslog([]byte(packet)); err == nil {
+			t.Errorf("ParseSyslog(%q) = %+v, want an error", packet, message)
+		}
+	}
+}
+
+func TestSyslogLine(t *testing.T) {
+	message := SyslogMessage{
+		Facility: 4, Severity: 3,
+		Timestamp: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		Hostname:  "web-1", AppName: "nginx", ProcID: "42", MsgID: "ACCESS",
+		StructuredData: map[string]map[string]string{"cv": {"tenant": "t1"}, "http": {"status": "500"}},
+		Message:        "upstream timed out",
+	}
+
+	tenantID, line, err := SyslogLine(message, "fallback", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := 42
+	want := LogLine{}
+	want.Device.DeviceID, want.Device.Hostname = "web-1", "web-1"
+	want.Event.DeviceID = "web-1"
+	want.Event.Timestamp = 1717243200000
+	want.Event.Severity = "error"
+	want.Event.Source, want.Event.ProcessName, want.Event.ProcessPID = "nginx", "nginx", &pid
+	want.Event.Message = "upstream timed out"
+	want.Event.Attributes = map[string]string{"facility": "4", "msgid": "ACCESS", "http.status": "500"}
+	if tenantID != "t1" || !reflect.DeepEqual(line, want) {
+		t.Errorf("SyslogLine = %q, %+v, want t1, %+v", tenantID, line, want)
+	}
+
+	// RFC 3164 messages have no parameters, they go to the default tenant, at now when they have no time
+	message = SyslogMessage{Hostname: "web-1", ProcID: "worker", Message: "x"}
+	tenantID, line, err = SyslogLine(message, "fallback", 1000)
+	if err != nil || tenantID != "fallback" || line.Event.Timestamp != 1000 || line.Event.ProcessPID != nil {
+		t.Errorf("SyslogLine = %q, %+v, %v, want the fallback tenant at 1000 without PID", tenantID, line, err)
+	}
+
+	// The device_id parameter wins over the hostname
+	message.StructuredData = map[string]map[string]string{"cv": {"device_id": "d-1"}}
+	if _, line, err = SyslogLine(message, "fallback", 0); err != nil || line.Device.DeviceID != "d-1" || line.Device.Hostname != "web-1" {
+		t.Errorf("SyslogLine = %+v, %v, want device d-1 named web-1", line.Device, err)
+	}
+
+	if _, _, err := SyslogLine(SyslogMessage{Hostname: "web-1"}, "", 0); err == nil {
+		t.Error("a message without tenant was accepted")
+	}
+	if _, _, err := SyslogLine(SyslogMessage{}, "t1", 0); err == nil {
+		t.Error("a message without device was accepted")
+	}
+}
+
+// splitSyslog returns the frames of a stream, read one byte at a time so frames arrive in pieces
+func splitSyslog(stream string) ([]string, error) {
+	scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(stream)))
+	scanner.Split(SplitSyslog)
+
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	return frames, scanner.Err()
+}
+
+func TestSplitSyslog(t *testing.T) {
+	tests := []struct {
+		stream string
+		want   []string
+	}{
+		// Octet counting, the messages can hold newlines
+		{"17 <34>1 - - - - - -21 <34>1 - - - - - - a\nb", []string{"<34>1 - - - - - -", "<34>1 - - - - - - a\nb"}},
+		// Newline framing, with CRLF and without a final newline
+		{"<34>1 - - - - - - a\r\n<34>Oct 11 22:14:15 host b\n<34>1 - - - - - - c", []string{
+			"<34>1 - - - - - - a", "<34>Oct 11 22:14:15 host b", "<34>1 - - - - - - c",
+		}},
+		// Both in one stream, the framing is told by the first character of every frame
+		{"<34>1 - - - - - - a\n3 abc<34>1 - - - - - - b\n", []string{"<34>1 - - - - - - a", "abc", "<34>1 - - - - - - b"}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		frames, err := splitSyslog(test.stream)
+		if err != nil || !reflect.DeepEqual(frames, test.want) {
+			t.Errorf("splitting %q gave %q, %v, want %q", test.stream, frames, err, test.want)
+		}
+	}
+}
+
+func TestSplitSyslogErrors(t *testing.T) {
+	streams := []string{
+		// The length is cut, or the message shorter than it
+		"15",
+		"15 <34>1 - -",
+		"3 abc20 <34>1",
+		// Lengths that aren't numbers
+		"1x <34>1 - - - - - -",
+		"99999999999999999999 <34>1",
+	}
+
+	for _, stream := range streams {
+		if frames, err := splitSyslog(stream); err == nil {
+			t.Errorf("splitting %q gave %q, want an error", stream, frames)
+		}
+	}
+}
+
+func TestSplitSyslogPartial(t *testing.T) {
+	// Frames that aren't complete yet ask for more data
+	for _, data := range []string{"1", "15 ", "15 <34>1 -", "<34>1 - - - - - - a"} {
+		if advance, token, err := SplitSyslog([]byte(data), false); advance != 0 || token != nil || err != nil {
+			t.Errorf("SplitSyslog(%q) = %d, %q, %v, want to read more", data, advance, token, err)
+		}
+	}
+}
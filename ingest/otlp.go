@@ -0,0 +1,950 @@
+package ingest
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OTLP metrics are read into resources, each with the points of its metrics. Only number points are mapped,
+// histograms, exponential histograms and summaries are kept as histogram series.
+
+// OTLPResource holds the points of the metrics of one OTLP resource
+type OTLPResource struct {
+	attributes map[string]string
+	points     []otlpPoint
+}
+
+type otlpPoint struct {
+	metric     string
+	attributes map[string]string
+	// Nanoseconds since the epoch, the start is only set on sums
+	start     uint64
+	timestamp uint64
+	value     float64
+	// Delta sums report the increase since start instead of a running total
+	delta bool
+	// Set on histogram and summary points instead of the value
+	histogram *models.Histogram
+}
+
+// Aggregation temporality of OTLP sums and histograms
+const otlpTemporalityDelta = 1
+
+// Fields of the Metric message holding distributions
+const (
+	otlpHistogram            = 9
+	otlpExponentialHistogram = 10
+	otlpSummary              = 11
+)
+
+// DecodeOTLPProtobuf reads a protobuf ExportMetricsServiceRequest
+func DecodeOTLPProtobuf(body []byte) ([]OTLPResource, error) {
+	var resources []OTLPResource
+	err := eachMessage(body, 1, func(message []byte) error {
+		resource, err := decodeResourceMetrics(message)
+		resources = append(resources, resource)
+		return err
+	})
+	return resources, err
+}
+
+// eachMessage calls fn with every embedded message of field in message
+func eachMessage(message []byte, field int, fn func([]byte) error) error {
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		if f != field || wireType != wireBytes {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+
+		embedded, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		if err := fn(embedded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeResourceMetrics(message []byte) (OTLPResource, error) {
+	resource := OTLPResource{attributes: make(map[string]string)}
+
+	// Resource, with its attributes in field 1
+	err := eachMessage(message, 1, func(embedded []byte) error {
+		return decodeAttributes(embedded, 1, resource.attributes)
+	})
+	if err != nil {
+		return resource, err
+	}
+
+	// Scope metrics, with the metrics in field 2
+	err = eachMessage(message, 2, func(scope []byte) error {
+		return eachMessage(scope, 2, func(metric []byte) error {
+			points, err := decodeMetric(metric)
+			resource.points = append(resource.points, points...)
+			return err
+		})
+	})
+	return resource, err
+}
+
+// decodeAttributes reads the KeyValue messages of field into attributes
+func decodeAttributes(message []byte, field int, attributes map[string]string) error {
+	return eachMessage(message, field, func(keyValue []byte) error {
+		return decodeKeyValue(keyValue, attributes)
+	})
+}
+
+// decodeKeyValue reads a KeyValue message into attributes
+func decodeKeyValue(message []byte, attributes map[string]string) error {
+	var key, value string
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f == 1 && wireType == wireBytes:
+			key, err = r.string()
+		case f == 2 && wireType == wireBytes:
+			var anyValue []byte
+			if anyValue, err = r.bytes(); err == nil {
+				value, err = decodeAnyValue(anyValue)
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	attributes[key] = value
+	return nil
+}
+
+// decodeAnyValue formats a scalar AnyValue as a string, arrays and maps are left empty
+func decodeAnyValue(message []byte) (string, error) {
+	var value string
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case f == 1 && wireType == wireBytes:
+			value, err = r.string()
+		case f == 2 && wireType == wireVarint:
+			var b uint64
+			b, err = r.varint()
+			value = strconv.FormatBool(b != 0)
+		case f == 3 && wireType == wireVarint:
+			var i uint64
+			i, err = r.varint()
+			value = strconv.FormatInt(int64(i), 10)
+		case f == 4 && wireType == wireFixed64:
+			var d float64
+			d, err = r.double()
+			value = strconv.FormatFloat(d, 'f', -1, 64)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return value, nil
+}
+
+// decodeMetric reads the points of a Metric message
+func decodeMetric(message []byte) ([]otlpPoint, error) {
+	var name string
+	var points []otlpPoint
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if wireType != wireBytes {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		embedded, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		switch f {
+		case 1:
+			name = string(embedded)
+
+		case 5, 7:
+			// Gauge and Sum, the temporality of a sum is in field 2
+			delta := false
+			if f == 7 {
+				temporality, err := varintField(embedded, 2)
+				if err != nil {
+					return nil, err
+				}
+				delta = temporality == otlpTemporalityDelta
+			}
+
+			err = eachMessage(embedded, 1, func(dataPoint []byte) error {
+				point, err := decodeNumberDataPoint(dataPoint)
+				point.delta = delta
+				points = append(points, point)
+				return err
+			})
+
+		case otlpHistogram, otlpExponentialHistogram, otlpSummary:
+			// Summaries are always cumulative, the temporality of histograms is in field 2
+			delta := false
+			if f != otlpSummary {
+				temporality, err := varintField(embedded, 2)
+				if err != nil {
+					return nil, err
+				}
+				delta = temporality == otlpTemporalityDelta
+			}
+
+			kind := f
+			err = eachMessage(embedded, 1, func(dataPoint []byte) error {
+				point, err := decodeDistributionPoint(dataPoint, kind)
+				point.histogram.Delta = delta
+				points = append(points, point)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range points {
+		points[i].metric = name + points[i].metric
+	}
+	return points, nil
+}
+
+// varintField returns the value of a varint field of a message
+func varintField(message []byte, field int) (uint64, error) {
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		if f == field && wireType == wireVarint {
+			return r.varint()
+		}
+		if err := r.skip(wireType); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func decodeNumberDataPoint(message []byte) (otlpPoint, error) {
+	point := otlpPoint{attributes: make(map[string]string)}
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return point, err
+		}
+
+		switch {
+		case f == 7 && wireType == wireBytes:
+			var keyValue []byte
+			if keyValue, err = r.bytes(); err == nil {
+				err = decodeKeyValue(keyValue, point.attributes)
+			}
+		case f == 2 && wireType == wireFixed64:
+			point.start, err = r.fixed64()
+		case f == 3 && wireType == wireFixed64:
+			point.timestamp, err = r.fixed64()
+		case f == 4 && wireType == wireFixed64:
+			point.value, err = r.double()
+		case f == 6 && wireType == wireFixed64:
+			var i uint64
+			i, err = r.fixed64()
+			point.value = float64(int64(i))
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return point, err
+		}
+	}
+
+	return point, nil
+}
+
+// decodeDistributionPoint reads a histogram, exponential histogram or summary data point. Exponential bucket
+// i of OTLP holds the values in (base^i, base^(i+1)], it is bucket i+1 of a models.Histogram.
+func decodeDistributionPoint(message []byte, kind int) (otlpPoint, error) {
+	point := otlpPoint{attributes: make(map[string]string), histogram: &models.Histogram{}}
+	h := point.histogram
+
+	// The points only share their times, count and sum fields
+	attributesField := 9
+	switch kind {
+	case otlpExponentialHistogram:
+		attributesField = 1
+		h.Exponential = true
+	case otlpSummary:
+		attributesField = 7
+		h.Quantiles = make(map[string]float64)
+	}
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return point, err
+		}
+
+		switch {
+		case f == attributesField && wireType == wireBytes:
+			var keyValue []byte
+			if keyValue, err = r.bytes(); err == nil {
+				err = decodeKeyValue(keyValue, point.attributes)
+			}
+		case f == 2 && wireType == wireFixed64:
+			point.start, err = r.fixed64()
+		case f == 3 && wireType == wireFixed64:
+			point.timestamp, err = r.fixed64()
+		case f == 4 && wireType == wireFixed64:
+			var n uint64
+			n, err = r.fixed64()
+			h.Count = float64(n)
+		case f == 5 && wireType == wireFixed64:
+			h.Sum, err = r.double()
+
+		case kind == otlpHistogram && f == 6:
+			err = r.repeated(wireType, wireFixed64, func(p *protoReader) error {
+				n, err := p.fixed64()
+				h.BucketCounts = append(h.BucketCounts, float64(n))
+				return err
+			})
+		case kind == otlpHistogram && f == 7:
+			err = r.repeated(wireType, wireFixed64, func(p *protoReader) error {
+				bound, err := p.double()
+				h.ExplicitBounds = append(h.ExplicitBounds, bound)
+				return err
+			})
+
+		case kind == otlpExponentialHistogram && f == 6 && wireType == wireVarint:
+			var scale int32
+			scale, err = r.sint32()
+			h.Schema = int(scale)
+		case kind == otlpExponentialHistogram && f == 7 && wireType == wireFixed64:
+			var n uint64
+			n, err = r.fixed64()
+			h.ZeroCount = float64(n)
+		case kind == otlpExponentialHistogram && (f == 8 || f == 9) && wireType == wireBytes:
+			var buckets []byte
+			if buckets, err = r.bytes(); err == nil {
+				if f == 8 {
+					h.Positive, err = decodeExponentialBuckets(buckets)
+				} else {
+					h.Negative, err = decodeExponentialBuckets(buckets)
+				}
+			}
+		case kind == otlpExponentialHistogram && f == 14 && wireType == wireFixed64:
+			h.ZeroThreshold, err = r.double()
+
+		case kind == otlpSummary && f == 6 && wireType == wireBytes:
+			var quantile []byte
+			if quantile, err = r.bytes(); err == nil {
+				err = decodeQuantileValue(quantile, h.Quantiles)
+			}
+
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return point, err
+		}
+	}
+
+	return point, nil
+}
+
+// decodeExponentialBuckets reads the offset (field 1) and bucket counts (field 2) of exponential buckets
+func decodeExponentialBuckets(message []byte) (map[int]float64, error) {
+	var offset int32
+	var counts []uint64
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case f == 1 && wireType == wireVarint:
+			offset, err = r.sint32()
+		case f == 2:
+			err = r.repeated(wireType, wireVarint, func(p *protoReader) error {
+				n, err := p.varint()
+				counts = append(counts, n)
+				return err
+			})
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buckets := make(map[int]float64, len(counts))
+	for i, count := range counts {
+		if count > 0 {
+			buckets[int(offset)+i+1] = float64(count)
+		}
+	}
+	return buckets, nil
+}
+
+// decodeQuantileValue reads the quantile (field 1) and value (field 2) of a summary
+func decodeQuantileValue(message []byte, quantiles map[string]float64) error {
+	var quantile, value float64
+
+	r := newProtoReader(message)
+	for !r.done() {
+		f, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f == 1 && wireType == wireFixed64:
+			quantile, err = r.double()
+		case f == 2 && wireType == wireFixed64:
+			value, err = r.double()
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	quantiles[strconv.FormatFloat(quantile, 'f', -1, 64)] = value
+	return nil
+}
+
+// Structs matching OTLP/JSON, 64 bit integers are sent as strings
+
+type otlpJSONInt string
+
+func (i *otlpJSONInt) UnmarshalJSON(data []byte) error {
+	*i = otlpJSONInt(strings.Trim(string(data), `"`))
+	return nil
+}
+
+type otlpJSONValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *otlpJSONInt `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string        `json:"key"`
+	Value otlpJSONValue `json:"value"`
+}
+
+type otlpJSONDataPoint struct {
+	Attributes        []otlpJSONKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpJSONInt        `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpJSONInt        `json:"timeUnixNano"`
+	AsDouble          *float64           `json:"asDouble"`
+	AsInt             *otlpJSONInt       `json:"asInt"`
+	Count             *otlpJSONInt       `json:"count"`
+	Sum               *float64           `json:"sum"`
+
+	BucketCounts   []otlpJSONInt           `json:"bucketCounts"`
+	ExplicitBounds []float64               `json:"explicitBounds"`
+	Scale          int                     `json:"scale"`
+	ZeroCount      otlpJSONInt             `json:"zeroCount"`
+	ZeroThreshold  float64                 `json:"zeroThreshold"`
+	Positive       *otlpJSONBuckets        `json:"positive"`
+	Negative       *otlpJSONBuckets        `json:"negative"`
+	QuantileValues []otlpJSONQuantileValue `json:"quantileValues"`
+}
+
+type otlpJSONBuckets struct {
+	Offset       int           `json:"offset"`
+	BucketCounts []otlpJSONInt `json:"bucketCounts"`
+}
+
+type otlpJSONQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpJSONData struct {
+	DataPoints             []otlpJSONDataPoint `json:"dataPoints"`
+	AggregationTemporality int                 `json:"aggregationTemporality"`
+}
+
+type otlpJSONMetric struct {
+	Name                 string        `json:"name"`
+	Gauge                *otlpJSONData `json:"gauge"`
+	Sum                  *otlpJSONData `json:"sum"`
+	Histogram            *otlpJSONData `json:"histogram"`
+	ExponentialHistogram *otlpJSONData `json:"exponentialHistogram"`
+	Summary              *otlpJSONData `json:"summary"`
+}
+
+type otlpJSONRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []otlpJSONMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+func (v otlpJSONValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return string(*v.IntValue)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+	}
+	return ""
+}
+
+func otlpJSONAttributes(keyValues []otlpJSONKeyValue) map[string]string {
+	attributes := make(map[string]string, len(keyValues))
+	for _, keyValue := range keyValues {
+		attributes[keyValue.Key] = keyValue.Value.String()
+	}
+	return attributes
+}
+
+func (i otlpJSONInt) uint64() uint64 {
+	value, _ := strconv.ParseUint(string(i), 10, 64)
+	return value
+}
+
+// histogram returns the distribution of a histogram, exponential histogram or summary data point
+func (dataPoint otlpJSONDataPoint) histogram(kind int) *models.Histogram {
+	h := &models.Histogram{}
+	if dataPoint.Count != nil {
+		h.Count = float64(dataPoint.Count.uint64())
+	}
+	if dataPoint.Sum != nil {
+		h.Sum = *dataPoint.Sum
+	}
+
+	switch kind {
+	case otlpHistogram:
+		h.ExplicitBounds = dataPoint.ExplicitBounds
+		for _, count := range dataPoint.BucketCounts {
+			h.BucketCounts = append(h.BucketCounts, float64(count.uint64()))
+		}
+	case otlpExponentialHistogram:
+		h.Exponential = true
+		h.Schema = dataPoint.Scale
+		h.ZeroCount = float64(dataPoint.ZeroCount.uint64())
+		h.ZeroThreshold = dataPoint.ZeroThreshold
+		h.Positive = dataPoint.Positive.buckets()
+		h.Negative = dataPoint.Negative.buckets()
+	case otlpSummary:
+		h.Quantiles = make(map[string]float64, len(dataPoint.QuantileValues))
+		for _, quantile := range dataPoint.QuantileValues {
+			h.Quantiles[strconv.FormatFloat(quantile.Quantile, 'f', -1, 64)] = quantile.Value
+		}
+	}
+
+	return h
+}
+
+// buckets returns exponential buckets by their models.Histogram index
+func (b *otlpJSONBuckets) buckets() map[int]float64 {
+	if b == nil {
+		return nil
+	}
+
+	buckets := make(map[int]float64, len(b.BucketCounts))
+	for i, count := range b.BucketCounts {
+		if n := count.uint64(); n > 0 {
+			buckets[b.Offset+i+1] = float64(n)
+		}
+	}
+	return buckets
+}
+
+// DecodeOTLPJSON reads an ExportMetricsServiceRequest in the OTLP/JSON encoding
+func DecodeOTLPJSON(body []byte) ([]OTLPResource, error) {
+	var request otlpJSONRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	var resources []OTLPResource
+	for _, resourceMetrics := range request.ResourceMetrics {
+		resource := OTLPResource{attributes: otlpJSONAttributes(resourceMetrics.Resource.Attributes)}
+
+		for _, scope := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scope.Metrics {
+				for _, data := range []*otlpJSONData{metric.Gauge, metric.Sum} {
+					if data == nil {
+						continue
+					}
+					for _, dataPoint := range data.DataPoints {
+						point := otlpPoint{
+							metric:     metric.Name,
+							attributes: otlpJSONAttributes(dataPoint.Attributes),
+							start:      dataPoint.StartTimeUnixNano.uint64(),
+							timestamp:  dataPoint.TimeUnixNano.uint64(),
+							delta:      data.AggregationTemporality == otlpTemporalityDelta,
+						}
+						if dataPoint.AsDouble != nil {
+							point.value = *dataPoint.AsDouble
+						} else if dataPoint.AsInt != nil {
+							value, _ := strconv.ParseInt(string(*dataPoint.AsInt), 10, 64)
+							point.value = float64(value)
+						}
+						resource.points = append(resource.points, point)
+					}
+				}
+
+				distributions := map[int]*otlpJSONData{
+					otlpHistogram:            metric.Histogram,
+					otlpExponentialHistogram: metric.ExponentialHistogram,
+					otlpSummary:              metric.Summary,
+				}
+				for kind, data := range distributions {
+					if data == nil {
+						continue
+					}
+					for _, dataPoint := range data.DataPoints {
+						point := otlpPoint{
+							metric:     metric.Name,
+							attributes: otlpJSONAttributes(dataPoint.Attributes),
+							start:      dataPoint.StartTimeUnixNano.uint64(),
+							timestamp:  dataPoint.TimeUnixNano.uint64(),
+							histogram:  dataPoint.histogram(kind),
+						}
+						point.histogram.Delta = kind != otlpSummary && data.AggregationTemporality == otlpTemporalityDelta
+						resource.points = append(resource.points, point)
+					}
+				}
+			}
+		}
+
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+// otlpDevice returns the device a resource is about, from its host.id, host.name or service.name
+func otlpDevice(attributes map[string]string) models.DeviceData {
+	device := models.DeviceData{DeviceID: attributes["host.id"], Hostname: attributes["host.name"]}
+	if device.Hostname == "" {
+		device.Hostname = attributes["service.name"]
+	}
+	if device.DeviceID == "" {
+		device.DeviceID = device.Hostname
+	}
+	device.IPAddress = attributes["host.ip"]
+	device.MACAddress = attributes["host.mac"]
+
+	return device
+}
+
+// OTLPStats says what an OTLP request was stored as
+type OTLPStats struct {
+	Points         int
+	Frames         int
+	GenericSamples int
+	Histograms     int
+}
+
+// StoreOTLP stores the points of OTLP resources. hostmetrics and process receiver metrics become host, disk,
+// network and process samples of the device of their resource, the other points are stored as generic series.
+func StoreOTLP(db *sql.DB, tenantID string, resources []OTLPResource) (OTLPStats, error) {
+	var stats OTLPStats
+
+	// Cumulative sums are turned into rates, which needs the points in time order
+	type resourcePoint struct {
+		resource *OTLPResource
+		otlpPoint
+	}
+	var points []resourcePoint
+	for i := range resources {
+		for _, point := range resources[i].points {
+			if !math.IsNaN(point.value) {
+				points = append(points, resourcePoint{resource: &resources[i], otlpPoint: point})
+			}
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].timestamp < points[j].timestamp })
+	stats.Points = len(points)
+
+	fs := newFrames(tenantID)
+	var generic []models.GenericSample
+	var histograms []models.HistogramSample
+	for _, point := range points {
+		device := otlpDevice(point.resource.attributes)
+		if point.histogram == nil && device.DeviceID != "" && mapOTLPPoint(fs, device, point.resource.attributes, point.otlpPoint) {
+			continue
+		}
+
+		// Point attributes win over the resource ones
+		labels := make(map[string]string, len(point.resource.attributes)+len(point.attributes))
+		for name, value := range point.resource.attributes {
+			labels[name] = value
+		}
+		for name, value := range point.attributes {
+			labels[name] = value
+		}
+
+		if point.histogram != nil {
+			metricType := models.GenericHistogram
+			if point.histogram.Quantiles != nil {
+				metricType = models.GenericSummary
+			}
+			if point.histogram.Valid() != nil {
+				continue
+			}
+
+			histograms = append(histograms, models.HistogramSample{
+				Name:      point.metric,
+				DeviceID:  device.DeviceID,
+				Type:      metricType,
+				Labels:    labels,
+				Timestamp: int64(point.timestamp / 1e6),
+				Histogram: *point.histogram,
+			})
+			continue
+		}
+
+		generic = append(generic, models.GenericSample{
+			Name:      point.metric,
+			DeviceID:  device.DeviceID,
+			Labels:    labels,
+			Timestamp: int64(point.timestamp / 1e6),
+			Value:     point.value,
+		})
+	}
+
+	stored, err := fs.store(db)
+	stats.Frames = stored
+	if err != nil {
+		return stats, err
+	}
+
+	if err := StoreGeneric(db, tenantID, generic); err != nil {
+		return stats, err
+	}
+	stats.GenericSamples = len(generic)
+
+	if err := StoreHistograms(db, tenantID, histograms); err != nil {
+		return stats, err
+	}
+	stats.Histograms = len(histograms)
+
+	return stats, nil
+}
+
+// Process receiver metrics stored in ProcessMetrics
+var otlpProcessMetrics = map[string]bool{
+	"process.cpu.time": true, "process.memory.usage": true, "process.memory.physical_usage": true, "process.threads": true,
+	"process.open_file_descriptors": true, "process.disk.io": true,
+}
+
+// mapOTLPPoint puts a hostmetrics or process receiver point into the frame of its device, it returns false
+// for the metrics it doesn't know
+func mapOTLPPoint(fs *frames, device models.DeviceData, resource map[string]string, point otlpPoint) bool {
+	timestamp := int64(point.timestamp / 1e6)
+	f := fs.get(device, timestamp)
+	attributes := point.attributes
+	value := point.value
+
+	// Per second increase of a sum, cumulative ones against their previous reading
+	rate := func(key string) (float64, bool) {
+		if point.delta {
+			if point.start == 0 || point.timestamp <= point.start {
+				return 0, false
+			}
+			return value / (float64(point.timestamp-point.start) / 1e9), true
+		}
+		return fs.state(f).rate(point.metric+"/"+key, value, timestamp)
+	}
+
+	// Process metrics come with the process in the resource
+	if otlpProcessMetrics[point.metric] {
+		pid, err := strconv.Atoi(resource["process.pid"])
+		if err != nil {
+			return false
+		}
+		name := resource["process.executable.name"]
+		key := resource["process.pid"]
+
+		process := f.process(key, pid, name)
+		if command := resource["process.command_line"]; command != "" {
+			process.Command = command
+		} else if command := resource["process.command"]; command != "" {
+			process.Command = strings.TrimSpace(command + " " + resource["process.command_args"])
+		}
+		if owner := resource["process.owner"]; owner != "" {
+			process.User = &owner
+		}
+		if parent, err := strconv.Atoi(resource["process.parent_pid"]); err == nil {
+			process.ParentPID = &parent
+		}
+
+		switch point.metric {
+		case "process.cpu.time":
+			// Time waiting for IO isn't CPU usage, like in the host CPU usage
+			if idleCPUModes[attributes["state"]] {
+				return true
+			}
+			if perSecond, ok := rate(key + "/" + attributes["state"]); ok {
+				f.addProcessCPUTime(key, pid, name, perSecond)
+			}
+		case "process.memory.usage", "process.memory.physical_usage":
+			process.RAMUsage = int64(value)
+		case "process.threads":
+			threads := int(value)
+			process.Threads = &threads
+		case "process.open_file_descriptors":
+			fds := int(value)
+			process.OpenFDs = &fds
+		case "process.disk.io":
+			bytes := int64(value)
+			if attributes["direction"] == "read" {
+				process.ReadBytes = &bytes
+			} else {
+				process.WriteBytes = &bytes
+			}
+		}
+		return true
+	}
+
+	switch point.metric {
+	case "system.cpu.time":
+		if perSecond, ok := rate(attributes["cpu"] + "/" + attributes["state"]); ok {
+			f.addCPUTime(strings.TrimPrefix(attributes["cpu"], "cpu"), attributes["state"], perSecond)
+		}
+
+	case "system.cpu.load_average.1m":
+		f.host.LoadAvg1 = value
+		f.report(hostLoad1)
+	case "system.cpu.load_average.5m":
+		f.host.LoadAvg5 = value
+		f.report(hostLoad5)
+	case "system.cpu.load_average.15m":
+		f.host.LoadAvg15 = value
+		f.report(hostLoad15)
+
+	case "system.memory.usage":
+		// The total is the sum of the states, unreclaimable slab memory is already counted as used
+		if attributes["state"] != "slab_unreclaimable" {
+			f.host.TotalMemory += int64(value)
+			f.report(hostTotalMemory)
+		}
+		if attributes["state"] == "used" {
+			f.host.RAMUsage = int64(value)
+			f.report(hostRAM)
+		}
+
+	case "system.filesystem.usage", "system.filesystem.inodes.usage":
+		if ignoredFSTypes[attributes["type"]] || attributes["mountpoint"] == "" {
+			return true
+		}
+
+		disk := f.disk(attributes["mountpoint"])
+		disk.FileSystem, disk.FSType = attributes["device"], attributes["type"]
+		if point.metric == "system.filesystem.usage" {
+			disk.TotalBytes += int64(value)
+			if attributes["state"] == "used" {
+				disk.UsedBytes = int64(value)
+			}
+		} else {
+			disk.InodesTotal += int64(value)
+			if attributes["state"] == "used" {
+				disk.InodesUsed = int64(value)
+			}
+		}
+
+	case "system.network.io", "system.network.packets", "system.network.errors", "system.network.dropped":
+		iface := f.networkInterface(attributes["device"])
+		counter := uint64(value)
+		receive := attributes["direction"] == "receive"
+		switch point.metric {
+		case "system.network.io":
+			if receive {
+				iface.RxBytes = counter
+			} else {
+				iface.TxBytes = counter
+			}
+		case "system.network.packets":
+			if receive {
+				iface.RxPackets = counter
+			} else {
+				iface.TxPackets = counter
+			}
+		case "system.network.errors":
+			if receive {
+				iface.RxErrors = counter
+			} else {
+				iface.TxErrors = counter
+			}
+		case "system.network.dropped":
+			if receive {
+				iface.RxDrops = counter
+			} else {
+				iface.TxDrops = counter
+			}
+		}
+
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,251 @@
+package ingest
+
+import (
+	"bytes"
+	"cloudVigilante/backend/models"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Protobuf encoding helpers to build OTLP requests field by field
+
+func pbUvarint(v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, v)]
+}
+
+func pbKey(field int, wireType int) []byte {
+	return pbUvarint(uint64(field<<3 | wireType))
+}
+
+func pbVarint(field int, v uint64) []byte {
+	return append(pbKey(field, wireVarint), pbUvarint(v)...)
+}
+
+func pbFixed64(field int, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(pbKey(field, wireFixed64), buf[:]...)
+}
+
+func pbDouble(field int, v float64) []byte {
+	return pbFixed64(field, math.Float64bits(v))
+}
+
+func pbMessage(field int, fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	return append(append(pbKey(field, wireBytes), pbUvarint(uint64(len(body)))...), body...)
+}
+
+func pbString(field int, s string) []byte {
+	return pbMessage(field, []byte(s))
+}
+
+// pbPackedFixed64 encodes a packed repeated fixed64 field
+func pbPackedFixed64(field int, values ...uint64) []byte {
+	var body []byte
+	for _, v := range values {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		body = append(body, buf[:]...)
+	}
+	return pbMessage(field, body)
+}
+
+// pbKeyValue encodes a KeyValue message, value being the fields of its AnyValue
+func pbKeyValue(field int, key string, value ...[]byte) []byte {
+	return pbMessage(field, pbString(1, key), pbMessage(2, value...))
+}
+
+const (
+	otlpTestTime  = 1700000000000000000
+	otlpTestStart = 1699999990000000000
+)
+
+// An ExportMetricsServiceRequest with a gauge, a delta sum, a histogram, an exponential histogram and a summary,
+// the resource has attributes of every scalar type and an array
+func otlpTestRequest() []byte {
+	resource := pbMessage(1,
+		pbKeyValue(1, "host.name", pbString(1, "web-1")),
+		pbKeyValue(1, "host.id", pbString(1, "i-123")),
+		pbKeyValue(1, "cores", pbVarint(3, 4)),
+		pbKeyValue(1, "offset", pbVarint(3, uint64(1<<64-5))),
+		pbKeyValue(1, "spot", pbVarint(2, 1)),
+		pbKeyValue(1, "ratio", pbDouble(4, 0.5)),
+		pbKeyValue(1, "tags", pbMessage(5, pbMessage(1, pbString(1, "a")))),
+	)
+	route := pbKeyValue(7, "route", pbString(1, "/a"))
+
+	metrics := [][]byte{
+		pbMessage(2,
+			pbString(1, "system.cpu.load_average.1m"),
+			pbMessage(5, pbMessage(1, pbFixed64(3, otlpTestTime), pbDouble(4, 0.25))),
+		),
+		pbMessage(2,
+			pbString(1, "http.requests"),
+			pbMessage(7,
+				pbMessage(1, route, pbFixed64(2, otlpTestStart), pbFixed64(3, otlpTestTime), pbFixed64(6, 12)),
+				pbVarint(2, otlpTemporalityDelta),
+				pbVarint(3, 1),
+			),
+		),
+		// Packed bucket counts and unpacked bounds
+		pbMessage(2,
+			pbString(1, "latency"),
+			pbMessage(otlpHistogram,
+				pbMessage(1,
+					pbKeyValue(9, "route", pbString(1, "/a")),
+					pbFixed64(2, otlpTestStart), pbFixed64(3, otlpTestTime),
+					pbFixed64(4, 5), pbDouble(5, 2.5),
+					pbPackedFixed64(6, 1, 3, 1),
+					pbDouble(7, 0.1), pbDouble(7, 1),
+				),
+				pbVarint(2, otlpTemporalityDelta),
+			),
+		),
+		// Scale 2 and offset -1, zigzag encoded
+		pbMessage(2,
+			pbString(1, "size"),
+			pbMessage(otlpExponentialHistogram,
+				pbMessage(1,
+					pbFixed64(3, otlpTestTime), pbFixed64(4, 4), pbDouble(5, 10),
+					pbVarint(6, 4), pbFixed64(7, 1), pbDouble(14, 0.001),
+					pbMessage(8, pbVarint(1, 1), pbMessage(2, pbUvarint(2), pbUvarint(0), pbUvarint(1))),
+				),
+				pbVarint(2, 2),
+			),
+		),
+		pbMessage(2,
+			pbString(1, "rpc"),
+			pbMessage(otlpSummary,
+				pbMessage(1,
+					pbFixed64(3, otlpTestTime), pbFixed64(4, 10), pbDouble(5, 3),
+					pbMessage(6, pbDouble(1, 0.5), pbDouble(2, 0.2)),
+					pbMessage(6, pbDouble(1, 0.99), pbDouble(2, 0.9)),
+				),
+			),
+		),
+	}
+
+	scope := pbMessage(2, append([][]byte{pbMessage(1, pbString(1, "hostmetrics"))}, metrics...)...)
+	return pbMessage(1, resource, scope)
+}
+
+// The same request in the OTLP/JSON encoding, with integers as strings or numbers
+const otlpTestJSON = `{"resourceMetrics": [{
+	"resource": {"attributes": [
+		{"key": "host.name", "value": {"stringValue": "web-1"}},
+		{"key": "host.id", "value": {"stringValue": "i-123"}},
+		{"key": "cores", "value": {"intValue": "4"}},
+		{"key": "offset", "value": {"intValue": -5}},
+		{"key": "spot", "value": {"boolValue": true}},
+		{"key": "ratio", "value": {"doubleValue": 0.5}},
+		{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}]}}}
+	]},
+	"scopeMetrics": [{"scope": {"name": "hostmetrics"}, "metrics": [
+		{"name": "system.cpu.load_average.1m", "gauge": {"dataPoints": [
+			{"timeUnixNano": "1700000000000000000", "asDouble": 0.25}
+		]}},
+		{"name": "http.requests", "sum": {"aggregationTemporality": 1, "isMonotonic": true, "dataPoints": [
+			{"attributes": [{"key": "route", "value": {"stringValue": "/a"}}],
+			 "startTimeUnixNano": "1699999990000000000", "timeUnixNano": "1700000000000000000", "asInt": 12}
+		]}},
+		{"name": "latency", "histogram": {"aggregationTemporality": 1, "dataPoints": [
+			{"attributes": [{"key": "route", "value": {"stringValue": "/a"}}],
+			 "startTimeUnixNano": "1699999990000000000", "timeUnixNano": "1700000000000000000",
+			 "count": "5", "sum": 2.5, "bucketCounts": ["1", "3", "1"], "explicitBounds": [0.1, 1]}
+		]}},
+		{"name": "size", "exponentialHistogram": {"aggregationTemporality": 2, "dataPoints": [
+			{"timeUnixNano": "1700000000000000000", "count": "4", "sum": 10, "scale": 2, "zeroCount": "1",
+			 "zeroThreshold": 0.001, "positive": {"offset": -1, "bucketCounts": ["2", "0", "1"]}}
+		]}},
+		{"name": "rpc", "summary": {"dataPoints": [
+			{"timeUnixNano": "1700000000000000000", "count": "10", "sum": 3,
+			 "quantileValues": [{"quantile": 0.5, "value": 0.2}, {"quantile": 0.99, "value": 0.9}]}
+		]}}
+	]}]
+}]}`
+
+var wantOTLPResources = []OTLPResource{{
+	attributes: map[string]string{
+		"host.name": "web-1", "host.id": "i-123", "cores": "4", "offset": "-5", "spot": "true", "ratio": "0.5", "tags": "",
+	},
+	points: []otlpPoint{
+		{metric: "system.cpu.load_average.1m", attributes: map[string]string{}, timestamp: otlpTestTime, value: 0.25},
+		{
+			metric: "http.requests", attributes: map[string]string{"route": "/a"},
+			start: otlpTestStart, timestamp: otlpTestTime, value: 12, delta: true,
+		},
+		{
+			metric: "latency", attributes: map[string]string{"route": "/a"}, start: otlpTestStart, timestamp: otlpTestTime,
+			histogram: &models.Histogram{
+				Count: 5, Sum: 2.5, Delta: true, ExplicitBounds: []float64{0.1, 1}, BucketCounts: []float64{1, 3, 1},
+			},
+		},
+		{
+			metric: "size", attributes: map[string]string{}, timestamp: otlpTestTime,
+			histogram: &models.Histogram{
+				Count: 4, Sum: 10, Exponential: true, Schema: 2, ZeroCount: 1, ZeroThreshold: 0.001,
+				Positive: map[int]float64{0: 2, 2: 1},
+			},
+		},
+		{
+			metric: "rpc", attributes: map[string]string{}, timestamp: otlpTestTime,
+			histogram: &models.Histogram{Count: 10, Sum: 3, Quantiles: map[string]float64{"0.5": 0.2, "0.99": 0.9}},
+		},
+	},
+}}
+
+func TestDecodeOTLPProtobuf(t *testing.T) {
+	resources, err := DecodeOTLPProtobuf(otlpTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resources, wantOTLPResources) {
+		t.Errorf("got %+v, want %+v", resources, wantOTLPResources)
+	}
+}
+
+func TestDecodeOTLPJSON(t *testing.T) {
+	resources, err := DecodeOTLPJSON([]byte(otlpTestJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resources, wantOTLPResources) {
+		t.Errorf("got %+v, want %+v", resources, wantOTLPResources)
+	}
+}
+
+func TestDecodeOTLPProtobufTruncated(t *testing.T) {
+	body := otlpTestRequest()
+	for _, n := range []int{1, 2, len(body) / 2, len(body) - 1} {
+		if _, err := DecodeOTLPProtobuf(body[:n]); err == nil {
+			t.Errorf("decoding the first %d of %d bytes didn't fail", n, len(body))
+		}
+	}
+}
+
+func TestOTLPDevice(t *testing.T) {
+	tests := []struct {
+		attributes map[string]string
+		want       models.DeviceData
+	}{
+		{
+			map[string]string{"host.id": "i-123", "host.name": "web-1", "host.ip": "10.0.0.1", "host.mac": "aa:bb"},
+			models.DeviceData{DeviceID: "i-123", Hostname: "web-1", IPAddress: "10.0.0.1", MACAddress: "aa:bb"},
+		},
+		{map[string]string{"host.name": "web-1"}, models.DeviceData{DeviceID: "web-1", Hostname: "web-1"}},
+		// Without host attributes the service is the device
+		{map[string]string{"service.name": "checkout"}, models.DeviceData{DeviceID: "checkout", Hostname: "checkout"}},
+		{map[string]string{"host.name": "web-1", "service.name": "checkout"}, models.DeviceData{DeviceID: "web-1", Hostname: "web-1"}},
+		{map[string]string{}, models.DeviceData{}},
+	}
+
+	for _, test := range tests {
+		if got := otlpDevice(test.attributes); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("otlpDevice(%v) = %+v, want %+v", test.attributes, got, test.want)
+		}
+	}
+}
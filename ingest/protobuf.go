@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protocol buffers wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncatedMessage = errors.New("truncated protobuf message")
+
+// protoReader walks the fields of a protobuf message, enough to read the remote write and OTLP messages
+// without generated code
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func newProtoReader(buf []byte) *protoReader {
+	return &protoReader{buf: buf}
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+// next reads the key of the next field
+func (r *protoReader) next() (int, int, error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 0x07), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	value, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errTruncatedMessage
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if r.pos+8 > len(r.buf) {
+		return 0, errTruncatedMessage
+	}
+	value := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return value, nil
+}
+
+func (r *protoReader) fixed32() (uint32, error) {
+	if r.pos+4 > len(r.buf) {
+		return 0, errTruncatedMessage
+	}
+	value := binary.LittleEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return value, nil
+}
+
+func (r *protoReader) double() (float64, error) {
+	bits, err := r.fixed64()
+	return math.Float64frombits(bits), err
+}
+
+// bytes reads a length delimited field, a string or an embedded message
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(r.buf)-r.pos) {
+		return nil, errTruncatedMessage
+	}
+	value := r.buf[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return value, nil
+}
+
+func (r *protoReader) string() (string, error) {
+	value, err := r.bytes()
+	return string(value), err
+}
+
+// skip skips the value of a field that isn't read
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		_, err = r.fixed32()
+	default:
+		err = errors.New("unsupported protobuf wire type")
+	}
+	return err
+}
+
+// repeated reads a repeated scalar field, packed or not, calling read for every element
+func (r *protoReader) repeated(wireType int, elementWireType int, read func(*protoReader) error) error {
+	if wireType == elementWireType {
+		return read(r)
+	}
+	if wireType != wireBytes {
+		return r.skip(wireType)
+	}
+
+	packed, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	p := newProtoReader(packed)
+	for !p.done() {
+		if err := read(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sint32 reads a zigzag encoded varint
+func (r *protoReader) sint32() (int32, error) {
+	value, err := r.varint()
+	return int32(value>>1) ^ -int32(value&1), err
+}
@@ -0,0 +1,399 @@
+package ingest
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+)
+
+// TimeSeries is a series of a Prometheus remote write request
+type TimeSeries struct {
+	Labels  map[string]string
+	Samples []RemoteSample
+}
+
+type RemoteSample struct {
+	Value float64
+	// Milliseconds since the epoch
+	Timestamp int64
+}
+
+// DecodeWriteRequest reads the series of a protobuf prometheus.WriteRequest. Metadata, exemplars and native
+// histograms are skipped.
+func DecodeWriteRequest(body []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+
+	r := newProtoReader(body)
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if field != 1 || wireType != wireBytes {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		message, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		ts, err := decodeTimeSeries(message)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, ts)
+	}
+
+	return series, nil
+}
+
+func decodeTimeSeries(message []byte) (TimeSeries, error) {
+	ts := TimeSeries{Labels: make(map[string]string)}
+
+	r := newProtoReader(message)
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return ts, err
+		}
+
+		if wireType != wireBytes || (field != 1 && field != 2) {
+			if err := r.skip(wireType); err != nil {
+				return ts, err
+			}
+			continue
+		}
+
+		embedded, err := r.bytes()
+		if err != nil {
+			return ts, err
+		}
+
+		if field == 1 {
+			name, value, err := decodeLabel(embedded)
+			if err != nil {
+				return ts, err
+			}
+			ts.Labels[name] = value
+			continue
+		}
+
+		sample, err := decodeSample(embedded)
+		if err != nil {
+			return ts, err
+		}
+		ts.Samples = append(ts.Samples, sample)
+	}
+
+	return ts, nil
+}
+
+func decodeLabel(message []byte) (string, string, error) {
+	var name, value string
+
+	r := newProtoReader(message)
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return "", "", err
+		}
+
+		switch {
+		case field == 1 && wireType == wireBytes:
+			name, err = r.string()
+		case field == 2 && wireType == wireBytes:
+			value, err = r.string()
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return name, value, nil
+}
+
+func decodeSample(message []byte) (RemoteSample, error) {
+	var sample RemoteSample
+
+	r := newProtoReader(message)
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return sample, err
+		}
+
+		switch {
+		case field == 1 && wireType == wireFixed64:
+			sample.Value, err = r.double()
+		case field == 2 && wireType == wireVarint:
+			var timestamp uint64
+			timestamp, err = r.varint()
+			sample.Timestamp = int64(timestamp)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return sample, err
+		}
+	}
+
+	return sample, nil
+}
+
+// Pseudo file systems left out of the disks, like our agent does
+var ignoredFSTypes = map[string]bool{
+	"tmpfs": true, "devtmpfs": true, "squashfs": true, "overlay": true, "nsfs": true, "ramfs": true, "proc": true, "sysfs": true,
+}
+
+// remoteDevice returns the device a series is about. The device_id and hostname labels set by the sender win,
+// else it is the host of the scrape target.
+func remoteDevice(labels map[string]string) models.DeviceData {
+	host := labels["instance"]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hostname := labels["hostname"]; hostname != "" {
+		host = hostname
+	}
+
+	device := models.DeviceData{DeviceID: labels["device_id"], Hostname: host}
+	if device.DeviceID == "" {
+		device.DeviceID = host
+	}
+	if device.Hostname == "" {
+		device.Hostname = device.DeviceID
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		device.IPAddress = host
+	}
+
+	return device
+}
+
+// remoteSeriesType guesses the type of a series from the suffixes of the Prometheus naming conventions. The
+// series of classic histograms are counters, only native histograms have samples holding buckets.
+func remoteSeriesType(name string) string {
+	for _, suffix := range []string{"_total", "_bucket", "_sum", "_count"} {
+		if strings.HasSuffix(name, suffix) {
+			return models.GenericCounter
+		}
+	}
+	return models.GenericGauge
+}
+
+// RemoteWriteStats says what a remote write request was stored as
+type RemoteWriteStats struct {
+	Samples        int
+	Frames         int
+	GenericSamples int
+}
+
+type remotePoint struct {
+	name   string
+	labels map[string]string
+	device models.DeviceData
+	RemoteSample
+}
+
+// RemoteWrite stores the series of a remote write request. node_exporter and process-exporter series become
+// host, disk, network and process samples of the device they were scraped from, the other series are stored
+// as generic series.
+func RemoteWrite(db *sql.DB, tenantID string, series []TimeSeries) (RemoteWriteStats, error) {
+	var stats RemoteWriteStats
+
+	// Counters are turned into rates, which needs the samples in time order
+	var points []remotePoint
+	for _, ts := range series {
+		name := ts.Labels["__name__"]
+		if name == "" {
+			return stats, fmt.Errorf("series without a metric name")
+		}
+		device := remoteDevice(ts.Labels)
+
+		for _, sample := range ts.Samples {
+			if math.IsNaN(sample.Value) {
+				// Staleness markers and gaps
+				continue
+			}
+			points = append(points, remotePoint{name: name, labels: ts.Labels, device: device, RemoteSample: sample})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+	stats.Samples = len(points)
+
+	fs := newFrames(tenantID)
+	var generic []models.GenericSample
+	for _, point := range points {
+		if point.device.DeviceID != "" && mapRemotePoint(fs, point) {
+			continue
+		}
+
+		labels := make(map[string]string, len(point.labels))
+		for name, value := range point.labels {
+			if name != "__name__" {
+				labels[name] = value
+			}
+		}
+		generic = append(generic, models.GenericSample{
+			Name:      point.name,
+			DeviceID:  point.device.DeviceID,
+			Type:      remoteSeriesType(point.name),
+			Labels:    labels,
+			Timestamp: point.Timestamp,
+			Value:     point.Value,
+		})
+	}
+
+	stored, err := fs.store(db)
+	stats.Frames = stored
+	if err != nil {
+		return stats, err
+	}
+
+	if err := StoreGeneric(db, tenantID, generic); err != nil {
+		return stats, err
+	}
+	stats.GenericSamples = len(generic)
+
+	return stats, nil
+}
+
+// mapRemotePoint puts a node_exporter or process-exporter sample into the frame of its device, it returns
+// false for the series it doesn't know
+func mapRemotePoint(fs *frames, point remotePoint) bool {
+	f := fs.get(point.device, point.Timestamp)
+	labels := point.labels
+	value := point.Value
+
+	// Counters keyed by series, so every one of them has its own previous reading
+	rate := func() (float64, bool) {
+		key := point.name
+		for _, label := range []string{"cpu", "mode", "device", "groupname"} {
+			key += "/" + labels[label]
+		}
+		return fs.state(f).rate(key, value, point.Timestamp)
+	}
+
+	switch point.name {
+	case "node_cpu_seconds_total":
+		if perSecond, ok := rate(); ok {
+			f.addCPUTime(labels["cpu"], labels["mode"], perSecond)
+		}
+
+	case "node_memory_MemTotal_bytes":
+		f.host.TotalMemory = int64(value)
+		f.report(hostTotalMemory)
+
+	case "node_memory_MemAvailable_bytes":
+		f.setMemoryAvailable(int64(value))
+
+	case "node_load1":
+		f.host.LoadAvg1 = value
+		f.report(hostLoad1)
+	case "node_load5":
+		f.host.LoadAvg5 = value
+		f.report(hostLoad5)
+	case "node_load15":
+		f.host.LoadAvg15 = value
+		f.report(hostLoad15)
+
+	case "node_filesystem_size_bytes", "node_filesystem_free_bytes", "node_filesystem_files", "node_filesystem_files_free":
+		if ignoredFSTypes[labels["fstype"]] || labels["mountpoint"] == "" {
+			return true
+		}
+
+		disk := f.disk(labels["mountpoint"])
+		disk.FileSystem, disk.FSType = labels["device"], labels["fstype"]
+		switch point.name {
+		case "node_filesystem_size_bytes":
+			// Used space is the size minus the free space, whichever comes first
+			disk.UsedBytes += int64(value)
+			disk.TotalBytes = int64(value)
+		case "node_filesystem_free_bytes":
+			disk.UsedBytes -= int64(value)
+		case "node_filesystem_files":
+			disk.InodesUsed += int64(value)
+			disk.InodesTotal = int64(value)
+		case "node_filesystem_files_free":
+			disk.InodesUsed -= int64(value)
+		}
+
+	case "node_filesystem_avail_bytes", "node_filesystem_readonly", "node_filesystem_device_error":
+		// Known, but nothing to store them as
+		return !ignoredFSTypes[labels["fstype"]]
+
+	case "node_network_receive_bytes_total", "node_network_transmit_bytes_total",
+		"node_network_receive_packets_total", "node_network_transmit_packets_total",
+		"node_network_receive_errs_total", "node_network_transmit_errs_total",
+		"node_network_receive_drop_total", "node_network_transmit_drop_total":
+		iface := f.networkInterface(labels["device"])
+		counter := uint64(value)
+		switch strings.TrimPrefix(point.name, "node_network_") {
+		case "receive_bytes_total":
+			iface.RxBytes = counter
+		case "transmit_bytes_total":
+			iface.TxBytes = counter
+		case "receive_packets_total":
+			iface.RxPackets = counter
+		case "transmit_packets_total":
+			iface.TxPackets = counter
+		case "receive_errs_total":
+			iface.RxErrors = counter
+		case "transmit_errs_total":
+			iface.TxErrors = counter
+		case "receive_drop_total":
+			iface.RxDrops = counter
+		case "transmit_drop_total":
+			iface.TxDrops = counter
+		}
+
+	case "namedprocess_namegroup_cpu_seconds_total":
+		group := labels["groupname"]
+		if perSecond, ok := rate(); ok {
+			f.addProcessCPUTime(group, 0, group, perSecond)
+		}
+
+	case "namedprocess_namegroup_memory_bytes":
+		if labels["memtype"] != "resident" {
+			return true
+		}
+		group := labels["groupname"]
+		f.process(group, 0, group).RAMUsage = int64(value)
+
+	case "namedprocess_namegroup_num_threads":
+		group := labels["groupname"]
+		threads := int(value)
+		f.process(group, 0, group).Threads = &threads
+
+	case "namedprocess_namegroup_open_filedesc":
+		group := labels["groupname"]
+		fds := int(value)
+		f.process(group, 0, group).OpenFDs = &fds
+
+	case "namedprocess_namegroup_read_bytes_total":
+		group := labels["groupname"]
+		bytes := int64(value)
+		f.process(group, 0, group).ReadBytes = &bytes
+
+	case "namedprocess_namegroup_write_bytes_total":
+		group := labels["groupname"]
+		bytes := int64(value)
+		f.process(group, 0, group).WriteBytes = &bytes
+
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,121 @@
+package ingest
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A prometheus.WriteRequest with node_load1{instance="web-1:9100",job="node"} at 0.25 and 0.5,
+// up{instance="web-1:9100"} at 1 and the metadata of up, which is skipped
+const writeRequestHex = "0a610a160a085f5f6e616d655f5f120a6e6f64655f6c6f6164310a160a08696e7374616e6365120a7765622d313a393130300a0b" +
+	"0a036a6f6212046e6f6465121009000000000000d03f1080d095ffbc31121009000000000000e03f1098c596ffbc310a3a0a0e0a085f5f6e61" +
+	"6d655f5f120275700a160a08696e7374616e6365120a7765622d313a39313030121009000000000000f03f1080d095ffbc311a0608011202" +
+	"7570"
+
+// The same request snappy compressed, with back references for the repeated labels
+const compressedWriteRequestHex = "a701640a610a160a085f5f6e616d655f5f120a6e6f64655f6c6f616431011870696e7374616e6365120a7765" +
+	"622d313a393130300a0b0a036a6f621204012b0c12100900050120d03f1080d095ffbc31151230e03f1098c596ffbc310a3a0a0e1d6308027570" +
+	"01734e5b00154e00f0114e0c1a0608010132"
+
+var wantWriteRequest = []TimeSeries{
+	{
+		Labels:  map[string]string{"__name__": "node_load1", "instance": "web-1:9100", "job": "node"},
+		Samples: []RemoteSample{{Value: 0.25, Timestamp: 1700000000000}, {Value: 0.5, Timestamp: 1700000015000}},
+	},
+	{
+		Labels:  map[string]string{"__name__": "up", "instance": "web-1:9100"},
+		Samples: []RemoteSample{{Value: 1, Timestamp: 1700000000000}},
+	},
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	series, err := DecodeWriteRequest(mustHex(t, writeRequestHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(series, wantWriteRequest) {
+		t.Errorf("got %+v, want %+v", series, wantWriteRequest)
+	}
+}
+
+func TestDecodeCompressedWriteRequest(t *testing.T) {
+	body, err := DecodeSnappy(mustHex(t, compressedWriteRequestHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, writeRequestHex); string(body) != string(want) {
+		t.Fatalf("decompressed to %x, want %x", body, want)
+	}
+
+	series, err := DecodeWriteRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(series, wantWriteRequest) {
+		t.Errorf("got %+v, want %+v", series, wantWriteRequest)
+	}
+}
+
+func TestDecodeWriteRequestTruncated(t *testing.T) {
+	body := mustHex(t, writeRequestHex)
+	for _, n := range []int{1, 2, 20, 50, 98, len(body) - 1} {
+		if _, err := DecodeWriteRequest(body[:n]); err == nil {
+			t.Errorf("no error for the first %d bytes", n)
+		}
+	}
+}
+
+func TestProtoReader(t *testing.T) {
+	// Field 1 varint 300, field 2 sint32 -3, field 3 packed varints 1 2 150, field 4 unpacked varint 7 and
+	// field 5 fixed32 1
+	r := newProtoReader(mustHex(t, "08ac02"+"1005"+"1a0401029601"+"2007"+"2d01000000"))
+
+	field, wireType, err := r.next()
+	if value, _ := r.varint(); err != nil || field != 1 || wireType != wireVarint || value != 300 {
+		t.Errorf("field 1: got %d %d %d %v", field, wireType, value, err)
+	}
+
+	field, _, _ = r.next()
+	if value, err := r.sint32(); err != nil || field != 2 || value != -3 {
+		t.Errorf("field 2: got %d %d %v", field, value, err)
+	}
+
+	var values []uint64
+	read := func(p *protoReader) error {
+		value, err := p.varint()
+		values = append(values, value)
+		return err
+	}
+	field, wireType, _ = r.next()
+	if err := r.repeated(wireType, wireVarint, read); err != nil || field != 3 {
+		t.Errorf("field 3: %v", err)
+	}
+	field, wireType, _ = r.next()
+	if err := r.repeated(wireType, wireVarint, read); err != nil || field != 4 {
+		t.Errorf("field 4: %v", err)
+	}
+	if !reflect.DeepEqual(values, []uint64{1, 2, 150, 7}) {
+		t.Errorf("repeated values: got %v", values)
+	}
+
+	_, wireType, _ = r.next()
+	if err := r.skip(wireType); err != nil || !r.done() {
+		t.Errorf("field 5: %v, done %v", err, r.done())
+	}
+
+	if err := newProtoReader(mustHex(t, "33")).skip(3); err == nil {
+		t.Error("group wire type: no error")
+	}
+}
+
+func FuzzDecodeWriteRequest(f *testing.F) {
+	f.Add(mustHex(f, writeRequestHex))
+	f.Add(mustHex(f, compressedWriteRequestHex))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if decoded, err := DecodeSnappy(body); err == nil {
+			body = decoded
+		}
+		DecodeWriteRequest(body)
+	})
+}
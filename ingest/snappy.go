@@ -0,0 +1,96 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Largest body accepted once decompressed, guards against a length prefix asking for huge allocations
+const maxDecodedSize = 64 << 20
+
+var errCorruptSnappy = errors.New("corrupt snappy block")
+
+// DecodeSnappy decompresses a snappy block, the framing Prometheus remote write uses. The block is the
+// uncompressed length as a varint followed by literals and back references to what was decoded before.
+func DecodeSnappy(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errCorruptSnappy
+	}
+	if length > maxDecodedSize {
+		return nil, fmt.Errorf("snappy block of %d bytes is over the %d bytes limit", length, maxDecodedSize)
+	}
+
+	dst := make([]byte, 0, length)
+	for s := n; s < len(src); {
+		tag := src[s]
+		s++
+
+		var literalLength, copyLength, offset int
+		switch tag & 0x03 {
+		case 0x00:
+			// Literal, lengths over 60 bytes are stored in the 1 to 4 bytes after the tag
+			literalLength = int(tag >> 2)
+			if literalLength >= 60 {
+				extra := literalLength - 59
+				if s+extra > len(src) {
+					return nil, errCorruptSnappy
+				}
+				literalLength = 0
+				for i := extra - 1; i >= 0; i-- {
+					literalLength = literalLength<<8 | int(src[s+i])
+				}
+				s += extra
+			}
+			literalLength++
+
+			if literalLength <= 0 || s+literalLength > len(src) {
+				return nil, errCorruptSnappy
+			}
+			dst = append(dst, src[s:s+literalLength]...)
+			s += literalLength
+			continue
+
+		case 0x01:
+			if s >= len(src) {
+				return nil, errCorruptSnappy
+			}
+			copyLength = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[s])
+			s++
+
+		case 0x02:
+			if s+2 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s:]))
+			s += 2
+
+		case 0x03:
+			if s+4 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s:]))
+			s += 4
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+copyLength) > length {
+			return nil, errCorruptSnappy
+		}
+
+		// Copies can overlap what they write, so go byte by byte
+		start := len(dst) - offset
+		for i := 0; i < copyLength; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, errCorruptSnappy
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,78 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func mustHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeSnappy(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []byte
+	}{
+		{"empty", "00", []byte{}},
+		{"literal", "05" + "10" + hex.EncodeToString([]byte("hello")), []byte("hello")},
+		// "abc" then a 1 byte offset copy of 9 bytes at offset 3, overlapping what it writes
+		{"overlapping copy", "0c" + "08616263" + "1503", []byte("abcabcabcabc")},
+		// 2 and 4 byte offset copies of 10 bytes at offset 10
+		{"copy with 2 byte offset", "14" + "24" + hex.EncodeToString([]byte("0123456789")) + "260a00", []byte("01234567890123456789")},
+		{"copy with 4 byte offset", "14" + "24" + hex.EncodeToString([]byte("0123456789")) + "270a000000", []byte("01234567890123456789")},
+		// Literals over 60 bytes store their length after the tag
+		{"long literal", "64" + "f063" + hex.EncodeToString([]byte(strings.Repeat("x", 100))), []byte(strings.Repeat("x", 100))},
+	}
+
+	for _, test := range tests {
+		got, err := DecodeSnappy(mustHex(t, test.src))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeSnappyCorrupt(t *testing.T) {
+	tests := map[string]string{
+		"no length":             "",
+		"truncated literal":     "05" + "10" + "6865",
+		"copy before any data":  "04" + "0100",
+		"offset past output":    "08" + "08616263" + "0105",
+		"longer than declared":  "02" + "08616263",
+		"shorter than declared": "05" + "08616263",
+		"truncated copy":        "08" + "08616263" + "26",
+		"huge length":           "ffffffff0f",
+	}
+
+	for name, src := range tests {
+		if _, err := DecodeSnappy(mustHex(t, src)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func FuzzDecodeSnappy(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03})
+	f.Add([]byte{0x14, 0x24, '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 0x27, 0x0a, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		decoded, err := DecodeSnappy(src)
+		if err == nil && len(decoded) > maxDecodedSize {
+			t.Fatalf("decoded %d bytes, over the limit", len(decoded))
+		}
+	})
+}
@@ -0,0 +1,484 @@
+package ingest
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsD metric types, DogStatsD distributions are kept like timers
+const (
+	statsdCounter   = "c"
+	statsdGauge     = "g"
+	statsdTimer     = "ms"
+	statsdHistogram = "h"
+	statsdDistrib   = "d"
+	statsdSet       = "s"
+)
+
+// Tags resolving the tenant and the device of a StatsD metric, the tenant tag isn't kept as a label
+const (
+	StatsDTenantTag   = "tenant"
+	statsdDeviceIDTag = "device_id"
+	statsdHostTag     = "host"
+)
+
+// StatsDMetric is a metric of a StatsD line, name:value|type|@rate|#tag:value,...
+type StatsDMetric struct {
+	Name string
+	Type string
+	// DogStatsD packs several values of one metric in a line
+	Values []float64
+	// Set members are kept as written
+	Members []string
+	// Gauges written with a sign adjust the last value
+	Relative   bool
+	SampleRate float64
+	Tags       map[string]string
+}
+
+// ParseStatsD reads the metrics of a packet, one per line. Events and service checks are skipped. Lines that
+// can't be parsed are returned as errors, so the others can still be used.
+func ParseStatsD(packet []byte) ([]StatsDMetric, []error) {
+	var metrics []StatsDMetric
+	var errs []error
+
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+			continue
+		}
+
+		metric, err := parseStatsDLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid line %q: %v", line, err))
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, errs
+}
+
+func parseStatsDLine(line string) (StatsDMetric, error) {
+	metric := StatsDMetric{SampleRate: 1, Tags: make(map[string]string)}
+
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return metric, fmt.Errorf("missing type")
+	}
+
+	colon := strings.Index(parts[0], ":")
+	if colon <= 0 {
+		return metric, fmt.Errorf("expected name:value")
+	}
+	metric.Name = parts[0][:colon]
+	metric.Type = parts[1]
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return metric, fmt.Errorf("invalid sample rate %q", part)
+			}
+			metric.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				name, value := tag, ""
+				if i := strings.Index(tag, ":"); i >= 0 {
+					name, value = tag[:i], tag[i+1:]
+				}
+				metric.Tags[name] = value
+			}
+		}
+		// Other DogStatsD extensions, like the container ID, are ignored
+	}
+
+	values := strings.Split(parts[0][colon+1:], ":")
+	switch metric.Type {
+	case statsdSet:
+		metric.Members = values
+		return metric, nil
+	case statsdCounter, statsdGauge, statsdTimer, statsdHistogram, statsdDistrib:
+	default:
+		return metric, fmt.Errorf("unknown type %q", metric.Type)
+	}
+
+	for _, value := range values {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return metric, fmt.Errorf("invalid value %q", value)
+		}
+		metric.Values = append(metric.Values, f)
+	}
+	if metric.Type == statsdGauge && (strings.HasPrefix(values[0], "+") || strings.HasPrefix(values[0], "-")) {
+		metric.Relative = true
+	}
+
+	return metric, nil
+}
+
+// statsdEntry is what was received of a series since the last flush
+type statsdEntry struct {
+	tenantID string
+	device   models.DeviceData
+	name     string
+	kind     string
+	labels   map[string]string
+	updated  bool
+	// Last value of a gauge, total of a counter
+	value   float64
+	samples []float64
+	// Number of timer samples sent by the clients, each sample standing for 1/rate of them
+	count   float64
+	members map[string]bool
+	// Flushes since the last update of a gauge or counter
+	idle int
+}
+
+// StatsD aggregates StatsD metrics between two flushes, like a StatsD server. Gauges keep their last value,
+// counters their total since the start, timers and histograms are summarised into count, sum, min and max, and
+// sets into the number of distinct members.
+type StatsD struct {
+	mu      sync.Mutex
+	entries map[string]*statsdEntry
+	// Flushes after which a gauge or counter that wasn't updated is forgotten
+	expireFlushes int
+}
+
+// Flushes a gauge or counter is kept without updates when the listener isn't told otherwise
+const DefaultStatsDExpireFlushes = 360
+
+// NewStatsD returns an aggregator forgetting the gauges and counters not updated for expireFlushes flushes,
+// DefaultStatsDExpireFlushes when it isn't positive
+func NewStatsD(expireFlushes int) *StatsD {
+	if expireFlushes <= 0 {
+		expireFlushes = DefaultStatsDExpireFlushes
+	}
+	return &StatsD{entries: make(map[string]*statsdEntry), expireFlushes: expireFlushes}
+}
+
+// statsdDevice returns the device a metric is about, from the device_id tag or else the host tag
+func statsdDevice(tags map[string]string) models.DeviceData {
+	device := models.DeviceData{DeviceID: tags[statsdDeviceIDTag], Hostname: tags[statsdHostTag]}
+	if device.DeviceID == "" {
+		device.DeviceID = device.Hostname
+	}
+	if device.Hostname == "" {
+		device.Hostname = device.DeviceID
+	}
+	return device
+}
+
+// Add adds a metric to the series of its tenant, metrics without a valid tenant tag are refused
+func (s *StatsD) Add(metric StatsDMetric) error {
+	tenantID := metric.Tags[StatsDTenantTag]
+	if tenantID == "" {
+		return fmt.Errorf("metric %s without a %s tag", metric.Name, StatsDTenantTag)
+	}
+	if !models.ValidTenantID(tenantID) {
+		return fmt.Errorf("metric %s of invalid tenant %q", metric.Name, tenantID)
+	}
+
+	labels := make(map[string]string, len(metric.Tags))
+	for name, value := range metric.Tags {
+		if name != StatsDTenantTag {
+			labels[name] = value
+		}
+	}
+	key := metric.Type + "/" + tenantID + "/" + genericKey(metric.Name, labels)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &statsdEntry{
+			tenantID: tenantID,
+			device:   statsdDevice(metric.Tags),
+			name:     metric.Name,
+			kind:     metric.Type,
+			labels:   labels,
+			members:  make(map[string]bool),
+		}
+		s.entries[key] = entry
+	}
+	entry.updated = true
+
+	switch metric.Type {
+	case statsdCounter:
+		for _, value := range metric.Values {
+			entry.value += value / metric.SampleRate
+		}
+	case statsdGauge:
+		for _, value := range metric.Values {
+			if metric.Relative {
+				entry.value += value
+			} else {
+				entry.value = value
+			}
+		}
+	case statsdSet:
+		for _, member := range metric.Members {
+			entry.members[member] = true
+		}
+	default:
+		entry.samples = append(entry.samples, metric.Values...)
+		entry.count += float64(len(metric.Values)) / metric.SampleRate
+	}
+
+	return nil
+}
+
+// genericKey identifies a series by its name and labels in name order
+func genericKey(name string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, label := range names {
+		b.WriteByte(0)
+		b.WriteString(label)
+		b.WriteByte('=')
+		b.WriteString(labels[label])
+	}
+	return b.String()
+}
+
+// StatsDFlushStats says what a flush was stored as
+type StatsDFlushStats struct {
+	Series         int
+	Frames         int
+	GenericSamples int
+	// Series of tenants that don't exist, they are dropped
+	Refused int
+}
+
+// take returns the series updated since the last flush by tenant, and starts the next flush interval
+func (s *StatsD) take() map[string][]statsdEntry {
+	byTenant := make(map[string][]statsdEntry)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, entry := range s.entries {
+		if !entry.updated {
+			// Gauges and counters are kept for relative updates and totals until they expire, the others are dropped.
+			// Any tag set makes a series, those of clients long gone would pile up.
+			entry.idle++
+			if (entry.kind != statsdGauge && entry.kind != statsdCounter) || entry.idle >= s.expireFlushes {
+				delete(s.entries, key)
+			}
+			continue
+		}
+
+		byTenant[entry.tenantID] = append(byTenant[entry.tenantID], *entry)
+		entry.updated = false
+		entry.idle = 0
+		entry.samples = nil
+		entry.count = 0
+		entry.members = make(map[string]bool)
+	}
+
+	return byTenant
+}
+
+// forget drops the series of a tenant and returns how many there were
+func (s *StatsD) forget(tenantID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	forgotten := 0
+	for key, entry := range s.entries {
+		if entry.tenantID == tenantID {
+			delete(s.entries, key)
+			forgotten++
+		}
+	}
+	return forgotten
+}
+
+// Flush stores the series updated since the last flush at now. Gauges named like the host, process and disk
+// metrics of the Prometheus API become samples of their device, the other series are stored as generic series.
+// Only tenants that exist are stored, the series of the others are dropped. A tenant failing to store doesn't stop
+// the others, the errors of all of them are returned together.
+func (s *StatsD) Flush(db *sql.DB, now time.Time) (StatsDFlushStats, error) {
+	var stats StatsDFlushStats
+	var errs []error
+	timestamp := now.UnixMilli()
+
+	for tenantID, entries := range s.take() {
+		exists, err := models.TenantExists(db, tenantID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error checking tenant %s: %v", tenantID, err))
+			continue
+		}
+		if !exists {
+			stats.Refused += s.forget(tenantID)
+			continue
+		}
+
+		fs := newFrames(tenantID)
+		var generic []models.GenericSample
+		add := func(entry statsdEntry, suffix string, value float64) {
+			metricType := models.GenericGauge
+			if entry.kind == statsdCounter {
+				metricType = models.GenericCounter
+			}
+
+			generic = append(generic, models.GenericSample{
+				Name:      entry.name + suffix,
+				DeviceID:  entry.device.DeviceID,
+				Type:      metricType,
+				Labels:    entry.labels,
+				Timestamp: timestamp,
+				Value:     value,
+			})
+		}
+
+		for _, entry := range entries {
+			stats.Series++
+
+			switch entry.kind {
+			case statsdGauge:
+				if entry.device.DeviceID == "" || !mapStatsDGauge(fs.get(entry.device, timestamp), entry) {
+					add(entry, "", entry.value)
+				}
+			case statsdCounter:
+				add(entry, "", entry.value)
+			case statsdSet:
+				add(entry, "", float64(len(entry.members)))
+			default:
+				if len(entry.samples) == 0 {
+					continue
+				}
+				sum, min, max := 0.0, entry.samples[0], entry.samples[0]
+				for _, value := range entry.samples {
+					sum += value
+					min = math.Min(min, value)
+					max = math.Max(max, value)
+				}
+				add(entry, "_count", entry.count)
+				add(entry, "_sum", sum)
+				add(entry, "_min", min)
+				add(entry, "_max", max)
+			}
+		}
+
+		stored, err := fs.store(db)
+		stats.Frames += stored
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error storing samples of tenant %s: %v", tenantID, err))
+		}
+
+		if err := StoreGeneric(db, tenantID, generic); err != nil {
+			errs = append(errs, fmt.Errorf("error storing series of tenant %s: %v", tenantID, err))
+			continue
+		}
+		stats.GenericSamples += len(generic)
+	}
+
+	return stats, joinErrors(errs)
+}
+
+// joinErrors returns an error with the messages of errs, nil when there are none
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+// mapStatsDGauge puts a gauge named like a metric of the Prometheus API into the frame of its device, it
+// returns false for the gauges it doesn't know. Process gauges need a pid tag, disk gauges a mount tag.
+func mapStatsDGauge(f *frame, entry statsdEntry) bool {
+	value := entry.value
+
+	switch entry.name {
+	case "host_cpu_usage_percent":
+		f.host.CPUUsage = value
+		f.report(hostCPU)
+	case "host_memory_used_bytes":
+		f.host.RAMUsage = int64(value)
+		f.report(hostRAM)
+	case "host_memory_total_bytes":
+		f.host.TotalMemory = int64(value)
+		f.report(hostTotalMemory)
+	case "host_load1":
+		f.host.LoadAvg1 = value
+		f.report(hostLoad1)
+	case "host_load5":
+		f.host.LoadAvg5 = value
+		f.report(hostLoad5)
+	case "host_load15":
+		f.host.LoadAvg15 = value
+		f.report(hostLoad15)
+
+	case "process_cpu_usage_percent", "process_memory_bytes", "process_threads", "process_open_fds",
+		"process_read_bytes_total", "process_write_bytes_total":
+		pid, err := strconv.Atoi(entry.labels["pid"])
+		if err != nil {
+			return false
+		}
+
+		process := f.process(entry.labels["pid"], pid, entry.labels["process"])
+		if command := entry.labels["command"]; command != "" {
+			process.Command = command
+		}
+		switch entry.name {
+		case "process_cpu_usage_percent":
+			process.CPUUsage = value
+		case "process_memory_bytes":
+			process.RAMUsage = int64(value)
+		case "process_threads":
+			threads := int(value)
+			process.Threads = &threads
+		case "process_open_fds":
+			fds := int(value)
+			process.OpenFDs = &fds
+		case "process_read_bytes_total":
+			bytes := int64(value)
+			process.ReadBytes = &bytes
+		case "process_write_bytes_total":
+			bytes := int64(value)
+			process.WriteBytes = &bytes
+		}
+
+	case "disk_used_bytes", "disk_total_bytes":
+		mount := entry.labels["mount"]
+		if mount == "" {
+			return false
+		}
+
+		disk := f.disk(mount)
+		if entry.name == "disk_used_bytes" {
+			disk.UsedBytes = int64(value)
+		} else {
+			disk.TotalBytes = int64(value)
+		}
+
+	default:
+		return false
+	}
+
+	return true
+}
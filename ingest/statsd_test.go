@@ -0,0 +1,268 @@
+package ingest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseStatsD(t *testing.T) {
+	tests := []struct {
+		line string
+		want StatsDMetric
+	}{
+		{"page.views:1|c", StatsDMetric{Name: "page.views", Type: "c", Values: []float64{1}}},
+		{"page.views:3|c|@0.1", StatsDMetric{Name: "page.views", Type: "c", Values: []float64{3}, SampleRate: 0.1}},
+		{"temperature:21.5|g", StatsDMetric{Name: "temperature", Type: "g", Values: []float64{21.5}}},
+		// Signed gauges adjust the last value
+		{"queue:+3|g", StatsDMetric{Name: "queue", Type: "g", Values: []float64{3}, Relative: true}},
+		{"queue:-2|g", StatsDMetric{Name: "queue", Type: "g", Values: []float64{-2}, Relative: true}},
+		{"latency:12.5|ms|@0.5", StatsDMetric{Name: "latency", Type: "ms", Values: []float64{12.5}, SampleRate: 0.5}},
+		{"size:512|h", StatsDMetric{Name: "size", Type: "h", Values: []float64{512}}},
+		// DogStatsD packs several values in a line
+		{"latency:1:2:3|d", StatsDMetric{Name: "latency", Type: "d", Values: []float64{1, 2, 3}}},
+		{"users:alice|s", StatsDMetric{Name: "users", Type: "s", Members: []string{"alice"}}},
+		// DogStatsD tags, with a tag without value, and the container ID extension
+		{
+			"requests:1|c|@0.25|#tenant:t1,host:web-1,route:/a:b,canary|c:0123abc",
+			StatsDMetric{
+				Name: "requests", Type: "c", Values: []float64{1}, SampleRate: 0.25,
+				Tags: map[string]string{"tenant": "t1", "host": "web-1", "route": "/a:b", "canary": ""},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		metrics, errs := ParseStatsD([]byte(test.line))
+		if len(errs) > 0 || len(metrics) != 1 {
+			t.Errorf("ParseStatsD(%q) = %+v, %v, want one metric", test.line, metrics, errs)
+			continue
+		}
+
+		want := test.want
+		if want.SampleRate == 0 {
+			want.SampleRate = 1
+		}
+		if want.Tags == nil {
+			want.Tags = map[string]string{}
+		}
+		if !reflect.DeepEqual(metrics[0], want) {
+			t.Errorf("ParseStatsD(%q) = %+v, want %+v", test.line, metrics[0], want)
+		}
+	}
+}
+
+func TestParseStatsDErrors(t *testing.T) {
+	lines := []string{
+		"page.views",
+		"page.views:1",
+		":1|c",
+		"page.views:1|x",
+		"page.views:abc|c",
+		"page.views:1::2|c",
+		"temperature:NaN|g",
+		"temperature:+Inf|g",
+		"page.views:1|c|@0",
+		"page.views:1|c|@1.5",
+		"page.views:1|c|@x",
+	}
+
+	for _, line := range lines {
+		if metrics, errs := ParseStatsD([]byte(line)); len(metrics) != 0 || len(errs) != 1 {
+			t.Errorf("ParseStatsD(%q) = %+v, %v, want an error", line, metrics, errs)
+		}
+	}
+}
+
+func TestParseStatsDPacket(t *testing.T) {
+	// Events and service checks are skipped, bad lines don't drop the others
+	packet := "_e{5,4}:title|text\npage.views:1|c\n\n_sc|disk|0\nbad\nqueue:2|g\n"
+
+	metrics, errs := ParseStatsD([]byte(packet))
+	if len(metrics) != 2 || metrics[0].Name != "page.views" || metrics[1].Name != "queue" {
+		t.Errorf("got metrics %+v, want page.views and queue", metrics)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got errors %v, want one", errs)
+	}
+}
+
+// statsdTestEntry returns the entry of a series of tenant t1
+func statsdTestEntry(t *testing.T, s *StatsD, kind string, name string, labels map[string]string) *statsdEntry {
+	t.Helper()
+	entry, ok := s.entries[kind+"/t1/"+genericKey(name, labels)]
+	if !ok {
+		t.Fatalf("no %s series %s%v", kind, name, labels)
+	}
+	return entry
+}
+
+func TestStatsDAdd(t *testing.T) {
+	s := NewStatsD(0)
+	packet := "" +
+		// Counters are scaled by their sample rate
+		"requests:1|c|@0.1|#tenant:t1\n" +
+		"requests:2|c|#tenant:t1\n" +
+		// Gauges keep their last value, signed ones adjust it
+		"queue:5|g|#tenant:t1\n" +
+		"queue:+3|g|#tenant:t1\n" +
+		"queue:-2|g|#tenant:t1\n" +
+		// Timers keep their samples, the count is scaled by the sample rate
+		"latency:10:30|ms|@0.5|#tenant:t1\n" +
+		"latency:20|ms|#tenant:t1\n" +
+		"users:alice|s|#tenant:t1\n" +
+		"users:bob|s|#tenant:t1\n" +
+		"users:alice|s|#tenant:t1\n" +
+		// Series are told apart by their tags, the tenant tag isn't a label
+		"requests:1|c|#tenant:t1,host:web-1,route:/a\n"
+
+	metrics, errs := ParseStatsD([]byte(packet))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	for _, metric := range metrics {
+		if err := s.Add(metric); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(s.entries) != 5 {
+		t.Errorf("got %d series, want 5", len(s.entries))
+	}
+	if entry := statsdTestEntry(t, s, "c", "requests", map[string]string{}); entry.value != 12 {
+		t.Errorf("counter is %v, want 12", entry.value)
+	}
+	if entry := statsdTestEntry(t, s, "g", "queue", map[string]string{}); entry.value != 6 {
+		t.Errorf("gauge is %v, want 6", entry.value)
+	}
+
+	timer := statsdTestEntry(t, s, "ms", "latency", map[string]string{})
+	if !reflect.DeepEqual(timer.samples, []float64{10, 30, 20}) || timer.count != 5 {
+		t.Errorf("timer has samples %v and count %v, want [10 30 20] and 5", timer.samples, timer.count)
+	}
+	if entry := statsdTestEntry(t, s, "s", "users", map[string]string{}); len(entry.members) != 2 {
+		t.Errorf("set has members %v, want alice and bob", entry.members)
+	}
+
+	tagged := statsdTestEntry(t, s, "c", "requests", map[string]string{"host": "web-1", "route": "/a"})
+	if tagged.value != 1 || tagged.device.DeviceID != "web-1" || tagged.device.Hostname != "web-1" {
+		t.Errorf("tagged counter is %v on %+v, want 1 on web-1", tagged.value, tagged.device)
+	}
+}
+
+func TestStatsDAddWithoutTenant(t *testing.T) {
+	s := NewStatsD(0)
+	if err := s.Add(StatsDMetric{Name: "requests", Type: "c", Values: []float64{1}, SampleRate: 1, Tags: map[string]string{"host": "web-1"}}); err == nil {
+		t.Error("a metric without a tenant tag was accepted")
+	}
+	if len(s.entries) != 0 {
+		t.Errorf("got %d series, want none", len(s.entries))
+	}
+}
+
+func TestStatsDAddInvalidTenant(t *testing.T) {
+	s := NewStatsD(0)
+	for _, tenantID := range []string{"t1`; DROP DATABASE x", "a.b", strings.Repeat("t", 60)} {
+		if err := s.Add(StatsDMetric{Name: "requests", Type: "c", Values: []float64{1}, SampleRate: 1, Tags: map[string]string{"tenant": tenantID}}); err == nil {
+			t.Errorf("a metric of tenant %q was accepted", tenantID)
+		}
+	}
+	if len(s.entries) != 0 {
+		t.Errorf("got %d series, want none", len(s.entries))
+	}
+}
+
+func TestStatsDForget(t *testing.T) {
+	s := NewStatsD(0)
+	for _, line := range []string{"requests:1|c|#tenant:t1", "latency:3|ms|#tenant:t1", "requests:1|c|#tenant:t2"} {
+		metrics, _ := ParseStatsD([]byte(line))
+		if err := s.Add(metrics[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if forgotten := s.forget("t1"); forgotten != 2 || len(s.entries) != 1 {
+		t.Errorf("forgot %d series of t1, %d left, want 2 and 1", forgotten, len(s.entries))
+	}
+}
+
+func TestGenericKey(t *testing.T) {
+	a := genericKey("requests", map[string]string{"host": "web-1", "route": "/a"})
+	b := genericKey("requests", map[string]string{"route": "/a", "host": "web-1"})
+	if a != b {
+		t.Errorf("keys differ with the label order: %q and %q", a, b)
+	}
+
+	// Labels can't run into each other
+	if genericKey("m", map[string]string{"a": "b,c=d"}) == genericKey("m", map[string]string{"a": "b", "c": "d"}) {
+		t.Error("different labels give the same key")
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	if err := joinErrors(nil); err != nil {
+		t.Errorf("joinErrors(nil) = %v, want nil", err)
+	}
+
+	err := joinErrors([]error{fmt.Errorf("tenant t1 failed"), fmt.Errorf("tenant t2 failed")})
+	if err == nil || err.Error() != "tenant t1 failed; tenant t2 failed" {
+		t.Errorf("got %v, want both errors", err)
+	}
+}
+
+func TestStatsDTake(t *testing.T) {
+	s := NewStatsD(3)
+	add := func(line string) {
+		t.Helper()
+		metrics, errs := ParseStatsD([]byte(line))
+		if len(errs) > 0 || len(metrics) != 1 {
+			t.Fatalf("ParseStatsD(%q) = %v, %v", line, metrics, errs)
+		}
+		if err := s.Add(metrics[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// take returns the names of the series of t1, and checks which series are left
+	take := func(wantLeft ...string) []string {
+		t.Helper()
+		var names []string
+		for _, entry := range s.take()["t1"] {
+			names = append(names, entry.name)
+		}
+		sort.Strings(names)
+
+		var left []string
+		for _, entry := range s.entries {
+			left = append(left, entry.name)
+		}
+		sort.Strings(left)
+		if !reflect.DeepEqual(left, wantLeft) {
+			t.Errorf("series left %v, want %v", left, wantLeft)
+		}
+		return names
+	}
+
+	add("queue:5|g|#tenant:t1")
+	add("requests:1|c|#tenant:t1")
+	add("latency:10|ms|#tenant:t1")
+	if names := take("latency", "queue", "requests"); !reflect.DeepEqual(names, []string{"latency", "queue", "requests"}) {
+		t.Errorf("took %v", names)
+	}
+
+	// Timers without samples are dropped at once, gauges and counters after 3 flushes without updates
+	if names := take("queue", "requests"); len(names) != 0 {
+		t.Errorf("took %v of series that weren't updated", names)
+	}
+	add("queue:+1|g|#tenant:t1")
+	if names := take("queue", "requests"); !reflect.DeepEqual(names, []string{"queue"}) {
+		t.Errorf("took %v, want the updated gauge", names)
+	}
+	if entry := statsdTestEntry(t, s, "g", "queue", map[string]string{}); entry.value != 6 {
+		t.Errorf("gauge is %v, want 6", entry.value)
+	}
+	take("queue")
+	take("queue")
+	take()
+}
@@ -0,0 +1,121 @@
+// Package ingest stores samples arriving through the foreign protocols (Prometheus remote write, OTLP,
+// Influx line protocol, StatsD) the same way as the samples of our own agent.
+package ingest
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// Store saves a sample of a device, creating the tenant db and its tables on first use
+func Store(db *sql.DB, tenantID string, device models.DeviceData, performance models.PerformanceData) error {
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		return fmt.Errorf("error creating PerformanceDB: %v", err)
+	}
+
+	if err := models.InsertPerformanceData(db, tenantID, device, performance); err != nil {
+		return fmt.Errorf("error inserting performance data: %v", err)
+	}
+
+	stateOf(tenantID, device.DeviceID).rememberHost(performance)
+	return nil
+}
+
+// StoreGeneric saves samples of series that have no table of their own
+func StoreGeneric(db *sql.DB, tenantID string, samples []models.GenericSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		return fmt.Errorf("error creating PerformanceDB: %v", err)
+	}
+
+	if err := models.InsertGenericSamples(db, tenantID, samples); err != nil {
+		return fmt.Errorf("error inserting generic samples: %v", err)
+	}
+
+	return nil
+}
+
+// StoreHistograms saves samples of histogram and summary series
+func StoreHistograms(db *sql.DB, tenantID string, samples []models.HistogramSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	if err := models.CreatePerformanceDB(db, tenantID); err != nil {
+		return fmt.Errorf("error creating PerformanceDB: %v", err)
+	}
+
+	if err := models.InsertHistogramSamples(db, tenantID, samples); err != nil {
+		return fmt.Errorf("error inserting histogram samples: %v", err)
+	}
+
+	return nil
+}
+
+// Protocols sending counters or partial samples need what was last seen of a device: the previous value of
+// every counter to turn it into a rate, and the last host values to complete samples that only carry processes.
+type deviceState struct {
+	mu       sync.Mutex
+	host     models.PerformanceData
+	hasHost  bool
+	counters map[string]counterReading
+}
+
+type counterReading struct {
+	value float64
+	// Milliseconds since the epoch
+	timestamp int64
+}
+
+var deviceStates sync.Map
+
+func stateOf(tenantID string, deviceID string) *deviceState {
+	state, _ := deviceStates.LoadOrStore(tenantID+"/"+deviceID, &deviceState{counters: make(map[string]counterReading)})
+	return state.(*deviceState)
+}
+
+// rate returns the per second increase of a counter since its previous reading, a drop being a reset to 0.
+// There is no rate on the first reading or when the reading isn't newer than the previous one.
+func (s *deviceState) rate(key string, value float64, timestamp int64) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.counters[key]
+	if ok && timestamp <= previous.timestamp {
+		return 0, false
+	}
+	s.counters[key] = counterReading{value: value, timestamp: timestamp}
+	if !ok {
+		return 0, false
+	}
+
+	increase := value - previous.value
+	if value < previous.value {
+		increase = value
+	}
+
+	return increase / (float64(timestamp-previous.timestamp) / 1000), true
+}
+
+// rememberHost keeps the host values of the last stored sample
+func (s *deviceState) rememberHost(performance models.PerformanceData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.host = performance
+	s.host.Processes, s.host.Disks, s.host.Interfaces, s.host.CoreUsage = nil, nil, nil, nil
+	s.hasHost = true
+}
+
+// lastHost returns the host values of the last stored sample
+func (s *deviceState) lastHost() (models.PerformanceData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.host, s.hasHost
+}
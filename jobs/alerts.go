@@ -0,0 +1,429 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often the alert rules are evaluated
+const AlertInterval = 30 * time.Second
+
+// Longest window a rule can aggregate
+const maxAlertWindow = 24 * time.Hour
+
+// How the samples of a series in the window of a rule are reduced to the value compared to its threshold.
+// Rules with AlertAbsent have no threshold, they detect the devices that sent no sample of their metric in
+// the window, that went offline.
+const (
+	AlertAvg    = "avg"
+	AlertMax    = "max"
+	AlertMin    = "min"
+	AlertLast   = "last"
+	AlertAbsent = "absent"
+)
+
+// Operators comparing the value of a series to the threshold of a rule
+var alertOperators = map[string]func(value float64, threshold float64) bool{
+	">":  func(value float64, threshold float64) bool { return value > threshold },
+	">=": func(value float64, threshold float64) bool { return value >= threshold },
+	"<":  func(value float64, threshold float64) bool { return value < threshold },
+	"<=": func(value float64, threshold float64) bool { return value <= threshold },
+	"==": func(value float64, threshold float64) bool { return value == threshold },
+	"!=": func(value float64, threshold float64) bool { return value != threshold },
+}
+
+// Severities of alert rules
+var AlertSeverities = []string{"critical", "warning", "info"}
+
+// ValidateAlertRule checks a rule of a tenant before it is saved
+func ValidateAlertRule(tenantID string, rule models.AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch rule.Aggregation {
+	case AlertAvg, AlertMax, AlertMin, AlertLast:
+		if _, ok := alertOperators[rule.Operator]; !ok {
+			return fmt.Errorf("unknown operator %q, expected >, >=, <, <=, == or !=", rule.Operator)
+		}
+		if math.IsNaN(rule.Threshold) || math.IsInf(rule.Threshold, 0) {
+			return fmt.Errorf("invalid threshold")
+		}
+	case AlertAbsent:
+		if rule.Operator != "" {
+			return fmt.Errorf("absent rules have no operator")
+		}
+	default:
+		return fmt.Errorf("unknown aggregation %q, expected avg, max, min, last or absent", rule.Aggregation)
+	}
+
+	if rule.Window <= 0 || rule.Window > maxAlertWindow {
+		return fmt.Errorf("window must be between 1s and %v", maxAlertWindow)
+	}
+	if rule.For < 0 {
+		return fmt.Errorf("for can't be negative")
+	}
+
+	knownSeverity := false
+	for _, severity := range AlertSeverities {
+		knownSeverity = knownSeverity || rule.Severity == severity
+	}
+	if !knownSeverity {
+		return fmt.Errorf("unknown severity %q, expected critical, warning or info", rule.Severity)
+	}
+
+	var filters []engine.Filter
+	if err := json.Unmarshal([]byte(rule.Filters), &filters); err != nil {
+		return fmt.Errorf("invalid filters: %v", err)
+	}
+
+	if strings.HasPrefix(rule.Metric, AnomalyMetricPrefix) {
+		if _, ok := AnomalySource(rule.Metric); !ok {
+			return fmt.Errorf("invalid anomaly detector in metric %q", rule.Metric)
+		}
+		if rule.Aggregation == AlertAbsent {
+			return fmt.Errorf("anomaly rules can't be absent rules")
+		}
+		// The series are the ones of the detector
+		if len(filters) > 0 || rule.GroupBy != "" {
+			return fmt.Errorf("anomaly rules have no filters or groupBy")
+		}
+		return nil
+	}
+
+	return engine.Validate(engine.Request{TenantID: tenantID, Metric: rule.Metric, GroupBy: rule.GroupBy, Filters: filters})
+}
+
+// RunAlerts evaluates the alert rules of every tenant, forever, every AlertInterval
+func RunAlerts(db *sql.DB) {
+	ticker := time.NewTicker(AlertInterval)
+	defer ticker.Stop()
+
+	for {
+		EvaluateAlerts(db, time.Now().UTC())
+		<-ticker.C
+	}
+}
+
+// EvaluateAlerts evaluates every rule of every tenant at now and queues the notifications of their transitions
+func EvaluateAlerts(db *sql.DB, now time.Time) {
+	tenants, err := models.ListTenants(db)
+	if err != nil {
+		log.Printf("Alerts: error listing tenants: %v", err)
+		return
+	}
+
+	for _, tenantID := range tenants {
+		rules, err := models.GetAlertRules(db, tenantID)
+		if err != nil {
+			log.Printf("Alerts: error reading the rules of tenant %s: %v", tenantID, err)
+			continue
+		}
+
+		channels, err := models.GetNotificationChannels(db, tenantID)
+		if err != nil {
+			log.Printf("Alerts: error reading the notification channels of tenant %s: %v", tenantID, err)
+			continue
+		}
+		routes, err := models.GetAlertRoutes(db, tenantID)
+		if err != nil {
+			log.Printf("Alerts: error reading the alert routes of tenant %s: %v", tenantID, err)
+			continue
+		}
+		muter, err := LoadMuter(db, tenantID, now)
+		if err != nil {
+			log.Printf("Alerts: error reading the silences of tenant %s: %v", tenantID, err)
+			continue
+		}
+		channelsByID := make(map[int64]models.NotificationChannel, len(channels))
+		for _, channel := range channels {
+			channelsByID[channel.ID] = channel
+		}
+
+		for _, rule := range rules {
+			events, err := EvaluateAlertRule(db, tenantID, rule, muter, now)
+			if err != nil {
+				log.Printf("Alerts: error evaluating rule %d of tenant %s: %v", rule.ID, tenantID, err)
+			}
+
+			var ruleChannels []models.NotificationChannel
+			for _, channelID := range routes[rule.ID] {
+				if channel, ok := channelsByID[channelID]; ok {
+					ruleChannels = append(ruleChannels, channel)
+				}
+			}
+			if err := QueueNotifications(db, tenantID, rule, ruleChannels, events, now); err != nil {
+				log.Printf("Alerts: error queueing the notifications of rule %d of tenant %s: %v", rule.ID, tenantID, err)
+			}
+		}
+	}
+}
+
+// alertValue reduces the samples of a series, false when it has none
+func alertValue(series engine.Series, aggregation string) (float64, bool) {
+	var values []float64
+	for _, sample := range series.Samples {
+		if !math.IsNaN(sample.Value) {
+			values = append(values, sample.Value)
+		}
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	value := values[0]
+	switch aggregation {
+	case AlertMax:
+		for _, v := range values {
+			value = math.Max(value, v)
+		}
+	case AlertMin:
+		for _, v := range values {
+			value = math.Min(value, v)
+		}
+	case AlertLast:
+		value = values[len(values)-1]
+	default:
+		value = 0
+		for _, v := range values {
+			value += v
+		}
+		value /= float64(len(values))
+	}
+
+	return value, true
+}
+
+// anomalySeries returns the anomalies a detector found in the window of a rule as series of their absolute scores,
+// oldest first, per device and series of the detector
+func anomalySeries(db *sql.DB, tenantID string, rule models.AlertRule, detectorID int64, now time.Time) ([]engine.DeviceResult, error) {
+	query := models.AnomalyQuery{DetectorID: detectorID, DetectedFrom: now.Add(-rule.Window).Format(timestampLayout)}
+	if len(rule.Devices) > 0 {
+		devices, err := helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), rule.Devices)
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) == 0 {
+			return nil, nil
+		}
+		for deviceID := range devices {
+			query.DeviceIDs = append(query.DeviceIDs, deviceID)
+		}
+	}
+
+	anomalies, err := models.GetAnomalies(db, tenantID, query)
+	if err != nil {
+		return nil, fmt.Errorf("error reading anomalies: %v", err)
+	}
+
+	var devices []engine.DeviceResult
+	deviceIndex := make(map[string]int)
+	seriesIndex := make(map[string]int)
+	for i := len(anomalies) - 1; i >= 0; i-- {
+		anomaly := anomalies[i]
+
+		d, ok := deviceIndex[anomaly.DeviceID]
+		if !ok {
+			d = len(devices)
+			deviceIndex[anomaly.DeviceID] = d
+			devices = append(devices, engine.DeviceResult{DeviceID: anomaly.DeviceID})
+		}
+		key := anomaly.DeviceID + "\x00" + anomaly.SeriesKey
+		s, ok := seriesIndex[key]
+		if !ok {
+			s = len(devices[d].Series)
+			seriesIndex[key] = s
+			devices[d].Series = append(devices[d].Series, engine.Series{Key: anomaly.SeriesKey, Labels: anomaly.Labels})
+		}
+
+		series := &devices[d].Series[s]
+		series.Samples = append(series.Samples, engine.Sample{Timestamp: anomaly.Timestamp, Value: math.Abs(anomaly.Score)})
+	}
+
+	return devices, nil
+}
+
+// EvaluateAlertRule compares every series of a rule to its threshold at now, moves their alerts through the
+// pending, firing and resolved states and returns the transitions, which are recorded in the history. Series
+// that stop matching or disappear resolve their alert, disabled rules match nothing. Alerts muted by muter go
+// through the same states, their transitions are marked silenced. Firing alerts whose silence ended fire again
+// so they are notified.
+func EvaluateAlertRule(db *sql.DB, tenantID string, rule models.AlertRule, muter *Muter, now time.Time) ([]models.AlertEvent, error) {
+	nowString := now.Format(timestampLayout)
+
+	type match struct {
+		deviceID string
+		series   engine.Series
+		value    float64
+	}
+	var matches []match
+
+	if rule.Enabled {
+		var devices []engine.DeviceResult
+		if detectorID, ok := AnomalySource(rule.Metric); ok {
+			var err error
+			if devices, err = anomalySeries(db, tenantID, rule, detectorID, now); err != nil {
+				return nil, err
+			}
+		} else {
+			var filters []engine.Filter
+			if err := json.Unmarshal([]byte(rule.Filters), &filters); err != nil {
+				return nil, fmt.Errorf("error reading filters: %v", err)
+			}
+
+			result, err := engine.Execute(db, engine.Request{
+				TenantID:  tenantID,
+				Metric:    rule.Metric,
+				Devices:   rule.Devices,
+				TimeStart: now.Add(-rule.Window).Format(helpers.TimestampLayout),
+				TimeEnd:   nowString,
+				GroupBy:   rule.GroupBy,
+				Filters:   filters,
+			})
+			if err != nil && !errors.Is(err, engine.ErrNoDevices) {
+				return nil, err
+			}
+			if result != nil {
+				devices = result.Devices
+			}
+		}
+
+		if rule.Aggregation == AlertAbsent {
+			reporting := make(map[string]bool)
+			for _, device := range devices {
+				for _, series := range device.Series {
+					if _, ok := alertValue(series, AlertLast); ok {
+						reporting[device.DeviceID] = true
+					}
+				}
+			}
+
+			known, err := helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), rule.Devices)
+			if err != nil {
+				return nil, err
+			}
+			deviceIDs := make([]string, 0, len(known))
+			for deviceID := range known {
+				deviceIDs = append(deviceIDs, deviceID)
+			}
+			sort.Strings(deviceIDs)
+
+			for _, deviceID := range deviceIDs {
+				if !reporting[deviceID] {
+					matches = append(matches, match{deviceID: deviceID, series: engine.Series{Labels: map[string]string{}}})
+				}
+			}
+		} else {
+			compare := alertOperators[rule.Operator]
+			for _, device := range devices {
+				for _, series := range device.Series {
+					value, ok := alertValue(series, rule.Aggregation)
+					if ok && compare(value, rule.Threshold) {
+						matches = append(matches, match{deviceID: device.DeviceID, series: series, value: value})
+					}
+				}
+			}
+		}
+	}
+
+	alerts, err := models.GetAlerts(db, tenantID, rule.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading alerts: %v", err)
+	}
+	existing := make(map[string]models.Alert, len(alerts))
+	for _, alert := range alerts {
+		existing[alert.Key] = alert
+	}
+
+	var events []models.AlertEvent
+	transition := func(alert models.Alert, state string) {
+		events = append(events, models.AlertEvent{
+			RuleID:     rule.ID,
+			Key:        alert.Key,
+			DeviceID:   alert.DeviceID,
+			SeriesKey:  alert.SeriesKey,
+			Labels:     alert.Labels,
+			State:      state,
+			Value:      alert.Value,
+			Threshold:  rule.Threshold,
+			Timestamp:  nowString,
+			SilencedBy: alert.SilencedBy,
+		})
+	}
+
+	seen := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		key := models.AlertKey(m.deviceID, m.series.Key)
+		seen[key] = true
+
+		alert, ok := existing[key]
+		if !ok {
+			alert = models.Alert{
+				RuleID:      rule.ID,
+				Key:         key,
+				DeviceID:    m.deviceID,
+				SeriesKey:   m.series.Key,
+				State:       models.AlertPending,
+				ActiveSince: nowString,
+			}
+		}
+		alert.Labels = m.series.Labels
+		alert.Value = m.value
+		alert.EvaluatedAt = nowString
+
+		wasSilenced := alert.SilencedBy != ""
+		alert.SilencedBy = muter.SilencedBy(rule, m.deviceID, m.series.Labels)
+		if !ok {
+			transition(alert, models.AlertPending)
+		} else if alert.State == models.AlertFiring && wasSilenced && alert.SilencedBy == "" {
+			transition(alert, models.AlertFiring)
+		}
+
+		activeSince, err := helpers.ParseTimestamp(alert.ActiveSince)
+		if err != nil {
+			return nil, err
+		}
+		if alert.State == models.AlertPending && now.Sub(activeSince) >= rule.For {
+			alert.State = models.AlertFiring
+			alert.FiredAt = nowString
+			transition(alert, models.AlertFiring)
+		}
+
+		if err := models.SaveAlert(db, tenantID, alert); err != nil {
+			return nil, fmt.Errorf("error saving alert: %v", err)
+		}
+	}
+
+	for key, alert := range existing {
+		if seen[key] {
+			continue
+		}
+
+		// Pending alerts that didn't last just go away
+		if err := models.DeleteAlert(db, tenantID, rule.ID, key); err != nil {
+			return nil, fmt.Errorf("error deleting alert: %v", err)
+		}
+		if alert.State == models.AlertFiring {
+			alert.SilencedBy = muter.SilencedBy(rule, alert.DeviceID, alert.Labels)
+			transition(alert, models.AlertResolved)
+		}
+	}
+
+	for _, event := range events {
+		if err := models.InsertAlertEvent(db, tenantID, event); err != nil {
+			return events, fmt.Errorf("error recording alert transition: %v", err)
+		}
+	}
+
+	return events, nil
+}
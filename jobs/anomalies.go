@@ -0,0 +1,612 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the anomaly detectors look for a new step to score
+const AnomalyInterval = time.Minute
+
+// How long after its end a step is scored, so the samples sent late are in
+const anomalyDelay = time.Minute
+
+// Models of the baselines: one for the whole training window, one per hour of the day, one per hour of the week
+const (
+	AnomalyRolling = "rolling"
+	AnomalyDaily   = "daily"
+	AnomalyWeekly  = "weekly"
+)
+
+// Deviations from the baseline that are anomalous
+const (
+	AnomalyAbove = "above"
+	AnomalyBelow = "below"
+	AnomalyBoth  = "both"
+)
+
+// Alert rules whose metric is this prefix and the ID of a detector, like anomaly:3, fire on its anomalies. Their
+// value is the absolute score of the anomalies found in their window.
+const AnomalyMetricPrefix = "anomaly:"
+
+// Longest training window
+const maxAnomalyTraining = 90 * 24 * time.Hour
+
+// Standard deviations are at least this share of the mean, so flat series don't make noise anomalous
+const minRelativeStddev = 0.01
+
+// Scores are capped, series that never moved before would score infinitely
+const maxAnomalyScore = 1000
+
+// Between two runs the steps that entered the training window are added to the baselines and those that left it are
+// removed. Baselines are learned again from the whole window this often, which drops the rounding errors, the
+// samples sent late or rolled up after their step was learned, and lets other series into the top ones.
+const anomalyRelearnInterval = 24 * time.Hour
+
+// AnomalyDefaults fills in the settings a detector was created without
+func AnomalyDefaults(detector *models.AnomalyDetector) {
+	if detector.Model == "" {
+		detector.Model = AnomalyRolling
+	}
+	if detector.Direction == "" {
+		detector.Direction = AnomalyBoth
+	}
+	if detector.Threshold == 0 {
+		detector.Threshold = 3
+	}
+
+	seasonal := detector.Model == AnomalyDaily || detector.Model == AnomalyWeekly
+	if detector.Step == 0 {
+		detector.Step = 5 * time.Minute
+		if seasonal {
+			detector.Step = time.Hour
+		}
+	}
+	if detector.Training == 0 {
+		switch detector.Model {
+		case AnomalyDaily:
+			detector.Training = 14 * 24 * time.Hour
+		case AnomalyWeekly:
+			detector.Training = 28 * 24 * time.Hour
+		default:
+			detector.Training = 24 * time.Hour
+		}
+	}
+	if detector.MinSamples == 0 {
+		detector.MinSamples = 12
+		if seasonal {
+			detector.MinSamples = 3
+		}
+	}
+}
+
+// ValidateAnomalyDetector checks a detector of a tenant before it is saved
+func ValidateAnomalyDetector(tenantID string, detector models.AnomalyDetector) error {
+	if detector.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch detector.Model {
+	case AnomalyRolling:
+	case AnomalyDaily, AnomalyWeekly:
+		// Every step has to fall in a single hour of the day
+		if detector.Step > time.Hour || time.Hour%detector.Step != 0 {
+			return fmt.Errorf("the step of daily and weekly detectors must divide an hour")
+		}
+	default:
+		return fmt.Errorf("unknown model %q, expected rolling, daily or weekly", detector.Model)
+	}
+
+	switch detector.Direction {
+	case AnomalyAbove, AnomalyBelow, AnomalyBoth:
+	default:
+		return fmt.Errorf("unknown direction %q, expected above, below or both", detector.Direction)
+	}
+
+	if detector.Step < time.Minute || detector.Step > 24*time.Hour || detector.Step%time.Second != 0 {
+		return fmt.Errorf("step must be whole seconds between 1m and 24h")
+	}
+	if detector.Training%time.Second != 0 || detector.Training > maxAnomalyTraining {
+		return fmt.Errorf("training must be whole seconds up to %v", maxAnomalyTraining)
+	}
+	if int64(detector.Training/detector.Step) > helpers.MaxBuckets {
+		return fmt.Errorf("training can't be longer than %d steps", helpers.MaxBuckets)
+	}
+	if detector.MinSamples < 2 {
+		return fmt.Errorf("minSamples must be at least 2")
+	}
+	if int64(detector.Training/detector.Step) < int64(detector.MinSamples) {
+		return fmt.Errorf("training must be at least minSamples steps")
+	}
+	if math.IsNaN(detector.Threshold) || math.IsInf(detector.Threshold, 0) || detector.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+	if math.IsNaN(detector.MinDeviation) || math.IsInf(detector.MinDeviation, 0) || detector.MinDeviation < 0 {
+		return fmt.Errorf("minDeviation can't be negative")
+	}
+	if detector.Top < 0 {
+		return fmt.Errorf("top can't be negative")
+	}
+
+	var filters []engine.Filter
+	if err := json.Unmarshal([]byte(detector.Filters), &filters); err != nil {
+		return fmt.Errorf("invalid filters: %v", err)
+	}
+
+	return engine.Validate(engine.Request{
+		TenantID:     tenantID,
+		Metric:       detector.Metric,
+		GroupBy:      detector.GroupBy,
+		Filters:      filters,
+		Step:         detector.Step,
+		Aggregations: []string{helpers.AggregationAvg},
+	})
+}
+
+// AnomalySource returns the detector an alert rule fires on, false when its metric isn't one
+func AnomalySource(metric string) (int64, bool) {
+	if !strings.HasPrefix(metric, AnomalyMetricPrefix) {
+		return 0, false
+	}
+	detectorID, err := strconv.ParseInt(strings.TrimPrefix(metric, AnomalyMetricPrefix), 10, 64)
+	return detectorID, err == nil && detectorID > 0
+}
+
+// anomalySlot returns the slot of a model a step starting at t is learned in
+func anomalySlot(model string, t time.Time) int {
+	t = t.UTC()
+	switch model {
+	case AnomalyDaily:
+		return t.Hour()
+	case AnomalyWeekly:
+		return int(t.Weekday())*24 + t.Hour()
+	}
+	return 0
+}
+
+// anomalyRequest is the query of a detector on [start, end)
+func anomalyRequest(tenantID string, detector models.AnomalyDetector, start time.Time, end time.Time) (engine.Request, error) {
+	var filters []engine.Filter
+	if err := json.Unmarshal([]byte(detector.Filters), &filters); err != nil {
+		return engine.Request{}, fmt.Errorf("error reading filters: %v", err)
+	}
+
+	return engine.Request{
+		TenantID:  tenantID,
+		Metric:    detector.Metric,
+		Devices:   detector.Devices,
+		TimeStart: start.Format(helpers.TimestampLayout),
+		TimeEnd:   end.Add(-time.Second).Format(helpers.TimestampLayout),
+		GroupBy:   detector.GroupBy,
+		Rank:      engine.Ranking{Function: engine.RankAvg, Limit: detector.Top},
+		Filters:   filters,
+	}, nil
+}
+
+// baselineKey identifies the baseline of a series for a slot
+func baselineKey(deviceID string, seriesKey string, slot int) string {
+	return fmt.Sprintf("%s\x00%s\x00%d", deviceID, seriesKey, slot)
+}
+
+// stepAverage is the average of a series over a step
+type stepAverage struct {
+	DeviceID  string
+	SeriesKey string
+	Labels    map[string]string
+	Start     time.Time
+	Value     float64
+}
+
+// stepAverages returns the averages over [start, end) of every step of the series of a detector, the top ones over
+// that range only unless top is false
+func stepAverages(db *sql.DB, tenantID string, detector models.AnomalyDetector, start time.Time, end time.Time,
+	top bool) ([]stepAverage, error) {
+	request, err := anomalyRequest(tenantID, detector, start, end)
+	if err != nil {
+		return nil, err
+	}
+	request.Step = detector.Step
+	request.Aggregations = []string{helpers.AggregationAvg}
+	if !top {
+		request.Rank.Limit = 0
+	}
+
+	result, err := engine.Execute(db, request)
+	if errors.Is(err, engine.ErrNoDevices) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var averages []stepAverage
+	for _, device := range result.Devices {
+		for _, series := range device.Series {
+			for _, bucket := range series.Buckets {
+				value, ok := bucket.Values[helpers.AggregationAvg]
+				if bucket.Gap || !ok || math.IsNaN(value) {
+					continue
+				}
+				timestamp, err := helpers.ParseTimestamp(bucket.Timestamp)
+				if err != nil {
+					return nil, err
+				}
+				averages = append(averages, stepAverage{
+					DeviceID:  device.DeviceID,
+					SeriesKey: series.Key,
+					Labels:    series.Labels,
+					Start:     timestamp,
+					Value:     value,
+				})
+			}
+		}
+	}
+
+	return averages, nil
+}
+
+// addSample adds a value to a baseline with Welford's update of its mean and sum of squared differences
+func addSample(baseline *models.AnomalyBaseline, value float64) {
+	baseline.Samples++
+	delta := value - baseline.Mean
+	baseline.Mean += delta / float64(baseline.Samples)
+	baseline.M2 += delta * (value - baseline.Mean)
+	setStddev(baseline)
+}
+
+// removeSample removes a value added to a baseline, reversing addSample
+func removeSample(baseline *models.AnomalyBaseline, value float64) {
+	if baseline.Samples <= 1 {
+		baseline.Samples, baseline.Mean, baseline.M2 = 0, 0, 0
+		setStddev(baseline)
+		return
+	}
+
+	baseline.Samples--
+	delta := value - baseline.Mean
+	baseline.Mean -= delta / float64(baseline.Samples)
+	// Rounding errors can't make it negative
+	baseline.M2 = math.Max(0, baseline.M2-delta*(value-baseline.Mean))
+	setStddev(baseline)
+}
+
+// setStddev computes the sample standard deviation of a baseline from its sum of squared differences
+func setStddev(baseline *models.AnomalyBaseline) {
+	baseline.Stddev = 0
+	if baseline.Samples > 1 {
+		baseline.Stddev = math.Sqrt(baseline.M2 / float64(baseline.Samples-1))
+	}
+}
+
+// moveBaselines adds the steps that entered the training window of a detector to its baselines by key and removes
+// those that left it. Series without a baseline are learned when learnNew is true, ignored otherwise. It returns
+// the keys of the baselines changed.
+func moveBaselines(detector models.AnomalyDetector, baselines map[string]*models.AnomalyBaseline, entered []stepAverage,
+	left []stepAverage, learnNew bool) map[string]bool {
+	changed := make(map[string]bool)
+
+	for _, average := range entered {
+		slot := anomalySlot(detector.Model, average.Start)
+		key := baselineKey(average.DeviceID, average.SeriesKey, slot)
+		baseline, ok := baselines[key]
+		if !ok {
+			if !learnNew {
+				continue
+			}
+			baseline = &models.AnomalyBaseline{
+				DetectorID: detector.ID,
+				DeviceID:   average.DeviceID,
+				SeriesKey:  average.SeriesKey,
+				Slot:       slot,
+			}
+			baselines[key] = baseline
+		}
+		baseline.Labels = average.Labels
+		addSample(baseline, average.Value)
+		changed[key] = true
+	}
+
+	for _, average := range left {
+		key := baselineKey(average.DeviceID, average.SeriesKey, anomalySlot(detector.Model, average.Start))
+		baseline, ok := baselines[key]
+		if !ok || baseline.Samples == 0 {
+			continue
+		}
+		removeSample(baseline, average.Value)
+		changed[key] = true
+	}
+
+	return changed
+}
+
+// sortBaselines sorts baselines by device, series and slot
+func sortBaselines(baselines []models.AnomalyBaseline) {
+	sort.Slice(baselines, func(i, j int) bool {
+		a, b := baselines[i], baselines[j]
+		if a.DeviceID != b.DeviceID {
+			return a.DeviceID < b.DeviceID
+		}
+		if a.SeriesKey != b.SeriesKey {
+			return a.SeriesKey < b.SeriesKey
+		}
+		return a.Slot < b.Slot
+	})
+}
+
+// LearnBaselines computes the baselines of a detector from the steps of its training window ending at until
+func LearnBaselines(db *sql.DB, tenantID string, detector models.AnomalyDetector, until time.Time) ([]models.AnomalyBaseline, error) {
+	averages, err := stepAverages(db, tenantID, detector, until.Add(-detector.Training), until, true)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]*models.AnomalyBaseline)
+	moveBaselines(detector, byKey, averages, nil, true)
+
+	baselines := make([]models.AnomalyBaseline, 0, len(byKey))
+	for _, baseline := range byKey {
+		baselines = append(baselines, *baseline)
+	}
+	sortBaselines(baselines)
+
+	return baselines, nil
+}
+
+// UpdateBaselines moves the training window of baselines learned until learnedUntil to end at until: the steps that
+// entered it are added to them and those that left it are removed. It returns the baselines with samples, and the
+// ones changed, with those left without samples.
+func UpdateBaselines(db *sql.DB, tenantID string, detector models.AnomalyDetector, baselines []models.AnomalyBaseline,
+	learnedUntil time.Time, until time.Time) ([]models.AnomalyBaseline, []models.AnomalyBaseline, error) {
+	// The top series are those learned from the whole window, the steps can't rank them
+	entered, err := stepAverages(db, tenantID, detector, learnedUntil, until, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	left, err := stepAverages(db, tenantID, detector, learnedUntil.Add(-detector.Training), until.Add(-detector.Training), false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byKey := make(map[string]*models.AnomalyBaseline, len(baselines))
+	for i := range baselines {
+		baseline := baselines[i]
+		byKey[baselineKey(baseline.DeviceID, baseline.SeriesKey, baseline.Slot)] = &baseline
+	}
+	changedKeys := moveBaselines(detector, byKey, entered, left, detector.Top == 0)
+
+	var kept, changed []models.AnomalyBaseline
+	for key, baseline := range byKey {
+		if baseline.Samples > 0 {
+			kept = append(kept, *baseline)
+		}
+		if changedKeys[key] {
+			changed = append(changed, *baseline)
+		}
+	}
+	sortBaselines(kept)
+	sortBaselines(changed)
+
+	return kept, changed, nil
+}
+
+// relearnBaselines tells whether the baselines of a detector learned until learnedUntil, zero when they weren't, are
+// learned again from the whole training window ending at until rather than updated
+func relearnBaselines(detector models.AnomalyDetector, learnedUntil time.Time, until time.Time) bool {
+	if learnedUntil.IsZero() || until.Before(learnedUntil) || until.Sub(learnedUntil) >= detector.Training {
+		return true
+	}
+	return !until.Truncate(anomalyRelearnInterval).Equal(learnedUntil.Truncate(anomalyRelearnInterval))
+}
+
+// AnomalyScore returns how many standard deviations of a baseline a value is from its mean, negative below it
+func AnomalyScore(baseline models.AnomalyBaseline, value float64) float64 {
+	stddev := math.Max(baseline.Stddev, minRelativeStddev*math.Abs(baseline.Mean))
+	deviation := value - baseline.Mean
+	if deviation == 0 {
+		return 0
+	}
+	if stddev == 0 {
+		return math.Copysign(maxAnomalyScore, deviation)
+	}
+	return math.Max(-maxAnomalyScore, math.Min(maxAnomalyScore, deviation/stddev))
+}
+
+// isAnomalous tells whether a value of a series deviates from its baseline enough for a detector
+func isAnomalous(detector models.AnomalyDetector, baseline models.AnomalyBaseline, value float64, score float64) bool {
+	if baseline.Samples < detector.MinSamples {
+		return false
+	}
+	if math.Abs(value-baseline.Mean) < detector.MinDeviation {
+		return false
+	}
+
+	switch detector.Direction {
+	case AnomalyAbove:
+		return score >= detector.Threshold
+	case AnomalyBelow:
+		return -score >= detector.Threshold
+	default:
+		return math.Abs(score) >= detector.Threshold
+	}
+}
+
+// ScoreStep scores the average of every series of a detector over the step [start, start+step) against
+// baselines and returns the anomalous ones
+func ScoreStep(db *sql.DB, tenantID string, detector models.AnomalyDetector, baselines []models.AnomalyBaseline, start time.Time,
+	now time.Time) ([]models.Anomaly, error) {
+	if len(baselines) == 0 {
+		return nil, nil
+	}
+	byKey := make(map[string]models.AnomalyBaseline, len(baselines))
+	for _, baseline := range baselines {
+		byKey[baselineKey(baseline.DeviceID, baseline.SeriesKey, baseline.Slot)] = baseline
+	}
+
+	request, err := anomalyRequest(tenantID, detector, start, start.Add(detector.Step))
+	if err != nil {
+		return nil, err
+	}
+	result, err := engine.Execute(db, request)
+	if errors.Is(err, engine.ErrNoDevices) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slot := anomalySlot(detector.Model, start)
+	var anomalies []models.Anomaly
+	for _, device := range result.Devices {
+		for _, series := range device.Series {
+			// Series that weren't learned yet, like new processes, can't be told anomalous
+			baseline, ok := byKey[baselineKey(device.DeviceID, series.Key, slot)]
+			if !ok {
+				continue
+			}
+			value, ok := alertValue(series, AlertAvg)
+			if !ok {
+				continue
+			}
+
+			score := AnomalyScore(baseline, value)
+			if !isAnomalous(detector, baseline, value, score) {
+				continue
+			}
+			anomalies = append(anomalies, models.Anomaly{
+				DetectorID: detector.ID,
+				DeviceID:   device.DeviceID,
+				SeriesKey:  series.Key,
+				Labels:     series.Labels,
+				Timestamp:  start.Format(timestampLayout),
+				Value:      value,
+				Expected:   baseline.Mean,
+				Stddev:     baseline.Stddev,
+				Score:      score,
+				DetectedAt: now.Format(timestampLayout),
+			})
+		}
+	}
+
+	return anomalies, nil
+}
+
+// RunAnomalies runs the anomaly detectors of every tenant, forever, every AnomalyInterval
+func RunAnomalies(db *sql.DB) {
+	ticker := time.NewTicker(AnomalyInterval)
+	defer ticker.Stop()
+
+	for {
+		DetectAnomalies(db, time.Now().UTC())
+		<-ticker.C
+	}
+}
+
+// DetectAnomalies runs every enabled detector of every tenant whose latest step ended since its last run
+func DetectAnomalies(db *sql.DB, now time.Time) {
+	tenants, err := models.ListTenants(db)
+	if err != nil {
+		log.Printf("Anomalies: error listing tenants: %v", err)
+		return
+	}
+
+	for _, tenantID := range tenants {
+		detectors, err := models.GetAnomalyDetectors(db, tenantID)
+		if err != nil {
+			log.Printf("Anomalies: error reading the detectors of tenant %s: %v", tenantID, err)
+			continue
+		}
+
+		for _, detector := range detectors {
+			if !detector.Enabled {
+				continue
+			}
+			if _, err := RunAnomalyDetector(db, tenantID, detector, now); err != nil {
+				log.Printf("Anomalies: error running detector %d of tenant %s: %v", detector.ID, tenantID, err)
+			}
+		}
+	}
+}
+
+// RunAnomalyDetector moves the training window of the baselines of a detector and scores the latest step that
+// ended at least anomalyDelay before now, unless it already did. Steps missed while it wasn't running aren't caught
+// up. It returns the anomalies found.
+func RunAnomalyDetector(db *sql.DB, tenantID string, detector models.AnomalyDetector, now time.Time) ([]models.Anomaly, error) {
+	end := now.Add(-anomalyDelay).Truncate(detector.Step)
+	if detector.EvaluatedUntil != "" {
+		evaluatedUntil, err := helpers.ParseTimestamp(detector.EvaluatedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if !end.After(evaluatedUntil) {
+			return nil, nil
+		}
+	}
+	start := end.Add(-detector.Step)
+
+	// The step scored is left out of the baselines, anomalies would make themselves normal
+	baselines, err := runBaselines(db, tenantID, detector, start)
+	if err != nil {
+		return nil, err
+	}
+
+	anomalies, err := ScoreStep(db, tenantID, detector, baselines, start, now)
+	if err != nil {
+		return nil, fmt.Errorf("error scoring step: %v", err)
+	}
+	if err := models.InsertAnomalies(db, tenantID, anomalies); err != nil {
+		return nil, fmt.Errorf("error saving anomalies: %v", err)
+	}
+
+	return anomalies, models.SetAnomalyDetectorEvaluated(db, tenantID, detector.ID, end.Format(timestampLayout))
+}
+
+// runBaselines returns the baselines of a detector for its training window ending at until, saved with it
+func runBaselines(db *sql.DB, tenantID string, detector models.AnomalyDetector, until time.Time) ([]models.AnomalyBaseline, error) {
+	var learnedUntil time.Time
+	if detector.LearnedUntil != "" {
+		var err error
+		if learnedUntil, err = helpers.ParseTimestamp(detector.LearnedUntil); err != nil {
+			return nil, err
+		}
+	}
+
+	if relearnBaselines(detector, learnedUntil, until) {
+		baselines, err := LearnBaselines(db, tenantID, detector, until)
+		if err != nil {
+			return nil, fmt.Errorf("error learning baselines: %v", err)
+		}
+		if err := models.ReplaceAnomalyBaselines(db, tenantID, detector.ID, baselines, until.Format(timestampLayout)); err != nil {
+			return nil, fmt.Errorf("error saving baselines: %v", err)
+		}
+		return baselines, nil
+	}
+
+	baselines, err := models.GetAnomalyBaselines(db, tenantID, detector.ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading baselines: %v", err)
+	}
+	// A step that was already learned, the baselines were saved but the step wasn't scored
+	if until.Equal(learnedUntil) {
+		return baselines, nil
+	}
+
+	baselines, changed, err := UpdateBaselines(db, tenantID, detector, baselines, learnedUntil, until)
+	if err != nil {
+		return nil, fmt.Errorf("error updating baselines: %v", err)
+	}
+	if err := models.UpdateAnomalyBaselines(db, tenantID, detector.ID, changed, until.Format(timestampLayout)); err != nil {
+		return nil, fmt.Errorf("error saving baselines: %v", err)
+	}
+	return baselines, nil
+}
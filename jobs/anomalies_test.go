@@ -0,0 +1,239 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAnomalySlot(t *testing.T) {
+	tokyo := mustLocation(t, "Asia/Tokyo")
+	tests := []struct {
+		model string
+		time  time.Time
+		want  int
+	}{
+		{AnomalyRolling, june(1, 13, 45), 0},
+		{AnomalyRolling, june(2, 0, 0), 0},
+		{AnomalyDaily, june(1, 0, 0), 0},
+		{AnomalyDaily, june(1, 13, 45), 13},
+		{AnomalyDaily, june(2, 23, 59), 23},
+		// Slots are hours in UTC, whatever the location of the time
+		{AnomalyDaily, time.Date(2024, 6, 1, 9, 0, 0, 0, tokyo), 0},
+		// Sunday is the first day of the week
+		{AnomalyWeekly, june(2, 0, 0), 0},
+		{AnomalyWeekly, june(2, 23, 30), 23},
+		{AnomalyWeekly, june(3, 0, 0), 24},
+		{AnomalyWeekly, june(5, 13, 15), 3*24 + 13},
+		{AnomalyWeekly, june(1, 23, 59), 167},
+		{AnomalyWeekly, time.Date(2024, 6, 2, 8, 0, 0, 0, tokyo), 167},
+	}
+
+	for _, test := range tests {
+		if got := anomalySlot(test.model, test.time); got != test.want {
+			t.Errorf("anomalySlot(%q, %s) = %d, want %d", test.model, test.time, got, test.want)
+		}
+	}
+}
+
+// testAverages returns hourly averages of two series over [start, end), they vary with the hour of the day and the step
+func testAverages(start time.Time, end time.Time) []stepAverage {
+	var averages []stepAverage
+	for step := start; step.Before(end); step = step.Add(time.Hour) {
+		i := float64(step.Sub(june(1, 0, 0)) / time.Hour)
+		averages = append(averages,
+			stepAverage{DeviceID: "d1", SeriesKey: "", Start: step, Value: 50 + 10*math.Sin(i/24*2*math.Pi) + math.Mod(i*7, 5)},
+			stepAverage{DeviceID: "d1", SeriesKey: "nginx", Labels: map[string]string{"process": "nginx"}, Start: step,
+				Value: 1e6 + math.Mod(i*i, 11)})
+	}
+	return averages
+}
+
+// learnAverages learns baselines from scratch
+func learnAverages(detector models.AnomalyDetector, averages []stepAverage) map[string]*models.AnomalyBaseline {
+	baselines := make(map[string]*models.AnomalyBaseline)
+	moveBaselines(detector, baselines, averages, nil, true)
+	return baselines
+}
+
+func TestMoveBaselines(t *testing.T) {
+	for _, model := range []string{AnomalyRolling, AnomalyDaily, AnomalyWeekly} {
+		detector := models.AnomalyDetector{ID: 3, Model: model, Step: time.Hour, Training: 8 * 24 * time.Hour}
+
+		// Moving the window hour by hour, then by half a day, ends with the baselines learned from the last window
+		until := june(1, 0, 0).Add(detector.Training)
+		baselines := learnAverages(detector, testAverages(june(1, 0, 0), until))
+		for _, move := range []time.Duration{time.Hour, time.Hour, 12 * time.Hour, time.Hour} {
+			next := until.Add(move)
+			entered := testAverages(until, next)
+			left := testAverages(until.Add(-detector.Training), next.Add(-detector.Training))
+			changed := moveBaselines(detector, baselines, entered, left, true)
+
+			for _, average := range append(entered, left...) {
+				if key := baselineKey(average.DeviceID, average.SeriesKey, anomalySlot(model, average.Start)); !changed[key] {
+					t.Errorf("%s: the baseline of %s at %s didn't change", model, average.SeriesKey, average.Start)
+				}
+			}
+			until = next
+		}
+
+		want := learnAverages(detector, testAverages(until.Add(-detector.Training), until))
+		if len(baselines) != len(want) {
+			t.Fatalf("%s: got %d baselines, want %d", model, len(baselines), len(want))
+		}
+		for key, w := range want {
+			got := baselines[key]
+			if got == nil || got.Samples != w.Samples || got.Slot != w.Slot || !closeTo(got.Mean, w.Mean) ||
+				!closeTo(got.Stddev, w.Stddev) || !closeTo(got.M2, w.M2) {
+				t.Errorf("%s: got baseline %+v, want %+v", model, got, w)
+			}
+		}
+	}
+}
+
+func TestMoveBaselinesSlots(t *testing.T) {
+	detector := models.AnomalyDetector{Model: AnomalyDaily}
+	baselines := learnAverages(detector, testAverages(june(1, 0, 0), june(4, 0, 0)))
+
+	if len(baselines) != 2*24 {
+		t.Fatalf("got %d daily baselines of two series, want 48", len(baselines))
+	}
+	for _, baseline := range baselines {
+		if baseline.Samples != 3 {
+			t.Errorf("the baseline of %q at %d:00 has %d samples, want one per day", baseline.SeriesKey, baseline.Slot, baseline.Samples)
+		}
+	}
+	if labels := baselines[baselineKey("d1", "nginx", 5)].Labels; labels["process"] != "nginx" {
+		t.Errorf("got labels %v", labels)
+	}
+}
+
+func TestMoveBaselinesNewSeries(t *testing.T) {
+	detector := models.AnomalyDetector{Model: AnomalyRolling}
+	baselines := learnAverages(detector, testAverages(june(1, 0, 0), june(1, 3, 0))[:3])
+	entered := []stepAverage{{DeviceID: "d2", Start: june(1, 3, 0), Value: 1}}
+
+	// Unless they are learned, the top series stay those learned from the whole window
+	if changed := moveBaselines(detector, baselines, entered, nil, false); len(changed) != 0 || len(baselines) != 2 {
+		t.Errorf("changed %v of baselines %v", changed, baselines)
+	}
+	if changed := moveBaselines(detector, baselines, entered, nil, true); len(changed) != 1 || baselines[baselineKey("d2", "", 0)] == nil {
+		t.Errorf("changed %v of baselines %v", changed, baselines)
+	}
+
+	// Series whose steps all left the window have no samples
+	left := []stepAverage{{DeviceID: "d2", Start: june(1, 0, 0), Value: 1}, {DeviceID: "d2", Start: june(1, 1, 0), Value: 1}}
+	moveBaselines(detector, baselines, nil, left, true)
+	if baseline := baselines[baselineKey("d2", "", 0)]; baseline.Samples != 0 || baseline.Mean != 0 || baseline.Stddev != 0 {
+		t.Errorf("got baseline %+v, want it empty", baseline)
+	}
+}
+
+func TestRemoveSample(t *testing.T) {
+	values := []float64{4, 8, 15, 16, 23, 42}
+	var baseline models.AnomalyBaseline
+	for _, value := range values {
+		addSample(&baseline, value)
+	}
+	if !closeTo(baseline.Mean, 18) || !closeTo(baseline.Stddev, math.Sqrt(910.0/5)) {
+		t.Fatalf("got mean %v and stddev %v of %v", baseline.Mean, baseline.Stddev, values)
+	}
+
+	removeSample(&baseline, 42)
+	removeSample(&baseline, 4)
+	if baseline.Samples != 4 || !closeTo(baseline.Mean, 15.5) || !closeTo(baseline.Stddev, math.Sqrt(113.0/3)) {
+		t.Errorf("got %+v after removing 42 and 4", baseline)
+	}
+}
+
+func TestRelearnBaselines(t *testing.T) {
+	detector := models.AnomalyDetector{Step: 5 * time.Minute, Training: 6 * time.Hour}
+	tests := []struct {
+		learnedUntil time.Time
+		until        time.Time
+		want         bool
+	}{
+		{time.Time{}, june(1, 12, 0), true},
+		{june(1, 12, 0), june(1, 12, 0), false},
+		{june(1, 12, 0), june(1, 12, 5), false},
+		{june(1, 12, 0), june(1, 17, 55), false},
+		// The whole window moved
+		{june(1, 12, 0), june(1, 18, 0), true},
+		{june(1, 12, 5), june(1, 12, 0), true},
+		// Once a day
+		{june(1, 23, 55), june(2, 0, 0), true},
+		{june(2, 0, 0), june(2, 0, 5), false},
+	}
+
+	for _, test := range tests {
+		if got := relearnBaselines(detector, test.learnedUntil, test.until); got != test.want {
+			t.Errorf("relearnBaselines(%s, %s) = %v, want %v", test.learnedUntil, test.until, got, test.want)
+		}
+	}
+}
+
+func TestAnomalyScore(t *testing.T) {
+	tests := []struct {
+		mean   float64
+		stddev float64
+		value  float64
+		want   float64
+	}{
+		{10, 2, 16, 3},
+		{10, 2, 7, -1.5},
+		{10, 2, 10, 0},
+		// At least 1% of the mean
+		{100, 0.1, 103, 3},
+		{-100, 0.1, -103, -3},
+		{10, 0, 11, 10},
+		// Capped
+		{0, 0, 1, maxAnomalyScore},
+		{0, 0, -1, -maxAnomalyScore},
+		{0, 0, 0, 0},
+		{0, 1e-9, 1, maxAnomalyScore},
+	}
+
+	for _, test := range tests {
+		baseline := models.AnomalyBaseline{Mean: test.mean, Stddev: test.stddev}
+		if got := AnomalyScore(baseline, test.value); !closeTo(got, test.want) {
+			t.Errorf("AnomalyScore(%v ± %v, %v) = %v, want %v", test.mean, test.stddev, test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsAnomalous(t *testing.T) {
+	baseline := models.AnomalyBaseline{Mean: 10, Stddev: 2, Samples: 5}
+	tests := []struct {
+		direction    string
+		minSamples   int
+		minDeviation float64
+		value        float64
+		want         bool
+	}{
+		{AnomalyBoth, 3, 0, 16, true},
+		{AnomalyBoth, 3, 0, 4, true},
+		{AnomalyBoth, 3, 0, 15, false},
+		{AnomalyAbove, 3, 0, 16, true},
+		{AnomalyAbove, 3, 0, 4, false},
+		{AnomalyBelow, 3, 0, 4, true},
+		{AnomalyBelow, 3, 0, 16, false},
+		// Not learned enough
+		{AnomalyBoth, 6, 0, 16, false},
+		// Not far enough from the mean
+		{AnomalyBoth, 3, 7, 16, false},
+		{AnomalyBoth, 3, 6, 16, true},
+	}
+
+	for _, test := range tests {
+		detector := models.AnomalyDetector{Threshold: 3, Direction: test.direction, MinSamples: test.minSamples, MinDeviation: test.minDeviation}
+		if got := isAnomalous(detector, baseline, test.value, AnomalyScore(baseline, test.value)); got != test.want {
+			t.Errorf("isAnomalous(%+v, %v) = %v, want %v", test, test.value, got, test.want)
+		}
+	}
+}
+
+// closeTo tells whether two floats are equal but for rounding errors
+func closeTo(a float64, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
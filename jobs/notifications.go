@@ -0,0 +1,392 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"cloudVigilante/backend/notify"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often the notifications due are sent
+const NotificationInterval = 10 * time.Second
+
+// Attempts of a delivery before it fails. The first retry waits retryBackoff, every other one twice as long as
+// the previous one, up to maxRetryBackoff.
+const (
+	maxDeliveryAttempts = 6
+	retryBackoff        = 30 * time.Second
+	maxRetryBackoff     = 30 * time.Minute
+)
+
+// A channel isn't notified twice in a row of the same alerts of a rule in the same state within DedupWindow
+const DedupWindow = time.Hour
+
+// Deliveries attempted per tenant at every run, and sent at once over all the tenants
+const (
+	deliveryBatchSize = 100
+	deliveryWorkers   = 8
+)
+
+// ChannelConfig reads the configuration of a channel
+func ChannelConfig(channel models.NotificationChannel) (notify.Config, error) {
+	var config notify.Config
+	if err := json.Unmarshal([]byte(channel.Config), &config); err != nil {
+		return config, fmt.Errorf("error reading the configuration of channel %d: %v", channel.ID, err)
+	}
+	return config, nil
+}
+
+// groupKey identifies the alerts of a rule notified on a channel
+func groupKey(channelID int64, ruleID int64, alertKeys []string) string {
+	keys := append([]string(nil), alertKeys...)
+	sort.Strings(keys)
+
+	hash := sha1.New()
+	hash.Write([]byte(strconv.FormatInt(channelID, 10) + "\x00" + strconv.FormatInt(ruleID, 10)))
+	for _, key := range keys {
+		hash.Write([]byte("\x00" + key))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// retryDelay returns how long to wait after a failed attempt before the next one
+func retryDelay(attempts int) time.Duration {
+	delay := retryBackoff
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// QueueNotifications queues the transitions of the alerts of a rule on its channels. The alerts that fired at
+// the same evaluation are grouped in one notification per channel, and so are the ones that resolved. Pending
+// alerts aren't notified, nor silenced transitions, and resolved ones only on the channels that send them.
+func QueueNotifications(db *sql.DB, tenantID string, rule models.AlertRule, channels []models.NotificationChannel,
+	events []models.AlertEvent, now time.Time) error {
+	byState := notifiedEvents(events)
+	if len(byState) == 0 || len(channels) == 0 {
+		return nil
+	}
+
+	deviceMap, err := helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), nil)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := notificationDeliveries(tenantID, rule, channels, byState, deviceMap, now,
+		func(groupKey string, since string) (string, error) {
+			return models.LastDeliveryState(db, tenantID, groupKey, since)
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		if _, err := models.InsertNotificationDelivery(db, tenantID, delivery); err != nil {
+			return fmt.Errorf("error queueing notification: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// notifiedEvents returns the events to notify by state, the firing and resolved ones that weren't silenced
+func notifiedEvents(events []models.AlertEvent) map[string][]models.AlertEvent {
+	byState := make(map[string][]models.AlertEvent)
+	for _, event := range events {
+		if event.SilencedBy == "" && (event.State == models.AlertFiring || event.State == models.AlertResolved) {
+			byState[event.State] = append(byState[event.State], event)
+		}
+	}
+	return byState
+}
+
+// notificationDeliveries returns the deliveries of the events of a rule on its channels. lastState returns the
+// state of the last notification of a group since a time, the deliveries notifying a group of the state it was
+// last notified of within DedupWindow are duplicates, which aren't sent.
+func notificationDeliveries(tenantID string, rule models.AlertRule, channels []models.NotificationChannel,
+	byState map[string][]models.AlertEvent, deviceMap map[string]string, now time.Time,
+	lastState func(groupKey string, since string) (string, error)) ([]models.NotificationDelivery, error) {
+	nowString := now.Format(timestampLayout)
+	since := now.Add(-DedupWindow).Format(timestampLayout)
+
+	var deliveries []models.NotificationDelivery
+	for _, state := range []string{models.AlertFiring, models.AlertResolved} {
+		stateEvents := byState[state]
+		if len(stateEvents) == 0 {
+			continue
+		}
+
+		notification := notify.Notification{
+			TenantID:    tenantID,
+			RuleID:      rule.ID,
+			RuleName:    rule.Name,
+			Description: rule.Description,
+			Severity:    rule.Severity,
+			State:       state,
+			Metric:      rule.Metric,
+			Operator:    rule.Operator,
+			Threshold:   rule.Threshold,
+			Timestamp:   nowString,
+		}
+		var alertKeys []string
+		for _, event := range stateEvents {
+			notification.Alerts = append(notification.Alerts, notify.Alert{
+				DeviceID:   event.DeviceID,
+				DeviceName: deviceMap[event.DeviceID],
+				Series:     event.SeriesKey,
+				Labels:     event.Labels,
+				Value:      event.Value,
+			})
+			alertKeys = append(alertKeys, event.Key)
+		}
+		payload, err := json.Marshal(notification)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, channel := range channels {
+			if !channel.Enabled || (state == models.AlertResolved && !channel.SendResolved) {
+				continue
+			}
+
+			delivery := models.NotificationDelivery{
+				ChannelID:     channel.ID,
+				RuleID:        rule.ID,
+				State:         state,
+				GroupKey:      groupKey(channel.ID, rule.ID, alertKeys),
+				AlertCount:    len(notification.Alerts),
+				Payload:       string(payload),
+				Status:        models.DeliveryPending,
+				CreatedAt:     nowString,
+				NextAttemptAt: nowString,
+			}
+
+			last, err := lastState(delivery.GroupKey, since)
+			if err != nil {
+				return nil, err
+			}
+			if last == state {
+				delivery.Status = models.DeliveryDuplicate
+				delivery.NextAttemptAt = ""
+			}
+
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+// RunNotifications sends the notifications due of every tenant, forever, every NotificationInterval
+func RunNotifications(db *sql.DB) {
+	ticker := time.NewTicker(NotificationInterval)
+	defer ticker.Stop()
+
+	for {
+		DeliverNotifications(db, time.Now().UTC())
+		<-ticker.C
+	}
+}
+
+// deliveryJob is a due delivery with the channels of its tenant
+type deliveryJob struct {
+	tenantID string
+	channels map[int64]models.NotificationChannel
+	delivery models.NotificationDelivery
+}
+
+// DeliverNotifications attempts the deliveries due at now of every tenant. They are sent by deliveryWorkers at
+// once, taking the tenants in turn, so that channels that time out don't hold back the others. The deliveries
+// not started within NotificationInterval are left for the next run.
+func DeliverNotifications(db *sql.DB, now time.Time) {
+	tenants, err := models.ListTenants(db)
+	if err != nil {
+		log.Printf("Notifications: error listing tenants: %v", err)
+		return
+	}
+
+	var byTenant [][]deliveryJob
+	for _, tenantID := range tenants {
+		jobs, err := dueDeliveries(db, tenantID, now)
+		if err != nil {
+			log.Printf("Notifications: error listing the notifications due of tenant %s: %v", tenantID, err)
+			continue
+		}
+		byTenant = append(byTenant, jobs)
+	}
+
+	deadline := time.Now().Add(NotificationInterval)
+	runDeliveries(interleaveDeliveries(byTenant), deliveryWorkers, deadline, func(job deliveryJob) {
+		if err := attemptDelivery(db, job, now); err != nil {
+			log.Printf("Notifications: error updating delivery %d of tenant %s: %v", job.delivery.ID, job.tenantID, err)
+		}
+	})
+}
+
+// dueDeliveries returns the deliveries of a tenant due at now
+func dueDeliveries(db *sql.DB, tenantID string, now time.Time) ([]deliveryJob, error) {
+	deliveries, err := models.GetDueDeliveries(db, tenantID, now.Format(timestampLayout), deliveryBatchSize)
+	if err != nil || len(deliveries) == 0 {
+		return nil, err
+	}
+
+	channels, err := models.GetNotificationChannels(db, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]models.NotificationChannel, len(channels))
+	for _, channel := range channels {
+		byID[channel.ID] = channel
+	}
+
+	jobs := make([]deliveryJob, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		jobs = append(jobs, deliveryJob{tenantID: tenantID, channels: byID, delivery: delivery})
+	}
+	return jobs, nil
+}
+
+// interleaveDeliveries takes the deliveries of the tenants in turn, in their order within a tenant
+func interleaveDeliveries(byTenant [][]deliveryJob) []deliveryJob {
+	var jobs []deliveryJob
+	for i := 0; ; i++ {
+		added := false
+		for _, tenantJobs := range byTenant {
+			if i < len(tenantJobs) {
+				jobs = append(jobs, tenantJobs[i])
+				added = true
+			}
+		}
+		if !added {
+			return jobs
+		}
+	}
+}
+
+// runDeliveries calls attempt on the jobs in order, on up to workers at once, and waits for them. The jobs not
+// started by deadline are skipped, it returns how many were started.
+func runDeliveries(jobs []deliveryJob, workers int, deadline time.Time, attempt func(deliveryJob)) int {
+	queue := make(chan deliveryJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				attempt(job)
+			}
+		}()
+	}
+
+	started := 0
+	for _, job := range jobs {
+		if !time.Now().Before(deadline) {
+			break
+		}
+		queue <- job
+		started++
+	}
+	close(queue)
+	wg.Wait()
+
+	return started
+}
+
+// attemptDelivery sends a delivery and records the outcome, retrying it later when it failed
+func attemptDelivery(db *sql.DB, job deliveryJob, now time.Time) error {
+	delivery := job.delivery
+	delivery.Attempts++
+	err := sendDelivery(job.channels, delivery)
+
+	switch {
+	case err == nil:
+		delivery.Status = models.DeliverySent
+		delivery.LastError = ""
+		delivery.NextAttemptAt = ""
+		delivery.SentAt = time.Now().UTC().Format(timestampLayout)
+	case delivery.Attempts >= maxDeliveryAttempts:
+		delivery.Status = models.DeliveryFailed
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = ""
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(retryDelay(delivery.Attempts)).Format(timestampLayout)
+	}
+
+	return models.UpdateNotificationDelivery(db, job.tenantID, delivery)
+}
+
+// sendDelivery sends a queued notification on its channel
+func sendDelivery(channels map[int64]models.NotificationChannel, delivery models.NotificationDelivery) error {
+	channel, ok := channels[delivery.ChannelID]
+	if !ok {
+		return fmt.Errorf("channel %d was deleted", delivery.ChannelID)
+	}
+	if !channel.Enabled {
+		return fmt.Errorf("channel %d is disabled", delivery.ChannelID)
+	}
+
+	config, err := ChannelConfig(channel)
+	if err != nil {
+		return err
+	}
+	var notification notify.Notification
+	if err := json.Unmarshal([]byte(delivery.Payload), &notification); err != nil {
+		return fmt.Errorf("error reading notification: %v", err)
+	}
+
+	return notify.Send(channel.Type, config, notification)
+}
+
+// SendTestNotification sends a test notification on a channel right away. Unless the channel is not saved yet,
+// the attempt is recorded with the deliveries of the channel. The error is the one of the send.
+func SendTestNotification(db *sql.DB, tenantID string, channel models.NotificationChannel, now time.Time) (models.NotificationDelivery, error) {
+	nowString := now.Format(timestampLayout)
+	notification := notify.Notification{TenantID: tenantID, State: notify.StateTest, Timestamp: nowString}
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return models.NotificationDelivery{}, err
+	}
+
+	delivery := models.NotificationDelivery{
+		ChannelID: channel.ID,
+		State:     notify.StateTest,
+		GroupKey:  groupKey(channel.ID, 0, nil),
+		Payload:   string(payload),
+		Status:    models.DeliverySent,
+		Attempts:  1,
+		CreatedAt: nowString,
+	}
+
+	config, sendErr := ChannelConfig(channel)
+	if sendErr == nil {
+		sendErr = notify.Send(channel.Type, config, notification)
+	}
+	if sendErr != nil {
+		delivery.Status = models.DeliveryFailed
+		delivery.LastError = sendErr.Error()
+	} else {
+		delivery.SentAt = time.Now().UTC().Format(timestampLayout)
+	}
+
+	if channel.ID != 0 {
+		if delivery.ID, err = models.InsertNotificationDelivery(db, tenantID, delivery); err != nil {
+			log.Printf("Notifications: error recording the test send of channel %d of tenant %s: %v", channel.ID, tenantID, err)
+		}
+	}
+
+	return delivery, sendErr
+}
@@ -0,0 +1,198 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/models"
+	"cloudVigilante/backend/notify"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:   30 * time.Second,
+		1:   30 * time.Second,
+		2:   time.Minute,
+		3:   2 * time.Minute,
+		5:   8 * time.Minute,
+		6:   16 * time.Minute,
+		7:   30 * time.Minute,
+		100: 30 * time.Minute,
+	}
+	for attempts, want := range tests {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestGroupKey(t *testing.T) {
+	key := groupKey(1, 2, []string{"b", "a", "c"})
+	if other := groupKey(1, 2, []string{"c", "b", "a"}); other != key {
+		t.Errorf("the key depends on the order of the alerts: %s and %s", key, other)
+	}
+
+	different := map[string]string{
+		"channel": groupKey(3, 2, []string{"a", "b", "c"}),
+		"rule":    groupKey(1, 3, []string{"a", "b", "c"}),
+		"alerts":  groupKey(1, 2, []string{"a", "b"}),
+		"ids":     groupKey(12, 0, []string{"a", "b", "c"}),
+	}
+	for what, other := range different {
+		if other == key {
+			t.Errorf("groups with another %s have the same key", what)
+		}
+	}
+}
+
+func TestNotificationDeliveries(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rule := models.AlertRule{ID: 7, Name: "High CPU", Severity: "critical", Metric: "cpu", Operator: ">", Threshold: 90}
+	channels := []models.NotificationChannel{
+		{ID: 1, Enabled: true, SendResolved: true},
+		{ID: 2, Enabled: true},
+		{ID: 3, SendResolved: true},
+	}
+	events := []models.AlertEvent{
+		{Key: "k1", DeviceID: "d1", State: models.AlertFiring, Value: 95},
+		{Key: "k2", DeviceID: "d2", State: models.AlertFiring, Value: 99},
+		{Key: "k3", DeviceID: "d3", State: models.AlertResolved, Value: 50},
+		// Pending and silenced transitions aren't notified
+		{Key: "k4", DeviceID: "d4", State: models.AlertPending, Value: 91},
+		{Key: "k5", DeviceID: "d5", State: models.AlertFiring, Value: 92, SilencedBy: "maintenance"},
+	}
+	deviceMap := map[string]string{"d1": "web-1", "d2": "web-2"}
+
+	// Channel 1 was told these alerts fired, channel 2 that they resolved, within the window
+	lastStates := map[string]string{
+		groupKey(1, 7, []string{"k2", "k1"}): models.AlertFiring,
+		groupKey(2, 7, []string{"k1", "k2"}): models.AlertResolved,
+	}
+	var sinces []string
+	lastState := func(groupKey string, since string) (string, error) {
+		sinces = append(sinces, since)
+		return lastStates[groupKey], nil
+	}
+
+	deliveries, err := notificationDeliveries("t1", rule, channels, notifiedEvents(events), deviceMap, now, lastState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		channelID int64
+		state     string
+		status    string
+		alerts    int
+	}
+	var got []summary
+	for _, delivery := range deliveries {
+		got = append(got, summary{delivery.ChannelID, delivery.State, delivery.Status, delivery.AlertCount})
+	}
+	want := []summary{
+		{1, models.AlertFiring, models.DeliveryDuplicate, 2},
+		{2, models.AlertFiring, models.DeliveryPending, 2},
+		{1, models.AlertResolved, models.DeliveryPending, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got deliveries %+v, want %+v", got, want)
+	}
+
+	if deliveries[0].NextAttemptAt != "" || deliveries[1].NextAttemptAt != "2024-06-01 12:00:00" {
+		t.Errorf("duplicates are due at %q and new deliveries at %q", deliveries[0].NextAttemptAt, deliveries[1].NextAttemptAt)
+	}
+	for _, since := range sinces {
+		if since != "2024-06-01 11:00:00" {
+			t.Errorf("looked for the last notification since %s, want the start of the dedup window", since)
+		}
+	}
+
+	var notification notify.Notification
+	if err := json.Unmarshal([]byte(deliveries[1].Payload), &notification); err != nil {
+		t.Fatal(err)
+	}
+	wantAlerts := []notify.Alert{{DeviceID: "d1", DeviceName: "web-1", Value: 95}, {DeviceID: "d2", DeviceName: "web-2", Value: 99}}
+	if notification.RuleName != "High CPU" || notification.State != notify.StateFiring || !reflect.DeepEqual(notification.Alerts, wantAlerts) {
+		t.Errorf("got notification %+v", notification)
+	}
+}
+
+func TestNotificationDeliveriesLastStateError(t *testing.T) {
+	byState := notifiedEvents([]models.AlertEvent{{Key: "k1", State: models.AlertFiring}})
+	channels := []models.NotificationChannel{{ID: 1, Enabled: true}}
+	lastState := func(string, string) (string, error) { return "", fmt.Errorf("connection refused") }
+
+	if _, err := notificationDeliveries("t1", models.AlertRule{}, channels, byState, nil, time.Now(), lastState); err == nil {
+		t.Error("the error of lastState was ignored")
+	}
+}
+
+func TestInterleaveDeliveries(t *testing.T) {
+	jobs := func(tenantID string, n int) []deliveryJob {
+		var jobs []deliveryJob
+		for i := 1; i <= n; i++ {
+			jobs = append(jobs, deliveryJob{tenantID: tenantID, delivery: models.NotificationDelivery{ID: int64(i)}})
+		}
+		return jobs
+	}
+
+	var got []string
+	for _, job := range interleaveDeliveries([][]deliveryJob{jobs("a", 3), nil, jobs("b", 1), jobs("c", 2)}) {
+		got = append(got, fmt.Sprintf("%s%d", job.tenantID, job.delivery.ID))
+	}
+	if want := []string{"a1", "b1", "c1", "a2", "c2", "a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRunDeliveries(t *testing.T) {
+	jobs := make([]deliveryJob, 12)
+
+	var mu sync.Mutex
+	running, maxRunning, attempted := 0, 0, 0
+	attempt := func(deliveryJob) {
+		mu.Lock()
+		running++
+		attempted++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+
+	if started := runDeliveries(jobs, 3, time.Now().Add(time.Minute), attempt); started != len(jobs) || attempted != len(jobs) {
+		t.Errorf("started %d and attempted %d of %d deliveries", started, attempted, len(jobs))
+	}
+	if maxRunning != 3 {
+		t.Errorf("up to %d deliveries were attempted at once, want 3", maxRunning)
+	}
+
+	if started := runDeliveries(jobs, 3, time.Now(), attempt); started != 0 {
+		t.Errorf("started %d deliveries after the deadline", started)
+	}
+}
+
+func TestRunDeliveriesDeadline(t *testing.T) {
+	// Every channel times out, the deliveries after the deadline are left for the next run
+	jobs := make([]deliveryJob, 20)
+	begin := time.Now()
+	started := runDeliveries(jobs, 2, begin.Add(75*time.Millisecond), func(deliveryJob) {
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	if started < 2 || started >= len(jobs) {
+		t.Errorf("started %d of %d deliveries", started, len(jobs))
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("the run took %v", elapsed)
+	}
+}
@@ -0,0 +1,46 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// How often the partition job makes sure the coming partitions exist
+const PartitionMaintenanceInterval = time.Hour
+
+// RunPartitionMaintenance keeps future partitions ready for every tenant, forever, every PartitionMaintenanceInterval
+func RunPartitionMaintenance(db *sql.DB) {
+	ticker := time.NewTicker(PartitionMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		MaintainPartitions(db)
+		<-ticker.C
+	}
+}
+
+// MaintainPartitions creates the partitions of the coming days or weeks. Expired partitions are dropped by the retention job.
+func MaintainPartitions(db *sql.DB) {
+	tenants, err := models.ListTenants(db)
+	if err != nil {
+		log.Printf("Partitions: error listing tenants: %v", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, tenantID := range tenants {
+		for _, table := range models.PartitionedTables {
+			created, err := models.EnsureFuturePartitions(db, tenantID, table, now)
+			if err != nil {
+				log.Printf("Partitions: error creating partitions of %s for tenant %s: %v", table, tenantID, err)
+				continue
+			}
+
+			if created > 0 {
+				log.Printf("Partitions: created %d partitions of %s for tenant %s", created, table, tenantID)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// How often the retention job looks for expired samples
+const RetentionInterval = time.Hour
+
+// Host samples deleted per transaction, and the pause between chunks so ingestion keeps its share of the db
+const (
+	retentionChunkSize  = 500
+	retentionChunkPause = 100 * time.Millisecond
+)
+
+// Layout of DATETIME values written by the jobs
+const timestampLayout = "2006-01-02 15:04:05"
+
+// RetentionProgress describes what the retention job is doing for a tenant
+type RetentionProgress struct {
+	Running     bool      `json:"running"`
+	DataType    string    `json:"dataType,omitempty"`
+	StartedAt   time.Time `json:"startedAt,omitempty"`
+	DeletedRows int64     `json:"deletedRows"`
+}
+
+var (
+	retentionMutex    sync.Mutex
+	retentionProgress = make(map[string]RetentionProgress)
+)
+
+// GetRetentionProgress returns the progress of the current retention run of a tenant
+func GetRetentionProgress(tenantID string) RetentionProgress {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	return retentionProgress[tenantID]
+}
+
+func setRetentionProgress(tenantID string, progress RetentionProgress) {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	retentionProgress[tenantID] = progress
+}
+
+// RunRetention enforces the retention policies of every tenant, forever, every RetentionInterval
+func RunRetention(db *sql.DB) {
+	ticker := time.NewTicker(RetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		EnforceRetention(db)
+		<-ticker.C
+	}
+}
+
+// EnforceRetention deletes the samples that outlived their tenant's retention policy
+func EnforceRetention(db *sql.DB) {
+	tenants, err := models.ListTenants(db)
+	if err != nil {
+		log.Printf("Retention: error listing tenants: %v", err)
+		return
+	}
+
+	for _, tenantID := range tenants {
+		policies, err := models.GetRetentionPolicies(db, tenantID)
+		if err != nil {
+			log.Printf("Retention: error reading policies of tenant %s: %v", tenantID, err)
+			continue
+		}
+
+		for _, policy := range policies {
+			if policy.DataType == models.RetentionHost {
+				policy.RetentionDays = hostRetentionDays(policies)
+			}
+			enforcePolicy(db, tenantID, policy)
+		}
+
+		setRetentionProgress(tenantID, RetentionProgress{})
+	}
+}
+
+// hostRetentionDays returns how long the host samples of a tenant are kept. Details go away with their host sample,
+// so a detail policy longer than the host one holds the host samples back.
+func hostRetentionDays(policies []models.RetentionPolicy) int {
+	days := 0
+	for _, policy := range policies {
+		if policy.RetentionDays > days {
+			days = policy.RetentionDays
+		}
+	}
+	return days
+}
+
+// enforcePolicy deletes one data type of a tenant and records the run
+func enforcePolicy(db *sql.DB, tenantID string, policy models.RetentionPolicy) {
+	startedAt := time.Now().UTC()
+	cutoff := startedAt.AddDate(0, 0, -policy.RetentionDays)
+
+	progress := RetentionProgress{Running: true, DataType: policy.DataType, StartedAt: startedAt}
+	setRetentionProgress(tenantID, progress)
+
+	run := models.RetentionRun{
+		DataType:  policy.DataType,
+		StartedAt: startedAt.Format(timestampLayout),
+		Status:    "success",
+	}
+
+	if err := expireSamples(db, tenantID, policy.DataType, cutoff, &run, &progress); err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		log.Printf("Retention: error deleting %s samples of tenant %s: %v", policy.DataType, tenantID, err)
+	}
+
+	run.FinishedAt = time.Now().UTC().Format(timestampLayout)
+	if err := models.InsertRetentionRun(db, tenantID, run); err != nil {
+		log.Printf("Retention: error recording run for tenant %s: %v", tenantID, err)
+	}
+
+	if run.DeletedRows > 0 {
+		log.Printf("Retention: deleted %d rows of %s samples for tenant %s", run.DeletedRows, policy.DataType, tenantID)
+	}
+}
+
+// expireSamples removes the samples of dataType taken before cutoff. Whole expired partitions are dropped,
+// what is left is deleted chunk by chunk.
+func expireSamples(db *sql.DB, tenantID string, dataType string, cutoff time.Time, run *models.RetentionRun, progress *RetentionProgress) error {
+	addDeleted := func(deleted int64) {
+		run.DeletedRows += deleted
+		progress.DeletedRows = run.DeletedRows
+		setRetentionProgress(tenantID, *progress)
+	}
+
+	// Host partitions can only be dropped once the details of their samples are gone
+	if dataType == models.RetentionHost {
+		for _, detailType := range models.SampleDetailTypes() {
+			if err := expireSamples(db, tenantID, detailType, cutoff, run, progress); err != nil {
+				return err
+			}
+		}
+	}
+
+	if table, ok := models.PartitionedTables[dataType]; ok {
+		dropped, err := models.DropExpiredPartitions(db, tenantID, table, cutoff)
+		addDeleted(dropped)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		deleted, err := models.DeleteExpiredChunk(db, tenantID, dataType, cutoff.Format(timestampLayout), retentionChunkSize)
+		if err != nil {
+			return err
+		}
+
+		if deleted == 0 {
+			return nil
+		}
+
+		addDeleted(deleted)
+		time.Sleep(retentionChunkPause)
+	}
+}
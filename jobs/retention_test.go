@@ -0,0 +1,23 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/models"
+	"testing"
+)
+
+func TestHostRetentionDays(t *testing.T) {
+	tests := []struct {
+		policies []models.RetentionPolicy
+		want     int
+	}{
+		{[]models.RetentionPolicy{{DataType: models.RetentionHost, RetentionDays: 30}}, 30},
+		{[]models.RetentionPolicy{{DataType: models.RetentionHost, RetentionDays: 30}, {DataType: models.RetentionProcess, RetentionDays: 7}}, 30},
+		{[]models.RetentionPolicy{{DataType: models.RetentionDisk, RetentionDays: 90}, {DataType: models.RetentionHost, RetentionDays: 30}}, 90},
+	}
+
+	for _, test := range tests {
+		if got := hostRetentionDays(test.policies); got != test.want {
+			t.Errorf("hostRetentionDays(%v) = %d, want %d", test.policies, got, test.want)
+		}
+	}
+}
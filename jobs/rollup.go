@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// How often the rollup job runs
+const RollupInterval = time.Minute
+
+// Samples can arrive a little late, buckets are only rolled up once this much time has passed after they close
+const rollupLateness = 2 * time.Minute
+
+// Largest window aggregated at once per resolution, keeps the memory used by a catch up bounded
+var rollupMaxWindow = map[int]time.Duration{
+	models.RollupMinute: time.Hour,
+	models.RollupHour:   24 * time.Hour,
+	models.RollupDay:    30 * 24 * time.Hour,
+}
+
+// RunRollups keeps the rollup tables of every tenant up to date, forever, every RollupInterval
+func RunRollups(db *sql.DB) {
+	ticker := time.NewTicker(RollupInterval)
+	defer ticker.Stop()
+
+	for {
+		UpdateRollups(db)
+		<-ticker.C
+	}
+}
+
+// UpdateRollups aggregates every closed bucket that isn't rolled up yet, finest resolution first
+func UpdateRollups(db *sql.DB) {
+	tenants, err := models.ListTenants(db)
+	if err != nil {
+		log.Printf("Rollups: error listing tenants: %v", err)
+		return
+	}
+
+	for _, tenantID := range tenants {
+		// A level can only go as far as the level it is built from
+		limit := time.Now().UTC().Add(-rollupLateness)
+
+		for _, resolution := range models.RollupResolutions {
+			rolledUpTo, err := rollupResolution(db, tenantID, resolution, limit)
+			if err != nil {
+				log.Printf("Rollups: error rolling up %ds buckets for tenant %s: %v", resolution, tenantID, err)
+				break
+			}
+			limit = rolledUpTo
+		}
+	}
+}
+
+// rollupResolution rolls up one resolution until limit, returns how far it got
+func rollupResolution(db *sql.DB, tenantID string, resolution int, limit time.Time) (time.Time, error) {
+	bucketSize := time.Duration(resolution) * time.Second
+	end := limit.Truncate(bucketSize)
+
+	from, err := models.GetRollupWatermark(db, tenantID, resolution)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// First run, start from the oldest data available
+	if from.IsZero() {
+		oldest, found, err := models.GetRollupSourceStart(db, tenantID, resolution)
+		if err != nil || !found {
+			return time.Time{}, err
+		}
+		from = oldest.Truncate(bucketSize)
+	}
+
+	for from.Before(end) {
+		to := from.Add(rollupMaxWindow[resolution])
+		if to.After(end) {
+			to = end
+		}
+
+		if err := models.RollupWindow(db, tenantID, resolution, from, to); err != nil {
+			return from, err
+		}
+		from = to
+	}
+
+	return from, nil
+}
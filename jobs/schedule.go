@@ -0,0 +1,212 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron expression of five fields, minute hour day-of-month month day-of-week, each one *, a value,
+// a range a-b, a list of them and an optional step /n. Months and days of the week can be named, JAN or MON, and
+// Sunday is 0 or 7. Like cron, a time matches when the day of the month or the day of the week does when both
+// are restricted, and when both do when either starts with *, like */2. @hourly, @daily, @weekly, @monthly and
+// @yearly are shorthands.
+type Schedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// Whether the day fields start with *
+	anyDay, anyWeekday bool
+}
+
+var scheduleShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var monthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+var weekdayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// parseScheduleValue reads a value of a field, a number or a name, the first name standing for first
+func parseScheduleValue(value string, names []string, first int) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return first + i, nil
+		}
+	}
+	return strconv.Atoi(value)
+}
+
+// parseScheduleField returns the bits of the values of a field between min and max
+func parseScheduleField(field string, min int, max int, names []string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		expression, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			expression = part[:i]
+		}
+
+		low, high := min, max
+		switch {
+		case expression == "*":
+		case strings.Contains(expression, "-"):
+			bounds := strings.SplitN(expression, "-", 2)
+			var err error
+			if low, err = parseScheduleValue(bounds[0], names, min); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			if high, err = parseScheduleValue(bounds[1], names, min); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+		default:
+			value, err := parseScheduleValue(expression, names, min)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			low = value
+			// a/n means from a to the end
+			if step == 1 {
+				high = value
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+// ParseSchedule reads a cron expression
+func ParseSchedule(expression string) (Schedule, error) {
+	var schedule Schedule
+
+	expression = strings.TrimSpace(expression)
+	if shorthand, ok := scheduleShorthands[strings.ToLower(expression)]; ok {
+		expression = shorthand
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return schedule, fmt.Errorf("invalid schedule %q, expected minute hour day-of-month month day-of-week", expression)
+	}
+
+	var err error
+	if schedule.minutes, err = parseScheduleField(fields[0], 0, 59, nil); err != nil {
+		return schedule, fmt.Errorf("invalid minute: %v", err)
+	}
+	if schedule.hours, err = parseScheduleField(fields[1], 0, 23, nil); err != nil {
+		return schedule, fmt.Errorf("invalid hour: %v", err)
+	}
+	if schedule.days, err = parseScheduleField(fields[2], 1, 31, nil); err != nil {
+		return schedule, fmt.Errorf("invalid day of month: %v", err)
+	}
+	if schedule.months, err = parseScheduleField(fields[3], 1, 12, monthNames); err != nil {
+		return schedule, fmt.Errorf("invalid month: %v", err)
+	}
+	if schedule.weekdays, err = parseScheduleField(fields[4], 0, 7, weekdayNames); err != nil {
+		return schedule, fmt.Errorf("invalid day of week: %v", err)
+	}
+	// 7 is Sunday too
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	schedule.anyDay = strings.HasPrefix(fields[2], "*")
+	schedule.anyWeekday = strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Matches tells whether the schedule starts at the minute of t, read in the location of t
+func (s Schedule) Matches(t time.Time) bool {
+	return s.minutes&(1<<uint(t.Minute())) != 0 && s.hours&(1<<uint(t.Hour())) != 0 &&
+		s.months&(1<<uint(t.Month())) != 0 && s.dayMatches(t)
+}
+
+// Next returns the first start of the schedule after t, in the location of t, false when there is none within
+// five years, like on February 30th
+func (s Schedule) Next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			// Counted in minutes, as the wall clock hour after t is ambiguous the day the clocks go back
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			next = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+
+		// Daylight saving time changes can bring a wall clock time back to an hour already searched
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+
+	return time.Time{}, false
+}
+
+// LastStart returns the latest start of the schedule at or before t and after t minus within, in the location
+// of t, false when there is none. Like Next, it skips the months, days and hours that don't match at once.
+func (s Schedule) LastStart(t time.Time, within time.Duration) (time.Time, bool) {
+	earliest := t.Add(-within)
+	t = t.Truncate(time.Minute)
+
+	for t.After(earliest) {
+		// The last minute before the month, day or hour of t
+		var previous time.Time
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			previous = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !s.dayMatches(t):
+			previous = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			previous = t.Add(-time.Duration(t.Minute()+1) * time.Minute)
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			previous = t.Add(-time.Minute)
+		default:
+			return t, true
+		}
+
+		// Daylight saving time changes can bring a wall clock time after the one already searched
+		if !previous.Before(t) {
+			previous = t.Add(-time.Minute)
+		}
+		t = previous
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,223 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustSchedule(t *testing.T, expression string) Schedule {
+	t.Helper()
+	schedule, err := ParseSchedule(expression)
+	if err != nil {
+		t.Fatalf("ParseSchedule(%q): %v", expression, err)
+	}
+	return schedule
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// June 2024 starts on a Saturday
+func june(day int, hour int, minute int) time.Time {
+	return time.Date(2024, 6, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	expressions := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@every 5m",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"a * * * *",
+		"* * * FOO *",
+		"* * * * MON-FOO",
+		"1,,2 * * * *",
+	}
+
+	for _, expression := range expressions {
+		if _, err := ParseSchedule(expression); err == nil {
+			t.Errorf("ParseSchedule(%q) didn't fail", expression)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	tests := []struct {
+		expression string
+		time       time.Time
+		want       bool
+	}{
+		{"* * * * *", june(1, 0, 0), true},
+		{"*/15 9-17 * * MON-FRI", june(3, 9, 15), true},
+		{"*/15 9-17 * * MON-FRI", june(3, 9, 16), false},
+		{"*/15 9-17 * * MON-FRI", june(3, 18, 0), false},
+		{"*/15 9-17 * * MON-FRI", june(1, 9, 15), false},
+		{"0,30 * * * *", june(1, 4, 30), true},
+		{"0,30 * * * *", june(1, 4, 45), false},
+		// a/n runs from a to the end of the range
+		{"10/20 * * * *", june(1, 4, 50), true},
+		{"10/20 * * * *", june(1, 4, 0), false},
+		{"0-30/10 * * * *", june(1, 4, 30), true},
+		{"0-30/10 * * * *", june(1, 4, 40), false},
+		// Names in any case, Sunday is 0 or 7
+		{"0 0 * jun sun", june(2, 0, 0), true},
+		{"0 0 * * 7", june(2, 0, 0), true},
+		{"0 0 * * 0", june(2, 0, 0), true},
+		{"0 0 * * 5-7", june(1, 0, 0), true},
+		{"0 0 * JAN-MAY *", june(1, 0, 0), false},
+		// When both day fields are restricted either one is enough: the 13th, or Fridays
+		{"0 0 13 * FRI", june(13, 0, 0), true},
+		{"0 0 13 * FRI", june(14, 0, 0), true},
+		{"0 0 13 * FRI", june(15, 0, 0), false},
+		// A restricted day of the month alone, or a day of the week alone
+		{"0 0 1 * *", june(1, 0, 0), true},
+		{"0 0 1 * *", june(8, 0, 0), false},
+		{"0 0 * * MON", june(3, 0, 0), true},
+		{"0 0 * * MON", june(4, 0, 0), false},
+		// A field starting with * counts as unrestricted, both must match then: odd days that are Mondays
+		{"0 0 */2 * MON", june(3, 0, 0), true},
+		{"0 0 */2 * MON", june(10, 0, 0), false},
+		{"0 0 */2 * MON", june(11, 0, 0), false},
+		{"0 0 1 * */2", june(1, 0, 0), true},
+		{"0 0 1 * */2", june(2, 0, 0), false},
+		// Shorthands
+		{"@hourly", june(1, 7, 0), true},
+		{"@daily", june(1, 7, 0), false},
+		{"@weekly", june(2, 0, 0), true},
+		{"@monthly", june(1, 0, 0), true},
+		{"@yearly", june(1, 0, 0), false},
+		// Read in the location of the time
+		{"0 9 * * *", time.Date(2024, 6, 1, 9, 0, 0, 0, mustLocation(t, "Asia/Tokyo")), true},
+	}
+
+	for _, test := range tests {
+		if got := mustSchedule(t, test.expression).Matches(test.time); got != test.want {
+			t.Errorf("%q matches %s: %v, want %v", test.expression, test.time.Format(time.RFC1123), got, test.want)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	paris := mustLocation(t, "Europe/Paris")
+	tests := []struct {
+		expression string
+		after      time.Time
+		want       time.Time
+	}{
+		{"* * * * *", june(1, 10, 0).Add(30 * time.Second), june(1, 10, 1)},
+		{"0 9 * * MON-FRI", june(1, 10, 0), june(3, 9, 0)},
+		{"30 * * * *", june(1, 10, 30), june(1, 11, 30)},
+		{"0 0 1 * *", june(1, 0, 0), time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * FRI", june(1, 0, 0), june(7, 0, 0)},
+		{"0 0 31 * *", june(1, 0, 0), time.Date(2024, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", june(1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"59 23 31 12 *", june(1, 0, 0), time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC)},
+		// 2:30 doesn't exist on the day the clocks go forward, the next one is the day after
+		{"30 2 * * *", time.Date(2024, 3, 31, 0, 0, 0, 0, paris), time.Date(2024, 4, 1, 2, 30, 0, 0, paris)},
+		// The day the clocks go back, 2:30 happens twice, the first one is in summer time
+		{"30 2 * * *", time.Date(2024, 10, 27, 0, 0, 0, 0, paris), time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		got, ok := mustSchedule(t, test.expression).Next(test.after)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("%q after %s = %s, %v, want %s", test.expression, test.after, got, ok, test.want)
+		}
+	}
+
+	if got, ok := mustSchedule(t, "0 0 30 2 *").Next(june(1, 0, 0)); ok {
+		t.Errorf("February 30th is at %s", got)
+	}
+}
+
+// lastStartByMinute is LastStart walking back minute by minute
+func lastStartByMinute(s Schedule, t time.Time, within time.Duration) (time.Time, bool) {
+	earliest := t.Add(-within)
+	for start := t.Truncate(time.Minute); start.After(earliest); start = start.Add(-time.Minute) {
+		if s.Matches(start) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func TestScheduleLastStart(t *testing.T) {
+	tests := []struct {
+		expression string
+		at         time.Time
+		within     time.Duration
+		want       time.Time
+	}{
+		// At or before t
+		{"0 9 * * *", june(1, 9, 0).Add(30 * time.Second), time.Hour, june(1, 9, 0)},
+		{"0 9 * * MON-FRI", june(1, 12, 0), 7 * 24 * time.Hour, time.Date(2024, 5, 31, 9, 0, 0, 0, time.UTC)},
+		{"0 0 13 * FRI", june(13, 12, 0), 7 * 24 * time.Hour, june(13, 0, 0)},
+		{"0 0 1 * *", june(20, 0, 0), 31 * 24 * time.Hour, june(1, 0, 0)},
+		{"*/20 * * * *", june(1, 10, 59), time.Hour, june(1, 10, 40)},
+	}
+
+	for _, test := range tests {
+		got, ok := mustSchedule(t, test.expression).LastStart(test.at, test.within)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("%q before %s = %s, %v, want %s", test.expression, test.at, got, ok, test.want)
+		}
+	}
+
+	// Starts must be after t minus within
+	if got, ok := mustSchedule(t, "0 9 * * *").LastStart(june(2, 8, 0), 23*time.Hour); ok {
+		t.Errorf("found a start at %s, the start of the window", got)
+	}
+	if got, ok := mustSchedule(t, "0 9 * * MON-FRI").LastStart(june(1, 12, 0), 24*time.Hour); ok {
+		t.Errorf("found a start at %s, more than a day ago", got)
+	}
+}
+
+func TestScheduleLastStartMatchesMinuteWalk(t *testing.T) {
+	expressions := []string{
+		"* * * * *", "*/7 * * * *", "30 2 * * *", "0 9-17 * * MON-FRI", "0 0 13 * FRI", "0 0 */2 * MON",
+		"15 3 1 * *", "0 0 31 * *", "0 12 * FEB *", "45 23 * * 0",
+	}
+	paris := mustLocation(t, "Europe/Paris")
+	times := []time.Time{
+		june(1, 12, 0),
+		june(3, 0, 0),
+		time.Date(2024, 3, 1, 0, 0, 30, 0, time.UTC),
+		// After the clocks went forward and back
+		time.Date(2024, 3, 31, 4, 0, 0, 0, paris),
+		time.Date(2024, 3, 31, 3, 30, 0, 0, paris),
+		time.Date(2024, 10, 27, 2, 15, 0, 0, paris),
+		time.Date(2024, 10, 27, 2, 15, 0, 0, paris).Add(time.Hour),
+		time.Date(2024, 10, 28, 3, 0, 0, 0, paris),
+	}
+
+	for _, expression := range expressions {
+		schedule := mustSchedule(t, expression)
+		for _, at := range times {
+			for _, within := range []time.Duration{time.Minute, 90 * time.Minute, 36 * time.Hour, 7 * 24 * time.Hour} {
+				got, gotOK := schedule.LastStart(at, within)
+				want, wantOK := lastStartByMinute(schedule, at, within)
+				if gotOK != wantOK || !got.Equal(want) {
+					t.Errorf("%q before %s within %v = %s, %v, want %s, %v", expression, at, within, got, gotOK, want, wantOK)
+				}
+			}
+		}
+	}
+}
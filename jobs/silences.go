@@ -0,0 +1,144 @@
+package jobs
+
+import (
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Longest maintenance window
+const maxMaintenanceDuration = 7 * 24 * time.Hour
+
+// ValidateMaintenanceWindow checks a maintenance window before it is saved
+func ValidateMaintenanceWindow(window models.MaintenanceWindow) error {
+	if window.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, err := ParseSchedule(window.Schedule); err != nil {
+		return err
+	}
+	if window.Duration < time.Minute || window.Duration > maxMaintenanceDuration {
+		return fmt.Errorf("duration must be between 1m and %v", maxMaintenanceDuration)
+	}
+	if _, err := time.LoadLocation(window.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", window.Timezone)
+	}
+	return nil
+}
+
+// MaintenanceStart returns when the current occurrence of a maintenance window started, false when it isn't under
+// way at now. The next start is returned when it is known.
+func MaintenanceStart(window models.MaintenanceWindow, now time.Time) (start time.Time, active bool, next time.Time, err error) {
+	schedule, err := ParseSchedule(window.Schedule)
+	if err != nil {
+		return start, false, next, err
+	}
+	location, err := time.LoadLocation(window.Timezone)
+	if err != nil {
+		return start, false, next, err
+	}
+
+	local := now.In(location)
+	start, active = schedule.LastStart(local, window.Duration)
+	next, _ = schedule.Next(local)
+
+	return start, active, next, nil
+}
+
+// Muter tells which alerts of a tenant are muted at an evaluation by its silences and maintenance windows. A nil
+// Muter mutes nothing.
+type Muter struct {
+	silences []models.Silence
+	windows  []models.MaintenanceWindow
+	// Device ID -> hostname
+	devices map[string]string
+}
+
+// LoadMuter reads the silences and the maintenance windows of a tenant under way at now
+func LoadMuter(db *sql.DB, tenantID string, now time.Time) (*Muter, error) {
+	silences, err := models.GetSilences(db, tenantID, now.Format(timestampLayout))
+	if err != nil {
+		return nil, fmt.Errorf("error reading silences: %v", err)
+	}
+	windows, err := models.GetMaintenanceWindows(db, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading maintenance windows: %v", err)
+	}
+
+	muter := &Muter{silences: silences}
+	for _, window := range windows {
+		if !window.Enabled {
+			continue
+		}
+		_, active, _, err := MaintenanceStart(window, now)
+		if err != nil {
+			log.Printf("Alerts: error reading maintenance window %d of tenant %s: %v", window.ID, tenantID, err)
+			continue
+		}
+		if active {
+			muter.windows = append(muter.windows, window)
+		}
+	}
+
+	if len(muter.silences) > 0 || len(muter.windows) > 0 {
+		if muter.devices, err = helpers.GetDeviceMap(db, fmt.Sprintf("Performance_%s", tenantID), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return muter, nil
+}
+
+// matchesDevice tells whether a device is one of names, any device when names is empty
+func matchesDevice(names []string, hostname string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if name == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// SilencedBy returns what mutes the alert of a series of a rule, like "silence:3" or "maintenance:2", or an empty
+// string when nothing does. Maintenance windows only mute the alerts of rules detecting devices that stopped
+// sending data when they suppress offline detection.
+func (m *Muter) SilencedBy(rule models.AlertRule, deviceID string, labels map[string]string) string {
+	if m == nil {
+		return ""
+	}
+	hostname := strings.TrimSpace(m.devices[deviceID])
+
+	for _, silence := range m.silences {
+		if silence.RuleID != 0 && silence.RuleID != rule.ID {
+			continue
+		}
+		if !matchesDevice(silence.Devices, hostname) {
+			continue
+		}
+		matches := true
+		for name, value := range silence.Labels {
+			matches = matches && labels[name] == value
+		}
+		if matches {
+			return fmt.Sprintf("silence:%d", silence.ID)
+		}
+	}
+
+	for _, window := range m.windows {
+		if rule.Aggregation == AlertAbsent && !window.SuppressOffline {
+			continue
+		}
+		if matchesDevice(window.Devices, hostname) {
+			return fmt.Sprintf("maintenance:%d", window.ID)
+		}
+	}
+
+	return ""
+}
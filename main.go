@@ -2,11 +2,13 @@ package main
 
 import (
 	"cloudVigilante/backend/handlers"
+	"cloudVigilante/backend/jobs"
 	"cloudVigilante/backend/models"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -24,6 +26,36 @@ func main() {
 
 	handlers.SetDB(db)
 
+	// Apply pending schema migrations to the tenants we already have
+	if err := models.MigrateAllTenants(db); err != nil {
+		log.Printf("Error migrating tenant databases: %v", err)
+	}
+
+	// Start the background jobs
+	go jobs.RunRetention(db)
+	go jobs.RunRollups(db)
+	go jobs.RunPartitionMaintenance(db)
+	go jobs.RunAlerts(db)
+	go jobs.RunNotifications(db)
+	go jobs.RunAnomalies(db)
+
+	// Start the listeners of the lightweight agents, when an address is configured for them
+	if addr := os.Getenv("STATSD_UDP_ADDR"); addr != "" {
+		// StatsD gauges and counters not updated for STATSD_EXPIRE_FLUSHES flushes of 10s are forgotten, an hour by default
+		expireFlushes, _ := strconv.Atoi(os.Getenv("STATSD_EXPIRE_FLUSHES"))
+		go handlers.ServeStatsD(addr, expireFlushes)
+	}
+	if addr := os.Getenv("NDJSON_TCP_ADDR"); addr != "" {
+		go handlers.ServeNDJSON(addr)
+	}
+	// Syslog messages without a tenant parameter, like all RFC 3164 ones, go to SYSLOG_TENANT when it is set
+	if addr := os.Getenv("SYSLOG_UDP_ADDR"); addr != "" {
+		go handlers.ServeSyslogUDP(addr, os.Getenv("SYSLOG_TENANT"))
+	}
+	if addr := os.Getenv("SYSLOG_TCP_ADDR"); addr != "" {
+		go handlers.ServeSyslogTCP(addr, os.Getenv("SYSLOG_TENANT"))
+	}
+
 	// Handle CORS
 	mux := http.NewServeMux()
 
@@ -43,12 +75,40 @@ func main() {
 
 	// Handle POST routes
 	mux.Handle("/api/v1/postmetrics", handlers.EnableCORS(http.HandlerFunc(handlers.ReceivePerformanceMetrics)))
+	mux.Handle("/api/v1/remote_write", handlers.EnableCORS(http.HandlerFunc(handlers.ReceiveRemoteWrite)))
+	mux.Handle("/v1/metrics", handlers.EnableCORS(http.HandlerFunc(handlers.ReceiveOTLPMetrics)))
+	mux.Handle("/api/v1/write", handlers.EnableCORS(http.HandlerFunc(handlers.ReceiveInfluxWrite)))
+	mux.Handle("/api/v1/logs", handlers.EnableCORS(http.HandlerFunc(handlers.ReceiveLogs)))
 	mux.Handle("/api/v1/cpumetrics", handlers.EnableCORS(http.HandlerFunc(handlers.RetrieveCPUMetrics)))
+	mux.Handle("/api/v1/hostcpumetrics", handlers.EnableCORS(http.HandlerFunc(handlers.RetrieveHostCPUMetrics)))
 	mux.Handle("/api/v1/rammetrics", handlers.EnableCORS(http.HandlerFunc(handlers.RetrieveRamMetrics)))
+	mux.Handle("/api/v1/diskmetrics", handlers.EnableCORS(http.HandlerFunc(handlers.RetrieveDiskMetrics)))
+	mux.Handle("/api/v1/networkmetrics", handlers.EnableCORS(http.HandlerFunc(handlers.RetrieveNetworkMetrics)))
+	mux.Handle("/api/v1/custommetrics", handlers.EnableCORS(http.HandlerFunc(handlers.HandleCustomMetrics)))
+	mux.Handle("/api/v1/query", handlers.EnableCORS(http.HandlerFunc(handlers.RunQuery)))
+	mux.Handle("/api/v1/histograms", handlers.EnableCORS(http.HandlerFunc(handlers.QueryHistograms)))
+	mux.Handle(handlers.PromAPIPrefix, handlers.EnableCORS(http.HandlerFunc(handlers.PromAPI)))
 
 	// Handle GET routes
 	mux.Handle("/api/v1/getdeviceinfo", handlers.EnableCORS((http.HandlerFunc(handlers.GetDeviceInfo))))
 	mux.Handle("/api/v1/onboard-device", handlers.EnableCORS((http.HandlerFunc(handlers.OnboarDevice))))
+	mux.Handle("/api/v1/retention", handlers.EnableCORS(http.HandlerFunc(handlers.ManageRetention)))
+	mux.Handle("/api/v1/storagereport", handlers.EnableCORS(http.HandlerFunc(handlers.GetStorageReport)))
+	mux.Handle("/api/v1/logs/search", handlers.EnableCORS(http.HandlerFunc(handlers.SearchLogs)))
+	mux.Handle("/api/v1/logs/around", handlers.EnableCORS(http.HandlerFunc(handlers.GetLogsAround)))
+	mux.Handle("/api/v1/alerts", handlers.EnableCORS(http.HandlerFunc(handlers.ManageAlerts)))
+	mux.Handle("/api/v1/alerts/active", handlers.EnableCORS(http.HandlerFunc(handlers.GetActiveAlerts)))
+	mux.Handle("/api/v1/alerts/history", handlers.EnableCORS(http.HandlerFunc(handlers.GetAlertHistory)))
+	mux.Handle("/api/v1/alerts/silences", handlers.EnableCORS(http.HandlerFunc(handlers.ManageSilences)))
+	mux.Handle("/api/v1/alerts/maintenance", handlers.EnableCORS(http.HandlerFunc(handlers.ManageMaintenanceWindows)))
+	mux.Handle("/api/v1/notifications/channels", handlers.EnableCORS(http.HandlerFunc(handlers.ManageNotificationChannels)))
+	mux.Handle("/api/v1/notifications/test", handlers.EnableCORS(http.HandlerFunc(handlers.TestNotificationChannel)))
+	mux.Handle("/api/v1/notifications/deliveries", handlers.EnableCORS(http.HandlerFunc(handlers.GetNotificationDeliveries)))
+	mux.Handle("/api/v1/anomalies", handlers.EnableCORS(http.HandlerFunc(handlers.GetAnomalies)))
+	mux.Handle("/api/v1/anomalies/detectors", handlers.EnableCORS(http.HandlerFunc(handlers.ManageAnomalyDetectors)))
+	mux.Handle("/api/v1/anomalies/baselines", handlers.EnableCORS(http.HandlerFunc(handlers.GetAnomalyBaselines)))
+	mux.Handle("/api/v1/listenerstats", handlers.EnableCORS(http.HandlerFunc(handlers.GetListenerStats)))
+	mux.Handle("/metrics/devices", handlers.EnableCORS(http.HandlerFunc(handlers.ExposeDeviceMetrics)))
 
 	log.Println("Server is running on port 8080")
 	log.Fatal(http.ListenAndServe(":8080", mux))
@@ -0,0 +1,378 @@
+package models
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Alert rules compare a metric of a tenant to a threshold. Every series of the metric matching a rule has its
+// own alert: pending while the comparison holds for less than the for duration of the rule, then firing until
+// it stops holding and the alert is resolved. AlertStates holds the pending and firing alerts, AlertHistory
+// every transition.
+
+// States of an alert
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+type AlertRule struct {
+	ID          int64
+	Name        string
+	Description string
+	Metric      string
+	// Device names, all devices when empty
+	Devices []string
+	// JSON array of the engine filters
+	Filters     string
+	GroupBy     string
+	Aggregation string
+	Operator    string
+	Threshold   float64
+	// Samples aggregated at every evaluation
+	Window time.Duration
+	// How long the comparison must hold before the alert fires
+	For       time.Duration
+	Severity  string
+	Enabled   bool
+	CreatedAt string
+	UpdatedAt string
+}
+
+const alertRuleColumns = `rule_id, name, COALESCE(description, ''), metric, devices, filters, COALESCE(group_by, ''), aggregation,
+    operator, threshold, window_seconds, for_seconds, severity, enabled, created_at, updated_at`
+
+func scanAlertRule(scanner interface{ Scan(...interface{}) error }) (AlertRule, error) {
+	var rule AlertRule
+	var devices string
+	var window, forSeconds int
+
+	err := scanner.Scan(&rule.ID, &rule.Name, &rule.Description, &rule.Metric, &devices, &rule.Filters, &rule.GroupBy,
+		&rule.Aggregation, &rule.Operator, &rule.Threshold, &window, &forSeconds, &rule.Severity, &rule.Enabled,
+		&rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		return rule, err
+	}
+
+	if err := json.Unmarshal([]byte(devices), &rule.Devices); err != nil {
+		return rule, fmt.Errorf("error reading devices of alert rule %d: %v", rule.ID, err)
+	}
+	rule.Window = time.Duration(window) * time.Second
+	rule.For = time.Duration(forSeconds) * time.Second
+
+	return rule, nil
+}
+
+// alertRuleArgs returns the values of the columns of a rule, from name to enabled
+func alertRuleArgs(rule AlertRule) ([]interface{}, error) {
+	if rule.Devices == nil {
+		rule.Devices = []string{}
+	}
+	devices, err := json.Marshal(rule.Devices)
+	if err != nil {
+		return nil, err
+	}
+	if rule.Filters == "" {
+		rule.Filters = "[]"
+	}
+
+	return []interface{}{rule.Name, nullString(rule.Description), rule.Metric, string(devices), rule.Filters, nullString(rule.GroupBy),
+		rule.Aggregation, rule.Operator, rule.Threshold, int(rule.Window / time.Second), int(rule.For / time.Second), rule.Severity,
+		rule.Enabled}, nil
+}
+
+// GetAlertRules returns the alert rules of a tenant by ID
+func GetAlertRules(db *sql.DB, tenantID string) ([]AlertRule, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.AlertRules ORDER BY rule_id", alertRuleColumns, dbName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// GetAlertRule returns an alert rule, nil when the tenant has none with that ID
+func GetAlertRule(db *sql.DB, tenantID string, ruleID int64) (*AlertRule, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	row := db.QueryRow(fmt.Sprintf("SELECT %s FROM %s.AlertRules WHERE rule_id = ?", alertRuleColumns, dbName), ruleID)
+
+	rule, err := scanAlertRule(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// CreateAlertRule saves a new alert rule and returns its ID
+func CreateAlertRule(db *sql.DB, tenantID string, rule AlertRule, now string) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := alertRuleArgs(rule)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.AlertRules (name, description, metric, devices, filters, group_by,
+        aggregation, operator, threshold, window_seconds, for_seconds, severity, enabled, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName), append(args, now, now)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// UpdateAlertRule replaces an alert rule, it returns false when the tenant has none with its ID. The alerts of
+// the rule are kept and evaluated against the new definition.
+func UpdateAlertRule(db *sql.DB, tenantID string, rule AlertRule, now string) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := alertRuleArgs(rule)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`UPDATE %s.AlertRules SET name = ?, description = ?, metric = ?, devices = ?,
+        filters = ?, group_by = ?, aggregation = ?, operator = ?, threshold = ?, window_seconds = ?, for_seconds = ?, severity = ?,
+        enabled = ?, updated_at = ? WHERE rule_id = ?`, dbName), append(args, now, rule.ID)...)
+	if err != nil {
+		return false, err
+	}
+
+	// Unchanged rows count as not affected, tell them apart from missing ones
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err == nil, err
+	}
+	existing, err := GetAlertRule(db, tenantID, rule.ID)
+	return existing != nil, err
+}
+
+// DeleteAlertRule deletes an alert rule, its alerts and its routes, their history is kept. It returns false when
+// the tenant has no rule with that ID.
+func DeleteAlertRule(db *sql.DB, tenantID string, ruleID int64) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf("DELETE FROM %s.AlertRules WHERE rule_id = ?", dbName), ruleID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s.AlertStates WHERE rule_id = ?", dbName), ruleID); err != nil {
+		return true, err
+	}
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s.AlertRoutes WHERE rule_id = ?", dbName), ruleID)
+	return true, err
+}
+
+// Alert is the pending or firing alert of a series of a rule
+type Alert struct {
+	RuleID    int64
+	Key       string
+	DeviceID  string
+	SeriesKey string
+	Labels    map[string]string
+	State     string
+	Value     float64
+	// When the comparison started to hold, and when the alert fired
+	ActiveSince string
+	FiredAt     string
+	EvaluatedAt string
+	// The silence or maintenance window muting the alert, like "silence:3" or "maintenance:2", empty when it isn't
+	SilencedBy string
+}
+
+// AlertKey identifies the alert of a series among the alerts of a rule
+func AlertKey(deviceID string, seriesKey string) string {
+	hash := sha1.Sum([]byte(deviceID + "\x00" + seriesKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// GetAlerts returns the pending and firing alerts of a tenant, of one rule unless ruleID is 0
+func GetAlerts(db *sql.DB, tenantID string, ruleID int64) ([]Alert, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	query := fmt.Sprintf(`SELECT rule_id, alert_key, device_id, series_key, labels, state, COALESCE(value, 0), active_since,
+        COALESCE(fired_at, ''), evaluated_at, COALESCE(silenced_by, '') FROM %s.AlertStates`, dbName)
+	var args []interface{}
+	if ruleID != 0 {
+		query += " WHERE rule_id = ?"
+		args = append(args, ruleID)
+	}
+	query += " ORDER BY rule_id, active_since"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		var alert Alert
+		var labels string
+		if err := rows.Scan(&alert.RuleID, &alert.Key, &alert.DeviceID, &alert.SeriesKey, &labels, &alert.State, &alert.Value,
+			&alert.ActiveSince, &alert.FiredAt, &alert.EvaluatedAt, &alert.SilencedBy); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(labels), &alert.Labels); err != nil {
+			return nil, fmt.Errorf("error reading labels of alert %s: %v", alert.Key, err)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+// SaveAlert creates or updates a pending or firing alert
+func SaveAlert(db *sql.DB, tenantID string, alert Alert) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	labels, err := json.Marshal(alert.Labels)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`INSERT INTO %s.AlertStates
+        (rule_id, alert_key, device_id, series_key, labels, state, value, active_since, fired_at, evaluated_at, silenced_by)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE labels = VALUES(labels), state = VALUES(state), value = VALUES(value),
+            active_since = VALUES(active_since), fired_at = VALUES(fired_at), evaluated_at = VALUES(evaluated_at),
+            silenced_by = VALUES(silenced_by)`, dbName),
+		alert.RuleID, alert.Key, alert.DeviceID, alert.SeriesKey, string(labels), alert.State, alert.Value, alert.ActiveSince,
+		nullString(alert.FiredAt), alert.EvaluatedAt, nullString(alert.SilencedBy))
+	return err
+}
+
+// DeleteAlert removes an alert that is no longer pending or firing
+func DeleteAlert(db *sql.DB, tenantID string, ruleID int64, key string) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s.AlertStates WHERE rule_id = ? AND alert_key = ?", dbName), ruleID, key)
+	return err
+}
+
+// AlertEvent is a transition of an alert, recorded in AlertHistory
+type AlertEvent struct {
+	ID        int64
+	RuleID    int64
+	Key       string
+	DeviceID  string
+	SeriesKey string
+	Labels    map[string]string
+	State     string
+	Value     float64
+	Threshold float64
+	Timestamp string
+	// Muted transitions aren't notified
+	SilencedBy string
+}
+
+// InsertAlertEvent records a transition of an alert
+func InsertAlertEvent(db *sql.DB, tenantID string, event AlertEvent) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	labels, err := json.Marshal(event.Labels)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`INSERT INTO %s.AlertHistory
+        (rule_id, alert_key, device_id, series_key, labels, state, value, threshold, timestamp, silenced_by)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName),
+		event.RuleID, event.Key, event.DeviceID, event.SeriesKey, string(labels), event.State, event.Value, event.Threshold, event.Timestamp,
+		nullString(event.SilencedBy))
+	return err
+}
+
+// AlertHistoryQuery selects transitions, the zero value of a field doesn't restrict them
+type AlertHistoryQuery struct {
+	RuleID   int64
+	DeviceID string
+	State    string
+	From     string
+	To       string
+	Limit    int
+}
+
+// GetAlertHistory returns the transitions matching a query, newest first
+func GetAlertHistory(db *sql.DB, tenantID string, query AlertHistoryQuery) ([]AlertEvent, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	var conditions []string
+	var args []interface{}
+	if query.RuleID != 0 {
+		conditions = append(conditions, "rule_id = ?")
+		args = append(args, query.RuleID)
+	}
+	if query.DeviceID != "" {
+		conditions = append(conditions, "device_id = ?")
+		args = append(args, query.DeviceID)
+	}
+	if query.State != "" {
+		conditions = append(conditions, "state = ?")
+		args = append(args, query.State)
+	}
+	if query.From != "" {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != "" {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, query.To)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, query.Limit)
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT event_id, rule_id, alert_key, device_id, series_key, labels, state, COALESCE(value, 0),
+        threshold, timestamp, COALESCE(silenced_by, '') FROM %s.AlertHistory %s ORDER BY timestamp DESC, event_id DESC LIMIT ?`, dbName, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AlertEvent{}
+	for rows.Next() {
+		var event AlertEvent
+		var labels string
+		if err := rows.Scan(&event.ID, &event.RuleID, &event.Key, &event.DeviceID, &event.SeriesKey, &labels, &event.State,
+			&event.Value, &event.Threshold, &event.Timestamp, &event.SilencedBy); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(labels), &event.Labels); err != nil {
+			return nil, fmt.Errorf("error reading labels of alert %s: %v", event.Key, err)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
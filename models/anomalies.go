@@ -0,0 +1,470 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Anomaly detectors learn the baseline of every series of a metric from its stored samples: the mean and standard
+// deviation of its averages over steps, for the whole training window or for every hour of the day or of the week.
+// The average of every new step is scored against its baseline, in standard deviations, and recorded in Anomalies
+// when the score passes the threshold of the detector.
+
+type AnomalyDetector struct {
+	ID     int64
+	Name   string
+	Metric string
+	// Device names, all devices when empty
+	Devices []string
+	// JSON array of the engine filters
+	Filters string
+	GroupBy string
+	// Series learned per device, the top ones by average, all of them when 0
+	Top int
+	// rolling, daily or weekly
+	Model string
+	// Width of the averages scored, and how far back the baselines are learned
+	Step     time.Duration
+	Training time.Duration
+	// Score, in standard deviations, from which a step is anomalous
+	Threshold float64
+	// above, below or both
+	Direction string
+	// Smallest difference to the mean that is anomalous, whatever the score
+	MinDeviation float64
+	// Steps a baseline needs before it is scored against
+	MinSamples int
+	Enabled    bool
+	// End of the last step scored
+	EvaluatedUntil string
+	// End of the training window of the baselines, empty until they are learned
+	LearnedUntil string
+	CreatedAt    string
+	UpdatedAt    string
+}
+
+const anomalyDetectorColumns = `detector_id, name, metric, devices, filters, COALESCE(group_by, ''), top, model, step_seconds,
+    training_seconds, threshold, direction, min_deviation, min_samples, enabled, COALESCE(evaluated_until, ''),
+    COALESCE(learned_until, ''), created_at, updated_at`
+
+func scanAnomalyDetectors(rows *sql.Rows) ([]AnomalyDetector, error) {
+	defer rows.Close()
+
+	detectors := []AnomalyDetector{}
+	for rows.Next() {
+		var detector AnomalyDetector
+		var devices string
+		var step, training int
+		if err := rows.Scan(&detector.ID, &detector.Name, &detector.Metric, &devices, &detector.Filters, &detector.GroupBy,
+			&detector.Top, &detector.Model, &step, &training, &detector.Threshold, &detector.Direction, &detector.MinDeviation,
+			&detector.MinSamples, &detector.Enabled, &detector.EvaluatedUntil, &detector.LearnedUntil, &detector.CreatedAt,
+			&detector.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(devices), &detector.Devices); err != nil {
+			return nil, fmt.Errorf("error reading devices of anomaly detector %d: %v", detector.ID, err)
+		}
+		detector.Step = time.Duration(step) * time.Second
+		detector.Training = time.Duration(training) * time.Second
+		detectors = append(detectors, detector)
+	}
+
+	return detectors, rows.Err()
+}
+
+// GetAnomalyDetectors returns the anomaly detectors of a tenant by ID
+func GetAnomalyDetectors(db *sql.DB, tenantID string) ([]AnomalyDetector, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.AnomalyDetectors ORDER BY detector_id", anomalyDetectorColumns, dbName))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAnomalyDetectors(rows)
+}
+
+// GetAnomalyDetector returns an anomaly detector, nil when the tenant has none with that ID
+func GetAnomalyDetector(db *sql.DB, tenantID string, detectorID int64) (*AnomalyDetector, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.AnomalyDetectors WHERE detector_id = ?", anomalyDetectorColumns, dbName),
+		detectorID)
+	if err != nil {
+		return nil, err
+	}
+
+	detectors, err := scanAnomalyDetectors(rows)
+	if err != nil || len(detectors) == 0 {
+		return nil, err
+	}
+	return &detectors[0], nil
+}
+
+// anomalyDetectorArgs returns the values of the columns of a detector, from name to enabled
+func anomalyDetectorArgs(detector AnomalyDetector) ([]interface{}, error) {
+	if detector.Devices == nil {
+		detector.Devices = []string{}
+	}
+	devices, err := json.Marshal(detector.Devices)
+	if err != nil {
+		return nil, err
+	}
+	if detector.Filters == "" {
+		detector.Filters = "[]"
+	}
+
+	return []interface{}{detector.Name, detector.Metric, string(devices), detector.Filters, nullString(detector.GroupBy), detector.Top,
+		detector.Model, int(detector.Step / time.Second), int(detector.Training / time.Second), detector.Threshold, detector.Direction,
+		detector.MinDeviation, detector.MinSamples, detector.Enabled}, nil
+}
+
+// CreateAnomalyDetector saves a new anomaly detector and returns its ID
+func CreateAnomalyDetector(db *sql.DB, tenantID string, detector AnomalyDetector, now string) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := anomalyDetectorArgs(detector)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.AnomalyDetectors (name, metric, devices, filters, group_by, top, model,
+        step_seconds, training_seconds, threshold, direction, min_deviation, min_samples, enabled, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName), append(args, now, now)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// UpdateAnomalyDetector replaces an anomaly detector, it returns false when the tenant has none with its ID. The
+// baselines of the detector are learned again at its next run.
+func UpdateAnomalyDetector(db *sql.DB, tenantID string, detector AnomalyDetector, now string) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := anomalyDetectorArgs(detector)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`UPDATE %s.AnomalyDetectors SET name = ?, metric = ?, devices = ?, filters = ?, group_by = ?,
+        top = ?, model = ?, step_seconds = ?, training_seconds = ?, threshold = ?, direction = ?, min_deviation = ?, min_samples = ?,
+        enabled = ?, evaluated_until = NULL, learned_until = NULL, updated_at = ? WHERE detector_id = ?`, dbName), append(args, now, detector.ID)...)
+	if err != nil {
+		return false, err
+	}
+
+	// Unchanged rows count as not affected, tell them apart from missing ones
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		if existing, err := GetAnomalyDetector(db, tenantID, detector.ID); err != nil || existing == nil {
+			return false, err
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s.AnomalyBaselines WHERE detector_id = ?", dbName), detector.ID)
+	return true, err
+}
+
+// DeleteAnomalyDetector deletes an anomaly detector and its baselines, its anomalies are kept. It returns false
+// when the tenant has no detector with that ID.
+func DeleteAnomalyDetector(db *sql.DB, tenantID string, detectorID int64) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf("DELETE FROM %s.AnomalyDetectors WHERE detector_id = ?", dbName), detectorID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s.AnomalyBaselines WHERE detector_id = ?", dbName), detectorID)
+	return true, err
+}
+
+// SetAnomalyDetectorEvaluated records the end of the last step a detector scored
+func SetAnomalyDetectorEvaluated(db *sql.DB, tenantID string, detectorID int64, evaluatedUntil string) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s.AnomalyDetectors SET evaluated_until = ? WHERE detector_id = ?", dbName),
+		evaluatedUntil, detectorID)
+	return err
+}
+
+// AnomalyBaseline is what a detector learned of a series, for one slot of its model
+type AnomalyBaseline struct {
+	DetectorID int64
+	DeviceID   string
+	SeriesKey  string
+	// Hour of the day or of the week, 0 for rolling baselines
+	Slot    int
+	Labels  map[string]string
+	Mean    float64
+	Stddev  float64
+	Samples int
+	// Sum of the squared differences to the mean, updated with Mean as steps enter and leave the training window
+	M2 float64
+}
+
+// GetAnomalyBaselines returns the baselines of a detector, of some devices only unless deviceIDs is empty
+func GetAnomalyBaselines(db *sql.DB, tenantID string, detectorID int64, deviceIDs []string) ([]AnomalyBaseline, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	query := fmt.Sprintf(`SELECT detector_id, device_id, series_key, slot, labels, mean, stddev, samples, m2 FROM %s.AnomalyBaselines
+        WHERE detector_id = ?`, dbName)
+	args := []interface{}{detectorID}
+	if len(deviceIDs) > 0 {
+		query += fmt.Sprintf(" AND device_id IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(deviceIDs)), ","))
+		for _, deviceID := range deviceIDs {
+			args = append(args, deviceID)
+		}
+	}
+	query += " ORDER BY device_id, series_key, slot"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	baselines := []AnomalyBaseline{}
+	for rows.Next() {
+		var baseline AnomalyBaseline
+		var labels string
+		if err := rows.Scan(&baseline.DetectorID, &baseline.DeviceID, &baseline.SeriesKey, &baseline.Slot, &labels, &baseline.Mean,
+			&baseline.Stddev, &baseline.Samples, &baseline.M2); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(labels), &baseline.Labels); err != nil {
+			return nil, fmt.Errorf("error reading labels of baseline of %s: %v", baseline.SeriesKey, err)
+		}
+		baselines = append(baselines, baseline)
+	}
+
+	return baselines, rows.Err()
+}
+
+// ReplaceAnomalyBaselines replaces the baselines of a detector with those learned from its training window ending at
+// learnedUntil
+func ReplaceAnomalyBaselines(db *sql.DB, tenantID string, detectorID int64, baselines []AnomalyBaseline, learnedUntil string) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s.AnomalyBaselines WHERE detector_id = ?", dbName), detectorID); err != nil {
+		return err
+	}
+	if err := saveAnomalyBaselines(tx, dbName, detectorID, baselines); err != nil {
+		return err
+	}
+	if err := setAnomalyDetectorLearned(tx, dbName, detectorID, learnedUntil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateAnomalyBaselines saves the baselines of a detector that changed when its training window moved to end at
+// learnedUntil, those left without samples are deleted
+func UpdateAnomalyBaselines(db *sql.DB, tenantID string, detectorID int64, changed []AnomalyBaseline, learnedUntil string) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var saved []AnomalyBaseline
+	for _, baseline := range changed {
+		if baseline.Samples > 0 {
+			saved = append(saved, baseline)
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s.AnomalyBaselines
+            WHERE detector_id = ? AND device_id = ? AND series_key = ? AND slot = ?`, dbName),
+			detectorID, baseline.DeviceID, baseline.SeriesKey, baseline.Slot); err != nil {
+			return err
+		}
+	}
+	if err := saveAnomalyBaselines(tx, dbName, detectorID, saved); err != nil {
+		return err
+	}
+	if err := setAnomalyDetectorLearned(tx, dbName, detectorID, learnedUntil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// saveAnomalyBaselines inserts baselines of a detector, or updates them when they exist
+func saveAnomalyBaselines(tx *sql.Tx, dbName string, detectorID int64, baselines []AnomalyBaseline) error {
+	if len(baselines) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s.AnomalyBaselines
+        (detector_id, device_id, series_key, slot, labels, mean, stddev, samples, m2) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE labels = VALUES(labels), mean = VALUES(mean), stddev = VALUES(stddev),
+        samples = VALUES(samples), m2 = VALUES(m2)`, dbName))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, baseline := range baselines {
+		labels, err := json.Marshal(baseline.Labels)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(detectorID, baseline.DeviceID, baseline.SeriesKey, baseline.Slot, string(labels), baseline.Mean,
+			baseline.Stddev, baseline.Samples, baseline.M2); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setAnomalyDetectorLearned records the end of the training window of the baselines of a detector
+func setAnomalyDetectorLearned(tx *sql.Tx, dbName string, detectorID int64, learnedUntil string) error {
+	_, err := tx.Exec(fmt.Sprintf("UPDATE %s.AnomalyDetectors SET learned_until = ? WHERE detector_id = ?", dbName),
+		learnedUntil, detectorID)
+	return err
+}
+
+// Anomaly is a step of a series that deviated from its baseline
+type Anomaly struct {
+	ID         int64
+	DetectorID int64
+	DeviceID   string
+	SeriesKey  string
+	Labels     map[string]string
+	// Start of the step
+	Timestamp string
+	Value     float64
+	// Mean and standard deviation of the baseline
+	Expected float64
+	Stddev   float64
+	// Deviation in standard deviations, negative below the mean
+	Score      float64
+	DetectedAt string
+}
+
+// InsertAnomalies records anomalies, the ones already recorded for the same step of a series are skipped
+func InsertAnomalies(db *sql.DB, tenantID string, anomalies []Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	placeholders := make([]string, 0, len(anomalies))
+	args := make([]interface{}, 0, 10*len(anomalies))
+	for _, anomaly := range anomalies {
+		labels, err := json.Marshal(anomaly.Labels)
+		if err != nil {
+			return err
+		}
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, anomaly.DetectorID, anomaly.DeviceID, anomaly.SeriesKey, string(labels), anomaly.Timestamp, anomaly.Value,
+			anomaly.Expected, anomaly.Stddev, anomaly.Score, anomaly.DetectedAt)
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`INSERT IGNORE INTO %s.Anomalies
+        (detector_id, device_id, series_key, labels, timestamp, value, expected, stddev, score, detected_at) VALUES %s`, dbName,
+		strings.Join(placeholders, ", ")), args...)
+	return err
+}
+
+// AnomalyQuery selects anomalies, the zero value of a field doesn't restrict them
+type AnomalyQuery struct {
+	DetectorID int64
+	DeviceIDs  []string
+	From       string
+	To         string
+	// Earliest detection
+	DetectedFrom string
+	// Smallest absolute score
+	MinScore float64
+	Limit    int
+}
+
+// GetAnomalies returns the anomalies matching a query, newest first
+func GetAnomalies(db *sql.DB, tenantID string, query AnomalyQuery) ([]Anomaly, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	var conditions []string
+	var args []interface{}
+	if query.DetectorID != 0 {
+		conditions = append(conditions, "detector_id = ?")
+		args = append(args, query.DetectorID)
+	}
+	if len(query.DeviceIDs) > 0 {
+		conditions = append(conditions, fmt.Sprintf("device_id IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(query.DeviceIDs)), ",")))
+		for _, deviceID := range query.DeviceIDs {
+			args = append(args, deviceID)
+		}
+	}
+	if query.From != "" {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != "" {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, query.To)
+	}
+	if query.DetectedFrom != "" {
+		conditions = append(conditions, "detected_at >= ?")
+		args = append(args, query.DetectedFrom)
+	}
+	if query.MinScore > 0 {
+		conditions = append(conditions, "ABS(score) >= ?")
+		args = append(args, query.MinScore)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := ""
+	if query.Limit > 0 {
+		limit = "LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT anomaly_id, detector_id, device_id, series_key, labels, timestamp, value, expected, stddev,
+        score, detected_at FROM %s.Anomalies %s ORDER BY timestamp DESC, anomaly_id DESC %s`, dbName, where, limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+		var anomaly Anomaly
+		var labels string
+		if err := rows.Scan(&anomaly.ID, &anomaly.DetectorID, &anomaly.DeviceID, &anomaly.SeriesKey, &labels, &anomaly.Timestamp,
+			&anomaly.Value, &anomaly.Expected, &anomaly.Stddev, &anomaly.Score, &anomaly.DetectedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(labels), &anomaly.Labels); err != nil {
+			return nil, fmt.Errorf("error reading labels of anomaly %d: %v", anomaly.ID, err)
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+
+	return anomalies, rows.Err()
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Series that don't map onto the host, process, disk or network tables are kept as generic series: a
+// metric name and a label set, identified by the SHA1 of both, with their samples in GenericSamples.
+// GenericSeriesLabels indexes the labels so series can be selected by label without reading the JSON.
+
+// Types of generic series, the samples of histograms and summaries are in GenericHistograms
+const (
+	GenericGauge     = "gauge"
+	GenericCounter   = "counter"
+	GenericHistogram = "histogram"
+)
+
+// ValidGenericType tells if a type can be given to a generic series
+func ValidGenericType(metricType string) bool {
+	return metricType == GenericGauge || metricType == GenericCounter || metricType == GenericHistogram || metricType == GenericSummary
+}
+
+// Label values are indexed up to this many characters, lookups on longer values compare the same prefix
+const GenericLabelIndexLength = 255
+
+type GenericSample struct {
+	Name     string
+	DeviceID string
+	// Type of the series when it is first stored, a gauge when empty
+	Type   string
+	Labels map[string]string
+	// Milliseconds since the epoch
+	Timestamp int64
+	Value     float64
+}
+
+// Generic series IDs already resolved, keyed by db and series hash
+var genericSeriesCache sync.Map
+
+// Generic samples keep milliseconds
+const genericTimestampLayout = "2006-01-02 15:04:05.000"
+
+// Rows per multi row INSERT of generic samples
+const genericInsertBatchSize = 500
+
+// genericSeriesHash identifies a series by its name, device and labels in name order
+func genericSeriesHash(name string, deviceID string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte(0)
+	b.WriteString(deviceID)
+	for _, label := range names {
+		b.WriteByte(0)
+		b.WriteString(label)
+		b.WriteByte('=')
+		b.WriteString(labels[label])
+	}
+
+	return hashString(b.String())
+}
+
+// genericSeriesID returns the ID of a series, adding it when it is new
+func genericSeriesID(db *sql.DB, dbName string, sample GenericSample) (int64, error) {
+	hash := genericSeriesHash(sample.Name, sample.DeviceID, sample.Labels)
+	cacheKey := dbName + "/" + hash
+
+	if id, ok := genericSeriesCache.Load(cacheKey); ok {
+		return id.(int64), nil
+	}
+
+	labels, err := json.Marshal(sample.Labels)
+	if err != nil {
+		return 0, err
+	}
+
+	var deviceID interface{}
+	if sample.DeviceID != "" {
+		deviceID = sample.DeviceID
+	}
+
+	metricType := sample.Type
+	if metricType == "" {
+		metricType = GenericGauge
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.GenericSeries (series_hash, metric_name, device_id, labels, metric_type) VALUES (?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE series_id = LAST_INSERT_ID(series_id)`, dbName), hash, sample.Name, deviceID, string(labels), metricType)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// A new series, index its labels
+	if inserted, err := result.RowsAffected(); err == nil && inserted == 1 {
+		if query, args := genericLabelsInsert(dbName+".", id, sample.Labels); query != "" {
+			if _, err := db.Exec(query, args...); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	genericSeriesCache.Store(cacheKey, id)
+	return id, nil
+}
+
+// GenericLabelValue returns a label value as it is indexed
+func GenericLabelValue(value string) string {
+	if len(value) <= GenericLabelIndexLength {
+		return value
+	}
+
+	runes := []rune(value)
+	if len(runes) <= GenericLabelIndexLength {
+		return value
+	}
+	return string(runes[:GenericLabelIndexLength])
+}
+
+// genericLabelsInsert returns the statement indexing the labels of a series, empty when it has none.
+// prefix qualifies the table with its db.
+func genericLabelsInsert(prefix string, seriesID int64, labels map[string]string) (string, []interface{}) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+
+	rows := make([]string, 0, len(labels))
+	args := make([]interface{}, 0, 3*len(labels))
+	for name, value := range labels {
+		rows = append(rows, "(?, ?, ?)")
+		args = append(args, GenericLabelValue(name), GenericLabelValue(value), seriesID)
+	}
+
+	return fmt.Sprintf("INSERT IGNORE INTO %sGenericSeriesLabels (label_name, label_value, series_id) VALUES %s",
+		prefix, strings.Join(rows, ", ")), args
+}
+
+// InsertGenericSamples stores samples of generic series, a sample already stored for the same time is overwritten
+func InsertGenericSamples(db *sql.DB, orgID string, samples []GenericSample) error {
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
+
+	for start := 0; start < len(samples); start += genericInsertBatchSize {
+		end := start + genericInsertBatchSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		rows := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 3*(end-start))
+		for _, sample := range samples[start:end] {
+			seriesID, err := genericSeriesID(db, dbName, sample)
+			if err != nil {
+				return err
+			}
+
+			rows = append(rows, "(?, ?, ?)")
+			args = append(args, seriesID, time.UnixMilli(sample.Timestamp).UTC().Format(genericTimestampLayout), sample.Value)
+		}
+
+		_, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.GenericSamples (series_id, timestamp, value) VALUES %s
+            ON DUPLICATE KEY UPDATE value = VALUES(value)`, dbName, strings.Join(rows, ", ")), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
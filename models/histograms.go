@@ -0,0 +1,121 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Histograms and summaries are generic series whose samples are a whole distribution, kept in
+// GenericHistograms with their buckets as JSON next to the count and sum.
+
+// Type of the generic series holding summaries, histograms are GenericHistogram
+const GenericSummary = "summary"
+
+// Histogram is one sample of a histogram or summary series. Counts are cumulative since the series started,
+// unless Delta is set and they only cover the time since the previous sample.
+type Histogram struct {
+	Count float64 `json:"count"`
+	Sum   float64 `json:"sum"`
+	Delta bool    `json:"delta,omitempty"`
+
+	// Explicit buckets: the count of every bucket, the last one above the last bound
+	ExplicitBounds []float64 `json:"explicitBounds,omitempty"`
+	BucketCounts   []float64 `json:"bucketCounts,omitempty"`
+
+	// Exponential buckets: bucket i holds the values in (base^(i-1), base^i] with base 2^(2^-schema), the
+	// negative buckets the same range of negative values. Values within the zero threshold are counted apart.
+	Exponential   bool            `json:"exponential,omitempty"`
+	Schema        int             `json:"schema,omitempty"`
+	ZeroThreshold float64         `json:"zeroThreshold,omitempty"`
+	ZeroCount     float64         `json:"zeroCount,omitempty"`
+	Positive      map[int]float64 `json:"positive,omitempty"`
+	Negative      map[int]float64 `json:"negative,omitempty"`
+
+	// Summary quantiles computed by the client, they can't be merged
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// Valid checks that the buckets of a histogram are consistent
+func (h Histogram) Valid() error {
+	if h.Count < 0 || h.Sum != h.Sum {
+		return fmt.Errorf("invalid count or sum")
+	}
+
+	if len(h.ExplicitBounds) > 0 || len(h.BucketCounts) > 0 {
+		if h.Exponential {
+			return fmt.Errorf("explicit and exponential buckets can't be mixed")
+		}
+		if len(h.BucketCounts) != len(h.ExplicitBounds)+1 {
+			return fmt.Errorf("expected %d bucket counts for %d bounds", len(h.ExplicitBounds)+1, len(h.ExplicitBounds))
+		}
+		for i := 1; i < len(h.ExplicitBounds); i++ {
+			if h.ExplicitBounds[i] <= h.ExplicitBounds[i-1] {
+				return fmt.Errorf("bucket bounds aren't increasing")
+			}
+		}
+	}
+
+	if h.Exponential && (h.Schema < -4 || h.Schema > 8) {
+		return fmt.Errorf("invalid schema %d, expected -4 to 8", h.Schema)
+	}
+
+	return nil
+}
+
+type HistogramSample struct {
+	Name     string
+	DeviceID string
+	// GenericHistogram or GenericSummary
+	Type   string
+	Labels map[string]string
+	// Milliseconds since the epoch
+	Timestamp int64
+	Histogram Histogram
+}
+
+// InsertHistogramSamples stores samples of histogram and summary series, a sample already stored for the
+// same time is overwritten
+func InsertHistogramSamples(db *sql.DB, orgID string, samples []HistogramSample) error {
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
+
+	for start := 0; start < len(samples); start += genericInsertBatchSize {
+		end := start + genericInsertBatchSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		rows := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 5*(end-start))
+		for _, sample := range samples[start:end] {
+			seriesID, err := genericSeriesID(db, dbName, GenericSample{
+				Name:     sample.Name,
+				DeviceID: sample.DeviceID,
+				Type:     sample.Type,
+				Labels:   sample.Labels,
+			})
+			if err != nil {
+				return err
+			}
+
+			encoded, err := json.Marshal(sample.Histogram)
+			if err != nil {
+				return err
+			}
+
+			rows = append(rows, "(?, ?, ?, ?, ?)")
+			args = append(args, seriesID, time.UnixMilli(sample.Timestamp).UTC().Format(genericTimestampLayout),
+				sample.Histogram.Count, sample.Histogram.Sum, string(encoded))
+		}
+
+		_, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.GenericHistograms (series_id, timestamp, count, sum, histogram) VALUES %s
+            ON DUPLICATE KEY UPDATE count = VALUES(count), sum = VALUES(sum), histogram = VALUES(histogram)`, dbName, strings.Join(rows, ", ")), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Log events are lines logged on a device, optionally by one of its processes, kept in LogEvents with a
+// full-text index on their message.
+
+// Severities of log events from the most to the least severe, indexed by their syslog code
+var LogSeverities = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+type LogEvent struct {
+	DeviceID string
+	// Milliseconds since the epoch
+	Timestamp int64
+	// One of LogSeverities, empty when unknown
+	Severity string
+	// Application or logger that wrote the line
+	Source      string
+	ProcessPID  *int
+	ProcessName string
+	Message     string
+	Attributes  map[string]string
+}
+
+// Log events inserted per statement
+const logInsertBatchSize = 500
+
+// InsertLogEvents stores log events of a tenant
+func InsertLogEvents(db *sql.DB, orgID string, events []LogEvent) error {
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
+
+	for start := 0; start < len(events); start += logInsertBatchSize {
+		end := start + logInsertBatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		rows := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 8*(end-start))
+		for _, event := range events[start:end] {
+			var attributes interface{}
+			if len(event.Attributes) > 0 {
+				encoded, err := json.Marshal(event.Attributes)
+				if err != nil {
+					return err
+				}
+				attributes = string(encoded)
+			}
+
+			rows = append(rows, "(?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, event.DeviceID, time.UnixMilli(event.Timestamp).UTC().Format(genericTimestampLayout),
+				nullString(event.Severity), nullString(event.Source), event.ProcessPID, nullString(event.ProcessName),
+				event.Message, attributes)
+		}
+
+		_, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.LogEvents
+            (device_id, timestamp, severity, source, process_pid, process_name, message, attributes) VALUES %s`,
+			dbName, strings.Join(rows, ", ")), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// LogQuery selects log events, the zero value of a field doesn't restrict them
+type LogQuery struct {
+	DeviceIDs []string
+	From      time.Time
+	To        time.Time
+	// Full-text search in the message, in the MySQL boolean mode syntax: +word -word "phrase" prefix*
+	Text        string
+	ProcessPID  *int
+	ProcessName string
+	// Events at least this severe
+	MinSeverity string
+	Limit       int
+	// Oldest events first, else the newest
+	Ascending bool
+}
+
+type StoredLogEvent struct {
+	ID int64
+	LogEvent
+}
+
+// SearchLogEvents returns the log events matching a query, by time
+func SearchLogEvents(db *sql.DB, orgID string, query LogQuery) ([]StoredLogEvent, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
+
+	conditions := []string{"timestamp BETWEEN ? AND ?"}
+	args := []interface{}{query.From.UTC().Format(genericTimestampLayout), query.To.UTC().Format(genericTimestampLayout)}
+
+	if len(query.DeviceIDs) > 0 {
+		conditions = append(conditions, fmt.Sprintf("device_id IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(query.DeviceIDs)), ",")))
+		for _, deviceID := range query.DeviceIDs {
+			args = append(args, deviceID)
+		}
+	}
+	if query.Text != "" {
+		conditions = append(conditions, "MATCH(message) AGAINST (? IN BOOLEAN MODE)")
+		args = append(args, query.Text)
+	}
+	if query.ProcessPID != nil {
+		conditions = append(conditions, "process_pid = ?")
+		args = append(args, *query.ProcessPID)
+	}
+	if query.ProcessName != "" {
+		conditions = append(conditions, "process_name = ?")
+		args = append(args, query.ProcessName)
+	}
+	if query.MinSeverity != "" {
+		var severities []string
+		for _, severity := range LogSeverities {
+			severities = append(severities, severity)
+			if severity == query.MinSeverity {
+				break
+			}
+		}
+		conditions = append(conditions, fmt.Sprintf("severity IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(severities)), ",")))
+		for _, severity := range severities {
+			args = append(args, severity)
+		}
+	}
+
+	order := "DESC"
+	if query.Ascending {
+		order = "ASC"
+	}
+	args = append(args, query.Limit)
+
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT log_id, device_id, timestamp, COALESCE(severity, ''), COALESCE(source, ''), process_pid,
+            COALESCE(process_name, ''), message, attributes
+        FROM %s.LogEvents
+        WHERE %s
+        ORDER BY timestamp %s, log_id %s
+        LIMIT ?
+    `, dbName, strings.Join(conditions, " AND "), order, order), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying log events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []StoredLogEvent
+	for rows.Next() {
+		var event StoredLogEvent
+		var timestamp string
+		var attributes sql.NullString
+		if err := rows.Scan(&event.ID, &event.DeviceID, &timestamp, &event.Severity, &event.Source, &event.ProcessPID,
+			&event.ProcessName, &event.Message, &attributes); err != nil {
+			return nil, fmt.Errorf("error scanning log event: %v", err)
+		}
+
+		parsed, err := time.Parse(genericTimestampLayout, timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing log event time %q: %v", timestamp, err)
+		}
+		event.Timestamp = parsed.UnixMilli()
+
+		if attributes.Valid {
+			if err := json.Unmarshal([]byte(attributes.String), &event.Attributes); err != nil {
+				return nil, fmt.Errorf("error reading log event attributes: %v", err)
+			}
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
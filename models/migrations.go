@@ -0,0 +1,553 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A schema change applied to every tenant db on top of the tables created in CreatePerformanceDB.
+// Migrations run in version order and are recorded in SchemaMigrations so each one runs only once.
+// Never change a migration that has shipped, append a new one instead.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+	// Optional data migration, runs after the statements
+	apply func(ctx context.Context, conn *sql.Conn) error
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "load average and cpu state breakdown",
+		statements: []string{
+			`ALTER TABLE PerformanceMetrics
+                ADD COLUMN load_avg_1 FLOAT,
+                ADD COLUMN load_avg_5 FLOAT,
+                ADD COLUMN load_avg_15 FLOAT,
+                ADD COLUMN cpu_user FLOAT,
+                ADD COLUMN cpu_system FLOAT,
+                ADD COLUMN cpu_iowait FLOAT,
+                ADD COLUMN cpu_steal FLOAT`,
+		},
+	},
+	{
+		version:     2,
+		description: "extended process attributes",
+		statements: []string{
+			`ALTER TABLE ProcessMetrics
+                ADD COLUMN process_user VARCHAR(255),
+                ADD COLUMN process_ppid INT,
+                ADD COLUMN process_state VARCHAR(16),
+                ADD COLUMN process_threads INT,
+                ADD COLUMN process_open_fds INT,
+                ADD COLUMN process_start_time DATETIME,
+                ADD COLUMN process_read_bytes BIGINT,
+                ADD COLUMN process_write_bytes BIGINT`,
+		},
+	},
+	{
+		version:     3,
+		description: "process instance and workload identity",
+		statements: []string{
+			`ALTER TABLE ProcessMetrics
+                ADD COLUMN process_instance CHAR(40),
+                ADD COLUMN workload_key VARCHAR(255),
+                ADD INDEX idx_process_instance (process_instance),
+                ADD INDEX idx_workload_key (workload_key)`,
+		},
+		apply: backfillProcessIdentity,
+	},
+	{
+		version:     4,
+		description: "process name and command dictionary",
+		statements: []string{
+			`ALTER TABLE ProcessMetrics
+                ADD COLUMN name_id INT,
+                ADD COLUMN command_id INT,
+                ADD FOREIGN KEY (name_id) REFERENCES ProcessNames(name_id),
+                ADD FOREIGN KEY (command_id) REFERENCES ProcessCommands(command_id)`,
+		},
+		apply: migrateProcessDictionary,
+	},
+	{
+		version:     5,
+		description: "time partitioned performance and process metrics",
+		statements: []string{
+			`ALTER TABLE ProcessMetrics ADD COLUMN timestamp DATETIME AFTER metric_id`,
+		},
+		apply: partitionMetricTables,
+	},
+	{
+		version:     6,
+		description: "covering indexes for the top process queries",
+		statements: []string{
+			// Samples are joined on (metric_id, timestamp), the usage columns make the ranking index only
+			`ALTER TABLE ProcessMetrics
+                ADD INDEX idx_process_sample_pid (metric_id, timestamp, process_pid, process_cpu_usage, process_ram_usage),
+                ADD INDEX idx_process_sample_instance (metric_id, timestamp, process_instance, process_cpu_usage, process_ram_usage),
+                ADD INDEX idx_process_sample_workload (metric_id, timestamp, workload_key, process_cpu_usage, process_ram_usage)`,
+			`ALTER TABLE ProcessRollups
+                ADD INDEX idx_process_rollups_rank (device_id, resolution, metric, bucket_start)`,
+		},
+	},
+	{
+		version:     7,
+		description: "generic series types and label index",
+		statements: []string{
+			`ALTER TABLE GenericSeries ADD COLUMN metric_type VARCHAR(16) NOT NULL DEFAULT 'gauge'`,
+			// Series are selected by label, the series_id index lists the labels of a series
+			`CREATE TABLE IF NOT EXISTS GenericSeriesLabels (
+                label_name VARCHAR(255) NOT NULL,
+                label_value VARCHAR(255) NOT NULL,
+                series_id BIGINT NOT NULL,
+                PRIMARY KEY (label_name, label_value, series_id),
+                INDEX idx_generic_series_labels_series (series_id)
+            )`,
+		},
+		apply: backfillGenericSeriesLabels,
+	},
+	{
+		version:     8,
+		description: "histogram and summary samples",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS GenericHistograms (
+                series_id BIGINT NOT NULL,
+                timestamp DATETIME(3) NOT NULL,
+                count DOUBLE NOT NULL,
+                sum DOUBLE,
+                histogram JSON NOT NULL,
+                PRIMARY KEY (series_id, timestamp)
+            )`,
+		},
+	},
+	{
+		version:     9,
+		description: "log events",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS LogEvents (
+                log_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                device_id VARCHAR(255) NOT NULL,
+                timestamp DATETIME(3) NOT NULL,
+                severity VARCHAR(16),
+                source VARCHAR(255),
+                process_pid INT,
+                process_name VARCHAR(255),
+                message TEXT NOT NULL,
+                attributes JSON,
+                INDEX idx_log_events_device (device_id, timestamp),
+                INDEX idx_log_events_time (timestamp),
+                FULLTEXT INDEX idx_log_events_message (message)
+            )`,
+		},
+	},
+	{
+		version:     10,
+		description: "alert rules, states and history",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS AlertRules (
+                rule_id INT AUTO_INCREMENT PRIMARY KEY,
+                name VARCHAR(255) NOT NULL,
+                description TEXT,
+                metric VARCHAR(255) NOT NULL,
+                devices JSON NOT NULL,
+                filters JSON NOT NULL,
+                group_by VARCHAR(32),
+                aggregation VARCHAR(8) NOT NULL,
+                operator VARCHAR(2) NOT NULL,
+                threshold DOUBLE NOT NULL,
+                window_seconds INT NOT NULL,
+                for_seconds INT NOT NULL,
+                severity VARCHAR(16) NOT NULL,
+                enabled BOOLEAN NOT NULL,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+			`CREATE TABLE IF NOT EXISTS AlertStates (
+                rule_id INT NOT NULL,
+                alert_key CHAR(40) NOT NULL,
+                device_id VARCHAR(255) NOT NULL,
+                series_key VARCHAR(255) NOT NULL,
+                labels JSON NOT NULL,
+                state VARCHAR(16) NOT NULL,
+                value DOUBLE,
+                active_since DATETIME NOT NULL,
+                fired_at DATETIME,
+                evaluated_at DATETIME NOT NULL,
+                PRIMARY KEY (rule_id, alert_key)
+            )`,
+			`CREATE TABLE IF NOT EXISTS AlertHistory (
+                event_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                rule_id INT NOT NULL,
+                alert_key CHAR(40) NOT NULL,
+                device_id VARCHAR(255) NOT NULL,
+                series_key VARCHAR(255) NOT NULL,
+                labels JSON NOT NULL,
+                state VARCHAR(16) NOT NULL,
+                value DOUBLE,
+                threshold DOUBLE NOT NULL,
+                timestamp DATETIME NOT NULL,
+                INDEX idx_alert_history_rule (rule_id, timestamp),
+                INDEX idx_alert_history_time (timestamp)
+            )`,
+		},
+	},
+	{
+		version:     11,
+		description: "notification channels, alert routes and deliveries",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS NotificationChannels (
+                channel_id INT AUTO_INCREMENT PRIMARY KEY,
+                name VARCHAR(255) NOT NULL,
+                type VARCHAR(16) NOT NULL,
+                config JSON NOT NULL,
+                send_resolved BOOLEAN NOT NULL,
+                enabled BOOLEAN NOT NULL,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+			`CREATE TABLE IF NOT EXISTS AlertRoutes (
+                rule_id INT NOT NULL,
+                channel_id INT NOT NULL,
+                PRIMARY KEY (rule_id, channel_id),
+                INDEX idx_alert_routes_channel (channel_id)
+            )`,
+			`CREATE TABLE IF NOT EXISTS NotificationDeliveries (
+                delivery_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                channel_id INT NOT NULL,
+                rule_id INT NOT NULL,
+                state VARCHAR(16) NOT NULL,
+                group_key CHAR(40) NOT NULL,
+                alert_count INT NOT NULL,
+                payload JSON NOT NULL,
+                status VARCHAR(16) NOT NULL,
+                attempts INT NOT NULL,
+                last_error TEXT,
+                created_at DATETIME NOT NULL,
+                next_attempt_at DATETIME,
+                sent_at DATETIME,
+                INDEX idx_notification_deliveries_due (status, next_attempt_at),
+                INDEX idx_notification_deliveries_group (group_key, created_at),
+                INDEX idx_notification_deliveries_channel (channel_id, created_at)
+            )`,
+		},
+	},
+	{
+		version:     12,
+		description: "alert silences and maintenance windows",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS Silences (
+                silence_id INT AUTO_INCREMENT PRIMARY KEY,
+                rule_id INT,
+                devices JSON NOT NULL,
+                labels JSON NOT NULL,
+                starts_at DATETIME NOT NULL,
+                ends_at DATETIME NOT NULL,
+                comment TEXT,
+                created_by VARCHAR(255),
+                created_at DATETIME NOT NULL,
+                INDEX idx_silences_time (ends_at, starts_at)
+            )`,
+			`CREATE TABLE IF NOT EXISTS MaintenanceWindows (
+                window_id INT AUTO_INCREMENT PRIMARY KEY,
+                name VARCHAR(255) NOT NULL,
+                devices JSON NOT NULL,
+                schedule VARCHAR(255) NOT NULL,
+                duration_seconds INT NOT NULL,
+                timezone VARCHAR(64) NOT NULL,
+                suppress_offline BOOLEAN NOT NULL,
+                enabled BOOLEAN NOT NULL,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+			`ALTER TABLE AlertStates ADD COLUMN silenced_by VARCHAR(64)`,
+			`ALTER TABLE AlertHistory ADD COLUMN silenced_by VARCHAR(64)`,
+		},
+	},
+	{
+		version:     13,
+		description: "anomaly detectors, baselines and anomalies",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS AnomalyDetectors (
+                detector_id INT AUTO_INCREMENT PRIMARY KEY,
+                name VARCHAR(255) NOT NULL,
+                metric VARCHAR(255) NOT NULL,
+                devices JSON NOT NULL,
+                filters JSON NOT NULL,
+                group_by VARCHAR(32),
+                top INT NOT NULL,
+                model VARCHAR(16) NOT NULL,
+                step_seconds INT NOT NULL,
+                training_seconds INT NOT NULL,
+                threshold DOUBLE NOT NULL,
+                direction VARCHAR(8) NOT NULL,
+                min_deviation DOUBLE NOT NULL,
+                min_samples INT NOT NULL,
+                enabled BOOLEAN NOT NULL,
+                evaluated_until DATETIME,
+                created_at DATETIME NOT NULL,
+                updated_at DATETIME NOT NULL
+            )`,
+			`CREATE TABLE IF NOT EXISTS AnomalyBaselines (
+                detector_id INT NOT NULL,
+                device_id VARCHAR(255) NOT NULL,
+                series_key VARCHAR(255) NOT NULL,
+                slot SMALLINT NOT NULL,
+                labels JSON NOT NULL,
+                mean DOUBLE NOT NULL,
+                stddev DOUBLE NOT NULL,
+                samples INT NOT NULL,
+                PRIMARY KEY (detector_id, device_id, series_key, slot)
+            )`,
+			`CREATE TABLE IF NOT EXISTS Anomalies (
+                anomaly_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+                detector_id INT NOT NULL,
+                device_id VARCHAR(255) NOT NULL,
+                series_key VARCHAR(255) NOT NULL,
+                labels JSON NOT NULL,
+                timestamp DATETIME NOT NULL,
+                value DOUBLE NOT NULL,
+                expected DOUBLE NOT NULL,
+                stddev DOUBLE NOT NULL,
+                score DOUBLE NOT NULL,
+                detected_at DATETIME NOT NULL,
+                UNIQUE KEY uq_anomalies_series (detector_id, device_id, series_key, timestamp),
+                INDEX idx_anomalies_time (timestamp)
+            )`,
+		},
+	},
+	{
+		version:     14,
+		description: "incremental anomaly baselines",
+		statements: []string{
+			`ALTER TABLE AnomalyDetectors ADD COLUMN learned_until DATETIME`,
+			`ALTER TABLE AnomalyBaselines ADD COLUMN m2 DOUBLE NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     15,
+		description: "metric_id indexes of the detail sample tables",
+		apply:       indexDetailMetricTables,
+	},
+}
+
+// applyMigrations runs the pending migrations on the tenant db selected on conn
+func applyMigrations(ctx context.Context, conn *sql.Conn) error {
+	var current int
+	err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM SchemaMigrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		for _, statement := range m.statements {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("error applying migration %d (%s): %w", m.version, m.description, err)
+			}
+		}
+
+		if m.apply != nil {
+			if err := m.apply(ctx, conn); err != nil {
+				return fmt.Errorf("error applying migration %d (%s): %w", m.version, m.description, err)
+			}
+		}
+
+		_, err := conn.ExecContext(ctx, "INSERT INTO SchemaMigrations (version, description, applied_at) VALUES (?, ?, ?)",
+			m.version, m.description, time.Now().UTC().Format(timestampLayout))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Applied migration %d: %s", m.version, m.description)
+	}
+
+	return nil
+}
+
+// Rows updated per round trip by the data migrations
+const migrationBatchSize = 1000
+
+// backfillProcessIdentity computes the instance and workload keys of the samples stored before they existed. The
+// keys are computed here, then written with one UPDATE per range of IDs.
+func backfillProcessIdentity(ctx context.Context, conn *sql.Conn) error {
+	var minID, maxID sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT MIN(process_metric_id), MAX(process_metric_id) FROM ProcessMetrics").Scan(&minID, &maxID); err != nil {
+		return err
+	}
+	if !minID.Valid {
+		return nil
+	}
+
+	for start := minID.Int64; start <= maxID.Int64; start += migrationBatchSize {
+		rows, err := conn.QueryContext(ctx, `
+            SELECT psm.process_metric_id, pm.device_id, psm.process_pid, COALESCE(psm.process_name, ''), COALESCE(psm.process_command, ''),
+                DATE_FORMAT(psm.process_start_time, '%Y-%m-%d %H:%i:%s')
+            FROM ProcessMetrics psm
+            JOIN PerformanceMetrics pm ON pm.metric_id = psm.metric_id
+            WHERE psm.process_metric_id BETWEEN ? AND ? AND psm.process_instance IS NULL`, start, start+migrationBatchSize-1)
+		if err != nil {
+			return err
+		}
+
+		var selects []string
+		var args []interface{}
+		for rows.Next() {
+			var id int64
+			var pid int
+			var deviceID, name, command string
+			var startTime *string
+			if err := rows.Scan(&id, &deviceID, &pid, &name, &command, &startTime); err != nil {
+				rows.Close()
+				return err
+			}
+			selects = append(selects, "SELECT ? AS id, ? AS process_instance, ? AS workload_key")
+			args = append(args, id, ProcessInstanceKey(deviceID, pid, startTime, name), WorkloadKey(name, command))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(selects) == 0 {
+			continue
+		}
+
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(`UPDATE ProcessMetrics psm
+            JOIN (%s) k ON k.id = psm.process_metric_id
+            SET psm.process_instance = k.process_instance, psm.workload_key = k.workload_key`, strings.Join(selects, " UNION ALL ")), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Indexes on metric_id of the detail sample tables, as created in CreatePerformanceDB
+var detailMetricIndexes = [][2]string{
+	{"DiskMetrics", "idx_disk_metrics_metric"},
+	{"NetworkMetrics", "idx_network_metrics_metric"},
+	{"CoreMetrics", "idx_core_metrics_metric"},
+}
+
+// indexDetailMetricTables gives the detail sample tables their index on metric_id. Tenants created with foreign keys
+// have the index the foreign key created, it is renamed, the others get one.
+func indexDetailMetricTables(ctx context.Context, conn *sql.Conn) error {
+	for _, index := range detailMetricIndexes {
+		table, name := index[0], index[1]
+
+		var existing sql.NullString
+		err := conn.QueryRowContext(ctx, `SELECT MIN(INDEX_NAME) FROM INFORMATION_SCHEMA.STATISTICS
+            WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = 'metric_id' AND SEQ_IN_INDEX = 1`, table).Scan(&existing)
+		if err != nil {
+			return err
+		}
+
+		var statement string
+		switch {
+		case !existing.Valid:
+			statement = fmt.Sprintf("ALTER TABLE %s ADD INDEX %s (metric_id)", table, name)
+		case existing.String != name:
+			statement = fmt.Sprintf("ALTER TABLE %s RENAME INDEX `%s` TO %s", table, existing.String, name)
+		default:
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfillGenericSeriesLabels indexes the labels of the generic series stored before the label index existed
+func backfillGenericSeriesLabels(ctx context.Context, conn *sql.Conn) error {
+	var lastID int64
+	for {
+		rows, err := conn.QueryContext(ctx, "SELECT series_id, labels FROM GenericSeries WHERE series_id > ? ORDER BY series_id LIMIT ?",
+			lastID, migrationBatchSize)
+		if err != nil {
+			return err
+		}
+
+		batch := make(map[int64]map[string]string)
+		var order []int64
+		for rows.Next() {
+			var id int64
+			var encoded string
+			if err := rows.Scan(&id, &encoded); err != nil {
+				rows.Close()
+				return err
+			}
+
+			labels := make(map[string]string)
+			if err := json.Unmarshal([]byte(encoded), &labels); err != nil {
+				rows.Close()
+				return fmt.Errorf("error reading labels of generic series %d: %v", id, err)
+			}
+			batch[id] = labels
+			order = append(order, id)
+		}
+		rows.Close()
+
+		if len(order) == 0 {
+			return nil
+		}
+
+		for _, id := range order {
+			query, args := genericLabelsInsert("", id, batch[id])
+			if query == "" {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		lastID = order[len(order)-1]
+	}
+}
+
+// ListTenants returns the ID of every tenant that has a performance db
+func ListTenants(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME LIKE 'Performance\\_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []string
+	for rows.Next() {
+		var schemaName string
+		if err := rows.Scan(&schemaName); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, strings.TrimPrefix(schemaName, "Performance_"))
+	}
+
+	return tenants, rows.Err()
+}
+
+// MigrateAllTenants brings every existing tenant db up to date, so queries work before the tenant's agents report again
+func MigrateAllTenants(db *sql.DB) error {
+	tenants, err := ListTenants(db)
+	if err != nil {
+		return fmt.Errorf("error listing tenants: %w", err)
+	}
+
+	for _, tenantID := range tenants {
+		if err := CreatePerformanceDB(db, tenantID); err != nil {
+			return fmt.Errorf("error migrating tenant %s: %w", tenantID, err)
+		}
+	}
+
+	return nil
+}
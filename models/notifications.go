@@ -0,0 +1,318 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Notification channels deliver the alerts that fire and resolve. AlertRoutes sends the alerts of a rule to its
+// channels, and NotificationDeliveries queues the notifications until they are sent, then keeps them as the
+// delivery history.
+
+// Statuses of a delivery
+const (
+	// Waiting for its first attempt or a retry
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	// Every attempt failed
+	DeliveryFailed = "failed"
+	// Not sent, the channel was just notified of the same alerts in the same state
+	DeliveryDuplicate = "duplicate"
+)
+
+type NotificationChannel struct {
+	ID   int64
+	Name string
+	Type string
+	// JSON of the notify.Config of the channel
+	Config       string
+	SendResolved bool
+	Enabled      bool
+	CreatedAt    string
+	UpdatedAt    string
+}
+
+func scanNotificationChannel(scanner interface{ Scan(...interface{}) error }) (NotificationChannel, error) {
+	var channel NotificationChannel
+	err := scanner.Scan(&channel.ID, &channel.Name, &channel.Type, &channel.Config, &channel.SendResolved, &channel.Enabled,
+		&channel.CreatedAt, &channel.UpdatedAt)
+	return channel, err
+}
+
+const notificationChannelColumns = "channel_id, name, type, config, send_resolved, enabled, created_at, updated_at"
+
+// GetNotificationChannels returns the notification channels of a tenant by ID
+func GetNotificationChannels(db *sql.DB, tenantID string) ([]NotificationChannel, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.NotificationChannels ORDER BY channel_id", notificationChannelColumns, dbName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []NotificationChannel{}
+	for rows.Next() {
+		channel, err := scanNotificationChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+
+	return channels, rows.Err()
+}
+
+// GetNotificationChannel returns a notification channel, nil when the tenant has none with that ID
+func GetNotificationChannel(db *sql.DB, tenantID string, channelID int64) (*NotificationChannel, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	row := db.QueryRow(fmt.Sprintf("SELECT %s FROM %s.NotificationChannels WHERE channel_id = ?", notificationChannelColumns, dbName),
+		channelID)
+
+	channel, err := scanNotificationChannel(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+// CreateNotificationChannel saves a new notification channel and returns its ID
+func CreateNotificationChannel(db *sql.DB, tenantID string, channel NotificationChannel, now string) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.NotificationChannels
+        (name, type, config, send_resolved, enabled, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`, dbName),
+		channel.Name, channel.Type, channel.Config, channel.SendResolved, channel.Enabled, now, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// UpdateNotificationChannel replaces a notification channel, it returns false when the tenant has none with its ID
+func UpdateNotificationChannel(db *sql.DB, tenantID string, channel NotificationChannel, now string) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf(`UPDATE %s.NotificationChannels SET name = ?, type = ?, config = ?, send_resolved = ?,
+        enabled = ?, updated_at = ? WHERE channel_id = ?`, dbName),
+		channel.Name, channel.Type, channel.Config, channel.SendResolved, channel.Enabled, now, channel.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// Unchanged rows count as not affected, tell them apart from missing ones
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err == nil, err
+	}
+	existing, err := GetNotificationChannel(db, tenantID, channel.ID)
+	return existing != nil, err
+}
+
+// DeleteNotificationChannel deletes a notification channel and its routes, its deliveries are kept. It returns
+// false when the tenant has no channel with that ID.
+func DeleteNotificationChannel(db *sql.DB, tenantID string, channelID int64) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf("DELETE FROM %s.NotificationChannels WHERE channel_id = ?", dbName), channelID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s.AlertRoutes WHERE channel_id = ?", dbName), channelID)
+	return true, err
+}
+
+// GetAlertRoutes returns the channels of the alert rules of a tenant, by rule ID
+func GetAlertRoutes(db *sql.DB, tenantID string) (map[int64][]int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT rule_id, channel_id FROM %s.AlertRoutes ORDER BY rule_id, channel_id", dbName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	routes := make(map[int64][]int64)
+	for rows.Next() {
+		var ruleID, channelID int64
+		if err := rows.Scan(&ruleID, &channelID); err != nil {
+			return nil, err
+		}
+		routes[ruleID] = append(routes[ruleID], channelID)
+	}
+
+	return routes, rows.Err()
+}
+
+// SetAlertRoutes replaces the channels of an alert rule
+func SetAlertRoutes(db *sql.DB, tenantID string, ruleID int64, channelIDs []int64) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s.AlertRoutes WHERE rule_id = ?", dbName), ruleID); err != nil {
+		return err
+	}
+	if len(channelIDs) > 0 {
+		placeholders := make([]string, 0, len(channelIDs))
+		args := make([]interface{}, 0, 2*len(channelIDs))
+		for _, channelID := range channelIDs {
+			placeholders = append(placeholders, "(?, ?)")
+			args = append(args, ruleID, channelID)
+		}
+		_, err := tx.Exec(fmt.Sprintf("INSERT IGNORE INTO %s.AlertRoutes (rule_id, channel_id) VALUES %s", dbName,
+			strings.Join(placeholders, ", ")), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// NotificationDelivery is a notification queued for a channel, and then the outcome of its delivery
+type NotificationDelivery struct {
+	ID        int64
+	ChannelID int64
+	// 0 for test sends
+	RuleID int64
+	State  string
+	// Identifies the alerts of a rule notified on a channel, whatever their state
+	GroupKey   string
+	AlertCount int
+	// JSON of the notify.Notification
+	Payload       string
+	Status        string
+	Attempts      int
+	LastError     string
+	CreatedAt     string
+	NextAttemptAt string
+	SentAt        string
+}
+
+const notificationDeliveryColumns = `delivery_id, channel_id, rule_id, state, group_key, alert_count, payload, status, attempts,
+    COALESCE(last_error, ''), created_at, COALESCE(next_attempt_at, ''), COALESCE(sent_at, '')`
+
+func scanNotificationDeliveries(rows *sql.Rows) ([]NotificationDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var d NotificationDelivery
+		if err := rows.Scan(&d.ID, &d.ChannelID, &d.RuleID, &d.State, &d.GroupKey, &d.AlertCount, &d.Payload, &d.Status,
+			&d.Attempts, &d.LastError, &d.CreatedAt, &d.NextAttemptAt, &d.SentAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// InsertNotificationDelivery queues or records a delivery and returns its ID
+func InsertNotificationDelivery(db *sql.DB, tenantID string, d NotificationDelivery) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.NotificationDeliveries (channel_id, rule_id, state, group_key, alert_count,
+        payload, status, attempts, last_error, created_at, next_attempt_at, sent_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName),
+		d.ChannelID, d.RuleID, d.State, d.GroupKey, d.AlertCount, d.Payload, d.Status, d.Attempts, nullString(d.LastError),
+		d.CreatedAt, nullString(d.NextAttemptAt), nullString(d.SentAt))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// UpdateNotificationDelivery records an attempt of a delivery
+func UpdateNotificationDelivery(db *sql.DB, tenantID string, d NotificationDelivery) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	_, err := db.Exec(fmt.Sprintf(`UPDATE %s.NotificationDeliveries SET status = ?, attempts = ?, last_error = ?,
+        next_attempt_at = ?, sent_at = ? WHERE delivery_id = ?`, dbName),
+		d.Status, d.Attempts, nullString(d.LastError), nullString(d.NextAttemptAt), nullString(d.SentAt), d.ID)
+	return err
+}
+
+// LastDeliveryState returns the state of the newest notification of a group queued since a time, whether it was
+// sent yet or not, or an empty string when there is none
+func LastDeliveryState(db *sql.DB, tenantID string, groupKey string, since string) (string, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	var state string
+	err := db.QueryRow(fmt.Sprintf(`SELECT state FROM %s.NotificationDeliveries WHERE group_key = ? AND created_at >= ?
+        AND status <> ? ORDER BY created_at DESC, delivery_id DESC LIMIT 1`, dbName), groupKey, since, DeliveryDuplicate).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return state, err
+}
+
+// GetDueDeliveries returns the pending deliveries whose next attempt is due at now, oldest first
+func GetDueDeliveries(db *sql.DB, tenantID string, now string, limit int) ([]NotificationDelivery, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s FROM %s.NotificationDeliveries WHERE status = ? AND next_attempt_at <= ?
+        ORDER BY next_attempt_at, delivery_id LIMIT ?`, notificationDeliveryColumns, dbName), DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNotificationDeliveries(rows)
+}
+
+// DeliveryQuery selects deliveries, the zero value of a field doesn't restrict them
+type DeliveryQuery struct {
+	ChannelID int64
+	RuleID    int64
+	Status    string
+	Limit     int
+}
+
+// GetNotificationDeliveries returns the deliveries matching a query, newest first
+func GetNotificationDeliveries(db *sql.DB, tenantID string, query DeliveryQuery) ([]NotificationDelivery, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	var conditions []string
+	var args []interface{}
+	if query.ChannelID != 0 {
+		conditions = append(conditions, "channel_id = ?")
+		args = append(args, query.ChannelID)
+	}
+	if query.RuleID != 0 {
+		conditions = append(conditions, "rule_id = ?")
+		args = append(args, query.RuleID)
+	}
+	if query.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, query.Status)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, query.Limit)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.NotificationDeliveries %s ORDER BY created_at DESC, delivery_id DESC LIMIT ?",
+		notificationDeliveryColumns, dbName, where), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNotificationDeliveries(rows)
+}
@@ -0,0 +1,267 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// PerformanceMetrics and ProcessMetrics are range partitioned on their timestamp, one partition per day or
+// week, so time range queries only read the partitions they need and retention can drop whole partitions.
+// A last MAXVALUE partition catches samples past the newest partition until the maintenance job splits it.
+
+// Widths a partition can cover
+const (
+	PartitionDay  = "day"
+	PartitionWeek = "week"
+)
+
+// Width of the partitions created from now on, existing partitions keep theirs
+var PartitionInterval = PartitionDay
+
+// Partitions kept ready ahead of the current one
+const PartitionsAhead = 7
+
+// Upper bound on the partitions created when an existing table gets partitioned, older samples share the first one
+const maxInitialPartitions = 500
+
+// Tables partitioned on their timestamp, by the retention data type they hold
+var PartitionedTables = map[string]string{
+	RetentionHost:    "PerformanceMetrics",
+	RetentionProcess: "ProcessMetrics",
+}
+
+// Name of the catch all partition
+const overflowPartition = "pmax"
+
+// Partition is one range partition of a table, holding the samples taken before LessThan
+type Partition struct {
+	Name     string
+	LessThan time.Time
+}
+
+// partitionStart returns the start of the partition holding t
+func partitionStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if PartitionInterval != PartitionWeek {
+		return day
+	}
+
+	// Weeks start on Monday
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// nextPartitionStart returns the start of the partition following the one starting at start
+func nextPartitionStart(start time.Time) time.Time {
+	if PartitionInterval == PartitionWeek {
+		return start.AddDate(0, 0, 7)
+	}
+
+	return start.AddDate(0, 0, 1)
+}
+
+// partitionDefinitions describes the partitions covering [from, to), named after the day they start on
+func partitionDefinitions(from time.Time, to time.Time) []string {
+	var definitions []string
+	for start := from; start.Before(to); start = nextPartitionStart(start) {
+		definitions = append(definitions, fmt.Sprintf("PARTITION p%s VALUES LESS THAN ('%s')",
+			start.Format("20060102"), nextPartitionStart(start).Format(timestampLayout)))
+	}
+
+	return definitions
+}
+
+// GetPartitions returns the partitions of a table in order, without the catch all one. A table that isn't partitioned has none.
+func GetPartitions(db *sql.DB, tenantID string, table string) ([]Partition, error) {
+	rows, err := db.Query(`SELECT PARTITION_NAME, PARTITION_DESCRIPTION FROM INFORMATION_SCHEMA.PARTITIONS
+        WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND PARTITION_NAME IS NOT NULL
+        ORDER BY PARTITION_ORDINAL_POSITION`, fmt.Sprintf("Performance_%s", tenantID), table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []Partition
+	for rows.Next() {
+		var name, description string
+		if err := rows.Scan(&name, &description); err != nil {
+			return nil, err
+		}
+
+		if name == overflowPartition {
+			continue
+		}
+
+		lessThan, err := time.Parse(timestampLayout, strings.Trim(description, "'"))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing bound of partition %s of %s: %v", name, table, err)
+		}
+		partitions = append(partitions, Partition{Name: name, LessThan: lessThan})
+	}
+
+	return partitions, rows.Err()
+}
+
+// EnsureFuturePartitions splits the catch all partition of a table so partitions exist up to PartitionsAhead past now
+func EnsureFuturePartitions(db *sql.DB, tenantID string, table string, now time.Time) (int, error) {
+	partitions, err := GetPartitions(db, tenantID, table)
+	if err != nil || len(partitions) == 0 {
+		return 0, err
+	}
+
+	target := partitionStart(now)
+	for i := 0; i <= PartitionsAhead; i++ {
+		target = nextPartitionStart(target)
+	}
+
+	// The new partitions start where the last one ends, even when the interval changed since
+	from := partitions[len(partitions)-1].LessThan
+	definitions := partitionDefinitions(from, target)
+	if len(definitions) == 0 {
+		return 0, nil
+	}
+
+	definitions = append(definitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN (MAXVALUE)", overflowPartition))
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE `Performance_%s`.%s REORGANIZE PARTITION %s INTO (%s)",
+		tenantID, table, overflowPartition, strings.Join(definitions, ", ")))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(definitions) - 1, nil
+}
+
+// DropExpiredPartitions drops the partitions of a table only holding samples taken before cutoff and returns
+// the number of rows they held. The newest partition is always kept so the table stays partitioned.
+func DropExpiredPartitions(db *sql.DB, tenantID string, table string, cutoff time.Time) (int64, error) {
+	partitions, err := GetPartitions(db, tenantID, table)
+	if err != nil {
+		return 0, err
+	}
+
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	var dropped int64
+	for i, partition := range partitions {
+		if i == len(partitions)-1 || partition.LessThan.After(cutoff) {
+			break
+		}
+
+		var rowCount int64
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s.%s PARTITION (%s)", dbName, table, partition.Name)).Scan(&rowCount); err != nil {
+			return dropped, err
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s.%s DROP PARTITION %s", dbName, table, partition.Name)); err != nil {
+			return dropped, err
+		}
+		dropped += rowCount
+	}
+
+	return dropped, nil
+}
+
+// partitionMetricTables moves PerformanceMetrics and ProcessMetrics to time partitions. Partitioned InnoDB tables
+// can't have foreign keys and need the timestamp in every unique key, so the foreign keys between the sample
+// tables go away and the timestamp joins the primary keys. ProcessMetrics gets the timestamp of its host sample.
+func partitionMetricTables(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, `SELECT TABLE_NAME, CONSTRAINT_NAME FROM INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS
+        WHERE CONSTRAINT_SCHEMA = DATABASE()
+            AND (TABLE_NAME IN ('PerformanceMetrics', 'ProcessMetrics') OR REFERENCED_TABLE_NAME IN ('PerformanceMetrics', 'ProcessMetrics'))`)
+	if err != nil {
+		return err
+	}
+
+	var dropForeignKeys []string
+	for rows.Next() {
+		var table, constraint string
+		if err := rows.Scan(&table, &constraint); err != nil {
+			rows.Close()
+			return err
+		}
+		dropForeignKeys = append(dropForeignKeys, fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", table, constraint))
+	}
+	rows.Close()
+
+	for _, statement := range dropForeignKeys {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	// Copy the host sample timestamp, one ID range at a time
+	var minID, maxID sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT MIN(process_metric_id), MAX(process_metric_id) FROM ProcessMetrics").Scan(&minID, &maxID); err != nil {
+		return err
+	}
+
+	if minID.Valid {
+		for start := minID.Int64; start <= maxID.Int64; start += migrationChunkSize {
+			_, err := conn.ExecContext(ctx, `UPDATE ProcessMetrics psm
+                JOIN PerformanceMetrics pm ON pm.metric_id = psm.metric_id
+                SET psm.timestamp = pm.timestamp
+                WHERE psm.process_metric_id BETWEEN ? AND ?`, start, start+migrationChunkSize-1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Process samples without a host sample are kept, placed at their start time or else at the migration
+	now := time.Now().UTC()
+	result, err := conn.ExecContext(ctx, "UPDATE ProcessMetrics SET timestamp = COALESCE(process_start_time, ?) WHERE timestamp IS NULL",
+		now.Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+	if orphans, err := result.RowsAffected(); err == nil && orphans > 0 {
+		log.Printf("Partitioning: %d process samples have no host sample, they were timestamped with their start time or now", orphans)
+	}
+
+	// Partitions from the oldest sample to PartitionsAhead past now
+	var oldest sql.NullString
+	if err := conn.QueryRowContext(ctx, "SELECT DATE_FORMAT(MIN(timestamp), '%Y-%m-%d %H:%i:%s') FROM PerformanceMetrics").Scan(&oldest); err != nil {
+		return err
+	}
+
+	from := partitionStart(now)
+	if oldest.Valid {
+		if t, err := time.Parse(timestampLayout, oldest.String); err == nil && t.Before(from) {
+			from = partitionStart(t)
+		}
+	}
+
+	to := partitionStart(now)
+	for i := 0; i <= PartitionsAhead; i++ {
+		to = nextPartitionStart(to)
+	}
+
+	definitions := partitionDefinitions(from, to)
+	if len(definitions) > maxInitialPartitions {
+		definitions = definitions[len(definitions)-maxInitialPartitions:]
+	}
+	definitions = append(definitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN (MAXVALUE)", overflowPartition))
+
+	statements := []string{
+		`ALTER TABLE ProcessMetrics MODIFY COLUMN timestamp DATETIME NOT NULL,
+            DROP PRIMARY KEY, ADD PRIMARY KEY (process_metric_id, timestamp)`,
+		`ALTER TABLE PerformanceMetrics DROP PRIMARY KEY, ADD PRIMARY KEY (metric_id, timestamp),
+            ADD INDEX idx_performance_device_time (device_id, timestamp)`,
+	}
+
+	for _, table := range []string{"PerformanceMetrics", "ProcessMetrics"} {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s PARTITION BY RANGE COLUMNS (timestamp) (%s)", table, strings.Join(definitions, ", ")))
+	}
+
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Partitioned PerformanceMetrics and ProcessMetrics into %d partitions", len(definitions))
+	return nil
+}
@@ -1,12 +1,18 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
+	"sync"
 )
 
+// Layout of DATETIME values as MySQL returns them
+const timestampLayout = "2006-01-02 15:04:05"
+
 // DB data structures
 
 type DeviceData struct {
@@ -24,24 +30,120 @@ type PerformanceData struct {
 	DiskUsage   int64
 	TotalMemory int64
 	UsedMemoryP float64
+	LoadAvg1    float64
+	LoadAvg5    float64
+	LoadAvg15   float64
+	CPUUser     float64
+	CPUSystem   float64
+	CPUIowait   float64
+	CPUSteal    float64
+	CoreUsage   []float64
 	Processes   []ProcessData
+	Disks       []DiskData
+	Interfaces  []NetworkData
 }
 
+// Extended attributes are optional, nil values are stored as NULL
 type ProcessData struct {
-	PID      int
-	Name     string
-	Command  string
-	CPUUsage float64
-	RAMUsage int64
+	PID        int
+	Name       string
+	Command    string
+	CPUUsage   float64
+	RAMUsage   int64
+	User       *string
+	ParentPID  *int
+	State      *string
+	Threads    *int
+	OpenFDs    *int
+	StartTime  *string
+	ReadBytes  *int64
+	WriteBytes *int64
+}
+
+type DiskData struct {
+	MountPoint  string
+	FileSystem  string
+	FSType      string
+	UsedBytes   int64
+	TotalBytes  int64
+	InodesUsed  int64
+	InodesTotal int64
+	ReadBytes   int64
+	WriteBytes  int64
+	ReadIOPS    float64
+	WriteIOPS   float64
+}
+
+// Network counters are cumulative as reported by the agent, rates are derived at query time
+type NetworkData struct {
+	Interface string
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDrops   uint64
+	TxDrops   uint64
+}
+
+// Tenants whose db, tables and migrations are already in place since the server started
+var preparedTenants sync.Map
+
+// Serialises schema setup so two first requests from a tenant don't race on the migrations
+var schemaMutex sync.Mutex
+
+// Tenant IDs are part of the name of their db, whose names are up to 64 characters
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,52}$`)
+
+// ValidTenantID tells whether a tenant ID only has the characters allowed in tenant IDs
+func ValidTenantID(tenantID string) bool {
+	return tenantIDPattern.MatchString(tenantID)
+}
+
+// TenantExists tells whether a tenant has a performance db. Listeners without authentication use it so they don't
+// create a db for any tenant they are sent.
+func TenantExists(db *sql.DB, tenantID string) (bool, error) {
+	if !ValidTenantID(tenantID) {
+		return false, nil
+	}
+	if _, ok := preparedTenants.Load(tenantID); ok {
+		return true, nil
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = ?)",
+		"Performance_"+tenantID).Scan(&exists)
+	return exists, err
 }
 
 // Handle creating the performance db
 func CreatePerformanceDB(db *sql.DB, orgID string) error {
 
+	// Nothing to do if the schema was already brought up to date
+	if _, ok := preparedTenants.Load(orgID); ok {
+		return nil
+	}
+
+	schemaMutex.Lock()
+	defer schemaMutex.Unlock()
+
+	if _, ok := preparedTenants.Load(orgID); ok {
+		return nil
+	}
+
+	// USE only applies to a single connection, so keep one for the whole setup
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
 	// Format db name and create it
 	dbName := fmt.Sprintf("`Performance_%s`", orgID)
 
-	_, err := db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", dbName))
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", dbName))
 
 	if err != nil {
 		log.Printf("Error creating table %s, Error: %s", dbName, err)
@@ -51,12 +153,12 @@ func CreatePerformanceDB(db *sql.DB, orgID string) error {
 	}
 
 	// Use the db just created
-	_, err = db.Exec(fmt.Sprintf("USE %s", dbName))
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("USE %s", dbName))
 	if err != nil {
 		return err
 	}
 
-	// logic to create the tables
+	// logic to create the tables, the sample tables have no foreign keys since they get partitioned by time
 	createTablesQuery := []string{
 		`CREATE TABLE IF NOT EXISTS Devices (
             id INT AUTO_INCREMENT PRIMARY KEY,
@@ -71,8 +173,7 @@ func CreatePerformanceDB(db *sql.DB, orgID string) error {
             timestamp DATETIME NOT NULL,
             cpu_usage FLOAT,
             ram_usage BIGINT,
-            disk_usage BIGINT,
-            FOREIGN KEY (device_id) REFERENCES Devices(device_id)
+            disk_usage BIGINT
         )`,
 		`CREATE TABLE IF NOT EXISTS ProcessMetrics (
             process_metric_id INT AUTO_INCREMENT PRIMARY KEY,
@@ -81,23 +182,148 @@ func CreatePerformanceDB(db *sql.DB, orgID string) error {
             process_name VARCHAR(255),
             process_command TEXT,
             process_cpu_usage FLOAT,
-            process_ram_usage BIGINT,
-            FOREIGN KEY (metric_id) REFERENCES PerformanceMetrics(metric_id)
+            process_ram_usage BIGINT
+        )`,
+		`CREATE TABLE IF NOT EXISTS DiskMetrics (
+            disk_metric_id INT AUTO_INCREMENT PRIMARY KEY,
+            metric_id INT NOT NULL,
+            mount_point VARCHAR(255) NOT NULL,
+            file_system VARCHAR(255),
+            fs_type VARCHAR(64),
+            used_bytes BIGINT,
+            total_bytes BIGINT,
+            inodes_used BIGINT,
+            inodes_total BIGINT,
+            read_bytes BIGINT,
+            write_bytes BIGINT,
+            read_iops FLOAT,
+            write_iops FLOAT,
+            INDEX idx_disk_metrics_metric (metric_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS NetworkMetrics (
+            network_metric_id INT AUTO_INCREMENT PRIMARY KEY,
+            metric_id INT NOT NULL,
+            interface_name VARCHAR(255) NOT NULL,
+            rx_bytes BIGINT UNSIGNED,
+            tx_bytes BIGINT UNSIGNED,
+            rx_packets BIGINT UNSIGNED,
+            tx_packets BIGINT UNSIGNED,
+            rx_errors BIGINT UNSIGNED,
+            tx_errors BIGINT UNSIGNED,
+            rx_drops BIGINT UNSIGNED,
+            tx_drops BIGINT UNSIGNED,
+            INDEX idx_network_metrics_metric (metric_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS CoreMetrics (
+            core_metric_id INT AUTO_INCREMENT PRIMARY KEY,
+            metric_id INT NOT NULL,
+            core_index INT NOT NULL,
+            core_usage FLOAT,
+            INDEX idx_core_metrics_metric (metric_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS ProcessNames (
+            name_id INT AUTO_INCREMENT PRIMARY KEY,
+            name_hash CHAR(40) UNIQUE NOT NULL,
+            process_name VARCHAR(255) NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS ProcessCommands (
+            command_id INT AUTO_INCREMENT PRIMARY KEY,
+            command_hash CHAR(40) UNIQUE NOT NULL,
+            process_command TEXT NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS StorageReports (
+            report_id INT AUTO_INCREMENT PRIMARY KEY,
+            description VARCHAR(255),
+            bytes_before BIGINT,
+            bytes_after BIGINT,
+            created_at DATETIME NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS RetentionPolicies (
+            data_type VARCHAR(32) PRIMARY KEY,
+            retention_days INT NOT NULL,
+            updated_at DATETIME NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS RetentionRuns (
+            run_id INT AUTO_INCREMENT PRIMARY KEY,
+            data_type VARCHAR(32) NOT NULL,
+            started_at DATETIME NOT NULL,
+            finished_at DATETIME NOT NULL,
+            deleted_rows BIGINT NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            error TEXT
+        )`,
+		`CREATE TABLE IF NOT EXISTS HostRollups (
+            device_id VARCHAR(255) NOT NULL,
+            resolution INT NOT NULL,
+            metric VARCHAR(32) NOT NULL,
+            bucket_start DATETIME NOT NULL,
+            min_value DOUBLE,
+            max_value DOUBLE,
+            sum_value DOUBLE,
+            sample_count BIGINT,
+            p95_value DOUBLE,
+            PRIMARY KEY (device_id, resolution, metric, bucket_start)
+        )`,
+		`CREATE TABLE IF NOT EXISTS ProcessRollups (
+            device_id VARCHAR(255) NOT NULL,
+            resolution INT NOT NULL,
+            metric VARCHAR(32) NOT NULL,
+            process_instance CHAR(40) NOT NULL,
+            process_pid INT,
+            name_id INT,
+            workload_key VARCHAR(255),
+            bucket_start DATETIME NOT NULL,
+            min_value DOUBLE,
+            max_value DOUBLE,
+            sum_value DOUBLE,
+            sample_count BIGINT,
+            p95_value DOUBLE,
+            PRIMARY KEY (device_id, resolution, metric, process_instance, bucket_start),
+            INDEX idx_process_rollups_bucket (device_id, resolution, bucket_start)
+        )`,
+		`CREATE TABLE IF NOT EXISTS RollupState (
+            resolution INT PRIMARY KEY,
+            rolled_up_to DATETIME NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS GenericSeries (
+            series_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            series_hash CHAR(40) UNIQUE NOT NULL,
+            metric_name VARCHAR(255) NOT NULL,
+            device_id VARCHAR(255),
+            labels JSON NOT NULL,
+            INDEX idx_generic_series_name (metric_name, device_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS GenericSamples (
+            series_id BIGINT NOT NULL,
+            timestamp DATETIME(3) NOT NULL,
+            value DOUBLE,
+            PRIMARY KEY (series_id, timestamp)
+        )`,
+		`CREATE TABLE IF NOT EXISTS SchemaMigrations (
+            version INT PRIMARY KEY,
+            description VARCHAR(255),
+            applied_at DATETIME NOT NULL
         )`,
 	}
 
 	for _, query := range createTablesQuery {
 
-		_, err := db.Exec(query)
+		_, err := conn.ExecContext(ctx, query)
 		if err != nil {
-			return nil
+			return err
 		}
 
 		log.Println("Create db and tables successfully")
 
 	}
 
+	// Bring the tables up to the latest schema
+	if err := applyMigrations(ctx, conn); err != nil {
+		return err
+	}
+
 	// In case all went well:
+	preparedTenants.Store(orgID, true)
 	return nil
 }
 
@@ -105,8 +331,7 @@ func CreatePerformanceDB(db *sql.DB, orgID string) error {
 func InsertPerformanceData(db *sql.DB, orgID string, deviceData DeviceData, perfData PerformanceData) error {
 
 	// Select the correct db
-	dbName := fmt.Sprintf("PerformanceDB_%s", orgID)
-	_, err := db.Exec(fmt.Sprintf("USE %s", dbName))
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
 
 	// Trim device hostname to fix problem with random chars
 
@@ -114,20 +339,29 @@ func InsertPerformanceData(db *sql.DB, orgID string, deviceData DeviceData, perf
 	deviceData.Hostname = strings.Replace(deviceData.Hostname, "\r", "", -1)
 
 	// Insert device data if it does not exist
-	insertDeviceQuery := `INSERT INTO Devices (device_id, device_hostname, mac_address, ip_address) 
+	insertDeviceQuery := fmt.Sprintf(`INSERT INTO %s.Devices (device_id, device_hostname, mac_address, ip_address) 
                           VALUES (?, ?, ?, ?)
-                          ON DUPLICATE KEY UPDATE device_hostname=VALUES(device_hostname), mac_address=VALUES(mac_address), ip_address=VALUES(ip_address)`
+                          ON DUPLICATE KEY UPDATE device_hostname=VALUES(device_hostname), mac_address=VALUES(mac_address), ip_address=VALUES(ip_address)`, dbName)
 
-	_, err = db.Exec(insertDeviceQuery, deviceData.DeviceID, deviceData.Hostname, deviceData.MACAddress, deviceData.IPAddress)
+	_, err := db.Exec(insertDeviceQuery, deviceData.DeviceID, deviceData.Hostname, deviceData.MACAddress, deviceData.IPAddress)
 	if err != nil {
 		return err
 	}
 
+	// Disk usage on the host is the sum of what is used on every mount
+	if perfData.DiskUsage == 0 {
+		for _, disk := range perfData.Disks {
+			perfData.DiskUsage += disk.UsedBytes
+		}
+	}
+
 	// Insert performance metrics
-	insertPerfQuery := `INSERT INTO PerformanceMetrics (device_id, timestamp, cpu_usage, ram_usage, disk_usage) 
-                        VALUES (?, ?, ?, ?, ?)`
+	insertPerfQuery := fmt.Sprintf(`INSERT INTO %s.PerformanceMetrics (device_id, timestamp, cpu_usage, ram_usage, disk_usage,
+                        load_avg_1, load_avg_5, load_avg_15, cpu_user, cpu_system, cpu_iowait, cpu_steal) 
+                        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName)
 
-	result, err := db.Exec(insertPerfQuery, perfData.DeviceID, perfData.Timestamp, perfData.CPUUsage, perfData.RAMUsage, perfData.DiskUsage)
+	result, err := db.Exec(insertPerfQuery, perfData.DeviceID, perfData.Timestamp, perfData.CPUUsage, perfData.RAMUsage, perfData.DiskUsage,
+		perfData.LoadAvg1, perfData.LoadAvg5, perfData.LoadAvg15, perfData.CPUUser, perfData.CPUSystem, perfData.CPUIowait, perfData.CPUSteal)
 	if err != nil {
 		return err
 	}
@@ -140,12 +374,64 @@ func InsertPerformanceData(db *sql.DB, orgID string, deviceData DeviceData, perf
 
 	log.Println("Got metricID")
 
+	// Insert per core utilisation
+	for coreIndex, coreUsage := range perfData.CoreUsage {
+		insertCoreQuery := fmt.Sprintf(`INSERT INTO %s.CoreMetrics (metric_id, core_index, core_usage) VALUES (?, ?, ?)`, dbName)
+
+		_, err := db.Exec(insertCoreQuery, metricID, coreIndex, coreUsage)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Insert process metrics
 	for _, process := range perfData.Processes {
-		insertProcessQuery := `INSERT INTO ProcessMetrics (metric_id, process_pid, process_name, process_command, process_cpu_usage, process_ram_usage) 
-		VALUES (?, ?, ?, ?, ?, ?)`
+		// Names and commands are stored once in their dictionaries
+		nameID, err := processNames.intern(db, dbName, process.Name)
+		if err != nil {
+			return err
+		}
 
-		_, err := db.Exec(insertProcessQuery, metricID, process.PID, process.Name, process.Command, process.CPUUsage, process.RAMUsage)
+		commandID, err := processCommands.intern(db, dbName, process.Command)
+		if err != nil {
+			return err
+		}
+
+		insertProcessQuery := fmt.Sprintf(`INSERT INTO %s.ProcessMetrics (metric_id, timestamp, process_pid, name_id, command_id, process_cpu_usage, process_ram_usage,
+		process_user, process_ppid, process_state, process_threads, process_open_fds, process_start_time, process_read_bytes, process_write_bytes,
+		process_instance, workload_key) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName)
+
+		instance := ProcessInstanceKey(perfData.DeviceID, process.PID, process.StartTime, process.Name)
+		workload := WorkloadKey(process.Name, process.Command)
+
+		_, err = db.Exec(insertProcessQuery, metricID, perfData.Timestamp, process.PID, nameID, commandID, process.CPUUsage, process.RAMUsage,
+			process.User, process.ParentPID, process.State, process.Threads, process.OpenFDs, process.StartTime, process.ReadBytes, process.WriteBytes,
+			instance, workload)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Insert disk metrics, one row per mount point
+	for _, disk := range perfData.Disks {
+		insertDiskQuery := fmt.Sprintf(`INSERT INTO %s.DiskMetrics (metric_id, mount_point, file_system, fs_type, used_bytes, total_bytes, inodes_used, inodes_total, read_bytes, write_bytes, read_iops, write_iops) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName)
+
+		_, err := db.Exec(insertDiskQuery, metricID, disk.MountPoint, disk.FileSystem, disk.FSType, disk.UsedBytes, disk.TotalBytes,
+			disk.InodesUsed, disk.InodesTotal, disk.ReadBytes, disk.WriteBytes, disk.ReadIOPS, disk.WriteIOPS)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Insert network counters, one row per interface
+	for _, iface := range perfData.Interfaces {
+		insertNetworkQuery := fmt.Sprintf(`INSERT INTO %s.NetworkMetrics (metric_id, interface_name, rx_bytes, tx_bytes, rx_packets, tx_packets, rx_errors, tx_errors, rx_drops, tx_drops) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName)
+
+		_, err := db.Exec(insertNetworkQuery, metricID, iface.Interface, iface.RxBytes, iface.TxBytes, iface.RxPackets, iface.TxPackets,
+			iface.RxErrors, iface.TxErrors, iface.RxDrops, iface.TxDrops)
 		if err != nil {
 			return err
 		}
@@ -154,3 +440,30 @@ func InsertPerformanceData(db *sql.DB, orgID string, deviceData DeviceData, perf
 	// all went ok
 	return nil
 }
+
+// RegisterDevice adds a device that only sends custom metrics, a device already known is left as it is
+func RegisterDevice(db *sql.DB, orgID string, deviceData DeviceData) error {
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
+
+	_, err := db.Exec(fmt.Sprintf(`INSERT IGNORE INTO %s.Devices (device_id, device_hostname, mac_address, ip_address) VALUES (?, ?, ?, ?)`, dbName),
+		deviceData.DeviceID, deviceData.Hostname, deviceData.MACAddress, deviceData.IPAddress)
+	return err
+}
+
+// ResolveDevice returns the ID of the known device with the ID or the hostname of deviceData, registering
+// deviceData when there is none. Senders that only know the hostname of a machine get the device of its agent.
+func ResolveDevice(db *sql.DB, orgID string, deviceData DeviceData) (string, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", orgID)
+
+	var deviceID string
+	err := db.QueryRow(fmt.Sprintf(`SELECT device_id FROM %s.Devices WHERE device_id = ? OR TRIM(device_hostname) = ?
+        ORDER BY device_id = ? DESC LIMIT 1`, dbName), deviceData.DeviceID, deviceData.Hostname, deviceData.DeviceID).Scan(&deviceID)
+	if err == nil {
+		return deviceID, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	return deviceData.DeviceID, RegisterDevice(db, orgID, deviceData)
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidTenantID(t *testing.T) {
+	tests := map[string]bool{
+		"1234":                  true,
+		"acme-prod_2":           true,
+		strings.Repeat("a", 52): true,
+		strings.Repeat("a", 53): false,
+		"":                      false,
+		"a`b":                   false,
+		"a.b":                   false,
+		"a b":                   false,
+		"../x":                  false,
+		"é":                     false,
+	}
+
+	for tenantID, want := range tests {
+		if got := ValidTenantID(tenantID); got != want {
+			t.Errorf("ValidTenantID(%q) = %v, want %v", tenantID, got, want)
+		}
+	}
+}
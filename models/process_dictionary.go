@@ -0,0 +1,202 @@
+package models
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Process names and commands repeat in every sample, so ProcessMetrics only keeps the ID of
+// the string in the ProcessNames and ProcessCommands dictionaries. The dictionaries are keyed
+// by the SHA1 of the string, which MySQL can compute too for the migration of existing rows.
+
+// dictionary describes one of the string dictionary tables
+type dictionary struct {
+	table       string
+	idColumn    string
+	hashColumn  string
+	valueColumn string
+}
+
+var (
+	processNames    = dictionary{"ProcessNames", "name_id", "name_hash", "process_name"}
+	processCommands = dictionary{"ProcessCommands", "command_id", "command_hash", "process_command"}
+)
+
+// Dictionary IDs already resolved, keyed by db, table and hash. Entries are never deleted from the dictionaries.
+var dictionaryCache sync.Map
+
+func hashString(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// intern returns the ID of value in the dictionary, adding it when it is new
+func (d dictionary) intern(db *sql.DB, dbName string, value string) (int64, error) {
+	hash := hashString(value)
+	cacheKey := dbName + "/" + d.table + "/" + hash
+
+	if id, ok := dictionaryCache.Load(cacheKey); ok {
+		return id.(int64), nil
+	}
+
+	// LAST_INSERT_ID(id) makes the existing ID come back when the string is already there
+	query := fmt.Sprintf(`INSERT INTO %s.%s (%s, %s) VALUES (?, ?)
+        ON DUPLICATE KEY UPDATE %s = LAST_INSERT_ID(%s)`, dbName, d.table, d.hashColumn, d.valueColumn, d.idColumn, d.idColumn)
+
+	result, err := db.Exec(query, hash, value)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	dictionaryCache.Store(cacheKey, id)
+	return id, nil
+}
+
+// migrate fills the dictionary from a column of ProcessMetrics and points the rows at it, one ID range at a time
+func (d dictionary) migrate(ctx context.Context, conn *sql.Conn, referenceColumn string) error {
+	_, err := conn.ExecContext(ctx, fmt.Sprintf(`INSERT IGNORE INTO %s (%s, %s)
+        SELECT DISTINCT SHA1(%s), %s FROM ProcessMetrics WHERE %s IS NOT NULL`,
+		d.table, d.hashColumn, d.valueColumn, d.valueColumn, d.valueColumn, d.valueColumn))
+	if err != nil {
+		return err
+	}
+
+	var minID, maxID sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT MIN(process_metric_id), MAX(process_metric_id) FROM ProcessMetrics").Scan(&minID, &maxID); err != nil {
+		return err
+	}
+
+	if !minID.Valid {
+		return nil
+	}
+
+	update := fmt.Sprintf(`UPDATE ProcessMetrics psm
+        JOIN %s d ON d.%s = SHA1(psm.%s)
+        SET psm.%s = d.%s
+        WHERE psm.process_metric_id BETWEEN ? AND ?`, d.table, d.hashColumn, d.valueColumn, referenceColumn, d.idColumn)
+
+	for start := minID.Int64; start <= maxID.Int64; start += migrationChunkSize {
+		if _, err := conn.ExecContext(ctx, update, start, start+migrationChunkSize-1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rows per UPDATE when rewriting ProcessMetrics, keeps each statement's locks short
+const migrationChunkSize = 10000
+
+// TableSize is the on disk size of a table as reported by INFORMATION_SCHEMA
+type TableSize struct {
+	Table      string
+	Rows       int64
+	DataBytes  int64
+	IndexBytes int64
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// GetTableSizes returns the size of every table of a tenant db
+func GetTableSizes(ctx context.Context, q querier, schemaName string) ([]TableSize, error) {
+	rows, err := q.QueryContext(ctx, `SELECT TABLE_NAME, COALESCE(TABLE_ROWS, 0), COALESCE(DATA_LENGTH, 0), COALESCE(INDEX_LENGTH, 0)
+        FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME`, schemaName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sizes []TableSize
+	for rows.Next() {
+		var size TableSize
+		if err := rows.Scan(&size.Table, &size.Rows, &size.DataBytes, &size.IndexBytes); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, rows.Err()
+}
+
+// processStorageBytes sums the size of the tables holding process samples and their strings
+func processStorageBytes(ctx context.Context, conn *sql.Conn, schemaName string) (int64, error) {
+	// Statistics are cached by MySQL 8, refresh them so the numbers reflect the migration
+	for _, table := range []string{"ProcessMetrics", processNames.table, processCommands.table} {
+		if _, err := conn.ExecContext(ctx, "ANALYZE TABLE "+table); err != nil {
+			return 0, err
+		}
+	}
+
+	sizes, err := GetTableSizes(ctx, conn, schemaName)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, size := range sizes {
+		switch size.Table {
+		case "ProcessMetrics", processNames.table, processCommands.table:
+			total += size.DataBytes + size.IndexBytes
+		}
+	}
+
+	return total, nil
+}
+
+// migrateProcessDictionary moves the process names and commands of existing samples into the dictionaries,
+// drops the old columns and records how much storage that saved in StorageReports
+func migrateProcessDictionary(ctx context.Context, conn *sql.Conn) error {
+	var schemaName string
+	if err := conn.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&schemaName); err != nil {
+		return err
+	}
+
+	// Only exists on MySQL 8, older servers don't cache the statistics anyway
+	conn.ExecContext(ctx, "SET SESSION information_schema_stats_expiry = 0")
+
+	bytesBefore, err := processStorageBytes(ctx, conn, schemaName)
+	if err != nil {
+		return err
+	}
+
+	if err := processNames.migrate(ctx, conn, "name_id"); err != nil {
+		return err
+	}
+
+	if err := processCommands.migrate(ctx, conn, "command_id"); err != nil {
+		return err
+	}
+
+	// INPLACE rebuilds the table, an INSTANT drop would keep the space allocated
+	_, err = conn.ExecContext(ctx, `ALTER TABLE ProcessMetrics DROP COLUMN process_name, DROP COLUMN process_command, ALGORITHM=INPLACE`)
+	if err != nil {
+		return err
+	}
+
+	bytesAfter, err := processStorageBytes(ctx, conn, schemaName)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "INSERT INTO StorageReports (description, bytes_before, bytes_after, created_at) VALUES (?, ?, ?, ?)",
+		"process name and command dictionary", bytesBefore, bytesAfter, time.Now().UTC().Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Process dictionary migration for %s: %d bytes before, %d bytes after", schemaName, bytesBefore, bytesAfter)
+	return nil
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Runs of digits and hex IDs in a command line are usually PIDs, ports or temp names that change between restarts
+var volatileToken = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9]+`)
+
+// Longest workload key we store, in characters like the column size
+const maxWorkloadKeyLength = 255
+
+// ProcessInstanceKey identifies one run of a process on a device. PIDs get recycled, but
+// device + PID + start time doesn't. Without a start time the process name is used instead.
+func ProcessInstanceKey(deviceID string, pid int, startTime *string, name string) string {
+	discriminator := name
+	if startTime != nil && *startTime != "" {
+		discriminator = normaliseStartTime(*startTime)
+	}
+
+	sum := sha1.Sum([]byte(strings.Join([]string{deviceID, strconv.Itoa(pid), discriminator}, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+// WorkloadKey identifies what a process is rather than which run it is, so a restarted service
+// keeps the same key. It is the executable name followed by its arguments with volatile tokens masked.
+func WorkloadKey(name string, command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return strings.ToLower(strings.TrimSpace(name))
+	}
+
+	parts := make([]string, 0, len(fields))
+	parts = append(parts, strings.ToLower(filepath.Base(fields[0])))
+	for _, arg := range fields[1:] {
+		parts = append(parts, volatileToken.ReplaceAllString(arg, "#"))
+	}
+
+	// Cut on a rune boundary, a split multi-byte character isn't valid UTF-8
+	key := strings.Join(parts, " ")
+	if utf8.RuneCountInString(key) > maxWorkloadKeyLength {
+		key = string([]rune(key)[:maxWorkloadKeyLength])
+	}
+
+	return key
+}
+
+// Start times are formatted like MySQL returns DATETIME so the key is the same whatever the agent sent
+func normaliseStartTime(startTime string) string {
+	for _, layout := range []string{timestampLayout, time.RFC3339Nano, "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, startTime); err == nil {
+			return t.Format(timestampLayout)
+		}
+	}
+
+	return startTime
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWorkloadKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"nginx", "", "nginx"},
+		{"java", "/usr/bin/Java -Xmx512m -jar app.jar --port 8080", "java -Xmx#m -jar app.jar --port #"},
+		{"worker", "/opt/worker --id 3f2b1c4d-1a2b-3c4d-5e6f-123456789abc", "worker --id #"},
+	}
+
+	for _, test := range tests {
+		if got := WorkloadKey(test.name, test.command); got != test.want {
+			t.Errorf("WorkloadKey(%q, %q) = %q, want %q", test.name, test.command, got, test.want)
+		}
+	}
+}
+
+func TestWorkloadKeyTruncatesOnRuneBoundary(t *testing.T) {
+	// 2 byte characters, the byte limit falls in the middle of one
+	command := "app " + strings.Repeat("é", 300)
+
+	key := WorkloadKey("app", command)
+	if !utf8.ValidString(key) {
+		t.Fatalf("WorkloadKey returned invalid UTF-8: %q", key)
+	}
+	if n := utf8.RuneCountInString(key); n != maxWorkloadKeyLength {
+		t.Errorf("WorkloadKey returned %d characters, want %d", n, maxWorkloadKeyLength)
+	}
+}
+
+func TestProcessInstanceKey(t *testing.T) {
+	start := "2024-05-01T10:00:00Z"
+	same := "2024-05-01 10:00:00"
+
+	if ProcessInstanceKey("d1", 42, &start, "nginx") != ProcessInstanceKey("d1", 42, &same, "nginx") {
+		t.Error("start times in different layouts give different keys")
+	}
+	if ProcessInstanceKey("d1", 42, nil, "nginx") == ProcessInstanceKey("d1", 42, nil, "redis") {
+		t.Error("processes without start time aren't told apart by name")
+	}
+}
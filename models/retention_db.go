@@ -0,0 +1,202 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of data a retention policy can apply to
+const (
+	RetentionHost    = "host"
+	RetentionProcess = "process"
+	RetentionDisk    = "disk"
+	RetentionNetwork = "network"
+)
+
+// Tables holding per sample details, they reference PerformanceMetrics by metric_id and go away with it
+var sampleDetailTables = map[string]string{
+	RetentionProcess: "ProcessMetrics",
+	RetentionDisk:    "DiskMetrics",
+	RetentionNetwork: "NetworkMetrics",
+	"core":           "CoreMetrics",
+}
+
+// SampleDetailTypes returns the kinds of per sample details, in a stable order
+func SampleDetailTypes() []string {
+	detailTypes := make([]string, 0, len(sampleDetailTables))
+	for detailType := range sampleDetailTables {
+		detailTypes = append(detailTypes, detailType)
+	}
+	sort.Strings(detailTypes)
+
+	return detailTypes
+}
+
+type RetentionPolicy struct {
+	DataType      string
+	RetentionDays int
+	UpdatedAt     string
+}
+
+type RetentionRun struct {
+	DataType    string
+	StartedAt   string
+	FinishedAt  string
+	DeletedRows int64
+	Status      string
+	Error       string
+}
+
+// ValidRetentionDataType tells if a policy can be set for the data type
+func ValidRetentionDataType(dataType string) bool {
+	if dataType == RetentionHost {
+		return true
+	}
+
+	_, ok := sampleDetailTables[dataType]
+	return ok && dataType != "core"
+}
+
+// GetRetentionPolicies returns the policies of a tenant, data types without one are kept forever
+func GetRetentionPolicies(db *sql.DB, tenantID string) ([]RetentionPolicy, error) {
+	query := fmt.Sprintf("SELECT data_type, retention_days, updated_at FROM `Performance_%s`.RetentionPolicies ORDER BY data_type", tenantID)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []RetentionPolicy{}
+	for rows.Next() {
+		var policy RetentionPolicy
+		if err := rows.Scan(&policy.DataType, &policy.RetentionDays, &policy.UpdatedAt); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, rows.Err()
+}
+
+// SetRetentionPolicy creates or updates a policy, zero days removes it
+func SetRetentionPolicy(db *sql.DB, tenantID string, dataType string, retentionDays int, updatedAt string) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	if retentionDays <= 0 {
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s.RetentionPolicies WHERE data_type = ?", dbName), dataType)
+		return err
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.RetentionPolicies (data_type, retention_days, updated_at) VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE retention_days = VALUES(retention_days), updated_at = VALUES(updated_at)`, dbName), dataType, retentionDays, updatedAt)
+	return err
+}
+
+// DeleteExpiredChunk deletes the samples of dataType taken before cutoff, at most chunkSize host samples worth at a time.
+// It returns the number of rows deleted across all tables, zero once nothing expired is left.
+func DeleteExpiredChunk(db *sql.DB, tenantID string, dataType string, cutoff string, chunkSize int) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	// Pick the host samples to work on
+	var selectQuery string
+	var tables []string
+	if dataType == RetentionHost {
+		selectQuery = fmt.Sprintf(`SELECT metric_id FROM %s.PerformanceMetrics WHERE timestamp < ? ORDER BY metric_id LIMIT ?`, dbName)
+
+		// Details first, so no detail is ever left without its host sample
+		for _, table := range sampleDetailTables {
+			tables = append(tables, table)
+		}
+		tables = append(tables, "PerformanceMetrics")
+	} else {
+		table, ok := sampleDetailTables[dataType]
+		if !ok {
+			return 0, fmt.Errorf("unknown retention data type: %s", dataType)
+		}
+
+		selectQuery = fmt.Sprintf(`SELECT DISTINCT d.metric_id FROM %s.%s d
+            JOIN %s.PerformanceMetrics pm ON pm.metric_id = d.metric_id
+            WHERE pm.timestamp < ? ORDER BY d.metric_id LIMIT ?`, dbName, table, dbName)
+		tables = []string{table}
+	}
+
+	rows, err := db.Query(selectQuery, cutoff, chunkSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var metricIDs []interface{}
+	for rows.Next() {
+		var metricID int64
+		if err := rows.Scan(&metricID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		metricIDs = append(metricIDs, metricID)
+	}
+	rows.Close()
+
+	if len(metricIDs) == 0 {
+		return 0, nil
+	}
+
+	// One transaction per chunk keeps the locks short but never leaves a sample half deleted
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(metricIDs)), ",")
+
+	var deleted int64
+	for _, table := range tables {
+		result, err := tx.Exec(fmt.Sprintf("DELETE FROM %s.%s WHERE metric_id IN (%s)", dbName, table, placeholders), metricIDs...)
+		if err != nil {
+			return 0, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += affected
+	}
+
+	return deleted, tx.Commit()
+}
+
+// InsertRetentionRun records the outcome of the retention job for one data type of a tenant
+func InsertRetentionRun(db *sql.DB, tenantID string, run RetentionRun) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	_, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.RetentionRuns (data_type, started_at, finished_at, deleted_rows, status, error)
+        VALUES (?, ?, ?, ?, ?, ?)`, dbName), run.DataType, run.StartedAt, run.FinishedAt, run.DeletedRows, run.Status, run.Error)
+	return err
+}
+
+// GetRetentionRuns returns the most recent runs of the retention job for a tenant
+func GetRetentionRuns(db *sql.DB, tenantID string, limit int) ([]RetentionRun, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	query := fmt.Sprintf(`SELECT data_type, started_at, finished_at, deleted_rows, status, COALESCE(error, '')
+        FROM %s.RetentionRuns ORDER BY run_id DESC LIMIT ?`, dbName)
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []RetentionRun{}
+	for rows.Next() {
+		var run RetentionRun
+		if err := rows.Scan(&run.DataType, &run.StartedAt, &run.FinishedAt, &run.DeletedRows, &run.Status, &run.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
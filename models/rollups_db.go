@@ -0,0 +1,357 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rollup resolutions in seconds. Each level is aggregated from the one before it, the first one from the raw samples.
+const (
+	RollupMinute = 60
+	RollupHour   = 3600
+	RollupDay    = 86400
+)
+
+var RollupResolutions = []int{RollupMinute, RollupHour, RollupDay}
+
+// Host level columns of PerformanceMetrics that get rolled up
+var HostRollupMetrics = []string{
+	"cpu_usage", "ram_usage", "disk_usage",
+	"load_avg_1", "load_avg_5", "load_avg_15",
+	"cpu_user", "cpu_system", "cpu_iowait", "cpu_steal",
+}
+
+// Process level columns of ProcessMetrics that get rolled up
+var ProcessRollupMetrics = []string{"process_cpu_usage", "process_ram_usage"}
+
+// RollupStats summarises the samples of one bucket
+type RollupStats struct {
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count int64
+	P95   float64
+}
+
+func (s RollupStats) Avg() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// MergeRollupStats combines buckets into a coarser one. Min, max, sum and count are exact; the p95 is
+// approximated as the count weighted 95th percentile of the children's p95, which is exact for raw samples.
+func MergeRollupStats(children []RollupStats) RollupStats {
+	merged := RollupStats{Min: children[0].Min, Max: children[0].Max}
+	for _, child := range children {
+		if child.Min < merged.Min {
+			merged.Min = child.Min
+		}
+		if child.Max > merged.Max {
+			merged.Max = child.Max
+		}
+		merged.Sum += child.Sum
+		merged.Count += child.Count
+	}
+
+	sorted := make([]RollupStats, len(children))
+	copy(sorted, children)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].P95 < sorted[j].P95 })
+
+	rank := int64(float64(merged.Count)*0.95 + 0.5)
+	var seen int64
+	for _, child := range sorted {
+		seen += child.Count
+		merged.P95 = child.P95
+		if seen >= rank {
+			break
+		}
+	}
+
+	return merged
+}
+
+func rawStats(value float64) RollupStats {
+	return RollupStats{Min: value, Max: value, Sum: value, Count: 1, P95: value}
+}
+
+// Identifies the series a bucket belongs to
+type hostSeriesKey struct {
+	deviceID string
+	metric   string
+}
+
+type processSeriesKey struct {
+	deviceID string
+	metric   string
+	instance string
+}
+
+// Non key attributes kept with a process rollup so it can be shown without going back to the raw samples
+type processLabels struct {
+	pid         int
+	nameID      sql.NullInt64
+	workloadKey string
+}
+
+// GetRollupWatermark returns up to when a resolution has been rolled up, the zero time if it never was
+func GetRollupWatermark(db *sql.DB, tenantID string, resolution int) (time.Time, error) {
+	var rolledUpTo string
+	query := fmt.Sprintf("SELECT rolled_up_to FROM `Performance_%s`.RollupState WHERE resolution = ?", tenantID)
+	err := db.QueryRow(query, resolution).Scan(&rolledUpTo)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(timestampLayout, rolledUpTo)
+}
+
+// GetRollupSourceStart returns the time of the oldest data a resolution would be built from
+func GetRollupSourceStart(db *sql.DB, tenantID string, resolution int) (time.Time, bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	var query string
+	var args []interface{}
+	if source := rollupSource(resolution); source == 0 {
+		query = fmt.Sprintf("SELECT MIN(timestamp) FROM %s.PerformanceMetrics", dbName)
+	} else {
+		query = fmt.Sprintf("SELECT MIN(bucket_start) FROM %s.HostRollups WHERE resolution = ?", dbName)
+		args = append(args, source)
+	}
+
+	var oldest sql.NullString
+	if err := db.QueryRow(query, args...).Scan(&oldest); err != nil {
+		return time.Time{}, false, err
+	}
+
+	if !oldest.Valid {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(timestampLayout, oldest.String)
+	return t, err == nil, err
+}
+
+// rollupSource returns the resolution a level is aggregated from, 0 for the raw samples
+func rollupSource(resolution int) int {
+	for i, r := range RollupResolutions {
+		if r == resolution && i > 0 {
+			return RollupResolutions[i-1]
+		}
+	}
+	return 0
+}
+
+// RollupWindow aggregates [from, to) into buckets of the given resolution and moves the watermark to `to`.
+// The window must start and end on bucket boundaries; rerunning it overwrites the same buckets.
+func RollupWindow(db *sql.DB, tenantID string, resolution int, from time.Time, to time.Time) error {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+	bucketSize := time.Duration(resolution) * time.Second
+
+	hostBuckets := make(map[hostSeriesKey]map[time.Time][]RollupStats)
+	processBuckets := make(map[processSeriesKey]map[time.Time][]RollupStats)
+	labels := make(map[processSeriesKey]processLabels)
+
+	addHost := func(key hostSeriesKey, bucket time.Time, stats RollupStats) {
+		if hostBuckets[key] == nil {
+			hostBuckets[key] = make(map[time.Time][]RollupStats)
+		}
+		hostBuckets[key][bucket] = append(hostBuckets[key][bucket], stats)
+	}
+
+	addProcess := func(key processSeriesKey, bucket time.Time, stats RollupStats) {
+		if processBuckets[key] == nil {
+			processBuckets[key] = make(map[time.Time][]RollupStats)
+		}
+		processBuckets[key][bucket] = append(processBuckets[key][bucket], stats)
+	}
+
+	fromValue, toValue := from.Format(timestampLayout), to.Format(timestampLayout)
+
+	if source := rollupSource(resolution); source == 0 {
+		// Host samples
+		columns := make([]string, len(HostRollupMetrics))
+		for i, metric := range HostRollupMetrics {
+			columns[i] = fmt.Sprintf("COALESCE(%s, 0)", metric)
+		}
+
+		rows, err := db.Query(fmt.Sprintf(`SELECT device_id, timestamp, %s FROM %s.PerformanceMetrics
+            WHERE timestamp >= ? AND timestamp < ?`, strings.Join(columns, ", "), dbName), fromValue, toValue)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var deviceID, timestamp string
+			values := make([]float64, len(HostRollupMetrics))
+			dest := []interface{}{&deviceID, &timestamp}
+			for i := range values {
+				dest = append(dest, &values[i])
+			}
+
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+
+			t, err := time.Parse(timestampLayout, timestamp)
+			if err != nil {
+				continue
+			}
+
+			for i, metric := range HostRollupMetrics {
+				addHost(hostSeriesKey{deviceID, metric}, t.Truncate(bucketSize), rawStats(values[i]))
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Process samples
+		rows, err = db.Query(fmt.Sprintf(`SELECT pm.device_id, pm.timestamp, psm.process_instance, psm.process_pid, psm.name_id,
+                COALESCE(psm.workload_key, ''), COALESCE(psm.process_cpu_usage, 0), COALESCE(psm.process_ram_usage, 0)
+            FROM %s.PerformanceMetrics pm
+            JOIN %s.ProcessMetrics psm ON pm.metric_id = psm.metric_id AND pm.timestamp = psm.timestamp
+            WHERE pm.timestamp >= ? AND pm.timestamp < ? AND psm.timestamp >= ? AND psm.timestamp < ?
+                AND psm.process_instance IS NOT NULL`, dbName, dbName), fromValue, toValue, fromValue, toValue)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var deviceID, timestamp, instance string
+			var label processLabels
+			var cpuUsage, ramUsage float64
+			if err := rows.Scan(&deviceID, &timestamp, &instance, &label.pid, &label.nameID, &label.workloadKey, &cpuUsage, &ramUsage); err != nil {
+				rows.Close()
+				return err
+			}
+
+			t, err := time.Parse(timestampLayout, timestamp)
+			if err != nil {
+				continue
+			}
+
+			for metric, value := range map[string]float64{"process_cpu_usage": cpuUsage, "process_ram_usage": ramUsage} {
+				key := processSeriesKey{deviceID, metric, instance}
+				labels[key] = label
+				addProcess(key, t.Truncate(bucketSize), rawStats(value))
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	} else {
+		// Finer rollups
+		rows, err := db.Query(fmt.Sprintf(`SELECT device_id, metric, bucket_start, min_value, max_value, sum_value, sample_count, p95_value
+            FROM %s.HostRollups WHERE resolution = ? AND bucket_start >= ? AND bucket_start < ?`, dbName), source, fromValue, toValue)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var key hostSeriesKey
+			var bucketStart string
+			var stats RollupStats
+			if err := rows.Scan(&key.deviceID, &key.metric, &bucketStart, &stats.Min, &stats.Max, &stats.Sum, &stats.Count, &stats.P95); err != nil {
+				rows.Close()
+				return err
+			}
+
+			t, err := time.Parse(timestampLayout, bucketStart)
+			if err != nil {
+				continue
+			}
+			addHost(key, t.Truncate(bucketSize), stats)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = db.Query(fmt.Sprintf(`SELECT device_id, metric, process_instance, process_pid, name_id, workload_key, bucket_start,
+                min_value, max_value, sum_value, sample_count, p95_value
+            FROM %s.ProcessRollups WHERE resolution = ? AND bucket_start >= ? AND bucket_start < ?`, dbName), source, fromValue, toValue)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var key processSeriesKey
+			var label processLabels
+			var bucketStart string
+			var stats RollupStats
+			if err := rows.Scan(&key.deviceID, &key.metric, &key.instance, &label.pid, &label.nameID, &label.workloadKey, &bucketStart,
+				&stats.Min, &stats.Max, &stats.Sum, &stats.Count, &stats.P95); err != nil {
+				rows.Close()
+				return err
+			}
+
+			t, err := time.Parse(timestampLayout, bucketStart)
+			if err != nil {
+				continue
+			}
+			labels[key] = label
+			addProcess(key, t.Truncate(bucketSize), stats)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	// Write the buckets and the watermark together
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hostInsert := fmt.Sprintf(`INSERT INTO %s.HostRollups (device_id, resolution, metric, bucket_start, min_value, max_value, sum_value, sample_count, p95_value)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE min_value = VALUES(min_value), max_value = VALUES(max_value), sum_value = VALUES(sum_value),
+            sample_count = VALUES(sample_count), p95_value = VALUES(p95_value)`, dbName)
+
+	for key, buckets := range hostBuckets {
+		for bucket, children := range buckets {
+			stats := MergeRollupStats(children)
+			if _, err := tx.Exec(hostInsert, key.deviceID, resolution, key.metric, bucket.Format(timestampLayout),
+				stats.Min, stats.Max, stats.Sum, stats.Count, stats.P95); err != nil {
+				return err
+			}
+		}
+	}
+
+	processInsert := fmt.Sprintf(`INSERT INTO %s.ProcessRollups (device_id, resolution, metric, process_instance, process_pid, name_id, workload_key,
+            bucket_start, min_value, max_value, sum_value, sample_count, p95_value)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE min_value = VALUES(min_value), max_value = VALUES(max_value), sum_value = VALUES(sum_value),
+            sample_count = VALUES(sample_count), p95_value = VALUES(p95_value)`, dbName)
+
+	for key, buckets := range processBuckets {
+		label := labels[key]
+		for bucket, children := range buckets {
+			stats := MergeRollupStats(children)
+			if _, err := tx.Exec(processInsert, key.deviceID, resolution, key.metric, key.instance, label.pid, label.nameID, label.workloadKey,
+				bucket.Format(timestampLayout), stats.Min, stats.Max, stats.Sum, stats.Count, stats.P95); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s.RollupState (resolution, rolled_up_to) VALUES (?, ?)
+        ON DUPLICATE KEY UPDATE rolled_up_to = VALUES(rolled_up_to)`, dbName), resolution, toValue); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
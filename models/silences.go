@@ -0,0 +1,305 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Silences and maintenance windows mute alerts: their alerts are still evaluated and recorded, with what silenced
+// them, but not notified. A silence mutes the alerts matching its rule, devices and labels between its start and
+// end. A maintenance window mutes the alerts of its devices every time its cron schedule starts it, for its duration.
+
+type Silence struct {
+	ID int64
+	// 0 for the alerts of every rule
+	RuleID int64
+	// Device names and labels the alerts must have, any when empty
+	Devices   []string
+	Labels    map[string]string
+	StartsAt  string
+	EndsAt    string
+	Comment   string
+	CreatedBy string
+	CreatedAt string
+}
+
+func scanSilences(rows *sql.Rows) ([]Silence, error) {
+	defer rows.Close()
+
+	silences := []Silence{}
+	for rows.Next() {
+		var silence Silence
+		var devices, labels string
+		if err := rows.Scan(&silence.ID, &silence.RuleID, &devices, &labels, &silence.StartsAt, &silence.EndsAt, &silence.Comment,
+			&silence.CreatedBy, &silence.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(devices), &silence.Devices); err != nil {
+			return nil, fmt.Errorf("error reading devices of silence %d: %v", silence.ID, err)
+		}
+		if err := json.Unmarshal([]byte(labels), &silence.Labels); err != nil {
+			return nil, fmt.Errorf("error reading labels of silence %d: %v", silence.ID, err)
+		}
+		silences = append(silences, silence)
+	}
+
+	return silences, rows.Err()
+}
+
+const silenceColumns = `silence_id, COALESCE(rule_id, 0), devices, labels, starts_at, ends_at, COALESCE(comment, ''),
+    COALESCE(created_by, ''), created_at`
+
+// GetSilences returns the silences of a tenant by ID, only the ones active at activeAt unless it is empty
+func GetSilences(db *sql.DB, tenantID string, activeAt string) ([]Silence, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	query := fmt.Sprintf("SELECT %s FROM %s.Silences", silenceColumns, dbName)
+	var args []interface{}
+	if activeAt != "" {
+		query += " WHERE ends_at > ? AND starts_at <= ?"
+		args = append(args, activeAt, activeAt)
+	}
+	query += " ORDER BY silence_id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSilences(rows)
+}
+
+// GetSilence returns a silence, nil when the tenant has none with that ID
+func GetSilence(db *sql.DB, tenantID string, silenceID int64) (*Silence, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.Silences WHERE silence_id = ?", silenceColumns, dbName), silenceID)
+	if err != nil {
+		return nil, err
+	}
+
+	silences, err := scanSilences(rows)
+	if err != nil || len(silences) == 0 {
+		return nil, err
+	}
+	return &silences[0], nil
+}
+
+// silenceArgs returns the values of the columns of a silence, from rule_id to created_by
+func silenceArgs(silence Silence) ([]interface{}, error) {
+	if silence.Devices == nil {
+		silence.Devices = []string{}
+	}
+	if silence.Labels == nil {
+		silence.Labels = map[string]string{}
+	}
+	devices, err := json.Marshal(silence.Devices)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := json.Marshal(silence.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleID interface{}
+	if silence.RuleID != 0 {
+		ruleID = silence.RuleID
+	}
+
+	return []interface{}{ruleID, string(devices), string(labels), silence.StartsAt, silence.EndsAt, nullString(silence.Comment),
+		nullString(silence.CreatedBy)}, nil
+}
+
+// CreateSilence saves a new silence and returns its ID
+func CreateSilence(db *sql.DB, tenantID string, silence Silence, now string) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := silenceArgs(silence)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.Silences (rule_id, devices, labels, starts_at, ends_at, comment, created_by,
+        created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, dbName), append(args, now)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// UpdateSilence replaces a silence, it returns false when the tenant has none with its ID
+func UpdateSilence(db *sql.DB, tenantID string, silence Silence) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := silenceArgs(silence)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`UPDATE %s.Silences SET rule_id = ?, devices = ?, labels = ?, starts_at = ?, ends_at = ?,
+        comment = ?, created_by = ? WHERE silence_id = ?`, dbName), append(args, silence.ID)...)
+	if err != nil {
+		return false, err
+	}
+
+	// Unchanged rows count as not affected, tell them apart from missing ones
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err == nil, err
+	}
+	existing, err := GetSilence(db, tenantID, silence.ID)
+	return existing != nil, err
+}
+
+// DeleteSilence deletes a silence, it returns false when the tenant has none with that ID
+func DeleteSilence(db *sql.DB, tenantID string, silenceID int64) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf("DELETE FROM %s.Silences WHERE silence_id = ?", dbName), silenceID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+type MaintenanceWindow struct {
+	ID   int64
+	Name string
+	// Device names of the group under maintenance, every device when empty
+	Devices []string
+	// Cron expression of the starts of the window: minute hour day-of-month month day-of-week
+	Schedule string
+	Duration time.Duration
+	// IANA time zone the schedule is read in
+	Timezone string
+	// Whether the window also mutes the alerts of the rules detecting devices that stopped sending data
+	SuppressOffline bool
+	Enabled         bool
+	CreatedAt       string
+	UpdatedAt       string
+}
+
+const maintenanceWindowColumns = `window_id, name, devices, schedule, duration_seconds, timezone, suppress_offline, enabled,
+    created_at, updated_at`
+
+func scanMaintenanceWindows(rows *sql.Rows) ([]MaintenanceWindow, error) {
+	defer rows.Close()
+
+	windows := []MaintenanceWindow{}
+	for rows.Next() {
+		var window MaintenanceWindow
+		var devices string
+		var duration int
+		if err := rows.Scan(&window.ID, &window.Name, &devices, &window.Schedule, &duration, &window.Timezone,
+			&window.SuppressOffline, &window.Enabled, &window.CreatedAt, &window.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(devices), &window.Devices); err != nil {
+			return nil, fmt.Errorf("error reading devices of maintenance window %d: %v", window.ID, err)
+		}
+		window.Duration = time.Duration(duration) * time.Second
+		windows = append(windows, window)
+	}
+
+	return windows, rows.Err()
+}
+
+// GetMaintenanceWindows returns the maintenance windows of a tenant by ID
+func GetMaintenanceWindows(db *sql.DB, tenantID string) ([]MaintenanceWindow, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.MaintenanceWindows ORDER BY window_id", maintenanceWindowColumns, dbName))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMaintenanceWindows(rows)
+}
+
+// GetMaintenanceWindow returns a maintenance window, nil when the tenant has none with that ID
+func GetMaintenanceWindow(db *sql.DB, tenantID string, windowID int64) (*MaintenanceWindow, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s.MaintenanceWindows WHERE window_id = ?", maintenanceWindowColumns, dbName),
+		windowID)
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := scanMaintenanceWindows(rows)
+	if err != nil || len(windows) == 0 {
+		return nil, err
+	}
+	return &windows[0], nil
+}
+
+// maintenanceWindowArgs returns the values of the columns of a window, from name to enabled
+func maintenanceWindowArgs(window MaintenanceWindow) ([]interface{}, error) {
+	if window.Devices == nil {
+		window.Devices = []string{}
+	}
+	devices, err := json.Marshal(window.Devices)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{window.Name, string(devices), window.Schedule, int(window.Duration / time.Second), window.Timezone,
+		window.SuppressOffline, window.Enabled}, nil
+}
+
+// CreateMaintenanceWindow saves a new maintenance window and returns its ID
+func CreateMaintenanceWindow(db *sql.DB, tenantID string, window MaintenanceWindow, now string) (int64, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := maintenanceWindowArgs(window)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`INSERT INTO %s.MaintenanceWindows (name, devices, schedule, duration_seconds, timezone,
+        suppress_offline, enabled, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, dbName), append(args, now, now)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// UpdateMaintenanceWindow replaces a maintenance window, it returns false when the tenant has none with its ID
+func UpdateMaintenanceWindow(db *sql.DB, tenantID string, window MaintenanceWindow, now string) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	args, err := maintenanceWindowArgs(window)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(fmt.Sprintf(`UPDATE %s.MaintenanceWindows SET name = ?, devices = ?, schedule = ?, duration_seconds = ?,
+        timezone = ?, suppress_offline = ?, enabled = ?, updated_at = ? WHERE window_id = ?`, dbName), append(args, now, window.ID)...)
+	if err != nil {
+		return false, err
+	}
+
+	// Unchanged rows count as not affected, tell them apart from missing ones
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err == nil, err
+	}
+	existing, err := GetMaintenanceWindow(db, tenantID, window.ID)
+	return existing != nil, err
+}
+
+// DeleteMaintenanceWindow deletes a maintenance window, it returns false when the tenant has none with that ID
+func DeleteMaintenanceWindow(db *sql.DB, tenantID string, windowID int64) (bool, error) {
+	dbName := fmt.Sprintf("`Performance_%s`", tenantID)
+
+	result, err := db.Exec(fmt.Sprintf("DELETE FROM %s.MaintenanceWindows WHERE window_id = ?", dbName), windowID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,131 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ports used when an email channel has none, by TLS mode
+const (
+	defaultSMTPPort    = 587
+	defaultSMTPTLSPort = 465
+)
+
+// emailMessage builds the message of a notification, plain text encoded as quoted-printable
+func emailMessage(config Config, n Notification, now time.Time) ([]byte, error) {
+	var message bytes.Buffer
+
+	header := func(name string, value string) {
+		fmt.Fprintf(&message, "%s: %s\r\n", name, value)
+	}
+	header("From", config.From)
+	header("To", strings.Join(config.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", n.Title()))
+	header("Date", now.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	message.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&message)
+	if _, err := body.Write([]byte(strings.ReplaceAll(n.Text(), "\n", "\r\n") + "\r\n")); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+func sendEmail(config Config, n Notification) error {
+	port := config.Port
+	if port == 0 {
+		port = defaultSMTPPort
+		if config.TLS == TLSImplicit {
+			port = defaultSMTPTLSPort
+		}
+	}
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: config.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: sendTimeout}
+	if config.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error starting SMTP session: %v", err)
+	}
+	defer client.Close()
+
+	if config.TLS == TLSOpportunistic || config.TLS == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("error starting TLS: %v", err)
+			}
+		} else if config.TLS == TLSStartTLS {
+			return fmt.Errorf("%s doesn't support STARTTLS", addr)
+		}
+	}
+
+	// PlainAuth refuses to send the password unencrypted, except to localhost
+	if config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return fmt.Errorf("error authenticating: %v", err)
+		}
+	}
+
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %v", err)
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("error sending MAIL FROM: %v", err)
+	}
+	for _, to := range config.To {
+		recipient, err := mail.ParseAddress(to)
+		if err != nil {
+			return fmt.Errorf("invalid to address: %v", err)
+		}
+		if err := client.Rcpt(recipient.Address); err != nil {
+			return fmt.Errorf("error sending RCPT TO %s: %v", recipient.Address, err)
+		}
+	}
+
+	message, err := emailMessage(config, n, time.Now())
+	if err != nil {
+		return fmt.Errorf("error building message: %v", err)
+	}
+	data, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error sending DATA: %v", err)
+	}
+	if _, err := data.Write(message); err != nil {
+		return fmt.Errorf("error sending message: %v", err)
+	}
+	if err := data.Close(); err != nil {
+		return fmt.Errorf("error sending message: %v", err)
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,240 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server for one session without TLS, it records the commands and the message it receives
+type fakeSMTP struct {
+	listener net.Listener
+	// Extensions announced in the EHLO response, and recipients refused
+	extensions []string
+	refuse     map[string]bool
+
+	commands []string
+	message  string
+	done     chan struct{}
+}
+
+func startFakeSMTP(t *testing.T, extensions ...string) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeSMTP{listener: listener, extensions: extensions, refuse: make(map[string]bool), done: make(chan struct{})}
+	go server.serve()
+	return server
+}
+
+// config returns the configuration of an email channel sending to the server
+func (s *fakeSMTP) config() Config {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return Config{
+		Host: "127.0.0.1",
+		Port: p,
+		From: "Alerts <alerts@example.com>",
+		To:   []string{"ops@example.com", "On Call <oncall@example.com>"},
+	}
+}
+
+func (s *fakeSMTP) serve() {
+	defer close(s.done)
+
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.commands = append(s.commands, line)
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO":
+			lines := append([]string{"localhost"}, s.extensions...)
+			for i, l := range lines {
+				separator := "-"
+				if i == len(lines)-1 {
+					separator = " "
+				}
+				text.PrintfLine("250%s%s", separator, l)
+			}
+		case "AUTH":
+			text.PrintfLine("235 2.7.0 Authentication successful")
+		case "RCPT":
+			address := strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			if s.refuse[address] {
+				text.PrintfLine("550 5.1.1 No such user")
+			} else {
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			message, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			s.message = string(message)
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		case "HELO", "MAIL", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// wait returns once the session is over
+func (s *fakeSMTP) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the SMTP session didn't end")
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	// Without STARTTLS offered the message is sent in the clear, PlainAuth allows it to localhost only
+	server := startFakeSMTP(t, "AUTH PLAIN")
+	config := server.config()
+	config.Username, config.Password = "alerts", "s3cret"
+
+	notification := testNotification
+	notification.RuleName = "Température élevée"
+	if err := Send(Email, config, notification); err != nil {
+		t.Fatal(err)
+	}
+	server.wait(t)
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00alerts\x00s3cret"))
+	want := []string{
+		"EHLO localhost",
+		"AUTH PLAIN " + credentials,
+		"MAIL FROM:<alerts@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<oncall@example.com>",
+		"DATA",
+		"QUIT",
+	}
+	if strings.Join(server.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got commands\n%s\nwant\n%s", strings.Join(server.commands, "\n"), strings.Join(want, "\n"))
+	}
+
+	message, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(server.message)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != notification.Title() {
+		t.Errorf("got subject %q, %v, want %q", subject, err, notification.Title())
+	}
+	if message.Header.Get("To") != "ops@example.com, On Call <oncall@example.com>" || message.Header.Get("From") != config.From {
+		t.Errorf("got headers %v", message.Header)
+	}
+	if _, err := message.Header.Date(); err != nil {
+		t.Errorf("invalid date: %v", err)
+	}
+
+	body, err := io.ReadAll(quotedprintable.NewReader(message.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server reads the CRLF line ends as LF
+	if want := notification.Text() + "\n"; string(body) != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+}
+
+func TestSendEmailStartTLSRequired(t *testing.T) {
+	server := startFakeSMTP(t)
+	config := server.config()
+	config.TLS = TLSStartTLS
+
+	err := Send(Email, config, testNotification)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("got error %v, want STARTTLS to be required", err)
+	}
+	server.wait(t)
+
+	for _, command := range server.commands {
+		if strings.HasPrefix(command, "MAIL") || strings.HasPrefix(command, "AUTH") {
+			t.Errorf("sent %q without TLS", command)
+		}
+	}
+}
+
+func TestSendEmailRecipientRefused(t *testing.T) {
+	server := startFakeSMTP(t)
+	server.refuse["oncall@example.com"] = true
+	config := server.config()
+	config.TLS = TLSNone
+
+	err := Send(Email, config, testNotification)
+	if err == nil || !strings.Contains(err.Error(), "oncall@example.com") || !strings.Contains(err.Error(), "550") {
+		t.Errorf("got error %v, want the refused recipient", err)
+	}
+	server.wait(t)
+
+	if server.message != "" {
+		t.Error("the message was sent without all its recipients")
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	// Lines over 76 characters are wrapped by soft line breaks, = is escaped
+	notification := testNotification
+	notification.Description = strings.Repeat("x", 100) + " a=b"
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	message, err := emailMessage(Config{From: "alerts@example.com", To: []string{"ops@example.com"}}, notification, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, body, found := strings.Cut(string(message), "\r\n\r\n")
+	if !found {
+		t.Fatalf("no blank line after the headers in %q", message)
+	}
+	wantHeader := "From: alerts@example.com\r\nTo: ops@example.com\r\nSubject: [FIRING:2] High CPU (critical)\r\n" +
+		"Date: Sat, 01 Jun 2024 12:00:00 +0000\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable"
+	if header != wantHeader {
+		t.Errorf("got headers\n%q\nwant\n%q", header, wantHeader)
+	}
+
+	for _, line := range strings.Split(body, "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("line of %d characters: %q", len(line), line)
+		}
+	}
+	if !strings.Contains(body, "a=3Db") {
+		t.Errorf("= isn't escaped in %q", body)
+	}
+}
@@ -0,0 +1,199 @@
+package notify
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Types of notification channels
+const (
+	// JSON of the notification, signed with HMAC-SHA256 when the channel has a secret
+	Webhook = "webhook"
+	// Plain text email sent through an SMTP server
+	Email = "email"
+	// Slack incoming webhook, also accepted by Mattermost and Rocket.Chat
+	Slack = "slack"
+	// Microsoft Teams incoming webhook, as a MessageCard
+	Teams = "teams"
+)
+
+var Types = []string{Webhook, Email, Slack, Teams}
+
+// States of a notification, the ones of the alerts it groups or a test send
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+	StateTest     = "test"
+)
+
+// How long a channel has to accept a notification
+const sendTimeout = 10 * time.Second
+
+// TLS modes of the SMTP connection
+const (
+	// STARTTLS when the server offers it, the default
+	TLSOpportunistic = ""
+	TLSStartTLS      = "starttls"
+	TLSImplicit      = "tls"
+	TLSNone          = "none"
+)
+
+// Config is the configuration of a channel, the fields used depend on its type
+type Config struct {
+	// Webhook, Slack and Teams
+	URL string `json:"url,omitempty"`
+	// Webhook: key of the signature, and headers added to the requests
+	Secret  string            `json:"secret,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Email
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	TLS      string   `json:"tls,omitempty"`
+}
+
+// Validate checks the configuration of a channel of a type
+func (c Config) Validate(channelType string) error {
+	switch channelType {
+	case Webhook, Slack, Teams:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q, expected an http or https URL", c.URL)
+		}
+		for name := range c.Headers {
+			if name == "" || strings.ContainsAny(name, " :\r\n") {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+
+	case Email:
+		if c.Host == "" {
+			return fmt.Errorf("host is required")
+		}
+		if c.Port < 0 || c.Port > 65535 {
+			return fmt.Errorf("invalid port %d", c.Port)
+		}
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			return fmt.Errorf("invalid from address %q: %v", c.From, err)
+		}
+		if len(c.To) == 0 {
+			return fmt.Errorf("at least one to address is required")
+		}
+		for _, to := range c.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("invalid to address %q: %v", to, err)
+			}
+		}
+		switch c.TLS {
+		case TLSOpportunistic, TLSStartTLS, TLSImplicit, TLSNone:
+		default:
+			return fmt.Errorf("unknown tls mode %q, expected starttls, tls or none", c.TLS)
+		}
+
+	default:
+		return fmt.Errorf("unknown channel type %q, expected one of %s", channelType, strings.Join(Types, ", "))
+	}
+
+	return nil
+}
+
+// Alert is an alert grouped in a notification
+type Alert struct {
+	DeviceID    string            `json:"deviceID"`
+	DeviceName  string            `json:"deviceName"`
+	Series      string            `json:"series"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveSince string            `json:"activeSince,omitempty"`
+}
+
+// Notification groups the alerts of a rule that fired or resolved at the same evaluation. It is also the body
+// of the webhook channels.
+type Notification struct {
+	TenantID    string  `json:"tenantID"`
+	RuleID      int64   `json:"ruleID"`
+	RuleName    string  `json:"ruleName"`
+	Description string  `json:"description,omitempty"`
+	Severity    string  `json:"severity"`
+	State       string  `json:"state"`
+	Metric      string  `json:"metric"`
+	Operator    string  `json:"operator"`
+	Threshold   float64 `json:"threshold"`
+	Alerts      []Alert `json:"alerts"`
+	Timestamp   string  `json:"timestamp"`
+}
+
+// Title summarises a notification in one line, like "[FIRING:2] High CPU (critical)"
+func (n Notification) Title() string {
+	if n.State == StateTest {
+		return fmt.Sprintf("[TEST] Test notification of tenant %s", n.TenantID)
+	}
+	return fmt.Sprintf("[%s:%d] %s (%s)", strings.ToUpper(n.State), len(n.Alerts), n.RuleName, n.Severity)
+}
+
+// Text describes the alerts of a notification, one per line
+func (n Notification) Text() string {
+	if n.State == StateTest {
+		return "This is a test notification, the channel is configured correctly."
+	}
+
+	var text strings.Builder
+	if n.Description != "" {
+		text.WriteString(n.Description + "\n")
+	}
+	fmt.Fprintf(&text, "%s %s %g\n", n.Metric, n.Operator, n.Threshold)
+
+	for _, alert := range n.Alerts {
+		device := alert.DeviceName
+		if device == "" {
+			device = alert.DeviceID
+		}
+		fmt.Fprintf(&text, "- %s", device)
+		if alert.Series != "" {
+			fmt.Fprintf(&text, " %s", alert.Series)
+		}
+		if labels := formatLabels(alert.Labels); labels != "" {
+			fmt.Fprintf(&text, " {%s}", labels)
+		}
+		fmt.Fprintf(&text, ": %g\n", alert.Value)
+	}
+
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// Send delivers a notification on a channel
+func Send(channelType string, config Config, n Notification) error {
+	switch channelType {
+	case Webhook:
+		return sendWebhook(config, n)
+	case Slack:
+		return sendSlack(config, n)
+	case Teams:
+		return sendTeams(config, n)
+	case Email:
+		return sendEmail(config, n)
+	default:
+		return fmt.Errorf("unknown channel type %q", channelType)
+	}
+}
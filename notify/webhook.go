@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of the signed webhooks. The signature is the HMAC-SHA256 of the timestamp, a dot and the body, keyed
+// with the secret of the channel, so receivers can reject forged and replayed notifications.
+const (
+	SignatureHeader = "X-CloudVigilante-Signature"
+	TimestampHeader = "X-CloudVigilante-Timestamp"
+)
+
+// Bytes of the response of a failed request kept in its error
+const maxErrorBody = 512
+
+var httpClient = &http.Client{Timeout: sendTimeout}
+
+// Sign returns the value of the signature header of a body sent at timestamp, a Unix time in seconds
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postJSON posts a payload, responses other than 2xx are errors
+func postJSON(config Config, payload interface{}, sign bool) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %v", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "cloudVigilante")
+	for name, value := range config.Headers {
+		request.Header.Set(name, value)
+	}
+	if sign && config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(TimestampHeader, timestamp)
+		request.Header.Set(SignatureHeader, Sign(config.Secret, timestamp, body))
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		return fmt.Errorf("unexpected response %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	io.Copy(io.Discard, response.Body)
+
+	return nil
+}
+
+func sendWebhook(config Config, n Notification) error {
+	return postJSON(config, n, true)
+}
+
+// Colors of the notifications by state and severity
+func color(n Notification) string {
+	switch {
+	case n.State == StateResolved || n.State == StateTest:
+		return "2EB67D"
+	case n.Severity == "critical":
+		return "E01E5A"
+	case n.Severity == "warning":
+		return "ECB22E"
+	default:
+		return "36C5F0"
+	}
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields,omitempty"`
+	Ts       int64        `json:"ts,omitempty"`
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+func sendSlack(config Config, n Notification) error {
+	attachment := slackAttachment{
+		Fallback: n.Title(),
+		Color:    "#" + color(n),
+		Title:    n.Title(),
+		Text:     n.Text(),
+		Ts:       time.Now().Unix(),
+	}
+	if n.State != StateTest {
+		attachment.Fields = []slackField{
+			{Title: "Severity", Value: n.Severity, Short: true},
+			{Title: "State", Value: n.State, Short: true},
+		}
+	}
+
+	return postJSON(config, slackMessage{Text: n.Title(), Attachments: []slackAttachment{attachment}}, false)
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teamsSection struct {
+	Text  string      `json:"text,omitempty"`
+	Facts []teamsFact `json:"facts,omitempty"`
+}
+
+type teamsMessageCard struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	ThemeColor string         `json:"themeColor"`
+	Summary    string         `json:"summary"`
+	Title      string         `json:"title"`
+	Sections   []teamsSection `json:"sections"`
+}
+
+func sendTeams(config Config, n Notification) error {
+	// Teams renders the text as markdown, where lines need a blank line between them
+	section := teamsSection{Text: strings.ReplaceAll(n.Text(), "\n", "\n\n")}
+	if n.State != StateTest {
+		section.Facts = []teamsFact{
+			{Name: "Severity", Value: n.Severity},
+			{Name: "State", Value: n.State},
+			{Name: "Timestamp", Value: n.Timestamp},
+		}
+	}
+
+	return postJSON(config, teamsMessageCard{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: color(n),
+		Summary:    n.Title(),
+		Title:      n.Title(),
+		Sections:   []teamsSection{section},
+	}, false)
+}
@@ -0,0 +1,202 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNotification = Notification{
+	TenantID:  "t1",
+	RuleID:    7,
+	RuleName:  "High CPU",
+	Severity:  "critical",
+	State:     StateFiring,
+	Metric:    "cpu",
+	Operator:  ">",
+	Threshold: 90,
+	Alerts: []Alert{
+		{DeviceID: "d1", DeviceName: "web-1", Value: 95},
+		{DeviceID: "d2", Series: "nginx", Labels: map[string]string{"pid": "42"}, Value: 99},
+	},
+	Timestamp: "2024-06-01 12:00:00",
+}
+
+// receivedRequest is a request received by a test server
+type receivedRequest struct {
+	method string
+	header http.Header
+	body   []byte
+}
+
+// startReceiver starts a server answering status with body, it sends the requests it receives on the channel
+func startReceiver(t *testing.T, status int, body string) (*httptest.Server, chan receivedRequest) {
+	t.Helper()
+	requests := make(chan receivedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		requests <- receivedRequest{method: r.Method, header: r.Header, body: data}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestSign(t *testing.T) {
+	want := "sha256=a0f647a122cbf41df207429e3c04a4dd382a7134c17270331e9d4c7ccc2f0f00"
+	if got := Sign("s3cret", "1700000000", []byte(`{"state":"firing"}`)); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	server, requests := startReceiver(t, http.StatusNoContent, "")
+	config := Config{
+		URL:     server.URL + "/hooks/alerts",
+		Secret:  "s3cret",
+		Headers: map[string]string{"Authorization": "Bearer token", "X-Team": "ops"},
+	}
+
+	if err := Send(Webhook, config, testNotification); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+
+	if request.method != http.MethodPost || request.header.Get("Content-Type") != "application/json" {
+		t.Errorf("got a %s of %s", request.method, request.header.Get("Content-Type"))
+	}
+	for name, value := range config.Headers {
+		if got := request.header.Get(name); got != value {
+			t.Errorf("header %s is %q, want %q", name, got, value)
+		}
+	}
+
+	// The body is the notification
+	var notification Notification
+	if err := json.Unmarshal(request.body, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(notification, testNotification) {
+		t.Errorf("got notification %+v, want %+v", notification, testNotification)
+	}
+
+	// Signed with the secret, at the time of the send
+	timestamp := request.header.Get(TimestampHeader)
+	if seconds, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(seconds, 0)) > time.Minute {
+		t.Errorf("got timestamp %q", timestamp)
+	}
+	if signature := request.header.Get(SignatureHeader); signature != Sign("s3cret", timestamp, request.body) {
+		t.Errorf("got signature %q, want %q", signature, Sign("s3cret", timestamp, request.body))
+	}
+}
+
+func TestSendWebhookWithoutSecret(t *testing.T) {
+	server, requests := startReceiver(t, http.StatusOK, "")
+
+	if err := Send(Webhook, Config{URL: server.URL}, testNotification); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+
+	if request.header.Get(SignatureHeader) != "" || request.header.Get(TimestampHeader) != "" {
+		t.Errorf("an unsigned webhook has the signature headers %v", request.header)
+	}
+}
+
+func TestSendWebhookError(t *testing.T) {
+	server, requests := startReceiver(t, http.StatusInternalServerError, strings.Repeat("boom ", 200))
+
+	err := Send(Webhook, Config{URL: server.URL}, testNotification)
+	<-requests
+	if err == nil {
+		t.Fatal("a 500 response isn't an error")
+	}
+	if !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "boom") || len(err.Error()) > maxErrorBody+100 {
+		t.Errorf("got error %q, want the status and the start of the body", err)
+	}
+}
+
+func TestSendSlack(t *testing.T) {
+	// The secret only signs webhooks
+	server, requests := startReceiver(t, http.StatusOK, "ok")
+	config := Config{URL: server.URL, Secret: "s3cret", Headers: map[string]string{"X-Team": "ops"}}
+
+	if err := Send(Slack, config, testNotification); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+
+	if request.header.Get("X-Team") != "ops" || request.header.Get(SignatureHeader) != "" {
+		t.Errorf("got headers %v", request.header)
+	}
+
+	var message slackMessage
+	if err := json.Unmarshal(request.body, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Text != "[FIRING:2] High CPU (critical)" || len(message.Attachments) != 1 {
+		t.Fatalf("got message %+v", message)
+	}
+	attachment := message.Attachments[0]
+	if attachment.Color != "#E01E5A" || attachment.Title != message.Text || attachment.Text != testNotification.Text() || attachment.Ts == 0 {
+		t.Errorf("got attachment %+v", attachment)
+	}
+	wantFields := []slackField{{Title: "Severity", Value: "critical", Short: true}, {Title: "State", Value: "firing", Short: true}}
+	if !reflect.DeepEqual(attachment.Fields, wantFields) {
+		t.Errorf("got fields %+v, want %+v", attachment.Fields, wantFields)
+	}
+}
+
+func TestSendTeams(t *testing.T) {
+	server, requests := startReceiver(t, http.StatusOK, "1")
+
+	resolved := testNotification
+	resolved.State = StateResolved
+	if err := Send(Teams, Config{URL: server.URL}, resolved); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+
+	var card map[string]interface{}
+	if err := json.Unmarshal(request.body, &card); err != nil {
+		t.Fatal(err)
+	}
+	if card["@type"] != "MessageCard" || card["@context"] != "https://schema.org/extensions" || card["themeColor"] != "2EB67D" ||
+		card["title"] != "[RESOLVED:2] High CPU (critical)" || card["summary"] != card["title"] {
+		t.Errorf("got card %v", card)
+	}
+
+	var sections []teamsSection
+	data, _ := json.Marshal(card["sections"])
+	json.Unmarshal(data, &sections)
+	want := []teamsSection{{
+		Text:  "cpu > 90\n\n- web-1: 95\n\n- d2 nginx {pid=\"42\"}: 99",
+		Facts: []teamsFact{{"Severity", "critical"}, {"State", "resolved"}, {"Timestamp", "2024-06-01 12:00:00"}},
+	}}
+	if !reflect.DeepEqual(sections, want) {
+		t.Errorf("got sections %+v, want %+v", sections, want)
+	}
+}
+
+func TestSendTestNotification(t *testing.T) {
+	server, requests := startReceiver(t, http.StatusOK, "")
+
+	if err := Send(Slack, Config{URL: server.URL}, Notification{TenantID: "t1", State: StateTest}); err != nil {
+		t.Fatal(err)
+	}
+
+	var message slackMessage
+	if err := json.Unmarshal((<-requests).body, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Text != "[TEST] Test notification of tenant t1" || message.Attachments[0].Fields != nil {
+		t.Errorf("got message %+v", message)
+	}
+}
@@ -0,0 +1,173 @@
+package promql
+
+import (
+	"math"
+	"sort"
+)
+
+// A group gathers the series aggregated together
+type group struct {
+	labels map[string]string
+	series []*series
+}
+
+// groupLabels returns the labels a series keeps in its group
+func groupLabels(aggregate *Aggregate, labels map[string]string) map[string]string {
+	kept := make(map[string]string)
+	if aggregate.Without {
+		for name, value := range labels {
+			kept[name] = value
+		}
+		delete(kept, LabelName)
+		for _, name := range aggregate.Grouping {
+			delete(kept, name)
+		}
+		return kept
+	}
+
+	for _, name := range aggregate.Grouping {
+		if value, ok := labels[name]; ok {
+			kept[name] = value
+		}
+	}
+	return kept
+}
+
+// aggregate evaluates an aggregation at every step
+func (e *evaluator) aggregate(aggregate *Aggregate) (interface{}, error) {
+	var param scalar
+	if aggregate.Param != nil {
+		value, err := e.eval(aggregate.Param)
+		if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		if param, ok = value.(scalar); !ok {
+			return nil, badData("expected a scalar as parameter of %s", aggregate.Op)
+		}
+	}
+
+	value, err := e.eval(aggregate.Expr)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := value.(vector)
+	if !ok {
+		return nil, badData("expected an instant vector in %s, use a function such as rate() on range vectors", aggregate.Op)
+	}
+
+	var order []string
+	groups := make(map[string]*group)
+	for _, s := range v {
+		labels := groupLabels(aggregate, s.labels)
+		key := signature(labels, nil, false)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+			groups[key] = &group{labels: labels}
+		}
+		groups[key].series = append(groups[key].series, s)
+	}
+
+	if aggregate.Op == "topk" || aggregate.Op == "bottomk" {
+		return e.selectK(aggregate.Op == "topk", param, order, groups), nil
+	}
+
+	result := make(vector, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		out := e.newSeries(g.labels)
+
+		values := make([]float64, 0, len(g.series))
+		for i := range e.steps {
+			values = values[:0]
+			for _, s := range g.series {
+				if s.present[i] {
+					values = append(values, s.values[i])
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+
+			out.present[i] = true
+			switch aggregate.Op {
+			case "sum":
+				out.values[i] = sum(values)
+			case "avg":
+				out.values[i] = sum(values) / float64(len(values))
+			case "count":
+				out.values[i] = float64(len(values))
+			case "min":
+				out.values[i] = math.Inf(1)
+				for _, value := range values {
+					out.values[i] = math.Min(out.values[i], value)
+				}
+			case "max":
+				out.values[i] = math.Inf(-1)
+				for _, value := range values {
+					out.values[i] = math.Max(out.values[i], value)
+				}
+			case "stddev":
+				out.values[i] = stddev(values)
+			case "quantile":
+				out.values[i] = quantile(param[i], values)
+			}
+		}
+		result = append(result, out)
+	}
+
+	return result, nil
+}
+
+func sum(values []float64) float64 {
+	var total float64
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
+
+// selectK keeps, at every step, the k largest or smallest series of every group with their own labels
+func (e *evaluator) selectK(top bool, k scalar, order []string, groups map[string]*group) vector {
+	var result vector
+	selected := make(map[*series]*series)
+
+	for i := range e.steps {
+		limit := int(k[i])
+		if limit < 1 {
+			continue
+		}
+
+		for _, key := range order {
+			var present []*series
+			for _, s := range groups[key].series {
+				if s.present[i] {
+					present = append(present, s)
+				}
+			}
+
+			sort.SliceStable(present, func(a, b int) bool {
+				if top {
+					return present[a].values[i] > present[b].values[i]
+				}
+				return present[a].values[i] < present[b].values[i]
+			})
+			if len(present) > limit {
+				present = present[:limit]
+			}
+
+			for _, s := range present {
+				out, ok := selected[s]
+				if !ok {
+					out = e.newSeries(s.labels)
+					selected[s] = out
+					result = append(result, out)
+				}
+				out.values[i], out.present[i] = s.values[i], true
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,574 @@
+package promql
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	inf = math.Inf(1)
+	nan = math.NaN()
+)
+
+// How far back an instant selector looks for the latest sample, as in Prometheus
+const LookbackDelta = 5 * time.Minute
+
+// Most steps a range query can have, as in Prometheus
+const MaxSteps = 11000
+
+// Result types of the Prometheus HTTP API
+const (
+	ResultScalar = "scalar"
+	ResultVector = "vector"
+	ResultMatrix = "matrix"
+)
+
+// Point is a sample, its timestamp in milliseconds
+type Point struct {
+	Timestamp int64
+	Value     float64
+}
+
+type Series struct {
+	Labels map[string]string
+	Points []Point
+}
+
+// Result of an evaluation. A scalar result has a single series without labels.
+type Result struct {
+	Scalar bool
+	Series []Series
+}
+
+// BadDataError is returned for queries that can't be parsed or evaluated as written
+type BadDataError struct {
+	Message string
+}
+
+func (e *BadDataError) Error() string {
+	return e.Message
+}
+
+func badData(format string, args ...interface{}) error {
+	return &BadDataError{Message: fmt.Sprintf(format, args...)}
+}
+
+// A scalar has a value at every step
+type scalar []float64
+
+// An instant vector is evaluated at every step, a series has a value at the steps it is present at
+type series struct {
+	labels  map[string]string
+	values  []float64
+	present []bool
+}
+
+type vector []*series
+
+// A range vector holds the raw points of its series, functions evaluate them over a window ending at every step
+type rangeVector struct {
+	series []rawSeries
+	window time.Duration
+}
+
+type rawSeries struct {
+	labels map[string]string
+	points []Point
+}
+
+type evaluator struct {
+	db       *sql.DB
+	tenantID string
+	start    time.Time
+	end      time.Time
+	step     time.Duration
+	// Step timestamps in milliseconds
+	steps []int64
+	// Reads the series of a selector from window before the first step to the last one
+	source func(selector *VectorSelector, window time.Duration) ([]rawSeries, error)
+}
+
+// Evaluate evaluates a query at every step from start to end. An instant query has start equal to end.
+func Evaluate(db *sql.DB, tenantID string, query string, start time.Time, end time.Time, step time.Duration) (*Result, error) {
+	e := &evaluator{db: db, tenantID: tenantID}
+	e.source = e.fetch
+	return e.evaluate(query, start, end, step)
+}
+
+// evaluate evaluates a query at every step from start to end, reading the series from the source of the evaluator
+func (e *evaluator) evaluate(query string, start time.Time, end time.Time, step time.Duration) (*Result, error) {
+	node, err := Parse(query)
+	if err != nil {
+		return nil, badData("%v", err)
+	}
+
+	if end.Before(start) {
+		return nil, badData("end timestamp must not be before start time")
+	}
+
+	e.start, e.end, e.step = start.UTC(), end.UTC(), step
+	if step <= 0 {
+		if !start.Equal(end) {
+			return nil, badData("zero or negative query resolution step widths are not accepted")
+		}
+		e.steps = []int64{start.UnixMilli()}
+	} else {
+		if int64(end.Sub(start)/step) >= MaxSteps {
+			return nil, badData("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", MaxSteps)
+		}
+		for t := start; !t.After(end); t = t.Add(step) {
+			e.steps = append(e.steps, t.UnixMilli())
+		}
+	}
+
+	value, err := e.eval(node)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case scalar:
+		return &Result{Scalar: true, Series: []Series{e.output(&series{labels: map[string]string{}, values: v, present: allPresent(len(v))})}}, nil
+
+	case vector:
+		result := &Result{Series: []Series{}}
+		for _, s := range v {
+			if out := e.output(s); len(out.Points) > 0 {
+				result.Series = append(result.Series, out)
+			}
+		}
+		sort.Slice(result.Series, func(i, j int) bool {
+			return signature(result.Series[i].Labels, nil, false) < signature(result.Series[j].Labels, nil, false)
+		})
+		return result, nil
+	}
+
+	return nil, badData("a range vector can't be the result of a query, use it in a function such as rate()")
+}
+
+func allPresent(n int) []bool {
+	present := make([]bool, n)
+	for i := range present {
+		present[i] = true
+	}
+	return present
+}
+
+// output turns a series evaluated at the steps into its points
+func (e *evaluator) output(s *series) Series {
+	out := Series{Labels: s.labels}
+	for i, t := range e.steps {
+		if s.present[i] {
+			out.Points = append(out.Points, Point{Timestamp: t, Value: s.values[i]})
+		}
+	}
+	return out
+}
+
+func (e *evaluator) newSeries(labels map[string]string) *series {
+	return &series{labels: labels, values: make([]float64, len(e.steps)), present: make([]bool, len(e.steps))}
+}
+
+func (e *evaluator) eval(node Node) (interface{}, error) {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		values := make(scalar, len(e.steps))
+		for i := range values {
+			values[i] = n.Value
+		}
+		return values, nil
+
+	case *VectorSelector:
+		if n.Range > 0 {
+			raw, err := e.source(n, n.Range)
+			if err != nil {
+				return nil, err
+			}
+			return rangeVector{series: raw, window: n.Range}, nil
+		}
+		return e.instant(n)
+
+	case *Unary:
+		value, err := e.eval(n.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return e.arithmetic("*", value, scalarOf(len(e.steps), -1))
+
+	case *Binary:
+		left, err := e.eval(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := e.eval(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return e.arithmetic(n.Op, left, right)
+
+	case *Call:
+		return e.call(n)
+
+	case *Aggregate:
+		return e.aggregate(n)
+	}
+
+	return nil, badData("unsupported expression")
+}
+
+func scalarOf(n int, value float64) scalar {
+	values := make(scalar, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+// instant evaluates a selector at every step to the latest point within the lookback delta
+func (e *evaluator) instant(selector *VectorSelector) (vector, error) {
+	raw, err := e.source(selector, LookbackDelta)
+	if err != nil {
+		return nil, err
+	}
+
+	lookback := LookbackDelta.Milliseconds()
+	result := make(vector, 0, len(raw))
+	for _, r := range raw {
+		s := e.newSeries(r.labels)
+		j := 0
+		for i, t := range e.steps {
+			for j < len(r.points) && r.points[j].Timestamp <= t {
+				j++
+			}
+			if j > 0 && r.points[j-1].Timestamp > t-lookback {
+				s.values[i] = r.points[j-1].Value
+				s.present[i] = true
+			}
+		}
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+// fetch reads the series of a selector from window before the first step to the last one
+func (e *evaluator) fetch(selector *VectorSelector, window time.Duration) ([]rawSeries, error) {
+	m, ok := metrics[selector.Name]
+	if !ok {
+		// Prometheus answers unknown metrics with no series
+		return nil, nil
+	}
+
+	request := engine.Request{
+		TenantID:  e.tenantID,
+		Metric:    m.engineMetric,
+		GroupBy:   m.groupBy,
+		TimeStart: e.start.Add(-window).Format(helpers.TimestampLayout),
+		TimeEnd:   e.end.Format(helpers.TimestampLayout),
+	}
+
+	// Ask for points a few times finer than the step or the window, so rollups are used for long ranges only
+	granularity := e.step
+	if granularity <= 0 || window/4 < granularity {
+		granularity = window / 4
+	}
+	if granularity <= 0 {
+		granularity = helpers.RawSampleInterval
+	}
+	request.MaxPoints = int(e.end.Sub(e.start.Add(-window))/granularity) + 1
+
+	matchers := make([]compiledMatcher, 0, len(selector.Matchers))
+	for _, matcher := range selector.Matchers {
+		compiled, err := compileMatcher(matcher)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, compiled)
+
+		// Every matcher is checked on the series, those the engine can apply narrow down what is read
+		if matcher.Label == LabelDevice && matcher.Op == "=" {
+			request.Devices = append(request.Devices, matcher.Value)
+			continue
+		}
+
+		label, ok := m.labels[matcher.Label]
+		if !ok || compiled.matches("") && (matcher.Op == "=" || matcher.Op == "=~") {
+			continue
+		}
+		request.Filters = append(request.Filters, engine.Filter{Label: label, Op: matcher.Op, Value: matcher.Value})
+	}
+
+	result, err := engine.Execute(e.db, request)
+	if errors.Is(err, engine.ErrNoDevices) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rawFromResult(m, result, matchers)
+}
+
+// rawFromResult labels the series of an engine result and keeps those matching
+func rawFromResult(m Metric, result *engine.Result, matchers []compiledMatcher) ([]rawSeries, error) {
+	var raw []rawSeries
+	for _, device := range result.Devices {
+		for _, s := range device.Series {
+			labels := map[string]string{
+				LabelName:     m.Name,
+				LabelDevice:   device.DeviceName,
+				LabelDeviceID: device.DeviceID,
+			}
+			for promLabel, engineLabel := range m.labels {
+				if value := s.Labels[engineLabel]; value != "" {
+					labels[promLabel] = value
+				}
+			}
+
+			if !matchAll(matchers, labels) {
+				continue
+			}
+
+			points := make([]Point, 0, len(s.Samples))
+			for _, sample := range s.Samples {
+				t, err := helpers.ParseTimestamp(sample.Timestamp)
+				if err != nil {
+					return nil, err
+				}
+				points = append(points, Point{Timestamp: t.UnixMilli(), Value: sample.Value})
+			}
+			raw = append(raw, rawSeries{labels: labels, points: points})
+		}
+	}
+
+	return raw, nil
+}
+
+type compiledMatcher struct {
+	Matcher
+	re *regexp.Regexp
+}
+
+func compileMatcher(matcher Matcher) (compiledMatcher, error) {
+	compiled := compiledMatcher{Matcher: matcher}
+	if matcher.Op == "=~" || matcher.Op == "!~" {
+		re, err := regexp.Compile("^(?:" + matcher.Value + ")$")
+		if err != nil {
+			return compiled, badData("invalid regular expression %q: %v", matcher.Value, err)
+		}
+		compiled.re = re
+	}
+	return compiled, nil
+}
+
+// matches tells if a label value matches, a missing label has an empty value
+func (m compiledMatcher) matches(value string) bool {
+	switch m.Op {
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	}
+	return value == m.Value
+}
+
+func matchAll(matchers []compiledMatcher, labels map[string]string) bool {
+	for _, matcher := range matchers {
+		if !matcher.matches(labels[matcher.Label]) {
+			return false
+		}
+	}
+	return true
+}
+
+// signature identifies a label set, restricted to the given labels or without them
+func signature(labels map[string]string, names []string, only bool) string {
+	keep := func(name string) bool {
+		for _, n := range names {
+			if n == name {
+				return only
+			}
+		}
+		return !only
+	}
+
+	keys := make([]string, 0, len(labels))
+	for name := range labels {
+		if keep(name) {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, name := range keys {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// withoutName returns a copy of the labels without the metric name
+func withoutName(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if name != LabelName {
+			copied[name] = value
+		}
+	}
+	return copied
+}
+
+// arithmetic applies a binary operator, vectors are matched on their labels without the metric name
+func (e *evaluator) arithmetic(op string, left interface{}, right interface{}) (interface{}, error) {
+	if _, ok := left.(rangeVector); ok {
+		return nil, badData("binary expressions can't take range vectors")
+	}
+	if _, ok := right.(rangeVector); ok {
+		return nil, badData("binary expressions can't take range vectors")
+	}
+
+	comparison := comparisons[op]
+	ls, leftScalar := left.(scalar)
+	rs, rightScalar := right.(scalar)
+
+	switch {
+	case leftScalar && rightScalar:
+		if comparison {
+			return nil, badData("comparisons between scalars need the bool modifier, which is not supported")
+		}
+		values := make(scalar, len(ls))
+		for i := range values {
+			values[i] = apply(op, ls[i], rs[i])
+		}
+		return values, nil
+
+	case rightScalar:
+		return e.vectorScalar(op, left.(vector), rs, false), nil
+
+	case leftScalar:
+		return e.vectorScalar(op, right.(vector), ls, true), nil
+	}
+
+	lv, rv := left.(vector), right.(vector)
+	rightBySignature := make(map[string]*series, len(rv))
+	for _, s := range rv {
+		sig := signature(s.labels, []string{LabelName}, false)
+		if _, ok := rightBySignature[sig]; ok {
+			return nil, badData("found duplicate series for the match group on the right hand side of the operation, many-to-many matching is not supported")
+		}
+		rightBySignature[sig] = s
+	}
+
+	var result vector
+	for _, l := range lv {
+		r, ok := rightBySignature[signature(l.labels, []string{LabelName}, false)]
+		if !ok {
+			continue
+		}
+
+		labels := l.labels
+		if !comparison {
+			labels = withoutName(l.labels)
+		}
+		s := e.newSeries(labels)
+		for i := range e.steps {
+			if !l.present[i] || !r.present[i] {
+				continue
+			}
+			if comparison {
+				if compare(op, l.values[i], r.values[i]) {
+					s.values[i], s.present[i] = l.values[i], true
+				}
+				continue
+			}
+			s.values[i], s.present[i] = apply(op, l.values[i], r.values[i]), true
+		}
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+// vectorScalar applies a binary operator between every series of a vector and a scalar
+func (e *evaluator) vectorScalar(op string, v vector, sc scalar, scalarLeft bool) vector {
+	comparison := comparisons[op]
+
+	result := make(vector, 0, len(v))
+	for _, in := range v {
+		labels := in.labels
+		if !comparison {
+			labels = withoutName(in.labels)
+		}
+		s := e.newSeries(labels)
+		for i := range e.steps {
+			if !in.present[i] {
+				continue
+			}
+
+			a, b := in.values[i], sc[i]
+			if scalarLeft {
+				a, b = b, a
+			}
+
+			if comparison {
+				if compare(op, a, b) {
+					s.values[i], s.present[i] = in.values[i], true
+				}
+				continue
+			}
+			s.values[i], s.present[i] = apply(op, a, b), true
+		}
+		result = append(result, s)
+	}
+
+	return result
+}
+
+func apply(op string, a float64, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return math.Mod(a, b)
+	case "^":
+		return math.Pow(a, b)
+	}
+	return nan
+}
+
+func compare(op string, a float64, b float64) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
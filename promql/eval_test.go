@@ -0,0 +1,292 @@
+package promql
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Evaluation time of the instant queries
+var evalTime = time.Unix(1700000000, 0).UTC()
+
+// points returns values every 15s, the last one at evalTime
+func points(values ...float64) []Point {
+	out := make([]Point, len(values))
+	last := evalTime.UnixMilli()
+	for i, value := range values {
+		out[i] = Point{Timestamp: last - int64(len(values)-1-i)*15000, Value: value}
+	}
+	return out
+}
+
+func testSeries(name string, labels map[string]string, values ...float64) rawSeries {
+	all := map[string]string{LabelName: name}
+	for label, value := range labels {
+		all[label] = value
+	}
+	return rawSeries{labels: all, points: points(values...)}
+}
+
+// The stored series the tests query
+var testData = map[string][]rawSeries{
+	"load": {
+		testSeries("load", map[string]string{"device": "a", "role": "web"}, 1),
+		testSeries("load", map[string]string{"device": "b", "role": "web"}, 3),
+		testSeries("load", map[string]string{"device": "c", "role": "db"}, 5),
+	},
+	// A counter going up 15 a scrape, reset once
+	"requests": {testSeries("requests", map[string]string{"device": "a"}, 0, 15, 30, 45, 15, 30)},
+	"temp":     {testSeries("temp", map[string]string{"device": "a"}, 9, 1, 2, 3, 4)},
+}
+
+// testEvaluator reads testData instead of the engine, applying the matchers of the selectors
+func testEvaluator() *evaluator {
+	e := &evaluator{}
+	e.source = func(selector *VectorSelector, window time.Duration) ([]rawSeries, error) {
+		var matchers []compiledMatcher
+		for _, matcher := range selector.Matchers {
+			compiled, err := compileMatcher(matcher)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, compiled)
+		}
+
+		var raw []rawSeries
+		for _, r := range testData[selector.Name] {
+			if matchAll(matchers, r.labels) {
+				raw = append(raw, r)
+			}
+		}
+		return raw, nil
+	}
+	return e
+}
+
+// labelString writes labels like {a="1",b="2"}
+func labelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + labels[name] + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func instant(t *testing.T, query string) map[string]float64 {
+	t.Helper()
+
+	result, err := testEvaluator().evaluate(query, evalTime, evalTime, 0)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+
+	values := make(map[string]float64)
+	for _, s := range result.Series {
+		if len(s.Points) != 1 {
+			t.Fatalf("%s: %s has %d points", query, labelString(s.Labels), len(s.Points))
+		}
+		values[labelString(s.Labels)] = s.Points[0].Value
+	}
+	return values
+}
+
+func TestEvalInstant(t *testing.T) {
+	tests := []struct {
+		query string
+		want  map[string]float64
+	}{
+		// Selectors and matchers
+		{`load{device="b"}`, map[string]float64{`{__name__="load",device="b",role="web"}`: 3}},
+		{`load{device=~"a|c"}`, map[string]float64{`{__name__="load",device="a",role="web"}`: 1, `{__name__="load",device="c",role="db"}`: 5}},
+		{`load{device!="a",role!~"d.*"}`, map[string]float64{`{__name__="load",device="b",role="web"}`: 3}},
+		{`load{device="z"}`, map[string]float64{}},
+
+		// Scalars
+		{"1 + 2 * 3", map[string]float64{"{}": 7}},
+		{"2 ^ 3 ^ 2", map[string]float64{"{}": 512}},
+		{"10 % 4 - -1", map[string]float64{"{}": 3}},
+		{"(1 + 2) / 4", map[string]float64{"{}": 0.75}},
+
+		// Vector and scalar operators drop the name, comparisons filter and keep it
+		{`load{device="a"} * 2 + 1`, map[string]float64{`{device="a",role="web"}`: 3}},
+		{`10 - load{role="db"}`, map[string]float64{`{device="c",role="db"}`: 5}},
+		{`-load{device="b"}`, map[string]float64{`{device="b",role="web"}`: -3}},
+		{"load > 2", map[string]float64{`{__name__="load",device="b",role="web"}`: 3, `{__name__="load",device="c",role="db"}`: 5}},
+		{"4 >= load", map[string]float64{`{__name__="load",device="a",role="web"}`: 1, `{__name__="load",device="b",role="web"}`: 3}},
+		{"load == 1", map[string]float64{`{__name__="load",device="a",role="web"}`: 1}},
+
+		// Vectors are matched on their labels without the name
+		{"load - load", map[string]float64{`{device="a",role="web"}`: 0, `{device="b",role="web"}`: 0, `{device="c",role="db"}`: 0}},
+		{`load / temp`, map[string]float64{}},
+		{`load{device="a"} != temp`, map[string]float64{}},
+
+		// Aggregations
+		{"sum(load)", map[string]float64{"{}": 9}},
+		{"avg(load)", map[string]float64{"{}": 3}},
+		{"min(load)", map[string]float64{"{}": 1}},
+		{"max(load)", map[string]float64{"{}": 5}},
+		{"count(load)", map[string]float64{"{}": 3}},
+		{"stddev(load)", map[string]float64{"{}": math.Sqrt(8.0 / 3)}},
+		{"quantile(0.5, load)", map[string]float64{"{}": 3}},
+		{"quantile(0.25, load)", map[string]float64{"{}": 2}},
+		{"sum by (role) (load)", map[string]float64{`{role="web"}`: 4, `{role="db"}`: 5}},
+		{"max(load) by (role)", map[string]float64{`{role="web"}`: 3, `{role="db"}`: 5}},
+		{"sum without (device) (load)", map[string]float64{`{role="web"}`: 4, `{role="db"}`: 5}},
+		{"topk(1, load)", map[string]float64{`{__name__="load",device="c",role="db"}`: 5}},
+		{"bottomk(2, load)", map[string]float64{`{__name__="load",device="a",role="web"}`: 1, `{__name__="load",device="b",role="web"}`: 3}},
+		{"topk by (role) (1, load)", map[string]float64{`{__name__="load",device="b",role="web"}`: 3, `{__name__="load",device="c",role="db"}`: 5}},
+		{"topk(0, load)", map[string]float64{}},
+
+		// Range functions, the window (t-1m, t] holds the last 4 points
+		{"rate(requests[1m])", map[string]float64{`{device="a"}`: 1}},
+		{"increase(requests[1m])", map[string]float64{`{device="a"}`: 60}},
+		{"irate(requests[1m])", map[string]float64{`{device="a"}`: 1}},
+		{"rate(requests[2m])", map[string]float64{`{device="a"}`: 1}},
+		{"delta(temp[1m])", map[string]float64{`{device="a"}`: 60.0 / 45 * 3}},
+		{"avg_over_time(temp[1m])", map[string]float64{`{device="a"}`: 2.5}},
+		{"min_over_time(temp[1m])", map[string]float64{`{device="a"}`: 1}},
+		{"max_over_time(temp[1m])", map[string]float64{`{device="a"}`: 4}},
+		{"max_over_time(temp[2m])", map[string]float64{`{device="a"}`: 9}},
+		{"sum_over_time(temp[1m])", map[string]float64{`{device="a"}`: 10}},
+		{"count_over_time(temp[1m])", map[string]float64{`{device="a"}`: 4}},
+		{"last_over_time(temp[1m])", map[string]float64{`{device="a"}`: 4}},
+		{"stddev_over_time(temp[1m])", map[string]float64{`{device="a"}`: math.Sqrt(1.25)}},
+		{"quantile_over_time(0.5, temp[1m])", map[string]float64{`{device="a"}`: 2.5}},
+		{"rate(requests[10s])", map[string]float64{}},
+
+		// Instant functions
+		{"clamp_max(load, 2)", map[string]float64{`{device="a",role="web"}`: 1, `{device="b",role="web"}`: 2, `{device="c",role="db"}`: 2}},
+		{`clamp_min(load{device="a"}, 2)`, map[string]float64{`{device="a",role="web"}`: 2}},
+		{`abs(-load{device="a"})`, map[string]float64{`{device="a",role="web"}`: 1}},
+		{`sqrt(load{device="a"} * 16)`, map[string]float64{`{device="a",role="web"}`: 4}},
+		{`round(load{device="a"} / 2)`, map[string]float64{`{device="a",role="web"}`: 1}},
+		{`floor(load{device="b"} / 2) + ceil(load{device="b"} / 2)`, map[string]float64{`{device="b",role="web"}`: 3}},
+		{"sum(rate(requests[1m])) * 60", map[string]float64{"{}": 60}},
+	}
+
+	for _, test := range tests {
+		got := instant(t, test.query)
+		if len(got) != len(test.want) {
+			t.Errorf("%s = %v, want %v", test.query, got, test.want)
+			continue
+		}
+		for labels, want := range test.want {
+			if value, ok := got[labels]; !ok || math.Abs(value-want) > 1e-9 {
+				t.Errorf("%s = %v, want %v", test.query, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestEvalRange(t *testing.T) {
+	// Steps every 2m up to 6m after the last point, an instant selector looks back 5m
+	start := evalTime.Add(-2 * time.Minute)
+	result, err := testEvaluator().evaluate(`load{device="a"}`, start, evalTime.Add(6*time.Minute), 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Series) != 1 {
+		t.Fatalf("got %d series, want 1", len(result.Series))
+	}
+
+	var timestamps []int64
+	for _, point := range result.Series[0].Points {
+		timestamps = append(timestamps, (point.Timestamp-evalTime.UnixMilli())/60000)
+	}
+	// Nothing before the point, then up to 5m after it
+	if want := []int64{0, 2, 4}; !equalInts(timestamps, want) {
+		t.Errorf("points at %v minutes after the sample, want %v", timestamps, want)
+	}
+
+	result, err = testEvaluator().evaluate("1 + 1", start, evalTime, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Scalar || len(result.Series[0].Points) != 3 {
+		t.Errorf("scalar range query returned %+v", result)
+	}
+}
+
+func equalInts(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		start time.Time
+		end   time.Time
+		step  time.Duration
+	}{
+		{"load[5m]", evalTime, evalTime, 0},
+		{"rate(load)", evalTime, evalTime, 0},
+		{"abs(load[5m])", evalTime, evalTime, 0},
+		{"sum(load[5m])", evalTime, evalTime, 0},
+		{"topk(load, load)", evalTime, evalTime, 0},
+		{"rate(requests[1m], 1)", evalTime, evalTime, 0},
+		{"load[5m] + 1", evalTime, evalTime, 0},
+		{"1 > 2", evalTime, evalTime, 0},
+		{`load{device=~"("}`, evalTime, evalTime, 0},
+		{"sum by (device) (load) + on load", evalTime, evalTime, 0},
+		{"load", evalTime, evalTime.Add(-time.Second), time.Second},
+		{"load", evalTime, evalTime.Add(time.Minute), 0},
+		{"load", evalTime, evalTime.Add(24 * time.Hour), time.Second},
+	}
+
+	for _, test := range tests {
+		_, err := testEvaluator().evaluate(test.query, test.start, test.end, test.step)
+		var badDataErr *BadDataError
+		if !errors.As(err, &badDataErr) {
+			t.Errorf("%s: got %v, want a BadDataError", test.query, err)
+		}
+	}
+}
+
+func TestCounterIncrease(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{[]float64{5}, 0},
+		{[]float64{5, 10, 12}, 7},
+		// A drop is a reset, the counter restarted from 0
+		{[]float64{5, 10, 2, 4}, 9},
+	}
+
+	for _, test := range tests {
+		if got := counterIncrease(points(test.values...)); got != test.want {
+			t.Errorf("counterIncrease(%v) = %v, want %v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	values := []float64{4, 1, 3, 2}
+	tests := map[float64]float64{0: 1, 0.5: 2.5, 1: 4, 0.9: 3.7}
+	for q, want := range tests {
+		if got := quantile(q, values); math.Abs(got-want) > 1e-9 {
+			t.Errorf("quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+	if !math.IsInf(quantile(-1, values), -1) || !math.IsInf(quantile(2, values), 1) || !math.IsNaN(quantile(0.5, nil)) {
+		t.Error("quantile out of range")
+	}
+}
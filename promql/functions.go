@@ -0,0 +1,266 @@
+package promql
+
+import (
+	"math"
+	"sort"
+)
+
+// A function either evaluates a range vector over the window ending at every step, or maps an instant vector
+type function struct {
+	// Scalar arguments before the vector, as in quantile_over_time(0.9, m[5m])
+	scalars  int
+	overTime func(points []Point, window float64, params []float64) (float64, bool)
+	instant  func(value float64, params []float64) float64
+	// Scalar arguments after the vector, as in clamp_min(m, 0)
+	trailing int
+}
+
+var functions = map[string]function{
+	"rate":               {overTime: rate},
+	"increase":           {overTime: increase},
+	"irate":              {overTime: irate},
+	"delta":              {overTime: delta},
+	"avg_over_time":      {overTime: avgOverTime},
+	"min_over_time":      {overTime: minOverTime},
+	"max_over_time":      {overTime: maxOverTime},
+	"sum_over_time":      {overTime: sumOverTime},
+	"count_over_time":    {overTime: countOverTime},
+	"last_over_time":     {overTime: lastOverTime},
+	"stddev_over_time":   {overTime: stddevOverTime},
+	"quantile_over_time": {scalars: 1, overTime: quantileOverTime},
+
+	"abs":       {instant: func(v float64, _ []float64) float64 { return math.Abs(v) }},
+	"ceil":      {instant: func(v float64, _ []float64) float64 { return math.Ceil(v) }},
+	"floor":     {instant: func(v float64, _ []float64) float64 { return math.Floor(v) }},
+	"round":     {instant: func(v float64, _ []float64) float64 { return math.Floor(v + 0.5) }},
+	"sqrt":      {instant: func(v float64, _ []float64) float64 { return math.Sqrt(v) }},
+	"clamp_min": {trailing: 1, instant: func(v float64, p []float64) float64 { return math.Max(v, p[0]) }},
+	"clamp_max": {trailing: 1, instant: func(v float64, p []float64) float64 { return math.Min(v, p[0]) }},
+}
+
+// call evaluates a function call
+func (e *evaluator) call(call *Call) (interface{}, error) {
+	f := functions[call.Function]
+	if len(call.Args) != f.scalars+1+f.trailing {
+		return nil, badData("expected %d arguments for %s(), got %d", f.scalars+1+f.trailing, call.Function, len(call.Args))
+	}
+
+	params := make([]scalar, 0, f.scalars+f.trailing)
+	var vectorArg interface{}
+	for i, arg := range call.Args {
+		value, err := e.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == f.scalars {
+			vectorArg = value
+			continue
+		}
+
+		s, ok := value.(scalar)
+		if !ok {
+			return nil, badData("expected a scalar as argument %d of %s()", i+1, call.Function)
+		}
+		params = append(params, s)
+	}
+
+	stepParams := func(i int) []float64 {
+		values := make([]float64, len(params))
+		for j, p := range params {
+			values[j] = p[i]
+		}
+		return values
+	}
+
+	if f.overTime != nil {
+		rv, ok := vectorArg.(rangeVector)
+		if !ok {
+			return nil, badData("expected a range vector as argument of %s(), as in %s(metric[5m])", call.Function, call.Function)
+		}
+
+		window := rv.window.Milliseconds()
+		result := make(vector, 0, len(rv.series))
+		for _, r := range rv.series {
+			s := e.newSeries(withoutName(r.labels))
+
+			// The points of the window (t - range, t], both ends only move forward
+			from, to := 0, 0
+			for i, t := range e.steps {
+				for to < len(r.points) && r.points[to].Timestamp <= t {
+					to++
+				}
+				for from < to && r.points[from].Timestamp <= t-window {
+					from++
+				}
+				if from == to {
+					continue
+				}
+
+				s.values[i], s.present[i] = f.overTime(r.points[from:to], rv.window.Seconds(), stepParams(i))
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	}
+
+	v, ok := vectorArg.(vector)
+	if !ok {
+		return nil, badData("expected an instant vector as argument of %s()", call.Function)
+	}
+
+	result := make(vector, 0, len(v))
+	for _, in := range v {
+		s := e.newSeries(withoutName(in.labels))
+		for i := range e.steps {
+			if in.present[i] {
+				s.values[i], s.present[i] = f.instant(in.values[i], stepParams(i)), true
+			}
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// counterIncrease returns how much a counter went up over the points, a drop being a reset to 0
+func counterIncrease(points []Point) float64 {
+	var total float64
+	for i := 1; i < len(points); i++ {
+		if points[i].Value < points[i-1].Value {
+			total += points[i].Value
+		} else {
+			total += points[i].Value - points[i-1].Value
+		}
+	}
+	return total
+}
+
+// rate is the per second increase between the first and the last point of the window
+func rate(points []Point, _ float64, _ []float64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	seconds := float64(points[len(points)-1].Timestamp-points[0].Timestamp) / 1000
+	return counterIncrease(points) / seconds, true
+}
+
+// increase extrapolates the rate to the whole window
+func increase(points []Point, window float64, params []float64) (float64, bool) {
+	perSecond, ok := rate(points, window, params)
+	return perSecond * window, ok
+}
+
+// irate is the per second increase between the last two points
+func irate(points []Point, window float64, params []float64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	return rate(points[len(points)-2:], window, params)
+}
+
+// delta is the difference between the last and the first point of a gauge, extrapolated to the whole window
+func delta(points []Point, window float64, _ []float64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+	seconds := float64(last.Timestamp-first.Timestamp) / 1000
+	return (last.Value - first.Value) / seconds * window, true
+}
+
+func avgOverTime(points []Point, window float64, params []float64) (float64, bool) {
+	sum, _ := sumOverTime(points, window, params)
+	return sum / float64(len(points)), true
+}
+
+func minOverTime(points []Point, _ float64, _ []float64) (float64, bool) {
+	value := points[0].Value
+	for _, p := range points[1:] {
+		if p.Value < value || math.IsNaN(value) {
+			value = p.Value
+		}
+	}
+	return value, true
+}
+
+func maxOverTime(points []Point, _ float64, _ []float64) (float64, bool) {
+	value := points[0].Value
+	for _, p := range points[1:] {
+		if p.Value > value || math.IsNaN(value) {
+			value = p.Value
+		}
+	}
+	return value, true
+}
+
+func sumOverTime(points []Point, _ float64, _ []float64) (float64, bool) {
+	var sum float64
+	for _, p := range points {
+		sum += p.Value
+	}
+	return sum, true
+}
+
+func countOverTime(points []Point, _ float64, _ []float64) (float64, bool) {
+	return float64(len(points)), true
+}
+
+func lastOverTime(points []Point, _ float64, _ []float64) (float64, bool) {
+	return points[len(points)-1].Value, true
+}
+
+func stddevOverTime(points []Point, _ float64, _ []float64) (float64, bool) {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	return stddev(values), true
+}
+
+func quantileOverTime(points []Point, _ float64, params []float64) (float64, bool) {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	return quantile(params[0], values), true
+}
+
+// stddev is the population standard deviation
+func stddev(values []float64) float64 {
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance / float64(len(values)))
+}
+
+// quantile interpolates linearly between the closest ranks, as Prometheus does
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 || math.IsNaN(q) {
+		return nan
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return inf
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := q * float64(len(sorted)-1)
+	lower := math.Floor(rank)
+	upper := math.Min(lower+1, float64(len(sorted)-1))
+	weight := rank - lower
+
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
@@ -0,0 +1,67 @@
+package promql
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Sample is the latest point of a series
+type Sample struct {
+	Labels map[string]string
+	Point
+}
+
+// Family holds the latest samples of a metric
+type Family struct {
+	Metric
+	Samples []Sample
+}
+
+// Latest returns the latest sample of every series taken within the lookback delta before at. Processes are
+// limited to the top ones of every device, ranked by their peak over the lookback delta.
+func Latest(db *sql.DB, tenantID string, at time.Time, top int) ([]Family, error) {
+	var families []Family
+	for _, m := range Metrics() {
+		request := engine.Request{
+			TenantID:  tenantID,
+			Metric:    m.engineMetric,
+			GroupBy:   m.groupBy,
+			TimeStart: at.UTC().Add(-LookbackDelta).Format(helpers.TimestampLayout),
+			TimeEnd:   at.UTC().Format(helpers.TimestampLayout),
+		}
+		if m.groupBy == engine.GroupByInstance {
+			request.Rank = engine.Ranking{Function: engine.RankMax, Limit: top}
+		}
+
+		result, err := engine.Execute(db, request)
+		if errors.Is(err, engine.ErrNoDevices) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := rawFromResult(m, result, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		family := Family{Metric: m}
+		for _, r := range raw {
+			if len(r.points) > 0 {
+				family.Samples = append(family.Samples, Sample{Labels: r.labels, Point: r.points[len(r.points)-1]})
+			}
+		}
+		sort.Slice(family.Samples, func(i, j int) bool {
+			return signature(family.Samples[i].Labels, nil, false) < signature(family.Samples[j].Labels, nil, false)
+		})
+
+		families = append(families, family)
+	}
+
+	return families, nil
+}
@@ -0,0 +1,121 @@
+package promql
+
+import (
+	"cloudVigilante/backend/engine"
+	"sort"
+)
+
+// Metric types of the Prometheus exposition format
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+// Metric is a metric as exposed under its Prometheus name
+type Metric struct {
+	Name string
+	Help string
+	Type string
+	// Query engine metric and grouping the series are read with
+	engineMetric string
+	groupBy      string
+	// Prometheus label -> query engine label
+	labels map[string]string
+}
+
+// Labels of every series, filled in from the device the series belongs to
+const (
+	LabelName     = "__name__"
+	LabelDevice   = "device"
+	LabelDeviceID = "device_id"
+)
+
+// Process labels, the volatile ones like the state are left out so a process keeps a single series
+var processLabels = map[string]string{
+	"pid":              "pid",
+	"process":          "name",
+	"command":          "command",
+	"process_instance": "instance",
+	"workload":         "workload",
+	"user":             "user",
+}
+
+var diskLabels = map[string]string{
+	"mount":       "mount",
+	"file_system": "file_system",
+	"fs_type":     "fs_type",
+}
+
+func hostMetric(name string, engineMetric string, help string) Metric {
+	return Metric{Name: name, Help: help, Type: TypeGauge, engineMetric: engineMetric, groupBy: engine.GroupByDevice, labels: map[string]string{}}
+}
+
+func processMetric(name string, engineMetric string, metricType string, help string) Metric {
+	return Metric{Name: name, Help: help, Type: metricType, engineMetric: engineMetric, groupBy: engine.GroupByInstance, labels: processLabels}
+}
+
+func diskMetric(name string, engineMetric string, help string) Metric {
+	return Metric{Name: name, Help: help, Type: TypeGauge, engineMetric: engineMetric, groupBy: engine.GroupByMount, labels: diskLabels}
+}
+
+// Metrics by Prometheus name
+var metrics = map[string]Metric{}
+
+func init() {
+	for _, m := range []Metric{
+		hostMetric("host_cpu_usage_percent", "host_cpu", "CPU usage of the device in percent."),
+		hostMetric("host_memory_used_bytes", "host_ram", "Memory used on the device in bytes."),
+		hostMetric("host_disk_used_bytes", "host_disk", "Disk space used on the device in bytes."),
+		hostMetric("host_load1", "load1", "Load average of the device over 1 minute."),
+		hostMetric("host_load5", "load5", "Load average of the device over 5 minutes."),
+		hostMetric("host_load15", "load15", "Load average of the device over 15 minutes."),
+		hostMetric("host_cpu_user_percent", "cpu_user", "CPU time spent in user mode in percent."),
+		hostMetric("host_cpu_system_percent", "cpu_system", "CPU time spent in kernel mode in percent."),
+		hostMetric("host_cpu_iowait_percent", "cpu_iowait", "CPU time spent waiting for I/O in percent."),
+		hostMetric("host_cpu_steal_percent", "cpu_steal", "CPU time stolen by the hypervisor in percent."),
+
+		processMetric("process_cpu_usage_percent", "cpu", TypeGauge, "CPU usage of the process in percent."),
+		processMetric("process_memory_bytes", "ram", TypeGauge, "Memory used by the process in bytes."),
+		processMetric("process_threads", "threads", TypeGauge, "Threads of the process."),
+		processMetric("process_open_fds", "open_fds", TypeGauge, "File descriptors opened by the process."),
+		processMetric("process_read_bytes_total", "read_bytes", TypeCounter, "Bytes read by the process."),
+		processMetric("process_write_bytes_total", "write_bytes", TypeCounter, "Bytes written by the process."),
+
+		diskMetric("disk_used_bytes", "disk", "Space used on the file system in bytes."),
+		diskMetric("disk_used_percent", "disk_used_percent", "Space used on the file system in percent."),
+		diskMetric("disk_inodes_used", "disk_inodes_used", "Inodes used on the file system."),
+		diskMetric("disk_read_iops", "disk_read_iops", "Read operations per second on the file system."),
+		diskMetric("disk_write_iops", "disk_write_iops", "Write operations per second on the file system."),
+	} {
+		metrics[m.Name] = m
+	}
+}
+
+// Metrics returns the metrics that can be queried, by name
+func Metrics() []Metric {
+	list := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// LabelNames returns the labels series can carry, across all metrics
+func LabelNames() []string {
+	names := map[string]bool{LabelName: true, LabelDevice: true, LabelDeviceID: true}
+	for _, m := range metrics {
+		for label := range m.labels {
+			names[label] = true
+		}
+	}
+
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+
+	return list
+}
@@ -0,0 +1,583 @@
+// Package promql evaluates a subset of PromQL on the stored host, process and disk metrics, so the
+// Prometheus data source of Grafana can graph them. Supported are vector and range selectors with label
+// matchers, arithmetic, the usual aggregations with by/without, topk/bottomk and the rate and *_over_time
+// functions.
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Node is a parsed expression
+type Node interface{}
+
+type NumberLiteral struct {
+	Value float64
+}
+
+type Matcher struct {
+	Label string
+	Op    string
+	Value string
+}
+
+// VectorSelector selects series by name and labels, Range is set for range selectors
+type VectorSelector struct {
+	Name     string
+	Matchers []Matcher
+	Range    time.Duration
+}
+
+type Call struct {
+	Function string
+	Args     []Node
+}
+
+type Aggregate struct {
+	Op       string
+	Param    Node
+	Expr     Node
+	Grouping []string
+	Without  bool
+}
+
+type Binary struct {
+	Op    string
+	Left  Node
+	Right Node
+}
+
+type Unary struct {
+	Expr Node
+}
+
+// Aggregation operators, the ones taking a parameter first
+var aggregations = map[string]bool{
+	"sum": false, "avg": false, "min": false, "max": false, "count": false, "stddev": false,
+	"topk": true, "bottomk": true, "quantile": true,
+}
+
+type token struct {
+	kind  string
+	value string
+	pos   int
+}
+
+const (
+	tokenEOF        = "EOF"
+	tokenIdentifier = "identifier"
+	tokenNumber     = "number"
+	tokenString     = "string"
+	tokenDuration   = "duration"
+	tokenPunct      = "punctuation"
+)
+
+// lex splits a query in tokens, the content of [ ] is read as a duration
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(input); {
+		c := rune(input[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+
+		case c == '[':
+			end := strings.IndexByte(input[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed range at position %d", i)
+			}
+			tokens = append(tokens, token{tokenDuration, strings.TrimSpace(input[i+1 : i+end]), i})
+			i += end + 1
+
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			var value strings.Builder
+			for ; j < len(input) && rune(input[j]) != c; j++ {
+				if input[j] == '\\' && c != '`' && j+1 < len(input) {
+					j++
+					switch input[j] {
+					case 'n':
+						value.WriteByte('\n')
+					case 't':
+						value.WriteByte('\t')
+					default:
+						value.WriteByte(input[j])
+					}
+					continue
+				}
+				value.WriteByte(input[j])
+			}
+			if j >= len(input) {
+				return nil, fmt.Errorf("unclosed string at position %d", i)
+			}
+			tokens = append(tokens, token{tokenString, value.String(), i})
+			i = j + 1
+
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(input) && unicode.IsDigit(rune(input[i+1]))):
+			j := i
+			for j < len(input) && (unicode.IsDigit(rune(input[j])) || input[j] == '.' || input[j] == 'e' || input[j] == 'E' ||
+				((input[j] == '+' || input[j] == '-') && (input[j-1] == 'e' || input[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, input[i:j], i})
+			i = j
+
+		case unicode.IsLetter(c) || c == '_' || c == ':':
+			j := i
+			for j < len(input) && (unicode.IsLetter(rune(input[j])) || unicode.IsDigit(rune(input[j])) || input[j] == '_' || input[j] == ':') {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdentifier, input[i:j], i})
+			i = j
+
+		default:
+			// Two character operators first
+			if i+1 < len(input) {
+				switch input[i : i+2] {
+				case "!=", "=~", "!~", "==", ">=", "<=":
+					tokens = append(tokens, token{tokenPunct, input[i : i+2], i})
+					i += 2
+					continue
+				}
+			}
+
+			if !strings.ContainsRune("{}(),=+-*/%^<>", c) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{tokenPunct, string(c), i})
+			i++
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(input)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a PromQL expression
+func Parse(input string) (Node, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", next.value, next.pos)
+	}
+
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(value string) bool {
+	if t := p.peek(); t.kind == tokenPunct && t.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(value string) error {
+	if !p.accept(value) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at position %d, found %q", value, t.pos, t.value)
+	}
+	return nil
+}
+
+// Comparison operators, they filter out the samples for which the comparison is false
+var comparisons = map[string]bool{"==": true, "!=": true, ">": true, "<": true, ">=": true, "<=": true}
+
+// expression parses comparisons, the lowest precedence
+func (p *parser) expression() (Node, error) {
+	left, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenPunct || !comparisons[t.value] {
+			return left, nil
+		}
+		p.next()
+
+		if next := p.peek(); next.kind == tokenIdentifier && next.value == "bool" {
+			return nil, fmt.Errorf("the bool modifier is not supported")
+		}
+
+		right, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: t.value, Left: left, Right: right}
+	}
+}
+
+// sum parses additions and subtractions
+func (p *parser) sum() (Node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenPunct || (t.value != "+" && t.value != "-") {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: t.value, Left: left, Right: right}
+	}
+}
+
+// term parses multiplications, divisions and modulos
+func (p *parser) term() (Node, error) {
+	left, err := p.power()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenPunct || (t.value != "*" && t.value != "/" && t.value != "%") {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.power()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: t.value, Left: left, Right: right}
+	}
+}
+
+// power parses exponentiation, which is right associative
+func (p *parser) power() (Node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.accept("^") {
+		right, err := p.power()
+		if err != nil {
+			return nil, err
+		}
+		return &Binary{Op: "^", Left: left, Right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) unary() (Node, error) {
+	if p.accept("-") {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Expr: expr}, nil
+	}
+
+	if p.accept("+") {
+		return p.unary()
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (Node, error) {
+	t := p.peek()
+
+	switch {
+	case t.kind == tokenNumber:
+		p.next()
+		value, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.value, t.pos)
+		}
+		return &NumberLiteral{Value: value}, nil
+
+	case t.kind == tokenPunct && t.value == "(":
+		p.next()
+		expr, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+
+	case t.kind == tokenPunct && t.value == "{":
+		return p.selector("")
+
+	case t.kind == tokenIdentifier:
+		p.next()
+
+		if t.value == "offset" {
+			return nil, fmt.Errorf("offset is not supported")
+		}
+
+		if _, ok := aggregations[t.value]; ok {
+			if next := p.peek(); next.kind == tokenPunct && next.value == "(" || next.kind == tokenIdentifier && (next.value == "by" || next.value == "without") {
+				return p.aggregate(t.value)
+			}
+		}
+
+		if next := p.peek(); next.kind == tokenPunct && next.value == "(" {
+			return p.call(t.value)
+		}
+
+		// Inf and NaN are numbers, not metrics
+		switch strings.ToLower(t.value) {
+		case "inf":
+			return &NumberLiteral{Value: inf}, nil
+		case "nan":
+			return &NumberLiteral{Value: nan}, nil
+		}
+
+		return p.selector(t.value)
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+}
+
+// selector parses the optional matchers and range following a metric name
+func (p *parser) selector(name string) (Node, error) {
+	selector := &VectorSelector{Name: name}
+
+	if p.accept("{") {
+		for !p.accept("}") {
+			label := p.next()
+			if label.kind != tokenIdentifier {
+				return nil, fmt.Errorf("expected label name at position %d, found %q", label.pos, label.value)
+			}
+
+			op := p.next()
+			if op.kind != tokenPunct || (op.value != "=" && op.value != "!=" && op.value != "=~" && op.value != "!~") {
+				return nil, fmt.Errorf("expected label matcher at position %d, found %q", op.pos, op.value)
+			}
+
+			value := p.next()
+			if value.kind != tokenString {
+				return nil, fmt.Errorf("expected label value at position %d, found %q", value.pos, value.value)
+			}
+
+			if label.value == "__name__" && op.value == "=" {
+				selector.Name = value.value
+			} else {
+				selector.Matchers = append(selector.Matchers, Matcher{Label: label.value, Op: op.value, Value: value.value})
+			}
+
+			if !p.accept(",") {
+				if err := p.expect("}"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
+	if selector.Name == "" {
+		return nil, fmt.Errorf("a selector needs a metric name")
+	}
+
+	if t := p.peek(); t.kind == tokenDuration {
+		p.next()
+		duration, err := ParseDuration(t.value)
+		if err != nil {
+			return nil, err
+		}
+		selector.Range = duration
+	}
+
+	if t := p.peek(); t.kind == tokenIdentifier && t.value == "offset" {
+		return nil, fmt.Errorf("offset is not supported")
+	}
+
+	return selector, nil
+}
+
+// labelList parses ( label, ... )
+func (p *parser) labelList() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	for !p.accept(")") {
+		label := p.next()
+		if label.kind != tokenIdentifier {
+			return nil, fmt.Errorf("expected label name at position %d, found %q", label.pos, label.value)
+		}
+		labels = append(labels, label.value)
+
+		if !p.accept(",") {
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	return labels, nil
+}
+
+// aggregate parses an aggregation, its by/without clause can come before or after the arguments
+func (p *parser) aggregate(op string) (Node, error) {
+	aggregate := &Aggregate{Op: op}
+
+	grouping := func() error {
+		t := p.peek()
+		if t.kind != tokenIdentifier || (t.value != "by" && t.value != "without") {
+			return nil
+		}
+		p.next()
+
+		labels, err := p.labelList()
+		if err != nil {
+			return err
+		}
+		aggregate.Grouping = labels
+		aggregate.Without = t.value == "without"
+		return nil
+	}
+
+	if err := grouping(); err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	if aggregations[op] {
+		param, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		aggregate.Param = param
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	aggregate.Expr = expr
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return aggregate, grouping()
+}
+
+func (p *parser) call(function string) (Node, error) {
+	if _, ok := functions[function]; !ok {
+		return nil, fmt.Errorf("unknown function: %s", function)
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	call := &Call{Function: function}
+	for !p.accept(")") {
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		if !p.accept(",") {
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	return call, nil
+}
+
+// Units of PromQL durations
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// ParseDuration parses a PromQL duration such as 5m or 1h30m
+func ParseDuration(value string) (time.Duration, error) {
+	var total time.Duration
+	rest := value
+
+	for rest != "" {
+		i := 0
+		for i < len(rest) && unicode.IsDigit(rune(rest[i])) {
+			i++
+		}
+		j := i
+		for j < len(rest) && unicode.IsLetter(rune(rest[j])) {
+			j++
+		}
+
+		amount, err := strconv.Atoi(rest[:i])
+		unit, ok := durationUnits[rest[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+
+		total += time.Duration(amount) * unit
+		rest = rest[j:]
+	}
+
+	if total <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+
+	return total, nil
+}
@@ -0,0 +1,107 @@
+package promql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Node
+	}{
+		{"42", &NumberLiteral{Value: 42}},
+		{"1.5e3", &NumberLiteral{Value: 1500}},
+		{"up", &VectorSelector{Name: "up"}},
+		{`{__name__="up", job="node"}`, &VectorSelector{Name: "up", Matchers: []Matcher{{"job", "=", "node"}}}},
+		{
+			`cpu{device!="a",process=~"ng.*", command!~'x\'y'}[5m]`,
+			&VectorSelector{Name: "cpu", Range: 5 * time.Minute, Matchers: []Matcher{
+				{"device", "!=", "a"}, {"process", "=~", "ng.*"}, {"command", "!~", "x'y"},
+			}},
+		},
+		// * binds tighter than +, comparisons are the loosest
+		{"1 + 2 * 3 > 4", &Binary{Op: ">",
+			Left:  &Binary{Op: "+", Left: &NumberLiteral{Value: 1}, Right: &Binary{Op: "*", Left: &NumberLiteral{Value: 2}, Right: &NumberLiteral{Value: 3}}},
+			Right: &NumberLiteral{Value: 4},
+		}},
+		// ^ is right associative
+		{"2 ^ 3 ^ 2", &Binary{Op: "^", Left: &NumberLiteral{Value: 2}, Right: &Binary{Op: "^", Left: &NumberLiteral{Value: 3}, Right: &NumberLiteral{Value: 2}}}},
+		{"(1 - 2) % 3", &Binary{Op: "%", Left: &Binary{Op: "-", Left: &NumberLiteral{Value: 1}, Right: &NumberLiteral{Value: 2}}, Right: &NumberLiteral{Value: 3}}},
+		{"-up", &Unary{Expr: &VectorSelector{Name: "up"}}},
+		{
+			`sum by (device) (rate(cpu[1m]))`,
+			&Aggregate{Op: "sum", Grouping: []string{"device"}, Expr: &Call{Function: "rate", Args: []Node{&VectorSelector{Name: "cpu", Range: time.Minute}}}},
+		},
+		{"avg(up) without (job, device)", &Aggregate{Op: "avg", Grouping: []string{"job", "device"}, Without: true, Expr: &VectorSelector{Name: "up"}}},
+		{"topk(3, cpu)", &Aggregate{Op: "topk", Param: &NumberLiteral{Value: 3}, Expr: &VectorSelector{Name: "cpu"}}},
+		{
+			"quantile_over_time(0.9, cpu[1h30m])",
+			&Call{Function: "quantile_over_time", Args: []Node{&NumberLiteral{Value: 0.9}, &VectorSelector{Name: "cpu", Range: 90 * time.Minute}}},
+		},
+		// Aggregation names are metrics when not followed by ( or by/without
+		{"count + 1", &Binary{Op: "+", Left: &VectorSelector{Name: "count"}, Right: &NumberLiteral{Value: 1}}},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	queries := []string{
+		"",
+		"up offset 5m",
+		"up{job=\"node\"",
+		"up{job=node}",
+		"up{job~\"node\"}",
+		`{job="node"}`,
+		"up[5m",
+		"up[5x]",
+		"unknown_function(up)",
+		"rate(up[5m]",
+		"1 > bool 2",
+		"sum(up) by job",
+		"topk(up)",
+		"up @ 5",
+		`"unclosed`,
+		"1 +",
+	}
+
+	for _, query := range queries {
+		if node, err := Parse(query); err == nil {
+			t.Errorf("Parse(%q) = %#v, want an error", query, node)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30s":   30 * time.Second,
+		"5m":    5 * time.Minute,
+		"1h30m": 90 * time.Minute,
+		"1d":    24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"1y":    365 * 24 * time.Hour,
+		"500ms": 500 * time.Millisecond,
+	}
+	for value, want := range tests {
+		if got, err := ParseDuration(value); err != nil || got != want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "0s", "5", "m", "5x", "-5m", "1.5h"} {
+		if got, err := ParseDuration(value); err == nil {
+			t.Errorf("ParseDuration(%q) = %v, want an error", value, got)
+		}
+	}
+}
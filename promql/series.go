@@ -0,0 +1,51 @@
+package promql
+
+import (
+	"database/sql"
+	"time"
+)
+
+// FindSeries returns the label sets of the series matching any of the selectors between start and end
+func FindSeries(db *sql.DB, tenantID string, selectors []string, start time.Time, end time.Time) ([]map[string]string, error) {
+	e := &evaluator{db: db, tenantID: tenantID, start: start.UTC(), end: end.UTC()}
+
+	seen := make(map[string]bool)
+	var found []map[string]string
+	for _, query := range selectors {
+		node, err := Parse(query)
+		if err != nil {
+			return nil, badData("%v", err)
+		}
+
+		selector, ok := node.(*VectorSelector)
+		if !ok || selector.Range > 0 {
+			return nil, badData("expected a series selector, got %s", query)
+		}
+
+		raw, err := e.fetch(selector, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range raw {
+			key := signature(r.labels, nil, false)
+			if !seen[key] {
+				seen[key] = true
+				found = append(found, r.labels)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// MetricsWithLabel returns the names of the metrics whose series can carry a label
+func MetricsWithLabel(label string) []string {
+	var names []string
+	for _, m := range Metrics() {
+		if _, ok := m.labels[label]; ok || label == LabelName || label == LabelDevice || label == LabelDeviceID {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
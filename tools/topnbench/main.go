@@ -0,0 +1,274 @@
+// Command topnbench loads a synthetic dataset into a tenant db and times the top process queries on it.
+//
+// It compares the former ranking, one GROUP BY query per device, with the single window function query
+// of the query engine, and prints the plan MySQL picks for the latter.
+//
+//	go run ./tools/topnbench -devices 50 -processes 40 -samples 1500
+//
+// loads 3 million process samples. Use -skip-load to rerun the timings on an already loaded tenant.
+package main
+
+import (
+	"cloudVigilante/backend/engine"
+	"cloudVigilante/backend/handlers/helpers"
+	"cloudVigilante/backend/models"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// Rows per multi row INSERT when loading
+const insertBatchSize = 1000
+
+func main() {
+	tenantID := flag.String("tenant", "topnbench", "tenant the synthetic data is loaded into")
+	devices := flag.Int("devices", 50, "number of devices")
+	processes := flag.Int("processes", 40, "processes per device")
+	samples := flag.Int("samples", 1500, "host samples per device")
+	interval := flag.Duration("interval", 10*time.Second, "time between two samples of a device")
+	top := flag.Int("top", 10, "processes ranked per device")
+	runs := flag.Int("runs", 5, "timed runs per query")
+	skipLoad := flag.Bool("skip-load", false, "time the queries on the data already loaded")
+	flag.Parse()
+
+	db, err := models.ConnectToDB()
+	if err != nil {
+		log.Fatalf("Error connecting to db: %v", err)
+	}
+	defer db.Close()
+
+	if err := models.CreatePerformanceDB(db, *tenantID); err != nil {
+		log.Fatalf("Error creating tenant db: %v", err)
+	}
+
+	dbName := fmt.Sprintf("Performance_%s", *tenantID)
+	end := time.Now().UTC().Truncate(time.Second)
+	start := end.Add(-time.Duration(*samples) * *interval)
+
+	if !*skipLoad {
+		loadStart := time.Now()
+		rows, err := load(db, dbName, *devices, *processes, *samples, start, *interval)
+		if err != nil {
+			log.Fatalf("Error loading synthetic data: %v", err)
+		}
+		log.Printf("Loaded %d process samples in %s", rows, time.Since(loadStart).Round(time.Millisecond))
+
+		if _, err := db.Exec(fmt.Sprintf("ANALYZE TABLE `%s`.PerformanceMetrics, `%s`.ProcessMetrics", dbName, dbName)); err != nil {
+			log.Fatalf("Error analyzing tables: %v", err)
+		}
+	}
+
+	deviceIDs := make([]string, *devices)
+	for i := range deviceIDs {
+		deviceIDs[i] = deviceID(i)
+	}
+
+	// Rank over the most recent half of the data, like a dashboard would
+	timeStart := end.Add(-time.Duration(*samples/2) * *interval).Format(helpers.TimestampLayout)
+	timeEnd := end.Format(helpers.TimestampLayout)
+
+	benchmarks := []struct {
+		name string
+		run  func() error
+	}{
+		{"per device queries, by pid", func() error {
+			return perDeviceTopPIDs(db, dbName, deviceIDs, timeStart, timeEnd, *top)
+		}},
+		{"single query, by pid", func() error {
+			return rankCPU(db, *tenantID, deviceIDs, timeStart, timeEnd, engine.GroupByPID, *top)
+		}},
+		{"single query, by instance", func() error {
+			return rankCPU(db, *tenantID, deviceIDs, timeStart, timeEnd, engine.GroupByInstance, *top)
+		}},
+		{"single query, by workload", func() error {
+			return rankCPU(db, *tenantID, deviceIDs, timeStart, timeEnd, engine.GroupByWorkload, *top)
+		}},
+	}
+
+	fmt.Printf("%-30s %12s %12s %12s\n", "query", "min", "median", "max")
+	for _, benchmark := range benchmarks {
+		durations := make([]time.Duration, 0, *runs)
+		for i := 0; i < *runs; i++ {
+			runStart := time.Now()
+			if err := benchmark.run(); err != nil {
+				log.Fatalf("Error running %s: %v", benchmark.name, err)
+			}
+			durations = append(durations, time.Since(runStart))
+		}
+
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		fmt.Printf("%-30s %12s %12s %12s\n", benchmark.name, durations[0].Round(time.Microsecond),
+			durations[len(durations)/2].Round(time.Microsecond), durations[len(durations)-1].Round(time.Microsecond))
+	}
+
+	if err := explain(db, dbName, deviceIDs, timeStart, timeEnd, *top); err != nil {
+		log.Fatalf("Error explaining the top process query: %v", err)
+	}
+}
+
+// rankCPU ranks the processes of every device the way the query endpoints do, from the raw samples
+func rankCPU(db *sql.DB, tenantID string, deviceIDs []string, timeStart string, timeEnd string, groupBy string, top int) error {
+	_, err := engine.Rank(db, engine.Request{
+		TenantID:  tenantID,
+		Metric:    "cpu",
+		TimeStart: timeStart,
+		TimeEnd:   timeEnd,
+		GroupBy:   groupBy,
+		Rank:      engine.Ranking{Function: engine.RankSum, Limit: top},
+	}, deviceIDs, 0)
+	return err
+}
+
+func deviceID(i int) string {
+	return fmt.Sprintf("bench-device-%04d", i)
+}
+
+// load inserts the devices, their host samples and the samples of their processes
+func load(db *sql.DB, dbName string, devices int, processes int, samples int, start time.Time, interval time.Duration) (int64, error) {
+	random := rand.New(rand.NewSource(1))
+	var loaded int64
+
+	for d := 0; d < devices; d++ {
+		device := deviceID(d)
+		if _, err := db.Exec(fmt.Sprintf("INSERT IGNORE INTO `%s`.Devices (device_id, device_hostname) VALUES (?, ?)", dbName), device, device); err != nil {
+			return loaded, err
+		}
+
+		// Every device runs the same kind of processes with its own PIDs, a few of them busy
+		weights := make([]float64, processes)
+		for p := range weights {
+			weights[p] = random.ExpFloat64()
+		}
+
+		var hostRows, processRows []string
+		var hostArgs, processArgs []interface{}
+
+		flush := func() error {
+			if len(hostRows) == 0 {
+				return nil
+			}
+
+			result, err := db.Exec(fmt.Sprintf("INSERT INTO `%s`.PerformanceMetrics (device_id, timestamp, cpu_usage, ram_usage, disk_usage) VALUES %s",
+				dbName, strings.Join(hostRows, ", ")), hostArgs...)
+			if err != nil {
+				return err
+			}
+
+			// A multi row INSERT hands out consecutive IDs starting at the returned one
+			firstID, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < len(processArgs); i += 8 {
+				processArgs[i] = firstID + processArgs[i].(int64)
+			}
+
+			for i := 0; i < len(processRows); i += insertBatchSize {
+				j := i + insertBatchSize
+				if j > len(processRows) {
+					j = len(processRows)
+				}
+
+				_, err := db.Exec(fmt.Sprintf(`INSERT INTO `+"`%s`"+`.ProcessMetrics (metric_id, timestamp, process_pid, process_cpu_usage, process_ram_usage,
+                    process_instance, workload_key, process_state) VALUES %s`, dbName, strings.Join(processRows[i:j], ", ")), processArgs[i*8:j*8]...)
+				if err != nil {
+					return err
+				}
+			}
+
+			loaded += int64(len(processRows))
+			hostRows, processRows, hostArgs, processArgs = nil, nil, nil, nil
+			return nil
+		}
+
+		for s := 0; s < samples; s++ {
+			timestamp := start.Add(time.Duration(s) * interval).Format(helpers.TimestampLayout)
+			offset := int64(len(hostRows))
+
+			hostRows = append(hostRows, "(?, ?, ?, ?, ?)")
+			hostArgs = append(hostArgs, device, timestamp, random.Float64()*100, random.Int63n(16<<30), random.Int63n(500<<30))
+
+			for p := 0; p < processes; p++ {
+				pid := 1000 + d*processes + p
+				name := fmt.Sprintf("worker-%d", p)
+				processRows = append(processRows, "(?, ?, ?, ?, ?, ?, ?, ?)")
+				processArgs = append(processArgs, offset, timestamp, pid, weights[p]*random.Float64()*10, random.Int63n(1<<30),
+					models.ProcessInstanceKey(device, pid, nil, name), models.WorkloadKey(name, "/usr/bin/"+name), "R")
+			}
+
+			if len(hostRows) == insertBatchSize/processes+1 {
+				if err := flush(); err != nil {
+					return loaded, err
+				}
+			}
+		}
+
+		if err := flush(); err != nil {
+			return loaded, err
+		}
+	}
+
+	return loaded, nil
+}
+
+// perDeviceTopPIDs is the ranking as it was done before, one query per device
+func perDeviceTopPIDs(db *sql.DB, dbName string, deviceIDs []string, timeStart string, timeEnd string, top int) error {
+	for _, device := range deviceIDs {
+		rows, err := db.Query(fmt.Sprintf(`
+            SELECT psm.process_pid
+            FROM `+"`%s`"+`.PerformanceMetrics pm
+            JOIN `+"`%s`"+`.ProcessMetrics psm ON pm.metric_id = psm.metric_id
+            WHERE pm.device_id = ? AND pm.timestamp BETWEEN ? AND ?
+            GROUP BY psm.process_pid
+            ORDER BY SUM(psm.process_cpu_usage) DESC
+            LIMIT %d`, dbName, dbName, top), device, timeStart, timeEnd)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// explain prints the plan of the ranking query used by the endpoints
+func explain(db *sql.DB, dbName string, deviceIDs []string, timeStart string, timeEnd string, top int) error {
+	args := make([]interface{}, 0, len(deviceIDs)+5)
+	for _, device := range deviceIDs {
+		args = append(args, device)
+	}
+	args = append(args, timeStart, timeEnd, timeStart, timeEnd, top)
+
+	var plan string
+	err := db.QueryRow(fmt.Sprintf(`EXPLAIN FORMAT=TREE
+        SELECT ranked.device_id, ranked.process_key FROM (
+            SELECT pm.device_id, psm.process_pid AS process_key,
+                ROW_NUMBER() OVER (PARTITION BY pm.device_id ORDER BY SUM(psm.process_cpu_usage) DESC) AS process_rank
+            FROM `+"`%s`"+`.PerformanceMetrics pm
+            JOIN `+"`%s`"+`.ProcessMetrics psm ON pm.metric_id = psm.metric_id AND pm.timestamp = psm.timestamp
+            WHERE pm.device_id IN (%s) AND pm.timestamp BETWEEN ? AND ? AND psm.timestamp BETWEEN ? AND ?
+            GROUP BY pm.device_id, psm.process_pid
+        ) ranked
+        WHERE ranked.process_rank <= ?`, dbName, dbName, strings.Trim(strings.Repeat("?,", len(deviceIDs)), ",")), args...).Scan(&plan)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nPlan of the single query:\n%s\n", plan)
+	return nil
+}